@@ -7,9 +7,10 @@ interface NotesPeerHook {
 }
 
 interface NotesMessage {
-	type: "content" | "sync";
+	type: "content" | "sync" | "error";
 	content: string;
 	html: string;
+	error?: string;
 }
 
 const useNotesPeer = (
@@ -30,7 +31,16 @@ const useNotesPeer = (
 
 		const connectWebSocket = () => {
 			try {
-				const socket = new WebSocket(`${url}/${roomId}?token=${token}`);
+				// Only interviewers edit the notes. Browsers cannot set headers on a
+				// WebSocket, so the access token is offered as a subprotocol.
+				const authToken = localStorage.getItem("token");
+				const protocols = authToken
+					? ["codepair", `bearer.${authToken}`]
+					: ["codepair"];
+				const socket = new WebSocket(
+					`${url}/${roomId}?token=${token}`,
+					protocols,
+				);
 				wsRef.current = socket;
 
 				socket.onmessage = (event) => {
@@ -39,6 +49,8 @@ const useNotesPeer = (
 							const message = JSON.parse(event.data) as NotesMessage;
 							if (message.type === "content" || message.type === "sync") {
 								setContent(message.html);
+							} else if (message.type === "error") {
+								console.error("Notes update rejected:", message.error);
 							}
 						} catch (err) {
 							console.error("Failed to parse notes WebSocket message:", err);
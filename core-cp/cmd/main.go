@@ -25,6 +25,11 @@ func setupRouter(
 	authService domain.AuthService,
 	authHandler *handlers.AuthHandler,
 	roomHandler *handlers.RoomHandler,
+	problemHandler *handlers.ProblemHandler,
+	templateHandler *handlers.TemplateHandler,
+	artifactHandler *handlers.ArtifactHandler,
+	historyHandler *handlers.HistoryHandler,
+	serviceSecret string,
 ) *gin.Engine {
 	r := gin.New()
 
@@ -61,6 +66,7 @@ func setupRouter(
 	rooms := r.Group("/rooms")
 	{
 		rooms.GET("/join", roomHandler.JoinRoom)
+		rooms.GET("/problem", problemHandler.GetRoomProblemByToken)
 
 		protected := rooms.Use(middleware.RequireAuth(authService))
 		{
@@ -69,10 +75,69 @@ func setupRouter(
 			protected.GET("/search", roomHandler.SearchRooms)
 			protected.DELETE("/:roomId", roomHandler.DeleteRoom)
 			protected.POST("/:roomId/end", roomHandler.EndInterview)
+			protected.GET("/:roomId/access", roomHandler.GetRoomAccess)
 			protected.PATCH("/:roomId/settings", roomHandler.UpdateRoomSettings)
+			protected.POST("/:roomId/token", roomHandler.RotateToken)
+			protected.POST("/:roomId/panelists", roomHandler.AddPanelist)
+			protected.DELETE("/:roomId/panelists/:userId", roomHandler.RemovePanelist)
+			protected.GET("/:roomId/problem", problemHandler.GetRoomProblem)
+			protected.PUT("/:roomId/problem", problemHandler.AttachProblem)
+			protected.GET("/:roomId/submissions", problemHandler.ListRoomSubmissions)
+			protected.POST("/:roomId/submissions", problemHandler.CreateSubmission)
+			protected.GET("/:roomId/questions", problemHandler.ListRoomQuestions)
+			protected.PUT("/:roomId/questions", problemHandler.SetRoomQuestions)
+			protected.GET("/:roomId/artifacts", artifactHandler.ListRoomArtifacts)
+			protected.POST("/:roomId/artifacts", artifactHandler.UploadArtifact)
+			protected.GET("/:roomId/quality", roomHandler.ListSessionQuality)
+			protected.POST("/:roomId/history", historyHandler.RecordEdits)
+			protected.GET("/:roomId/history", historyHandler.GetDocument)
+			protected.GET("/:roomId/history/replay", historyHandler.StreamReplay)
+			protected.PUT("/:roomId/removed", roomHandler.SaveRemovedParticipants)
 		}
 	}
 
+	// Routes for peer-cp only, authenticated by its request signature
+	internal := r.Group("/internal")
+	nonces := middleware.NewNonceCache()
+	{
+		internal.GET("/rooms/:roomId", middleware.RequireServiceSignature(serviceSecret, nonces, false), roomHandler.GetServiceRoom)
+		internal.GET("/rooms/:roomId/validate", middleware.RequireServiceSignature(serviceSecret, nonces, false), roomHandler.ValidateRoomAccess)
+		internal.POST("/rooms/:roomId/artifacts", middleware.RequireServiceSignature(serviceSecret, nonces, true), artifactHandler.UploadServiceArtifact)
+		internal.POST("/rooms/:roomId/history", middleware.RequireServiceSignature(serviceSecret, nonces, false), historyHandler.RecordServiceEdits)
+		internal.PUT("/rooms/:roomId/notes", middleware.RequireServiceSignature(serviceSecret, nonces, false), roomHandler.SaveRoomNotes)
+		internal.PUT("/rooms/:roomId/removed", middleware.RequireServiceSignature(serviceSecret, nonces, false), roomHandler.SaveServiceRemovedParticipants)
+		internal.POST("/rooms/:roomId/quality", middleware.RequireServiceSignature(serviceSecret, nonces, false), roomHandler.RecordSessionQuality)
+	}
+
+	problems := r.Group("/problems")
+	problems.Use(middleware.RequireAuth(authService))
+	{
+		problems.GET("", problemHandler.ListProblems)
+		problems.POST("", problemHandler.CreateProblem)
+		problems.GET("/:problemId", problemHandler.GetProblem)
+		problems.PATCH("/:problemId", problemHandler.UpdateProblem)
+		problems.DELETE("/:problemId", problemHandler.DeleteProblem)
+		problems.GET("/:problemId/submissions", problemHandler.ListProblemSubmissions)
+	}
+
+	templates := r.Group("/templates")
+	templates.Use(middleware.RequireAuth(authService))
+	{
+		templates.GET("", templateHandler.ListTemplates)
+		templates.POST("", templateHandler.CreateTemplate)
+		templates.GET("/:templateId", templateHandler.GetTemplate)
+		templates.PATCH("/:templateId", templateHandler.UpdateTemplate)
+		templates.DELETE("/:templateId", templateHandler.DeleteTemplate)
+	}
+
+	artifacts := r.Group("/artifacts")
+	artifacts.Use(middleware.RequireAuth(authService))
+	{
+		artifacts.GET("/:artifactId/download", artifactHandler.DownloadArtifact)
+		artifacts.PATCH("/:artifactId/retention", artifactHandler.UpdateRetention)
+		artifacts.DELETE("/:artifactId", artifactHandler.DeleteArtifact)
+	}
+
 	return r
 }
 
@@ -99,15 +164,29 @@ func main() {
 	// Initialize repositories and services
 	userRepo := postgres.NewUserRepository(db)
 	roomRepo := postgres.NewRoomRepository(db)
+	problemRepo := postgres.NewProblemRepository(db)
+	submissionRepo := postgres.NewSubmissionRepository(db)
+	templateRepo := postgres.NewRoomTemplateRepository(db)
+	artifactRepo := postgres.NewArtifactRepository(db)
+	editOpRepo := postgres.NewEditOpRepository(db)
 	authService := service.NewAuthService(userRepo, cfg)
-	roomService := service.NewRoomService(roomRepo)
+	roomEvents := service.NewRoomEventPublisher(cfg.Events, logger)
+	roomService := service.NewRoomService(roomRepo, templateRepo, userRepo, roomEvents)
+	problemService := service.NewProblemService(problemRepo, submissionRepo, roomRepo)
+	templateService := service.NewTemplateService(templateRepo, problemRepo, userRepo)
+	artifactService := service.NewArtifactService(artifactRepo, roomRepo, cfg.Artifacts.StorageDir, cfg.Artifacts.RetentionDays)
+	historyService := service.NewHistoryService(editOpRepo, roomRepo)
 
 	// Initialize handlers
 	authHandler := handlers.NewAuthHandler(authService)
 	roomHandler := handlers.NewRoomHandler(roomService)
+	problemHandler := handlers.NewProblemHandler(problemService)
+	templateHandler := handlers.NewTemplateHandler(templateService)
+	artifactHandler := handlers.NewArtifactHandler(artifactService, cfg.Artifacts.MaxUploadMB)
+	historyHandler := handlers.NewHistoryHandler(historyService)
 
 	// Setup router
-	router := setupRouter(logger, authService, authHandler, roomHandler)
+	router := setupRouter(logger, authService, authHandler, roomHandler, problemHandler, templateHandler, artifactHandler, historyHandler, cfg.Service.Secret)
 
 	// NBIO engine configuration
 	engine := nbhttp.NewEngine(nbhttp.Config{
@@ -137,6 +216,9 @@ func main() {
 		zap.String("mode", "nbio"),
 	)
 
+	// Purge artifacts past their retention period
+	go purgeArtifacts(logger, artifactService, cfg.Artifacts.PurgeInterval)
+
 	// Graceful shutdown
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
@@ -153,3 +235,18 @@ func main() {
 
 	logger.Info("server stopped gracefully")
 }
+
+func purgeArtifacts(logger *zap.Logger, artifactService domain.ArtifactService, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		purged, err := artifactService.PurgeExpired(context.Background())
+		if err != nil {
+			logger.Error("failed to purge expired artifacts", zap.Error(err))
+		}
+		if purged > 0 {
+			logger.Info("purged expired artifacts", zap.Int("count", purged))
+		}
+	}
+}
@@ -1,15 +1,19 @@
 package config
 
 import (
+	"errors"
 	"time"
 
 	"github.com/spf13/viper"
 )
 
 type Config struct {
-	Server   ServerConfig
-	Database DatabaseConfig
-	JWT      JWTConfig
+	Server    ServerConfig
+	Database  DatabaseConfig
+	JWT       JWTConfig
+	Artifacts ArtifactsConfig
+	Events    EventsConfig
+	Service   ServiceConfig
 }
 
 type ServerConfig struct {
@@ -34,6 +38,26 @@ type JWTConfig struct {
 	RefreshSecret      string
 }
 
+type ArtifactsConfig struct {
+	StorageDir    string
+	RetentionDays int
+	PurgeInterval time.Duration
+	MaxUploadMB   int64
+}
+
+// EventsConfig lists the peer-cp endpoints told about room changes. Events
+// are signed with Secret and not sent when no URL is configured.
+type EventsConfig struct {
+	WebhookURLs []string
+	Secret      string
+}
+
+// ServiceConfig holds the secret peer-cp signs its calls to the /internal
+// routes with. The routes are disabled when it is empty.
+type ServiceConfig struct {
+	Secret string
+}
+
 func LoadConfig() (*Config, error) {
 	viper.SetConfigName("config")
 	viper.SetConfigType("yaml")
@@ -58,6 +82,23 @@ func LoadConfig() (*Config, error) {
 		config.JWT.TokenExpiry = 24 * time.Hour
 	}
 
+	if config.Artifacts.StorageDir == "" {
+		config.Artifacts.StorageDir = "./artifacts"
+	}
+	if config.Artifacts.RetentionDays == 0 {
+		config.Artifacts.RetentionDays = 90
+	}
+	if config.Artifacts.PurgeInterval == 0 {
+		config.Artifacts.PurgeInterval = time.Hour
+	}
+	if config.Artifacts.MaxUploadMB == 0 {
+		config.Artifacts.MaxUploadMB = 2048
+	}
+
+	if len(config.Events.WebhookURLs) > 0 && config.Events.Secret == "" {
+		return nil, errors.New("events.secret is required when events.webhookURLs is set")
+	}
+
 	return &config, nil
 }
 
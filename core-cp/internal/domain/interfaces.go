@@ -2,6 +2,8 @@ package domain
 
 import (
 	"context"
+	"io"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -19,7 +21,7 @@ type UserRepository interface {
 }
 
 type RoomRepository interface {
-	Create(ctx context.Context, room *Room) error
+	Create(ctx context.Context, room *Room, questionIDs []uuid.UUID) error
 	FindByID(ctx context.Context, id uuid.UUID) (*Room, error)
 	FindByToken(ctx context.Context, token string) (*Room, error)
 	GetRoom(ctx context.Context, roomID uuid.UUID) (*Room, error)
@@ -27,7 +29,51 @@ type RoomRepository interface {
 	SetActive(ctx context.Context, id uuid.UUID, active bool) error
 	SearchRooms(ctx context.Context, interviewerID uuid.UUID, query string) ([]Room, error)
 	UpdateRoomSettings(ctx context.Context, id uuid.UUID, settings RoomSettings) error
+	SetProblem(ctx context.Context, id uuid.UUID, problemID *uuid.UUID) error
 	Delete(ctx context.Context, id uuid.UUID) error
+	AddSessionQuality(ctx context.Context, quality *SessionQuality) error
+	ListSessionQuality(ctx context.Context, roomID uuid.UUID) ([]SessionQuality, error)
+	SetToken(ctx context.Context, id uuid.UUID, token string) error
+	AddPanelist(ctx context.Context, id uuid.UUID, panelist *User) error
+	RemovePanelist(ctx context.Context, id uuid.UUID, panelist *User) error
+}
+
+type RoomTemplateRepository interface {
+	Create(ctx context.Context, template *RoomTemplate) error
+	FindByID(ctx context.Context, id uuid.UUID) (*RoomTemplate, error)
+	ListAccessible(ctx context.Context, userID uuid.UUID) ([]RoomTemplate, error)
+	Update(ctx context.Context, id uuid.UUID, update TemplateUpdate) error
+	Delete(ctx context.Context, id uuid.UUID) error
+}
+
+type ProblemRepository interface {
+	Create(ctx context.Context, problem *Problem) error
+	FindByID(ctx context.Context, id uuid.UUID) (*Problem, error)
+	List(ctx context.Context, params ListProblemsParams) ([]Problem, error)
+	Update(ctx context.Context, id uuid.UUID, update ProblemUpdate) error
+	Delete(ctx context.Context, id uuid.UUID) error
+	SetRoomQuestions(ctx context.Context, roomID uuid.UUID, problemIDs []uuid.UUID) error
+	ListRoomQuestions(ctx context.Context, roomID uuid.UUID) ([]Problem, error)
+}
+
+type SubmissionRepository interface {
+	Create(ctx context.Context, submission *Submission) error
+	ListByRoom(ctx context.Context, roomID uuid.UUID) ([]Submission, error)
+	ListByProblem(ctx context.Context, problemID uuid.UUID, interviewerID *uuid.UUID) ([]Submission, error)
+}
+
+type ArtifactRepository interface {
+	Create(ctx context.Context, artifact *Artifact) error
+	FindByID(ctx context.Context, id uuid.UUID) (*Artifact, error)
+	ListByRoom(ctx context.Context, roomID uuid.UUID) ([]Artifact, error)
+	ListExpired(ctx context.Context, now time.Time) ([]Artifact, error)
+	SetExpiry(ctx context.Context, id uuid.UUID, expiresAt *time.Time) error
+	Delete(ctx context.Context, id uuid.UUID) error
+}
+
+type EditOpRepository interface {
+	CreateBatch(ctx context.Context, ops []EditOp) error
+	ListByRoom(ctx context.Context, roomID uuid.UUID, until *time.Time) ([]EditOp, error)
 }
 
 type AuthService interface {
@@ -45,12 +91,66 @@ type AuthService interface {
 }
 
 type RoomService interface {
-	CreateRoom(ctx context.Context, interviewer *User, candidateName string) (*Room, error)
+	CreateRoom(ctx context.Context, interviewer *User, params CreateRoomParams) (*Room, error)
 	GetRoom(ctx context.Context, roomID uuid.UUID) (*Room, error)
+	GetMemberRoom(ctx context.Context, roomID uuid.UUID, interviewerID uuid.UUID) (*Room, error)
 	ValidateRoomToken(ctx context.Context, token string) (*Room, error)
+	ValidateRoomAccess(ctx context.Context, roomID uuid.UUID, token string) (*Room, error)
 	ListRooms(ctx context.Context, interviewerID uuid.UUID, params ListRoomsParams) ([]Room, error)
 	EndInterview(ctx context.Context, roomID uuid.UUID, interviewerID uuid.UUID) error
 	SearchRooms(ctx context.Context, interviewerID uuid.UUID, query string) ([]Room, error)
 	UpdateRoomSettings(ctx context.Context, roomID uuid.UUID, interviewerID uuid.UUID, settings RoomSettings) error
+	SaveRoomNotes(ctx context.Context, roomID uuid.UUID, notes string) error
+	SaveRemovedParticipants(ctx context.Context, roomID uuid.UUID, interviewer *User, removed []string) error
 	DeleteRoom(ctx context.Context, roomID uuid.UUID, interviewerID uuid.UUID) error
+	RecordSessionQuality(ctx context.Context, roomID uuid.UUID, quality *SessionQuality) error
+	ListSessionQuality(ctx context.Context, roomID uuid.UUID, interviewerID uuid.UUID) ([]SessionQuality, error)
+	RotateRoomToken(ctx context.Context, roomID uuid.UUID, interviewerID uuid.UUID) (string, error)
+	AddPanelist(ctx context.Context, roomID uuid.UUID, interviewerID uuid.UUID, panelistID uuid.UUID) error
+	RemovePanelist(ctx context.Context, roomID uuid.UUID, interviewerID uuid.UUID, panelistID uuid.UUID) error
+}
+
+// RoomEventPublisher delivers room events to peer-cp in the background.
+// Publish never blocks the request that changed the room.
+type RoomEventPublisher interface {
+	Publish(event RoomEvent)
+}
+
+type TemplateService interface {
+	CreateTemplate(ctx context.Context, owner *User, template *RoomTemplate) error
+	GetTemplate(ctx context.Context, templateID uuid.UUID, user *User) (*RoomTemplate, error)
+	ListTemplates(ctx context.Context, user *User) ([]RoomTemplate, error)
+	UpdateTemplate(ctx context.Context, templateID uuid.UUID, user *User, update TemplateUpdate) error
+	DeleteTemplate(ctx context.Context, templateID uuid.UUID, user *User) error
+}
+
+type ProblemService interface {
+	CreateProblem(ctx context.Context, author *User, problem *Problem) error
+	GetProblem(ctx context.Context, problemID uuid.UUID) (*Problem, error)
+	ListProblems(ctx context.Context, params ListProblemsParams) ([]Problem, error)
+	UpdateProblem(ctx context.Context, problemID uuid.UUID, user *User, update ProblemUpdate) error
+	DeleteProblem(ctx context.Context, problemID uuid.UUID, user *User) error
+	SetRoomQuestions(ctx context.Context, roomID uuid.UUID, interviewerID uuid.UUID, problemIDs []uuid.UUID) error
+	ListRoomQuestions(ctx context.Context, roomID uuid.UUID, interviewerID uuid.UUID) ([]Problem, error)
+	AttachProblem(ctx context.Context, roomID uuid.UUID, interviewerID uuid.UUID, problemID *uuid.UUID) error
+	GetRoomProblem(ctx context.Context, roomID uuid.UUID, interviewerID uuid.UUID) (*Problem, error)
+	GetRoomProblemByToken(ctx context.Context, token string) (*Problem, error)
+	RecordSubmission(ctx context.Context, roomID uuid.UUID, interviewerID uuid.UUID, submission *Submission) error
+	ListRoomSubmissions(ctx context.Context, roomID uuid.UUID, interviewerID uuid.UUID) ([]Submission, error)
+	ListProblemSubmissions(ctx context.Context, problemID uuid.UUID, user *User) ([]Submission, error)
+}
+
+type ArtifactService interface {
+	StoreArtifact(ctx context.Context, roomID uuid.UUID, uploader *User, artifact *Artifact, content io.Reader) error
+	ListRoomArtifacts(ctx context.Context, roomID uuid.UUID, user *User) ([]Artifact, error)
+	GetArtifact(ctx context.Context, artifactID uuid.UUID, user *User) (*Artifact, error)
+	SetRetention(ctx context.Context, artifactID uuid.UUID, user *User, expiresAt *time.Time) error
+	DeleteArtifact(ctx context.Context, artifactID uuid.UUID, user *User) error
+	PurgeExpired(ctx context.Context) (int, error)
+}
+
+type HistoryService interface {
+	RecordEdits(ctx context.Context, roomID uuid.UUID, uploader *User, ops []EditOp) error
+	DocumentAt(ctx context.Context, roomID uuid.UUID, user *User, at time.Time) ([]HistoryFile, error)
+	Replay(ctx context.Context, roomID uuid.UUID, user *User) (*Replay, error)
 }
@@ -32,6 +32,183 @@ type Room struct {
 	Description    string         `gorm:"type:text"`
 	Notes          string         `gorm:"type:text"`
 
+	ProblemID  *uuid.UUID   `gorm:"type:uuid;index"`
+	TemplateID *uuid.UUID   `gorm:"type:uuid;index"`
+	Rubric     []RubricItem `gorm:"type:jsonb;serializer:json"`
+	Panelists  []User       `gorm:"many2many:room_panelists"`
+
+	// Roster IDs interviewers removed from the interview, kept out until
+	// readmitted. Written by peer-cp.
+	Removed pq.StringArray `gorm:"type:text[]"`
+
 	CreatedAt time.Time `gorm:"index"`
 	UpdatedAt time.Time `gorm:"index"`
 }
+
+// RoomTemplate is a reusable interview format. Shared templates are visible
+// to every interviewer; only leads can share. A deployment is one team:
+// leads create, promote and deactivate every interviewer in it, so sharing
+// is not scoped any further.
+type RoomTemplate struct {
+	ID             uuid.UUID      `gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	OwnerID        uuid.UUID      `gorm:"type:uuid;not null;index"`
+	Owner          User           `gorm:"foreignKey:OwnerID"`
+	Name           string         `gorm:"not null"`
+	Duration       int            `gorm:"default:60"` // in minutes
+	TechnicalStack pq.StringArray `gorm:"type:text[]"`
+	Description    string         `gorm:"type:text"`
+	QuestionIDs    []uuid.UUID    `gorm:"type:jsonb;serializer:json"` // in interview order
+	Rubric         []RubricItem   `gorm:"type:jsonb;serializer:json"`
+	PanelistIDs    []uuid.UUID    `gorm:"type:jsonb;serializer:json"`
+	Shared         bool           `gorm:"default:false;index"`
+
+	CreatedAt time.Time
+	UpdatedAt time.Time `gorm:"index"`
+}
+
+type RubricItem struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Weight      int    `json:"weight"`
+}
+
+type Problem struct {
+	ID          uuid.UUID         `gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	AuthorID    uuid.UUID         `gorm:"type:uuid;not null;index"`
+	Author      User              `gorm:"foreignKey:AuthorID"`
+	Title       string            `gorm:"not null"`
+	Statement   string            `gorm:"type:text"` // markdown
+	Difficulty  string            `gorm:"type:varchar(10);default:'medium';index"`
+	Tags        pq.StringArray    `gorm:"type:text[]"`
+	StarterCode map[string]string `gorm:"type:jsonb;serializer:json"` // language -> code
+	Harnesses   []Harness         `gorm:"type:jsonb;serializer:json"`
+	TestCases   []TestCase        `gorm:"foreignKey:ProblemID;constraint:OnDelete:CASCADE"`
+
+	CreatedAt time.Time `gorm:"index"`
+	UpdatedAt time.Time
+}
+
+// Harness is a function-level test driver. It becomes the program entry point
+// and the candidate's code is written next to it as SolutionFile.
+type Harness struct {
+	Language     string `json:"language"`
+	SolutionFile string `json:"solutionFile"`
+	Code         string `json:"code"`
+}
+
+// RoomQuestion is a question planned for a room, in interview order
+type RoomQuestion struct {
+	RoomID    uuid.UUID `gorm:"type:uuid;primaryKey"`
+	Room      Room      `gorm:"foreignKey:RoomID;constraint:OnDelete:CASCADE"`
+	ProblemID uuid.UUID `gorm:"type:uuid;primaryKey"`
+	Problem   Problem   `gorm:"foreignKey:ProblemID;constraint:OnDelete:CASCADE"`
+	Position  int
+}
+
+type TestCase struct {
+	ID             uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	ProblemID      uuid.UUID `gorm:"type:uuid;not null;index"`
+	Name           string
+	Input          string `gorm:"type:text"`
+	ExpectedOutput string `gorm:"type:text"`
+	Hidden         bool   `gorm:"default:false"`
+	Position       int
+	CreatedAt      time.Time
+}
+
+type Submission struct {
+	ID          uuid.UUID          `gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	RoomID      uuid.UUID          `gorm:"type:uuid;not null;index"`
+	Room        Room               `gorm:"foreignKey:RoomID;constraint:OnDelete:CASCADE"`
+	ProblemID   uuid.UUID          `gorm:"type:uuid;not null;index"`
+	SubmittedBy uuid.UUID          `gorm:"type:uuid"`
+	Language    string             `gorm:"type:varchar(32)"`
+	Code        string             `gorm:"type:text"`
+	Passed      int                `gorm:"default:0"`
+	Total       int                `gorm:"default:0"`
+	DurationMs  int64              `gorm:"default:0"`
+	Results     []SubmissionResult `gorm:"foreignKey:SubmissionID;constraint:OnDelete:CASCADE"`
+
+	CreatedAt time.Time `gorm:"index"`
+}
+
+type SubmissionResult struct {
+	ID           uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	SubmissionID uuid.UUID `gorm:"type:uuid;not null;index"`
+	TestCaseID   uuid.UUID `gorm:"type:uuid;not null"`
+	Hidden       bool
+	Passed       bool
+	Status       string `gorm:"type:varchar(20)"`
+	DurationMs   int64
+	CPUTimeMs    int64
+	MaxMemoryKB  int64
+}
+
+// SessionQuality summarises one participant's media connection during an
+// interview. peer-cp sends it when the participant leaves the call.
+type SessionQuality struct {
+	ID              uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	RoomID          uuid.UUID `gorm:"type:uuid;not null;index"`
+	Room            Room      `gorm:"foreignKey:RoomID;constraint:OnDelete:CASCADE"`
+	ClientID        string    `gorm:"type:varchar(64)"`
+	Participant     string    `gorm:"type:varchar(255)"`
+	Interviewer     bool      `gorm:"default:false"`
+	CandidateType   string    `gorm:"type:varchar(16)"` // host, srflx, prflx or relay
+	Protocol        string    `gorm:"type:varchar(8)"`
+	Samples         int
+	PoorSamples     int
+	AvgRTTMs        float64
+	MaxRTTMs        float64
+	AvgJitterMs     float64
+	PacketLossPct   float64
+	AvgInboundKbps  float64
+	AvgOutboundKbps float64
+	JoinedAt        time.Time
+	LeftAt          time.Time
+
+	CreatedAt time.Time `gorm:"index"`
+}
+
+// Artifact is a file produced during an interview, such as a recording.
+// Artifacts are kept until ExpiresAt and can only be downloaded by leads.
+type Artifact struct {
+	ID          uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	RoomID      uuid.UUID  `gorm:"type:uuid;not null;index"`
+	Room        Room       `gorm:"foreignKey:RoomID;constraint:OnDelete:CASCADE"`
+	Kind        string     `gorm:"type:varchar(32);not null"`
+	Participant string     `gorm:"type:varchar(255)"` // Whose media the file holds
+	FileName    string     `gorm:"not null"`
+	ContentType string     `gorm:"type:varchar(100)"`
+	SizeBytes   int64      `gorm:"default:0"`
+	StoragePath string     `gorm:"not null"`
+	UploadedBy  uuid.UUID  `gorm:"type:uuid"`
+	ConsentedAt *time.Time // When the participant agreed to be recorded
+	StartedAt   *time.Time
+	EndedAt     *time.Time
+	ExpiresAt   *time.Time `gorm:"index"`
+
+	CreatedAt time.Time `gorm:"index"`
+}
+
+// EditOp is one change to a room's editor files, recorded by peer-cp in the
+// order it was applied. Replaying a room's ops rebuilds its files at any
+// point of the interview.
+type EditOp struct {
+	ID         uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	RoomID     uuid.UUID `gorm:"type:uuid;not null;index:idx_edit_ops_room_time,priority:1;uniqueIndex:idx_edit_ops_room_seq,priority:1"`
+	Room       Room      `gorm:"foreignKey:RoomID;constraint:OnDelete:CASCADE"`
+	Instance   string    `gorm:"type:varchar(64);uniqueIndex:idx_edit_ops_room_seq,priority:2"` // peer-cp instance that applied the op
+	Seq        int64     `gorm:"uniqueIndex:idx_edit_ops_room_seq,priority:3"`                  // Order of the op on its instance
+	Kind       string    `gorm:"type:varchar(16);not null"`                                     // edit, create, rename or delete
+	Path       string    `gorm:"type:varchar(255);not null"`
+	NewPath    string    `gorm:"type:varchar(255)"`
+	Language   string    `gorm:"type:varchar(32)"`
+	Position   int       // In Unicode code points
+	Deleted    int       // Code points removed at Position
+	Inserted   string    `gorm:"type:text"`
+	AuthorID   string    `gorm:"type:varchar(64)"` // Interviewer user ID, or "candidate"
+	AuthorName string    `gorm:"type:varchar(255)"`
+	OccurredAt time.Time `gorm:"not null;index:idx_edit_ops_room_time,priority:2"`
+
+	CreatedAt time.Time
+}
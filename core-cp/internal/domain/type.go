@@ -1,5 +1,11 @@
 package domain
 
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
 type RoomSettings struct {
 	IsActive       *bool    `json:"isActive,omitempty"`
 	CandidateName  *string  `json:"candidateName,omitempty"`
@@ -8,6 +14,7 @@ type RoomSettings struct {
 	TechnicalStack []string `json:"technicalStack,omitempty"`
 	Description    *string  `json:"description,omitempty"`
 	Notes          *string  `json:"notes,omitempty"`
+	Removed        []string `json:"-"` // Only peer-cp changes who is removed
 }
 
 type ListRoomsParams struct {
@@ -17,3 +24,128 @@ type ListRoomsParams struct {
 	Offset    int
 	Status    *bool // filter by active/inactive
 }
+
+type ProblemUpdate struct {
+	Title       *string
+	Statement   *string
+	Difficulty  *string
+	Tags        []string
+	StarterCode map[string]string
+	Harnesses   []Harness
+	TestCases   []TestCase // replaces every test case when not nil
+}
+
+type ListProblemsParams struct {
+	Query      string // matched against the title
+	Tag        string
+	Difficulty string
+	Limit      int
+	Offset     int
+}
+
+// CreateRoomParams are applied on top of the template when one is given
+type CreateRoomParams struct {
+	CandidateName  string
+	TemplateID     *uuid.UUID
+	Duration       *int
+	TechnicalStack []string
+	Description    *string
+}
+
+type TemplateUpdate struct {
+	Name           *string
+	Duration       *int
+	TechnicalStack []string
+	Description    *string
+	QuestionIDs    []uuid.UUID
+	Rubric         []RubricItem
+	PanelistIDs    []uuid.UUID
+	Shared         *bool
+}
+
+// Room events sent to peer-cp
+const (
+	RoomEventUpdated            = "room_updated"
+	RoomEventEnded              = "room_ended"
+	RoomEventDeleted            = "room_deleted"
+	RoomEventTokenRotated       = "token_rotated"
+	RoomEventParticipantAdded   = "participant_added"
+	RoomEventParticipantRemoved = "participant_removed"
+)
+
+// RoomEvent tells peer-cp about a change to a room it may be hosting, so the
+// change reaches live sessions without waiting for re-validation
+type RoomEvent struct {
+	ID          uuid.UUID         `json:"id"`
+	Type        string            `json:"type"`
+	RoomID      uuid.UUID         `json:"roomId"`
+	Room        *RoomEventDetails `json:"room,omitempty"`
+	Participant *RoomParticipant  `json:"participant,omitempty"` // On participant_added and participant_removed
+	OccurredAt  time.Time         `json:"occurredAt"`
+}
+
+// RoomEventDetails are the room settings shown during an interview
+type RoomEventDetails struct {
+	CandidateName  string     `json:"candidateName"`
+	IsActive       bool       `json:"isActive"`
+	ScheduledTime  *time.Time `json:"scheduledTime,omitempty"`
+	Duration       int        `json:"duration"`
+	TechnicalStack []string   `json:"technicalStack,omitempty"`
+	Description    string     `json:"description,omitempty"`
+}
+
+type RoomParticipant struct {
+	ID    uuid.UUID `json:"id"`
+	Email string    `json:"email"`
+	Name  string    `json:"name"`
+}
+
+// Edit op kinds
+const (
+	EditOpEdit   = "edit"
+	EditOpCreate = "create"
+	EditOpRename = "rename"
+	EditOpDelete = "delete"
+)
+
+// HistoryFile is an editor file as it was at some point of an interview
+type HistoryFile struct {
+	Path     string `json:"path"`
+	Language string `json:"language,omitempty"`
+	Content  string `json:"content"`
+}
+
+// Replay is a room's edit history laid out for a player. Keyframes hold the
+// files before the op at their index, so the player can seek without
+// applying every op from the start.
+type Replay struct {
+	StartedAt time.Time
+	EndedAt   time.Time
+	Authors   []ReplayAuthor
+	Ops       []ReplayOp
+	Keyframes []ReplayKeyframe
+}
+
+type ReplayAuthor struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// ReplayOp is an EditOp with short keys, as replays hold thousands of them
+type ReplayOp struct {
+	Offset   int64  `json:"t"` // Milliseconds since the first op
+	Author   int    `json:"a"` // Index into the replay's authors
+	Kind     string `json:"k"`
+	Path     string `json:"p"`
+	NewPath  string `json:"n,omitempty"`
+	Language string `json:"l,omitempty"`
+	Position int    `json:"o,omitempty"`
+	Deleted  int    `json:"d,omitempty"`
+	Inserted string `json:"i,omitempty"`
+}
+
+type ReplayKeyframe struct {
+	Index  int           `json:"index"`
+	Offset int64         `json:"t"`
+	Files  []HistoryFile `json:"files"`
+}
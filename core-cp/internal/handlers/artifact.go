@@ -0,0 +1,206 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/elskow/codepair/core-cp/internal/domain"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+type ArtifactHandler struct {
+	artifactService domain.ArtifactService
+	maxUploadBytes  int64
+}
+
+func NewArtifactHandler(artifactService domain.ArtifactService, maxUploadMB int64) *ArtifactHandler {
+	return &ArtifactHandler{
+		artifactService: artifactService,
+		maxUploadBytes:  maxUploadMB * 1024 * 1024,
+	}
+}
+
+// UploadArtifact - Multipart upload from the peer service, on behalf of an interviewer
+func (h *ArtifactHandler) UploadArtifact(c *gin.Context) {
+	h.uploadArtifact(c, c.MustGet("user").(*domain.User))
+}
+
+// UploadServiceArtifact - Multipart upload signed by the peer service itself
+func (h *ArtifactHandler) UploadServiceArtifact(c *gin.Context) {
+	h.uploadArtifact(c, nil)
+}
+
+func (h *ArtifactHandler) uploadArtifact(c *gin.Context, uploader *domain.User) {
+	roomID, err := uuid.Parse(c.Param("roomId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid room ID"})
+		return
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, h.maxUploadBytes)
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "file is required"})
+		return
+	}
+
+	artifact := &domain.Artifact{
+		Kind:        c.PostForm("kind"),
+		Participant: c.PostForm("participant"),
+		FileName:    fileHeader.Filename,
+		ContentType: fileHeader.Header.Get("Content-Type"),
+	}
+	if artifact.ConsentedAt, err = parseOptionalTime(c.PostForm("consentedAt")); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid consentedAt"})
+		return
+	}
+	if artifact.StartedAt, err = parseOptionalTime(c.PostForm("startedAt")); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid startedAt"})
+		return
+	}
+	if artifact.EndedAt, err = parseOptionalTime(c.PostForm("endedAt")); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid endedAt"})
+		return
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer file.Close()
+
+	if err := h.artifactService.StoreArtifact(c.Request.Context(), roomID, uploader, artifact, file); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, artifactToResponse(*artifact))
+}
+
+// ListRoomArtifacts - Only for leads
+func (h *ArtifactHandler) ListRoomArtifacts(c *gin.Context) {
+	roomID, err := uuid.Parse(c.Param("roomId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid room ID"})
+		return
+	}
+
+	user := c.MustGet("user").(*domain.User)
+	artifacts, err := h.artifactService.ListRoomArtifacts(c.Request.Context(), roomID, user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	response := make([]gin.H, len(artifacts))
+	for i, artifact := range artifacts {
+		response[i] = artifactToResponse(artifact)
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// DownloadArtifact - Only for leads
+func (h *ArtifactHandler) DownloadArtifact(c *gin.Context) {
+	artifactID, err := uuid.Parse(c.Param("artifactId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid artifact ID"})
+		return
+	}
+
+	user := c.MustGet("user").(*domain.User)
+	artifact, err := h.artifactService.GetArtifact(c.Request.Context(), artifactID, user)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	if artifact.ContentType != "" {
+		c.Header("Content-Type", artifact.ContentType)
+	}
+	c.FileAttachment(artifact.StoragePath, artifact.FileName)
+}
+
+// UpdateRetention - Only for leads
+func (h *ArtifactHandler) UpdateRetention(c *gin.Context) {
+	artifactID, err := uuid.Parse(c.Param("artifactId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid artifact ID"})
+		return
+	}
+
+	var request struct {
+		ExpiresAt *time.Time `json:"expiresAt"` // null keeps the artifact indefinitely
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user := c.MustGet("user").(*domain.User)
+	if err := h.artifactService.SetRetention(c.Request.Context(), artifactID, user, request.ExpiresAt); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "retention updated successfully"})
+}
+
+// DeleteArtifact - Only for leads
+func (h *ArtifactHandler) DeleteArtifact(c *gin.Context) {
+	artifactID, err := uuid.Parse(c.Param("artifactId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid artifact ID"})
+		return
+	}
+
+	user := c.MustGet("user").(*domain.User)
+	if err := h.artifactService.DeleteArtifact(c.Request.Context(), artifactID, user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "artifact deleted successfully"})
+}
+
+func parseOptionalTime(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func artifactToResponse(artifact domain.Artifact) gin.H {
+	response := gin.H{
+		"id":          artifact.ID,
+		"roomId":      artifact.RoomID,
+		"kind":        artifact.Kind,
+		"participant": artifact.Participant,
+		"fileName":    artifact.FileName,
+		"contentType": artifact.ContentType,
+		"sizeBytes":   artifact.SizeBytes,
+		"createdAt":   artifact.CreatedAt,
+	}
+
+	if artifact.ConsentedAt != nil {
+		response["consentedAt"] = artifact.ConsentedAt.Format(time.RFC3339)
+	}
+	if artifact.StartedAt != nil {
+		response["startedAt"] = artifact.StartedAt.Format(time.RFC3339)
+	}
+	if artifact.EndedAt != nil {
+		response["endedAt"] = artifact.EndedAt.Format(time.RFC3339)
+	}
+	if artifact.ExpiresAt != nil {
+		response["expiresAt"] = artifact.ExpiresAt.Format(time.RFC3339)
+	}
+
+	return response
+}
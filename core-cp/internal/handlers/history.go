@@ -0,0 +1,183 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/elskow/codepair/core-cp/internal/domain"
+	"github.com/elskow/codepair/core-cp/pkg/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+type HistoryHandler struct {
+	historyService domain.HistoryService
+}
+
+func NewHistoryHandler(historyService domain.HistoryService) *HistoryHandler {
+	return &HistoryHandler{
+		historyService: historyService,
+	}
+}
+
+// RecordEdits - Edit ops from the peer service, on behalf of an interviewer
+func (h *HistoryHandler) RecordEdits(c *gin.Context) {
+	h.recordEdits(c, c.MustGet("user").(*domain.User))
+}
+
+// RecordServiceEdits - Edit ops signed by the peer service itself
+func (h *HistoryHandler) RecordServiceEdits(c *gin.Context) {
+	h.recordEdits(c, nil)
+}
+
+func (h *HistoryHandler) recordEdits(c *gin.Context, uploader *domain.User) {
+	roomID, err := uuid.Parse(c.Param("roomId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid room ID"})
+		return
+	}
+
+	var request struct {
+		Ops []struct {
+			Instance   string    `json:"instance"`
+			Seq        int64     `json:"seq"`
+			Kind       string    `json:"kind" binding:"required"`
+			Path       string    `json:"path" binding:"required"`
+			NewPath    string    `json:"newPath"`
+			Language   string    `json:"language"`
+			Position   int       `json:"position"`
+			Deleted    int       `json:"deleted"`
+			Inserted   string    `json:"inserted"`
+			AuthorID   string    `json:"authorId"`
+			AuthorName string    `json:"authorName"`
+			OccurredAt time.Time `json:"occurredAt" binding:"required"`
+		} `json:"ops" binding:"required,dive"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ops := make([]domain.EditOp, len(request.Ops))
+	for i, op := range request.Ops {
+		ops[i] = domain.EditOp{
+			Instance:   op.Instance,
+			Seq:        op.Seq,
+			Kind:       op.Kind,
+			Path:       op.Path,
+			NewPath:    op.NewPath,
+			Language:   op.Language,
+			Position:   op.Position,
+			Deleted:    op.Deleted,
+			Inserted:   op.Inserted,
+			AuthorID:   op.AuthorID,
+			AuthorName: op.AuthorName,
+			OccurredAt: op.OccurredAt,
+		}
+	}
+
+	if err := h.historyService.RecordEdits(c.Request.Context(), roomID, uploader, ops); err != nil {
+		c.JSON(historyErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"recorded": len(ops)})
+}
+
+// historyErrorStatus answers a caller outside the room with 403 and invalid
+// ops with 400
+func historyErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, utils.ErrUnauthorized):
+		return http.StatusForbidden
+	case errors.Is(err, utils.ErrInvalidEditOp):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// GetDocument - The room's files at ?at= (RFC 3339), now when left out
+func (h *HistoryHandler) GetDocument(c *gin.Context) {
+	roomID, err := uuid.Parse(c.Param("roomId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid room ID"})
+		return
+	}
+
+	at := time.Now()
+	if value := c.Query("at"); value != "" {
+		if at, err = time.Parse(time.RFC3339Nano, value); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid at"})
+			return
+		}
+	}
+
+	user := c.MustGet("user").(*domain.User)
+	files, err := h.historyService.DocumentAt(c.Request.Context(), roomID, user, at)
+	if err != nil {
+		c.JSON(historyErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"at":    at.Format(time.RFC3339Nano),
+		"files": files,
+	})
+}
+
+// StreamReplay - The room's edit history as newline-delimited JSON: a header,
+// then the ops in order with a keyframe before every few hundred of them
+func (h *HistoryHandler) StreamReplay(c *gin.Context) {
+	roomID, err := uuid.Parse(c.Param("roomId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid room ID"})
+		return
+	}
+
+	user := c.MustGet("user").(*domain.User)
+	replay, err := h.historyService.Replay(c.Request.Context(), roomID, user)
+	if err != nil {
+		c.JSON(historyErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Status(http.StatusOK)
+
+	encoder := json.NewEncoder(c.Writer)
+	header := gin.H{
+		"type":      "header",
+		"authors":   replay.Authors,
+		"ops":       len(replay.Ops),
+		"keyframes": len(replay.Keyframes),
+	}
+	if len(replay.Ops) > 0 {
+		header["startedAt"] = replay.StartedAt.Format(time.RFC3339Nano)
+		header["endedAt"] = replay.EndedAt.Format(time.RFC3339Nano)
+	}
+	if err := encoder.Encode(header); err != nil {
+		return
+	}
+
+	next := 0
+	for i, op := range replay.Ops {
+		if next < len(replay.Keyframes) && replay.Keyframes[next].Index == i {
+			if err := encoder.Encode(struct {
+				Type string `json:"type"`
+				domain.ReplayKeyframe
+			}{"keyframe", replay.Keyframes[next]}); err != nil {
+				return
+			}
+			next++
+		}
+		if err := encoder.Encode(struct {
+			Type string `json:"type"`
+			domain.ReplayOp
+		}{"op", op}); err != nil {
+			return
+		}
+	}
+	c.Writer.Flush()
+}
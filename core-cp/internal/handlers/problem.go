@@ -0,0 +1,506 @@
+package handlers
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/elskow/codepair/core-cp/internal/domain"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+type ProblemHandler struct {
+	problemService domain.ProblemService
+}
+
+func NewProblemHandler(problemService domain.ProblemService) *ProblemHandler {
+	return &ProblemHandler{problemService: problemService}
+}
+
+type testCaseRequest struct {
+	Name           string `json:"name"`
+	Input          string `json:"input"`
+	ExpectedOutput string `json:"expectedOutput"`
+	Hidden         bool   `json:"hidden"`
+}
+
+type harnessRequest struct {
+	Language     string `json:"language" binding:"required"`
+	SolutionFile string `json:"solutionFile" binding:"required"`
+	Code         string `json:"code" binding:"required"`
+}
+
+// CreateProblem - Only for interviewers
+func (h *ProblemHandler) CreateProblem(c *gin.Context) {
+	var request struct {
+		Title       string            `json:"title" binding:"required"`
+		Statement   string            `json:"statement"`
+		Difficulty  string            `json:"difficulty" binding:"omitempty,oneof=easy medium hard"`
+		Tags        []string          `json:"tags"`
+		StarterCode map[string]string `json:"starterCode"`
+		Harnesses   []harnessRequest  `json:"harnesses" binding:"dive"`
+		TestCases   []testCaseRequest `json:"testCases"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	problem := &domain.Problem{
+		Title:       request.Title,
+		Statement:   request.Statement,
+		Difficulty:  request.Difficulty,
+		Tags:        request.Tags,
+		StarterCode: request.StarterCode,
+		Harnesses:   toHarnesses(request.Harnesses),
+		TestCases:   toTestCases(request.TestCases),
+	}
+
+	author := c.MustGet("user").(*domain.User)
+	if err := h.problemService.CreateProblem(c.Request.Context(), author, problem); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, problemToResponse(*problem))
+}
+
+// ListProblems - Browse the question bank
+func (h *ProblemHandler) ListProblems(c *gin.Context) {
+	params := domain.ListProblemsParams{
+		Query:      c.Query("q"),
+		Tag:        c.Query("tag"),
+		Difficulty: c.Query("difficulty"),
+		Limit:      50,
+	}
+
+	problems, err := h.problemService.ListProblems(c.Request.Context(), params)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	response := make([]gin.H, len(problems))
+	for i, problem := range problems {
+		response[i] = problemToSummary(problem)
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// UpdateProblem - Only for the author or a lead
+func (h *ProblemHandler) UpdateProblem(c *gin.Context) {
+	problemID, err := uuid.Parse(c.Param("problemId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid problem ID"})
+		return
+	}
+
+	var request struct {
+		Title       *string            `json:"title,omitempty"`
+		Statement   *string            `json:"statement,omitempty"`
+		Difficulty  *string            `json:"difficulty,omitempty" binding:"omitempty,oneof=easy medium hard"`
+		Tags        []string           `json:"tags,omitempty"`
+		StarterCode map[string]string  `json:"starterCode,omitempty"`
+		Harnesses   []harnessRequest   `json:"harnesses,omitempty" binding:"dive"`
+		TestCases   *[]testCaseRequest `json:"testCases,omitempty"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	update := domain.ProblemUpdate{
+		Title:       request.Title,
+		Statement:   request.Statement,
+		Difficulty:  request.Difficulty,
+		Tags:        request.Tags,
+		StarterCode: request.StarterCode,
+	}
+	if request.Harnesses != nil {
+		update.Harnesses = toHarnesses(request.Harnesses)
+	}
+	if request.TestCases != nil {
+		update.TestCases = toTestCases(*request.TestCases)
+	}
+
+	user := c.MustGet("user").(*domain.User)
+	if err := h.problemService.UpdateProblem(c.Request.Context(), problemID, user, update); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	problem, err := h.problemService.GetProblem(c.Request.Context(), problemID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, problemToResponse(*problem))
+}
+
+// DeleteProblem - Only for the author or a lead
+func (h *ProblemHandler) DeleteProblem(c *gin.Context) {
+	problemID, err := uuid.Parse(c.Param("problemId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid problem ID"})
+		return
+	}
+
+	user := c.MustGet("user").(*domain.User)
+	if err := h.problemService.DeleteProblem(c.Request.Context(), problemID, user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// SetRoomQuestions - Plans the questions for a room, in order
+func (h *ProblemHandler) SetRoomQuestions(c *gin.Context) {
+	roomID, err := uuid.Parse(c.Param("roomId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid room ID"})
+		return
+	}
+
+	var request struct {
+		ProblemIDs []uuid.UUID `json:"problemIds"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	interviewer := c.MustGet("user").(*domain.User)
+	if err := h.problemService.SetRoomQuestions(c.Request.Context(), roomID, interviewer.ID, request.ProblemIDs); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// ListRoomQuestions - Only for interviewers
+func (h *ProblemHandler) ListRoomQuestions(c *gin.Context) {
+	roomID, err := uuid.Parse(c.Param("roomId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid room ID"})
+		return
+	}
+
+	interviewer := c.MustGet("user").(*domain.User)
+	problems, err := h.problemService.ListRoomQuestions(c.Request.Context(), roomID, interviewer.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	response := make([]gin.H, len(problems))
+	for i, problem := range problems {
+		response[i] = problemToSummary(problem)
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// GetProblem - Only for interviewers, includes hidden test cases
+func (h *ProblemHandler) GetProblem(c *gin.Context) {
+	problemID, err := uuid.Parse(c.Param("problemId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid problem ID"})
+		return
+	}
+
+	problem, err := h.problemService.GetProblem(c.Request.Context(), problemID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "problem not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, problemToResponse(*problem))
+}
+
+// AttachProblem - Only for interviewers, a null problemId detaches the problem
+func (h *ProblemHandler) AttachProblem(c *gin.Context) {
+	roomID, err := uuid.Parse(c.Param("roomId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid room ID"})
+		return
+	}
+
+	var request struct {
+		ProblemID *uuid.UUID `json:"problemId"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	interviewer := c.MustGet("user").(*domain.User)
+	if err := h.problemService.AttachProblem(c.Request.Context(), roomID, interviewer.ID, request.ProblemID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// GetRoomProblem - Only for interviewers, includes hidden test cases
+func (h *ProblemHandler) GetRoomProblem(c *gin.Context) {
+	roomID, err := uuid.Parse(c.Param("roomId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid room ID"})
+		return
+	}
+
+	interviewer := c.MustGet("user").(*domain.User)
+	problem, err := h.problemService.GetRoomProblem(c.Request.Context(), roomID, interviewer.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, problemToResponse(*problem))
+}
+
+// GetRoomProblemByToken - For candidates using token, visible test cases only
+func (h *ProblemHandler) GetRoomProblemByToken(c *gin.Context) {
+	token := roomToken(c)
+	if token == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "token is required"})
+		return
+	}
+
+	problem, err := h.problemService.GetRoomProblemByToken(c.Request.Context(), token)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, problemToResponse(*problem))
+}
+
+// CreateSubmission - Stores graded test results for the room
+func (h *ProblemHandler) CreateSubmission(c *gin.Context) {
+	roomID, err := uuid.Parse(c.Param("roomId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid room ID"})
+		return
+	}
+
+	var request struct {
+		ProblemID uuid.UUID `json:"problemId" binding:"required"`
+		Language  string    `json:"language" binding:"required"`
+		Code      string    `json:"code"`
+		Results   []struct {
+			TestCaseID  uuid.UUID `json:"testCaseId" binding:"required"`
+			Passed      bool      `json:"passed"`
+			Status      string    `json:"status"`
+			DurationMs  int64     `json:"durationMs"`
+			CPUTimeMs   int64     `json:"cpuTimeMs"`
+			MaxMemoryKB int64     `json:"maxMemoryKb"`
+		} `json:"results" binding:"required,dive"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	submission := &domain.Submission{
+		ProblemID: request.ProblemID,
+		Language:  request.Language,
+		Code:      request.Code,
+		Results:   make([]domain.SubmissionResult, len(request.Results)),
+	}
+	for i, result := range request.Results {
+		submission.Results[i] = domain.SubmissionResult{
+			TestCaseID:  result.TestCaseID,
+			Passed:      result.Passed,
+			Status:      result.Status,
+			DurationMs:  result.DurationMs,
+			CPUTimeMs:   result.CPUTimeMs,
+			MaxMemoryKB: result.MaxMemoryKB,
+		}
+	}
+
+	interviewer := c.MustGet("user").(*domain.User)
+	if err := h.problemService.RecordSubmission(c.Request.Context(), roomID, interviewer.ID, submission); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, submissionToResponse(*submission))
+}
+
+// ListRoomSubmissions - Only for interviewers
+func (h *ProblemHandler) ListRoomSubmissions(c *gin.Context) {
+	roomID, err := uuid.Parse(c.Param("roomId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid room ID"})
+		return
+	}
+
+	interviewer := c.MustGet("user").(*domain.User)
+	submissions, err := h.problemService.ListRoomSubmissions(c.Request.Context(), roomID, interviewer.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	response := make([]gin.H, len(submissions))
+	for i, submission := range submissions {
+		response[i] = submissionToResponse(submission)
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// ListProblemSubmissions - Compare candidates on the same problem
+func (h *ProblemHandler) ListProblemSubmissions(c *gin.Context) {
+	problemID, err := uuid.Parse(c.Param("problemId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid problem ID"})
+		return
+	}
+
+	user := c.MustGet("user").(*domain.User)
+	submissions, err := h.problemService.ListProblemSubmissions(c.Request.Context(), problemID, user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	response := make([]gin.H, len(submissions))
+	for i, submission := range submissions {
+		response[i] = submissionToResponse(submission)
+		if submission.Room.ID != uuid.Nil {
+			response[i]["candidateName"] = submission.Room.CandidateName
+		}
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+func toHarnesses(requests []harnessRequest) []domain.Harness {
+	harnesses := make([]domain.Harness, len(requests))
+	for i, harness := range requests {
+		harnesses[i] = domain.Harness(harness)
+	}
+	return harnesses
+}
+
+func toTestCases(requests []testCaseRequest) []domain.TestCase {
+	testCases := make([]domain.TestCase, len(requests))
+	for i, tc := range requests {
+		testCases[i] = domain.TestCase{
+			Name:           tc.Name,
+			Input:          tc.Input,
+			ExpectedOutput: tc.ExpectedOutput,
+			Hidden:         tc.Hidden,
+		}
+	}
+	return testCases
+}
+
+func problemToSummary(problem domain.Problem) gin.H {
+	hidden := 0
+	for _, tc := range problem.TestCases {
+		if tc.Hidden {
+			hidden++
+		}
+	}
+
+	languages := make([]string, 0, len(problem.StarterCode))
+	for language := range problem.StarterCode {
+		languages = append(languages, language)
+	}
+	sort.Strings(languages)
+
+	response := gin.H{
+		"id":              problem.ID,
+		"title":           problem.Title,
+		"difficulty":      problem.Difficulty,
+		"tags":            problem.Tags,
+		"languages":       languages,
+		"testCaseCount":   len(problem.TestCases),
+		"hiddenTestCount": hidden,
+		"updatedAt":       problem.UpdatedAt,
+	}
+
+	if problem.Author.ID != uuid.Nil {
+		response["author"] = gin.H{
+			"id":   problem.Author.ID,
+			"name": problem.Author.Name,
+		}
+	}
+
+	return response
+}
+
+func problemToResponse(problem domain.Problem) gin.H {
+	testCases := make([]gin.H, len(problem.TestCases))
+	for i, tc := range problem.TestCases {
+		testCases[i] = gin.H{
+			"id":             tc.ID,
+			"name":           tc.Name,
+			"input":          tc.Input,
+			"expectedOutput": tc.ExpectedOutput,
+			"hidden":         tc.Hidden,
+		}
+	}
+
+	harnesses := make([]gin.H, len(problem.Harnesses))
+	for i, harness := range problem.Harnesses {
+		harnesses[i] = gin.H{
+			"language":     harness.Language,
+			"solutionFile": harness.SolutionFile,
+			"code":         harness.Code,
+		}
+	}
+
+	return gin.H{
+		"id":          problem.ID,
+		"title":       problem.Title,
+		"statement":   problem.Statement,
+		"difficulty":  problem.Difficulty,
+		"tags":        problem.Tags,
+		"starterCode": problem.StarterCode,
+		"harnesses":   harnesses,
+		"testCases":   testCases,
+		"createdAt":   problem.CreatedAt,
+		"updatedAt":   problem.UpdatedAt,
+	}
+}
+
+func submissionToResponse(submission domain.Submission) gin.H {
+	results := make([]gin.H, len(submission.Results))
+	for i, result := range submission.Results {
+		results[i] = gin.H{
+			"testCaseId":  result.TestCaseID,
+			"hidden":      result.Hidden,
+			"passed":      result.Passed,
+			"status":      result.Status,
+			"durationMs":  result.DurationMs,
+			"cpuTimeMs":   result.CPUTimeMs,
+			"maxMemoryKb": result.MaxMemoryKB,
+		}
+	}
+
+	return gin.H{
+		"id":         submission.ID,
+		"roomId":     submission.RoomID,
+		"problemId":  submission.ProblemID,
+		"language":   submission.Language,
+		"passed":     submission.Passed,
+		"total":      submission.Total,
+		"durationMs": submission.DurationMs,
+		"results":    results,
+		"createdAt":  submission.CreatedAt,
+	}
+}
@@ -1,10 +1,12 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 	"time"
 
 	"github.com/elskow/codepair/core-cp/internal/domain"
+	"github.com/elskow/codepair/core-cp/pkg/utils"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 )
@@ -72,10 +74,79 @@ func (h *RoomHandler) UpdateRoomSettings(c *gin.Context) {
 	c.JSON(http.StatusOK, roomToResponse(*room))
 }
 
+// SaveRoomNotes - Signed by the peer service itself
+func (h *RoomHandler) SaveRoomNotes(c *gin.Context) {
+	roomID, err := uuid.Parse(c.Param("roomId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid room ID"})
+		return
+	}
+
+	var request struct {
+		Notes *string `json:"notes" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.roomService.SaveRoomNotes(c.Request.Context(), roomID, *request.Notes); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// SaveRemovedParticipants - From the peer service, on behalf of an interviewer
+func (h *RoomHandler) SaveRemovedParticipants(c *gin.Context) {
+	h.saveRemovedParticipants(c, c.MustGet("user").(*domain.User))
+}
+
+// SaveServiceRemovedParticipants - Signed by the peer service itself
+func (h *RoomHandler) SaveServiceRemovedParticipants(c *gin.Context) {
+	h.saveRemovedParticipants(c, nil)
+}
+
+func (h *RoomHandler) saveRemovedParticipants(c *gin.Context, interviewer *domain.User) {
+	roomID, err := uuid.Parse(c.Param("roomId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid room ID"})
+		return
+	}
+
+	var request struct {
+		Removed []string `json:"removed" binding:"required,max=100,dive,required,max=64"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = h.roomService.SaveRemovedParticipants(c.Request.Context(), roomID, interviewer, request.Removed)
+	switch {
+	case errors.Is(err, utils.ErrRoomNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, utils.ErrUnauthorized):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
 // CreateRoom - Only for interviewers
 func (h *RoomHandler) CreateRoom(c *gin.Context) {
 	var request struct {
-		CandidateName string `json:"candidateName" binding:"required"`
+		CandidateName  string     `json:"candidateName" binding:"required"`
+		TemplateID     *uuid.UUID `json:"templateId"`
+		Duration       *int       `json:"duration"`
+		TechnicalStack []string   `json:"technicalStack"`
+		Description    *string    `json:"description"`
 	}
 
 	if err := c.ShouldBindJSON(&request); err != nil {
@@ -86,7 +157,13 @@ func (h *RoomHandler) CreateRoom(c *gin.Context) {
 	}
 
 	interviewer := c.MustGet("user").(*domain.User)
-	room, err := h.roomService.CreateRoom(c.Request.Context(), interviewer, request.CandidateName)
+	room, err := h.roomService.CreateRoom(c.Request.Context(), interviewer, domain.CreateRoomParams{
+		CandidateName:  request.CandidateName,
+		TemplateID:     request.TemplateID,
+		Duration:       request.Duration,
+		TechnicalStack: request.TechnicalStack,
+		Description:    request.Description,
+	})
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": err.Error(),
@@ -94,17 +171,12 @@ func (h *RoomHandler) CreateRoom(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusCreated, gin.H{
-		"id":            room.ID,
-		"candidateName": room.CandidateName,
-		"token":         room.Token,
-		"isActive":      room.IsActive,
-	})
+	c.JSON(http.StatusCreated, roomToResponse(*room))
 }
 
 // JoinRoom - For candidates using token
 func (h *RoomHandler) JoinRoom(c *gin.Context) {
-	token := c.Query("token")
+	token := roomToken(c)
 	if token == "" {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"error": "token is required",
@@ -120,6 +192,7 @@ func (h *RoomHandler) JoinRoom(c *gin.Context) {
 		return
 	}
 
+	// Candidates join with this route, the panel stays with the interviewers
 	c.JSON(http.StatusOK, gin.H{
 		"id":            room.ID,
 		"roomId":        room.ID,
@@ -128,6 +201,91 @@ func (h *RoomHandler) JoinRoom(c *gin.Context) {
 	})
 }
 
+// GetRoomAccess - For interviewers of the room. peer-cp uses it to check the
+// panel when it has no service secret, as for development.
+func (h *RoomHandler) GetRoomAccess(c *gin.Context) {
+	roomID, err := uuid.Parse(c.Param("roomId"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "invalid room ID"})
+		return
+	}
+
+	interviewer := c.MustGet("user").(*domain.User)
+	room, err := h.roomService.GetMemberRoom(c.Request.Context(), roomID, interviewer.ID)
+	switch {
+	case errors.Is(err, utils.ErrUnauthorized):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusNotFound, gin.H{"error": "room not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, roomAccessResponse(*room))
+}
+
+// ValidateRoomAccess - For peer-cp, signed with the service secret. The token
+// must belong to the room being joined.
+func (h *RoomHandler) ValidateRoomAccess(c *gin.Context) {
+	roomID, err := uuid.Parse(c.Param("roomId"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "invalid room ID"})
+		return
+	}
+
+	token := roomToken(c)
+	if token == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "token is required"})
+		return
+	}
+
+	room, err := h.roomService.ValidateRoomAccess(c.Request.Context(), roomID, token)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, roomAccessResponse(*room))
+}
+
+// GetServiceRoom - For peer-cp, signed with the service secret. Returns the
+// current token, which room events leave out.
+func (h *RoomHandler) GetServiceRoom(c *gin.Context) {
+	roomID, err := uuid.Parse(c.Param("roomId"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "invalid room ID"})
+		return
+	}
+
+	room, err := h.roomService.GetRoom(c.Request.Context(), roomID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "room not found"})
+		return
+	}
+
+	response := roomAccessResponse(*room)
+	response["token"] = room.Token
+	c.JSON(http.StatusOK, response)
+}
+
+// roomAccessResponse is what peer-cp needs to let someone into a room: its
+// state and who sits on the interview panel
+func roomAccessResponse(room domain.Room) gin.H {
+	interviewerIDs := []uuid.UUID{room.InterviewerID}
+	for _, panelist := range room.Panelists {
+		interviewerIDs = append(interviewerIDs, panelist.ID)
+	}
+
+	return gin.H{
+		"id":             room.ID,
+		"roomId":         room.ID,
+		"candidateName":  room.CandidateName,
+		"isActive":       room.IsActive,
+		"interviewerIds": interviewerIDs,
+		"removed":        append([]string{}, room.Removed...),
+	}
+}
+
 // GetInterviewerRooms - Only for interviewers
 func (h *RoomHandler) GetInterviewerRooms(c *gin.Context) {
 	interviewer := c.MustGet("user").(*domain.User)
@@ -208,6 +366,198 @@ func (h *RoomHandler) DeleteRoom(c *gin.Context) {
 	c.Status(http.StatusNoContent)
 }
 
+// RotateToken - Only for the room's interviewer. The old candidate link stops working.
+func (h *RoomHandler) RotateToken(c *gin.Context) {
+	roomID, err := uuid.Parse(c.Param("roomId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid room ID",
+		})
+		return
+	}
+
+	interviewer := c.MustGet("user").(*domain.User)
+	token, err := h.roomService.RotateRoomToken(c.Request.Context(), roomID, interviewer.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"token": token})
+}
+
+// AddPanelist - Only for the room's interviewer
+func (h *RoomHandler) AddPanelist(c *gin.Context) {
+	roomID, err := uuid.Parse(c.Param("roomId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid room ID",
+		})
+		return
+	}
+
+	var request struct {
+		UserID uuid.UUID `json:"userId" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	interviewer := c.MustGet("user").(*domain.User)
+	if err := h.roomService.AddPanelist(c.Request.Context(), roomID, interviewer.ID, request.UserID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	room, err := h.roomService.GetRoom(c.Request.Context(), roomID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, roomToResponse(*room))
+}
+
+// RemovePanelist - Only for the room's interviewer
+func (h *RoomHandler) RemovePanelist(c *gin.Context) {
+	roomID, err := uuid.Parse(c.Param("roomId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid room ID",
+		})
+		return
+	}
+
+	userID, err := uuid.Parse(c.Param("userId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid user ID",
+		})
+		return
+	}
+
+	interviewer := c.MustGet("user").(*domain.User)
+	if err := h.roomService.RemovePanelist(c.Request.Context(), roomID, interviewer.ID, userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// RecordSessionQuality - Signed by the peer service itself
+func (h *RoomHandler) RecordSessionQuality(c *gin.Context) {
+	roomID, err := uuid.Parse(c.Param("roomId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid room ID",
+		})
+		return
+	}
+
+	var request struct {
+		ClientID        string    `json:"clientId"`
+		Participant     string    `json:"participant"`
+		Interviewer     bool      `json:"interviewer"`
+		CandidateType   string    `json:"candidateType"`
+		Protocol        string    `json:"protocol"`
+		Samples         int       `json:"samples"`
+		PoorSamples     int       `json:"poorSamples"`
+		AvgRTTMs        float64   `json:"avgRttMs"`
+		MaxRTTMs        float64   `json:"maxRttMs"`
+		AvgJitterMs     float64   `json:"avgJitterMs"`
+		PacketLossPct   float64   `json:"packetLossPct"`
+		AvgInboundKbps  float64   `json:"avgInboundKbps"`
+		AvgOutboundKbps float64   `json:"avgOutboundKbps"`
+		JoinedAt        time.Time `json:"joinedAt" binding:"required"`
+		LeftAt          time.Time `json:"leftAt" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	quality := &domain.SessionQuality{
+		ClientID:        request.ClientID,
+		Participant:     request.Participant,
+		Interviewer:     request.Interviewer,
+		CandidateType:   request.CandidateType,
+		Protocol:        request.Protocol,
+		Samples:         request.Samples,
+		PoorSamples:     request.PoorSamples,
+		AvgRTTMs:        request.AvgRTTMs,
+		MaxRTTMs:        request.MaxRTTMs,
+		AvgJitterMs:     request.AvgJitterMs,
+		PacketLossPct:   request.PacketLossPct,
+		AvgInboundKbps:  request.AvgInboundKbps,
+		AvgOutboundKbps: request.AvgOutboundKbps,
+		JoinedAt:        request.JoinedAt,
+		LeftAt:          request.LeftAt,
+	}
+	if err := h.roomService.RecordSessionQuality(c.Request.Context(), roomID, quality); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"id": quality.ID})
+}
+
+// ListSessionQuality - Only for the room's interviewers
+func (h *RoomHandler) ListSessionQuality(c *gin.Context) {
+	roomID, err := uuid.Parse(c.Param("roomId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid room ID",
+		})
+		return
+	}
+
+	interviewer := c.MustGet("user").(*domain.User)
+	reports, err := h.roomService.ListSessionQuality(c.Request.Context(), roomID, interviewer.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	response := make([]gin.H, len(reports))
+	for i, report := range reports {
+		response[i] = sessionQualityToResponse(report)
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+func sessionQualityToResponse(quality domain.SessionQuality) gin.H {
+	return gin.H{
+		"id":              quality.ID,
+		"clientId":        quality.ClientID,
+		"participant":     quality.Participant,
+		"interviewer":     quality.Interviewer,
+		"candidateType":   quality.CandidateType,
+		"protocol":        quality.Protocol,
+		"samples":         quality.Samples,
+		"poorSamples":     quality.PoorSamples,
+		"avgRttMs":        quality.AvgRTTMs,
+		"maxRttMs":        quality.MaxRTTMs,
+		"avgJitterMs":     quality.AvgJitterMs,
+		"packetLossPct":   quality.PacketLossPct,
+		"avgInboundKbps":  quality.AvgInboundKbps,
+		"avgOutboundKbps": quality.AvgOutboundKbps,
+		"joinedAt":        quality.JoinedAt.Format(time.RFC3339),
+		"leftAt":          quality.LeftAt.Format(time.RFC3339),
+	}
+}
+
+// roomToken reads a room token from the X-Room-Token header, which keeps it
+// out of access logs, or else from the token query parameter
+func roomToken(c *gin.Context) string {
+	if token := c.GetHeader("X-Room-Token"); token != "" {
+		return token
+	}
+	return c.Query("token")
+}
+
 func roomToResponse(room domain.Room) gin.H {
 	response := gin.H{
 		"id":            room.ID,
@@ -227,6 +577,26 @@ func roomToResponse(room domain.Room) gin.H {
 	if len(room.TechnicalStack) > 0 {
 		response["technicalStack"] = room.TechnicalStack
 	}
+	if room.Description != "" {
+		response["description"] = room.Description
+	}
+	if room.TemplateID != nil {
+		response["templateId"] = room.TemplateID
+	}
+	if len(room.Rubric) > 0 {
+		response["rubric"] = room.Rubric
+	}
+	if len(room.Panelists) > 0 {
+		panelists := make([]gin.H, len(room.Panelists))
+		for i, panelist := range room.Panelists {
+			panelists[i] = gin.H{
+				"id":    panelist.ID,
+				"email": panelist.Email,
+				"name":  panelist.Name,
+			}
+		}
+		response["panelists"] = panelists
+	}
 
 	if room.Interviewer.ID != uuid.Nil {
 		response["interviewer"] = gin.H{
@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/elskow/codepair/core-cp/internal/domain"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+type TemplateHandler struct {
+	templateService domain.TemplateService
+}
+
+func NewTemplateHandler(templateService domain.TemplateService) *TemplateHandler {
+	return &TemplateHandler{templateService: templateService}
+}
+
+type rubricItemRequest struct {
+	Name        string `json:"name" binding:"required"`
+	Description string `json:"description"`
+	Weight      int    `json:"weight" binding:"min=0"`
+}
+
+// CreateTemplate - Only for interviewers
+func (h *TemplateHandler) CreateTemplate(c *gin.Context) {
+	var request struct {
+		Name           string              `json:"name" binding:"required"`
+		Duration       int                 `json:"duration" binding:"omitempty,min=1"`
+		TechnicalStack []string            `json:"technicalStack"`
+		Description    string              `json:"description"`
+		QuestionIDs    []uuid.UUID         `json:"questionIds"`
+		Rubric         []rubricItemRequest `json:"rubric" binding:"dive"`
+		PanelistIDs    []uuid.UUID         `json:"panelistIds"`
+		Shared         bool                `json:"shared"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	template := &domain.RoomTemplate{
+		Name:           request.Name,
+		Duration:       request.Duration,
+		TechnicalStack: request.TechnicalStack,
+		Description:    request.Description,
+		QuestionIDs:    request.QuestionIDs,
+		Rubric:         toRubric(request.Rubric),
+		PanelistIDs:    request.PanelistIDs,
+		Shared:         request.Shared,
+	}
+	if template.Duration == 0 {
+		template.Duration = 60
+	}
+
+	owner := c.MustGet("user").(*domain.User)
+	if err := h.templateService.CreateTemplate(c.Request.Context(), owner, template); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, templateToResponse(*template))
+}
+
+// ListTemplates - Own templates and every shared one
+func (h *TemplateHandler) ListTemplates(c *gin.Context) {
+	user := c.MustGet("user").(*domain.User)
+
+	templates, err := h.templateService.ListTemplates(c.Request.Context(), user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	response := make([]gin.H, len(templates))
+	for i, template := range templates {
+		response[i] = templateToResponse(template)
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+func (h *TemplateHandler) GetTemplate(c *gin.Context) {
+	templateID, err := uuid.Parse(c.Param("templateId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid template ID"})
+		return
+	}
+
+	user := c.MustGet("user").(*domain.User)
+	template, err := h.templateService.GetTemplate(c.Request.Context(), templateID, user)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, templateToResponse(*template))
+}
+
+func (h *TemplateHandler) UpdateTemplate(c *gin.Context) {
+	templateID, err := uuid.Parse(c.Param("templateId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid template ID"})
+		return
+	}
+
+	var request struct {
+		Name           *string             `json:"name"`
+		Duration       *int                `json:"duration" binding:"omitempty,min=1"`
+		TechnicalStack []string            `json:"technicalStack"`
+		Description    *string             `json:"description"`
+		QuestionIDs    []uuid.UUID         `json:"questionIds"`
+		Rubric         []rubricItemRequest `json:"rubric" binding:"dive"`
+		PanelistIDs    []uuid.UUID         `json:"panelistIds"`
+		Shared         *bool               `json:"shared"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	update := domain.TemplateUpdate{
+		Name:           request.Name,
+		Duration:       request.Duration,
+		TechnicalStack: request.TechnicalStack,
+		Description:    request.Description,
+		QuestionIDs:    request.QuestionIDs,
+		PanelistIDs:    request.PanelistIDs,
+		Shared:         request.Shared,
+	}
+	if request.Rubric != nil {
+		update.Rubric = toRubric(request.Rubric)
+	}
+
+	user := c.MustGet("user").(*domain.User)
+	if err := h.templateService.UpdateTemplate(c.Request.Context(), templateID, user, update); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	template, err := h.templateService.GetTemplate(c.Request.Context(), templateID, user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, templateToResponse(*template))
+}
+
+func (h *TemplateHandler) DeleteTemplate(c *gin.Context) {
+	templateID, err := uuid.Parse(c.Param("templateId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid template ID"})
+		return
+	}
+
+	user := c.MustGet("user").(*domain.User)
+	if err := h.templateService.DeleteTemplate(c.Request.Context(), templateID, user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "template deleted successfully"})
+}
+
+func toRubric(items []rubricItemRequest) []domain.RubricItem {
+	rubric := make([]domain.RubricItem, len(items))
+	for i, item := range items {
+		rubric[i] = domain.RubricItem{
+			Name:        item.Name,
+			Description: item.Description,
+			Weight:      item.Weight,
+		}
+	}
+	return rubric
+}
+
+func templateToResponse(template domain.RoomTemplate) gin.H {
+	response := gin.H{
+		"id":             template.ID,
+		"name":           template.Name,
+		"duration":       template.Duration,
+		"technicalStack": template.TechnicalStack,
+		"description":    template.Description,
+		"questionIds":    template.QuestionIDs,
+		"rubric":         template.Rubric,
+		"panelistIds":    template.PanelistIDs,
+		"shared":         template.Shared,
+		"createdAt":      template.CreatedAt,
+		"updatedAt":      template.UpdatedAt,
+	}
+
+	if template.Owner.ID != uuid.Nil {
+		response["owner"] = gin.H{
+			"id":    template.Owner.ID,
+			"email": template.Owner.Email,
+			"name":  template.Owner.Name,
+		}
+	}
+
+	return response
+}
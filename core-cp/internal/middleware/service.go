@@ -0,0 +1,156 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/elskow/codepair/core-cp/pkg/utils"
+	"github.com/gin-gonic/gin"
+)
+
+// maxSignedBodyBytes bounds the bodies buffered to check their hash
+const maxSignedBodyBytes = 1 << 20
+
+// NonceCache remembers the nonces of signed requests until their timestamp
+// expires, so a captured request is only accepted once. One cache is shared
+// by all internal routes.
+type NonceCache struct {
+	mu      sync.Mutex
+	expires map[string]time.Time
+	swept   time.Time
+}
+
+func NewNonceCache() *NonceCache {
+	return &NonceCache{expires: make(map[string]time.Time)}
+}
+
+// use records a nonce and reports whether it was not seen before
+func (n *NonceCache) use(nonce string, timestamp time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	// Expired nonces are swept once a minute rather than on every request
+	if now := time.Now(); now.Sub(n.swept) > time.Minute {
+		for seen, expires := range n.expires {
+			if now.After(expires) {
+				delete(n.expires, seen)
+			}
+		}
+		n.swept = now
+	}
+
+	if _, seen := n.expires[nonce]; seen {
+		return false
+	}
+	n.expires[nonce] = timestamp.Add(utils.MaxSignatureAge)
+	return true
+}
+
+// RequireServiceSignature guards internal routes with a request signed by
+// peer-cp with the shared secret. The routes are disabled when no secret is
+// configured. streamBody spools a body too large to buffer to a temporary
+// file while checking its hash.
+func RequireServiceSignature(secret string, nonces *NonceCache, streamBody bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if secret == "" {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		timestamp, err := strconv.ParseInt(c.GetHeader(utils.TimestampHeader), 10, 64)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid service signature"})
+			return
+		}
+		signedAt := time.Unix(timestamp, 0)
+		if age := time.Since(signedAt); age > utils.MaxSignatureAge || age < -utils.MaxSignatureAge {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "service signature expired"})
+			return
+		}
+
+		// The signature covers the claimed hash, so the body is only read for
+		// requests that come from peer-cp
+		contentHash := c.GetHeader(utils.ContentHashHeader)
+		nonce := c.GetHeader(utils.NonceHeader)
+		payload := utils.ServiceRequestPayload(c.Request.Method, c.Request.URL.Path, c.Request.URL.Query().Encode(),
+			contentHash, c.GetHeader("X-Room-Token"), nonce)
+		if nonce == "" || !utils.VerifyPayload(secret, timestamp, payload, c.GetHeader(utils.SignatureHeader)) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid service signature"})
+			return
+		}
+		if !nonces.use(nonce, signedAt) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "service request replayed"})
+			return
+		}
+
+		if streamBody {
+			body, err := spoolBody(c.Request.Body, contentHash)
+			if errors.Is(err, errContentHash) {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid service signature"})
+				return
+			}
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "failed to read request body"})
+				return
+			}
+			defer func() {
+				body.Close()
+				os.Remove(body.Name())
+			}()
+			c.Request.Body = io.NopCloser(body)
+		} else {
+			body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxSignedBodyBytes))
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": "request body too large"})
+				return
+			}
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "failed to read request body"})
+				return
+			}
+			sum := sha256.Sum256(body)
+			if hex.EncodeToString(sum[:]) != contentHash {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid service signature"})
+				return
+			}
+			c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		}
+
+		c.Next()
+	}
+}
+
+var errContentHash = errors.New("body does not match its signed hash")
+
+// spoolBody copies a body to a temporary file while hashing it, and returns
+// the file rewound once the hash matches
+func spoolBody(body io.Reader, contentHash string) (*os.File, error) {
+	file, err := os.CreateTemp("", "codepair-body-*")
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(file, hash), body); err == nil {
+		if hex.EncodeToString(hash.Sum(nil)) != contentHash {
+			err = errContentHash
+		} else {
+			_, err = file.Seek(0, io.SeekStart)
+		}
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return file, nil
+}
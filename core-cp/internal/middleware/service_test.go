@@ -0,0 +1,205 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/elskow/codepair/core-cp/pkg/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+const testSecret = "secret"
+
+// signedRequest signs a request the way peer-cp does
+func signedRequest(method, target string, body []byte, signedAt time.Time, nonce string) *http.Request {
+	req := httptest.NewRequest(method, target, bytes.NewReader(body))
+	sum := sha256.Sum256(body)
+	contentHash := hex.EncodeToString(sum[:])
+	req.Header.Set("X-Room-Token", "token")
+	payload := utils.ServiceRequestPayload(method, req.URL.Path, req.URL.Query().Encode(), contentHash, "token", nonce)
+
+	req.Header.Set(utils.TimestampHeader, strconv.FormatInt(signedAt.Unix(), 10))
+	req.Header.Set(utils.ContentHashHeader, contentHash)
+	req.Header.Set(utils.NonceHeader, nonce)
+	req.Header.Set(utils.SignatureHeader, utils.SignPayload(testSecret, signedAt.Unix(), payload))
+	return req
+}
+
+func serviceRouter(streamBody bool) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/internal/rooms/:roomId", RequireServiceSignature(testSecret, NewNonceCache(), streamBody), func(c *gin.Context) {
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		c.String(http.StatusOK, strconv.Itoa(len(body)))
+	})
+	return r
+}
+
+func TestRequireServiceSignature(t *testing.T) {
+	body := []byte(`{"notes":"strong candidate"}`)
+	large := bytes.Repeat([]byte("a"), maxSignedBodyBytes+1)
+
+	tests := []struct {
+		name       string
+		streamBody bool
+		request    func() *http.Request
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name: "valid",
+			request: func() *http.Request {
+				return signedRequest(http.MethodPost, "/internal/rooms/1?a=1&b=2", body, time.Now(), "n1")
+			},
+			wantStatus: http.StatusOK,
+			wantBody:   strconv.Itoa(len(body)),
+		},
+		{
+			name: "query in another order",
+			request: func() *http.Request {
+				req := signedRequest(http.MethodPost, "/internal/rooms/1?a=1&b=2", body, time.Now(), "n1")
+				req.URL.RawQuery = "b=2&a=1"
+				return req
+			},
+			wantStatus: http.StatusOK,
+			wantBody:   strconv.Itoa(len(body)),
+		},
+		{
+			name: "tampered path",
+			request: func() *http.Request {
+				req := signedRequest(http.MethodPost, "/internal/rooms/1", body, time.Now(), "n1")
+				req.URL.Path = "/internal/rooms/2"
+				return req
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "tampered query",
+			request: func() *http.Request {
+				req := signedRequest(http.MethodPost, "/internal/rooms/1?a=1", body, time.Now(), "n1")
+				req.URL.RawQuery = "a=2"
+				return req
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "tampered body",
+			request: func() *http.Request {
+				req := signedRequest(http.MethodPost, "/internal/rooms/1", body, time.Now(), "n1")
+				req.Body = io.NopCloser(bytes.NewReader([]byte(`{"notes":"weak candidate"}`)))
+				return req
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "tampered room token",
+			request: func() *http.Request {
+				req := signedRequest(http.MethodPost, "/internal/rooms/1", body, time.Now(), "n1")
+				req.Header.Set("X-Room-Token", "other")
+				return req
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "missing nonce",
+			request: func() *http.Request {
+				return signedRequest(http.MethodPost, "/internal/rooms/1", body, time.Now(), "")
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "expired timestamp",
+			request: func() *http.Request {
+				return signedRequest(http.MethodPost, "/internal/rooms/1", body, time.Now().Add(-utils.MaxSignatureAge-time.Minute), "n1")
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "timestamp from the future",
+			request: func() *http.Request {
+				return signedRequest(http.MethodPost, "/internal/rooms/1", body, time.Now().Add(utils.MaxSignatureAge+time.Minute), "n1")
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "oversize body",
+			request: func() *http.Request {
+				return signedRequest(http.MethodPost, "/internal/rooms/1", large, time.Now(), "n1")
+			},
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:       "streamed body",
+			streamBody: true,
+			request: func() *http.Request {
+				return signedRequest(http.MethodPost, "/internal/rooms/1", large, time.Now(), "n1")
+			},
+			wantStatus: http.StatusOK,
+			wantBody:   strconv.Itoa(len(large)),
+		},
+		{
+			name:       "tampered streamed body",
+			streamBody: true,
+			request: func() *http.Request {
+				req := signedRequest(http.MethodPost, "/internal/rooms/1", large, time.Now(), "n1")
+				req.Body = io.NopCloser(bytes.NewReader(append(bytes.Clone(large), 'b')))
+				return req
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			serviceRouter(tt.streamBody).ServeHTTP(w, tt.request())
+
+			assert.Equal(t, tt.wantStatus, w.Code)
+			if tt.wantBody != "" {
+				assert.Equal(t, tt.wantBody, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestRequireServiceSignatureReplay(t *testing.T) {
+	r := serviceRouter(false)
+	body := []byte(`{}`)
+	signedAt := time.Now()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, signedRequest(http.MethodPost, "/internal/rooms/1", body, signedAt, "n1"))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, signedRequest(http.MethodPost, "/internal/rooms/1", body, signedAt, "n1"))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, signedRequest(http.MethodPost, "/internal/rooms/1", body, signedAt, "n2"))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestRequireServiceSignatureDisabled(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/internal/rooms/:roomId", RequireServiceSignature("", NewNonceCache(), false), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, signedRequest(http.MethodPost, "/internal/rooms/1", nil, time.Now(), "n1"))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,58 @@
+package postgres
+
+import (
+	"context"
+	"time"
+
+	"github.com/elskow/codepair/core-cp/internal/domain"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type artifactRepository struct {
+	db *gorm.DB
+}
+
+func NewArtifactRepository(db *gorm.DB) domain.ArtifactRepository {
+	return &artifactRepository{db: db}
+}
+
+func (r *artifactRepository) Create(ctx context.Context, artifact *domain.Artifact) error {
+	return r.db.WithContext(ctx).Create(artifact).Error
+}
+
+func (r *artifactRepository) FindByID(ctx context.Context, id uuid.UUID) (*domain.Artifact, error) {
+	var artifact domain.Artifact
+	if err := r.db.WithContext(ctx).First(&artifact, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	return &artifact, nil
+}
+
+func (r *artifactRepository) ListByRoom(ctx context.Context, roomID uuid.UUID) ([]domain.Artifact, error) {
+	var artifacts []domain.Artifact
+	err := r.db.WithContext(ctx).
+		Where("room_id = ?", roomID).
+		Order("created_at ASC").
+		Find(&artifacts).Error
+	return artifacts, err
+}
+
+func (r *artifactRepository) ListExpired(ctx context.Context, now time.Time) ([]domain.Artifact, error) {
+	var artifacts []domain.Artifact
+	err := r.db.WithContext(ctx).
+		Where("expires_at IS NOT NULL AND expires_at <= ?", now).
+		Find(&artifacts).Error
+	return artifacts, err
+}
+
+func (r *artifactRepository) SetExpiry(ctx context.Context, id uuid.UUID, expiresAt *time.Time) error {
+	return r.db.WithContext(ctx).
+		Model(&domain.Artifact{}).
+		Where("id = ?", id).
+		Update("expires_at", expiresAt).Error
+}
+
+func (r *artifactRepository) Delete(ctx context.Context, id uuid.UUID) error {
+	return r.db.WithContext(ctx).Delete(&domain.Artifact{}, "id = ?", id).Error
+}
@@ -0,0 +1,45 @@
+package postgres
+
+import (
+	"context"
+	"time"
+
+	"github.com/elskow/codepair/core-cp/internal/domain"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type editOpRepository struct {
+	db *gorm.DB
+}
+
+func NewEditOpRepository(db *gorm.DB) domain.EditOpRepository {
+	return &editOpRepository{db: db}
+}
+
+// CreateBatch stores ops, skipping those already stored. peer-cp sends a
+// batch again when it did not get the answer to the first attempt.
+func (r *editOpRepository) CreateBatch(ctx context.Context, ops []domain.EditOp) error {
+	return r.db.WithContext(ctx).
+		Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "room_id"}, {Name: "instance"}, {Name: "seq"}},
+			DoNothing: true,
+		}).
+		Create(&ops).Error
+}
+
+// ListByRoom returns a room's ops in the order they were applied, up to and
+// including until when it is set
+func (r *editOpRepository) ListByRoom(ctx context.Context, roomID uuid.UUID, until *time.Time) ([]domain.EditOp, error) {
+	query := r.db.WithContext(ctx).Where("room_id = ?", roomID)
+	if until != nil {
+		query = query.Where("occurred_at <= ?", *until)
+	}
+
+	var ops []domain.EditOp
+	err := query.
+		Order("occurred_at ASC, instance ASC, seq ASC").
+		Find(&ops).Error
+	return ops, err
+}
@@ -13,5 +13,14 @@ func AutoMigrate(db *gorm.DB) error {
 	return db.AutoMigrate(
 		&domain.User{},
 		&domain.Room{},
+		&domain.RoomTemplate{},
+		&domain.Problem{},
+		&domain.TestCase{},
+		&domain.RoomQuestion{},
+		&domain.Submission{},
+		&domain.SubmissionResult{},
+		&domain.Artifact{},
+		&domain.SessionQuality{},
+		&domain.EditOp{},
 	)
 }
@@ -0,0 +1,213 @@
+package postgres
+
+import (
+	"context"
+
+	"github.com/elskow/codepair/core-cp/internal/domain"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"gorm.io/gorm"
+)
+
+type problemRepository struct {
+	db *gorm.DB
+}
+
+func NewProblemRepository(db *gorm.DB) domain.ProblemRepository {
+	return &problemRepository{db: db}
+}
+
+func (r *problemRepository) Create(ctx context.Context, problem *domain.Problem) error {
+	return r.db.WithContext(ctx).Create(problem).Error
+}
+
+func (r *problemRepository) FindByID(ctx context.Context, id uuid.UUID) (*domain.Problem, error) {
+	var problem domain.Problem
+	err := r.db.WithContext(ctx).
+		Preload("TestCases", func(db *gorm.DB) *gorm.DB {
+			return db.Order("position ASC")
+		}).
+		First(&problem, "id = ?", id).
+		Error
+	if err != nil {
+		return nil, err
+	}
+	return &problem, nil
+}
+
+func (r *problemRepository) List(ctx context.Context, params domain.ListProblemsParams) ([]domain.Problem, error) {
+	var problems []domain.Problem
+
+	query := r.db.WithContext(ctx).Model(&domain.Problem{})
+
+	if params.Query != "" {
+		query = query.Where("title ILIKE ?", "%"+params.Query+"%")
+	}
+	if params.Tag != "" {
+		query = query.Where("? = ANY(tags)", params.Tag)
+	}
+	if params.Difficulty != "" {
+		query = query.Where("difficulty = ?", params.Difficulty)
+	}
+
+	if params.Limit > 0 {
+		query = query.Limit(params.Limit)
+	}
+	if params.Offset > 0 {
+		query = query.Offset(params.Offset)
+	}
+
+	err := query.
+		Preload("Author").
+		Preload("TestCases", func(db *gorm.DB) *gorm.DB {
+			return db.Order("position ASC")
+		}).
+		Order("updated_at DESC").
+		Find(&problems).Error
+	return problems, err
+}
+
+func (r *problemRepository) Update(ctx context.Context, id uuid.UUID, update domain.ProblemUpdate) error {
+	updates := map[string]interface{}{}
+
+	if update.Title != nil {
+		updates["title"] = *update.Title
+	}
+	if update.Statement != nil {
+		updates["statement"] = *update.Statement
+	}
+	if update.Difficulty != nil {
+		updates["difficulty"] = *update.Difficulty
+	}
+	if update.Tags != nil {
+		updates["tags"] = pq.StringArray(update.Tags)
+	}
+
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		problem := domain.Problem{ID: id}
+
+		// Serialized columns have to go through the model to be encoded
+		if update.StarterCode != nil {
+			problem.StarterCode = update.StarterCode
+			if err := tx.Model(&problem).Select("StarterCode").Updates(&problem).Error; err != nil {
+				return err
+			}
+		}
+		if update.Harnesses != nil {
+			problem.Harnesses = update.Harnesses
+			if err := tx.Model(&problem).Select("Harnesses").Updates(&problem).Error; err != nil {
+				return err
+			}
+		}
+
+		if len(updates) > 0 {
+			if err := tx.Model(&domain.Problem{}).Where("id = ?", id).Updates(updates).Error; err != nil {
+				return err
+			}
+		}
+
+		if update.TestCases == nil {
+			return nil
+		}
+
+		if err := tx.Where("problem_id = ?", id).Delete(&domain.TestCase{}).Error; err != nil {
+			return err
+		}
+		if len(update.TestCases) == 0 {
+			return nil
+		}
+		for i := range update.TestCases {
+			update.TestCases[i].ProblemID = id
+		}
+		return tx.Create(&update.TestCases).Error
+	})
+}
+
+func (r *problemRepository) Delete(ctx context.Context, id uuid.UUID) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&domain.Room{}).Where("problem_id = ?", id).Update("problem_id", nil).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&domain.Problem{}, "id = ?", id).Error
+	})
+}
+
+// SetRoomQuestions replaces the questions planned for a room, keeping the given order
+func (r *problemRepository) SetRoomQuestions(ctx context.Context, roomID uuid.UUID, problemIDs []uuid.UUID) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("room_id = ?", roomID).Delete(&domain.RoomQuestion{}).Error; err != nil {
+			return err
+		}
+		if len(problemIDs) == 0 {
+			return nil
+		}
+
+		questions := make([]domain.RoomQuestion, len(problemIDs))
+		for i, problemID := range problemIDs {
+			questions[i] = domain.RoomQuestion{
+				RoomID:    roomID,
+				ProblemID: problemID,
+				Position:  i,
+			}
+		}
+		return tx.Omit("Room", "Problem").Create(&questions).Error
+	})
+}
+
+func (r *problemRepository) ListRoomQuestions(ctx context.Context, roomID uuid.UUID) ([]domain.Problem, error) {
+	var problems []domain.Problem
+	err := r.db.WithContext(ctx).
+		Select("problems.*").
+		Joins("JOIN room_questions ON room_questions.problem_id = problems.id").
+		Where("room_questions.room_id = ?", roomID).
+		Order("room_questions.position ASC").
+		Preload("TestCases", func(db *gorm.DB) *gorm.DB {
+			return db.Order("position ASC")
+		}).
+		Find(&problems).Error
+	return problems, err
+}
+
+type submissionRepository struct {
+	db *gorm.DB
+}
+
+func NewSubmissionRepository(db *gorm.DB) domain.SubmissionRepository {
+	return &submissionRepository{db: db}
+}
+
+func (r *submissionRepository) Create(ctx context.Context, submission *domain.Submission) error {
+	return r.db.WithContext(ctx).Create(submission).Error
+}
+
+func (r *submissionRepository) ListByRoom(ctx context.Context, roomID uuid.UUID) ([]domain.Submission, error) {
+	var submissions []domain.Submission
+	err := r.db.WithContext(ctx).
+		Preload("Results").
+		Where("room_id = ?", roomID).
+		Order("created_at DESC").
+		Find(&submissions).Error
+	return submissions, err
+}
+
+// ListByProblem returns every submission for a problem, optionally limited to
+// rooms owned by one interviewer
+func (r *submissionRepository) ListByProblem(ctx context.Context, problemID uuid.UUID, interviewerID *uuid.UUID) ([]domain.Submission, error) {
+	var submissions []domain.Submission
+
+	query := r.db.WithContext(ctx).
+		Select("submissions.*").
+		Joins("JOIN rooms ON submissions.room_id = rooms.id").
+		Where("submissions.problem_id = ?", problemID)
+
+	if interviewerID != nil {
+		query = query.Where("rooms.interviewer_id = ?", *interviewerID)
+	}
+
+	err := query.
+		Preload("Room").
+		Preload("Results").
+		Order("submissions.passed DESC, submissions.duration_ms ASC").
+		Find(&submissions).Error
+	return submissions, err
+}
@@ -24,6 +24,7 @@ func (r *roomRepository) GetRoom(ctx context.Context, roomID uuid.UUID) (*domain
 	var room domain.Room
 	err := r.db.WithContext(ctx).
 		Preload("Interviewer").
+		Preload("Panelists").
 		First(&room, "id = ?", roomID).
 		Error
 	if err != nil {
@@ -101,6 +102,15 @@ func (r *roomRepository) UpdateRoomSettings(ctx context.Context, id uuid.UUID, s
 	if settings.TechnicalStack != nil {
 		updates["technical_stack"] = pq.StringArray(settings.TechnicalStack)
 	}
+	if settings.Description != nil {
+		updates["description"] = *settings.Description
+	}
+	if settings.Notes != nil {
+		updates["notes"] = *settings.Notes
+	}
+	if settings.Removed != nil {
+		updates["removed"] = pq.StringArray(settings.Removed)
+	}
 
 	return r.db.WithContext(ctx).
 		Model(&domain.Room{}).
@@ -109,8 +119,28 @@ func (r *roomRepository) UpdateRoomSettings(ctx context.Context, id uuid.UUID, s
 		Error
 }
 
-func (r *roomRepository) Create(ctx context.Context, room *domain.Room) error {
-	return r.db.WithContext(ctx).Create(room).Error
+// Create stores the room with its planned questions, so a room is never left
+// without the questions its template plans
+func (r *roomRepository) Create(ctx context.Context, room *domain.Room, questionIDs []uuid.UUID) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// Panelists are existing users, only the join rows are written
+		if err := tx.Omit("Panelists.*").Create(room).Error; err != nil {
+			return err
+		}
+		if len(questionIDs) == 0 {
+			return nil
+		}
+
+		questions := make([]domain.RoomQuestion, len(questionIDs))
+		for i, problemID := range questionIDs {
+			questions[i] = domain.RoomQuestion{
+				RoomID:    room.ID,
+				ProblemID: problemID,
+				Position:  i,
+			}
+		}
+		return tx.Omit("Room", "Problem").Create(&questions).Error
+	})
 }
 
 func (r *roomRepository) FindByID(ctx context.Context, id uuid.UUID) (*domain.Room, error) {
@@ -124,7 +154,7 @@ func (r *roomRepository) FindByID(ctx context.Context, id uuid.UUID) (*domain.Ro
 
 func (r *roomRepository) FindByToken(ctx context.Context, token string) (*domain.Room, error) {
 	var room domain.Room
-	err := r.db.WithContext(ctx).Where("token = ?", token).First(&room).Error
+	err := r.db.WithContext(ctx).Preload("Panelists").Where("token = ?", token).First(&room).Error
 	if err != nil {
 		return nil, err
 	}
@@ -135,6 +165,42 @@ func (r *roomRepository) SetActive(ctx context.Context, id uuid.UUID, active boo
 	return r.db.WithContext(ctx).Model(&domain.Room{}).Where("id = ?", id).Update("is_active", active).Error
 }
 
+func (r *roomRepository) SetProblem(ctx context.Context, id uuid.UUID, problemID *uuid.UUID) error {
+	return r.db.WithContext(ctx).Model(&domain.Room{}).Where("id = ?", id).Update("problem_id", problemID).Error
+}
+
 func (r *roomRepository) Delete(ctx context.Context, id uuid.UUID) error {
 	return r.db.WithContext(ctx).Delete(&domain.Room{}, "id = ?", id).Error
 }
+
+func (r *roomRepository) AddSessionQuality(ctx context.Context, quality *domain.SessionQuality) error {
+	return r.db.WithContext(ctx).Create(quality).Error
+}
+
+func (r *roomRepository) ListSessionQuality(ctx context.Context, roomID uuid.UUID) ([]domain.SessionQuality, error) {
+	var reports []domain.SessionQuality
+	err := r.db.WithContext(ctx).
+		Where("room_id = ?", roomID).
+		Order("joined_at ASC").
+		Find(&reports).Error
+	return reports, err
+}
+
+func (r *roomRepository) SetToken(ctx context.Context, id uuid.UUID, token string) error {
+	return r.db.WithContext(ctx).Model(&domain.Room{}).Where("id = ?", id).Update("token", token).Error
+}
+
+func (r *roomRepository) AddPanelist(ctx context.Context, id uuid.UUID, panelist *domain.User) error {
+	return r.db.WithContext(ctx).
+		Model(&domain.Room{ID: id}).
+		Omit("Panelists.*").
+		Association("Panelists").
+		Append(panelist)
+}
+
+func (r *roomRepository) RemovePanelist(ctx context.Context, id uuid.UUID, panelist *domain.User) error {
+	return r.db.WithContext(ctx).
+		Model(&domain.Room{ID: id}).
+		Association("Panelists").
+		Delete(panelist)
+}
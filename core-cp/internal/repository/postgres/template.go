@@ -0,0 +1,97 @@
+package postgres
+
+import (
+	"context"
+
+	"github.com/elskow/codepair/core-cp/internal/domain"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"gorm.io/gorm"
+)
+
+type roomTemplateRepository struct {
+	db *gorm.DB
+}
+
+func NewRoomTemplateRepository(db *gorm.DB) domain.RoomTemplateRepository {
+	return &roomTemplateRepository{db: db}
+}
+
+func (r *roomTemplateRepository) Create(ctx context.Context, template *domain.RoomTemplate) error {
+	return r.db.WithContext(ctx).Create(template).Error
+}
+
+func (r *roomTemplateRepository) FindByID(ctx context.Context, id uuid.UUID) (*domain.RoomTemplate, error) {
+	var template domain.RoomTemplate
+	err := r.db.WithContext(ctx).
+		Preload("Owner").
+		First(&template, "id = ?", id).
+		Error
+	if err != nil {
+		return nil, err
+	}
+	return &template, nil
+}
+
+// ListAccessible returns the user's own templates and every shared one
+func (r *roomTemplateRepository) ListAccessible(ctx context.Context, userID uuid.UUID) ([]domain.RoomTemplate, error) {
+	var templates []domain.RoomTemplate
+	err := r.db.WithContext(ctx).
+		Preload("Owner").
+		Where("owner_id = ? OR shared = ?", userID, true).
+		Order("updated_at DESC").
+		Find(&templates).Error
+	return templates, err
+}
+
+func (r *roomTemplateRepository) Update(ctx context.Context, id uuid.UUID, update domain.TemplateUpdate) error {
+	updates := map[string]interface{}{}
+
+	if update.Name != nil {
+		updates["name"] = *update.Name
+	}
+	if update.Duration != nil {
+		updates["duration"] = *update.Duration
+	}
+	if update.TechnicalStack != nil {
+		updates["technical_stack"] = pq.StringArray(update.TechnicalStack)
+	}
+	if update.Description != nil {
+		updates["description"] = *update.Description
+	}
+	if update.Shared != nil {
+		updates["shared"] = *update.Shared
+	}
+
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// Serialized columns have to go through the model to be encoded
+		template := domain.RoomTemplate{ID: id}
+		var serialized []string
+		if update.QuestionIDs != nil {
+			template.QuestionIDs = update.QuestionIDs
+			serialized = append(serialized, "QuestionIDs")
+		}
+		if update.Rubric != nil {
+			template.Rubric = update.Rubric
+			serialized = append(serialized, "Rubric")
+		}
+		if update.PanelistIDs != nil {
+			template.PanelistIDs = update.PanelistIDs
+			serialized = append(serialized, "PanelistIDs")
+		}
+		if len(serialized) > 0 {
+			if err := tx.Model(&template).Select(serialized).Updates(&template).Error; err != nil {
+				return err
+			}
+		}
+
+		if len(updates) == 0 {
+			return nil
+		}
+		return tx.Model(&domain.RoomTemplate{}).Where("id = ?", id).Updates(updates).Error
+	})
+}
+
+func (r *roomTemplateRepository) Delete(ctx context.Context, id uuid.UUID) error {
+	return r.db.WithContext(ctx).Delete(&domain.RoomTemplate{}, "id = ?", id).Error
+}
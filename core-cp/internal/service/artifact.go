@@ -0,0 +1,186 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/elskow/codepair/core-cp/internal/domain"
+	"github.com/google/uuid"
+)
+
+var artifactKinds = map[string]bool{
+	"recording": true,
+	"workspace": true, // Final editor files, saved when the interview ends
+	"integrity": true, // Candidate's pastes and focus changes, saved when the interview ends
+}
+
+type artifactService struct {
+	artifactRepo domain.ArtifactRepository
+	roomRepo     domain.RoomRepository
+	storageDir   string
+	retention    time.Duration
+}
+
+func NewArtifactService(
+	artifactRepo domain.ArtifactRepository,
+	roomRepo domain.RoomRepository,
+	storageDir string,
+	retentionDays int,
+) domain.ArtifactService {
+	return &artifactService{
+		artifactRepo: artifactRepo,
+		roomRepo:     roomRepo,
+		storageDir:   storageDir,
+		retention:    time.Duration(retentionDays) * 24 * time.Hour,
+	}
+}
+
+// StoreArtifact writes the uploaded file to the artifact store and registers
+// it with the room. Only the room's interviewer and panelists can upload. A
+// nil uploader is peer-cp, authenticated by its service signature.
+func (s *artifactService) StoreArtifact(ctx context.Context, roomID uuid.UUID, uploader *domain.User, artifact *domain.Artifact, content io.Reader) error {
+	if !artifactKinds[artifact.Kind] {
+		return errors.New("invalid artifact kind")
+	}
+
+	room, err := s.roomRepo.GetRoom(ctx, roomID)
+	if err != nil {
+		return err
+	}
+	if uploader != nil && !isRoomMember(room, uploader.ID) {
+		return errors.New("unauthorized: not an interviewer of this room")
+	}
+
+	artifact.ID = uuid.New()
+	artifact.RoomID = roomID
+	if uploader != nil {
+		artifact.UploadedBy = uploader.ID
+	}
+	artifact.FileName = filepath.Base(artifact.FileName)
+	artifact.StoragePath = filepath.Join(roomID.String(), artifact.ID.String()+filepath.Ext(artifact.FileName))
+	if s.retention > 0 {
+		expiresAt := time.Now().Add(s.retention)
+		artifact.ExpiresAt = &expiresAt
+	}
+
+	fullPath := filepath.Join(s.storageDir, artifact.StoragePath)
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0o750); err != nil {
+		return fmt.Errorf("failed to create artifact directory: %w", err)
+	}
+
+	file, err := os.OpenFile(fullPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o640)
+	if err != nil {
+		return fmt.Errorf("failed to create artifact file: %w", err)
+	}
+
+	size, err := io.Copy(file, content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(fullPath)
+		return fmt.Errorf("failed to store artifact: %w", err)
+	}
+	artifact.SizeBytes = size
+
+	if err := s.artifactRepo.Create(ctx, artifact); err != nil {
+		os.Remove(fullPath)
+		return err
+	}
+	return nil
+}
+
+func (s *artifactService) ListRoomArtifacts(ctx context.Context, roomID uuid.UUID, user *domain.User) ([]domain.Artifact, error) {
+	if err := requireLead(user); err != nil {
+		return nil, err
+	}
+	return s.artifactRepo.ListByRoom(ctx, roomID)
+}
+
+// GetArtifact returns the artifact with StoragePath resolved to a file on disk
+func (s *artifactService) GetArtifact(ctx context.Context, artifactID uuid.UUID, user *domain.User) (*domain.Artifact, error) {
+	if err := requireLead(user); err != nil {
+		return nil, err
+	}
+
+	artifact, err := s.artifactRepo.FindByID(ctx, artifactID)
+	if err != nil {
+		return nil, err
+	}
+	artifact.StoragePath = filepath.Join(s.storageDir, artifact.StoragePath)
+	return artifact, nil
+}
+
+// SetRetention changes when an artifact is purged. A nil expiry keeps it
+// until it is deleted by hand, e.g. while a dispute is open.
+func (s *artifactService) SetRetention(ctx context.Context, artifactID uuid.UUID, user *domain.User, expiresAt *time.Time) error {
+	if err := requireLead(user); err != nil {
+		return err
+	}
+
+	if _, err := s.artifactRepo.FindByID(ctx, artifactID); err != nil {
+		return err
+	}
+	return s.artifactRepo.SetExpiry(ctx, artifactID, expiresAt)
+}
+
+func (s *artifactService) DeleteArtifact(ctx context.Context, artifactID uuid.UUID, user *domain.User) error {
+	if err := requireLead(user); err != nil {
+		return err
+	}
+
+	artifact, err := s.artifactRepo.FindByID(ctx, artifactID)
+	if err != nil {
+		return err
+	}
+	return s.removeArtifact(ctx, artifact)
+}
+
+// PurgeExpired deletes every artifact past its retention period
+func (s *artifactService) PurgeExpired(ctx context.Context) (int, error) {
+	artifacts, err := s.artifactRepo.ListExpired(ctx, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for i := range artifacts {
+		if err := s.removeArtifact(ctx, &artifacts[i]); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+func (s *artifactService) removeArtifact(ctx context.Context, artifact *domain.Artifact) error {
+	err := os.Remove(filepath.Join(s.storageDir, artifact.StoragePath))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove artifact file: %w", err)
+	}
+	return s.artifactRepo.Delete(ctx, artifact.ID)
+}
+
+func isRoomMember(room *domain.Room, userID uuid.UUID) bool {
+	if room.InterviewerID == userID {
+		return true
+	}
+	for _, panelist := range room.Panelists {
+		if panelist.ID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+func requireLead(user *domain.User) error {
+	if user.Role != "lead" {
+		return errors.New("unauthorized: only lead interviewers can access artifacts")
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/elskow/codepair/core-cp/config"
+	"github.com/elskow/codepair/core-cp/internal/domain"
+	"github.com/elskow/codepair/core-cp/pkg/utils"
+	"go.uber.org/zap"
+)
+
+const (
+	eventQueueSize     = 256
+	eventDeliveryTries = 4
+	eventRetryDelay    = time.Second // Doubled after every failed try
+)
+
+type webhookPublisher struct {
+	secret  string
+	client  *http.Client
+	logger  *zap.Logger
+	targets []chan domain.RoomEvent
+}
+
+type noopPublisher struct{}
+
+func (noopPublisher) Publish(domain.RoomEvent) {}
+
+// NewRoomEventPublisher posts room events to every configured peer-cp
+// endpoint. Each endpoint has its own queue, so one that is down does not
+// hold up the others, and receives events in the order they happened.
+func NewRoomEventPublisher(cfg config.EventsConfig, logger *zap.Logger) domain.RoomEventPublisher {
+	if len(cfg.WebhookURLs) == 0 {
+		return noopPublisher{}
+	}
+
+	p := &webhookPublisher{
+		secret: cfg.Secret,
+		client: &http.Client{Timeout: 10 * time.Second},
+		logger: logger,
+	}
+	for _, url := range cfg.WebhookURLs {
+		queue := make(chan domain.RoomEvent, eventQueueSize)
+		p.targets = append(p.targets, queue)
+		go p.deliver(url, queue)
+	}
+	return p
+}
+
+func (p *webhookPublisher) Publish(event domain.RoomEvent) {
+	for _, queue := range p.targets {
+		select {
+		case queue <- event:
+		default:
+			// peer-cp still picks the change up when it re-validates the room
+			p.logger.Warn("room event queue full, dropping event",
+				zap.String("type", event.Type),
+				zap.String("roomID", event.RoomID.String()))
+		}
+	}
+}
+
+func (p *webhookPublisher) deliver(url string, queue <-chan domain.RoomEvent) {
+	for event := range queue {
+		body, err := json.Marshal(event)
+		if err != nil {
+			p.logger.Error("failed to marshal room event", zap.Error(err))
+			continue
+		}
+
+		delay := eventRetryDelay
+		for try := 1; ; try++ {
+			err = p.post(url, body)
+			if err == nil || try == eventDeliveryTries {
+				break
+			}
+			time.Sleep(delay)
+			delay *= 2
+		}
+		if err != nil {
+			p.logger.Error("failed to deliver room event",
+				zap.String("url", url),
+				zap.String("type", event.Type),
+				zap.String("roomID", event.RoomID.String()),
+				zap.Error(err))
+		}
+	}
+}
+
+func (p *webhookPublisher) post(url string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(utils.TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(utils.SignatureHeader, utils.SignPayload(p.secret, timestamp, body))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+	"unicode/utf8"
+
+	"github.com/elskow/codepair/core-cp/internal/domain"
+	"github.com/elskow/codepair/core-cp/pkg/utils"
+	"github.com/google/uuid"
+)
+
+// replayKeyframeInterval is how many ops a replay player applies at most
+// after seeking to a keyframe
+const replayKeyframeInterval = 200
+
+var editOpKinds = map[string]bool{
+	domain.EditOpEdit:   true,
+	domain.EditOpCreate: true,
+	domain.EditOpRename: true,
+	domain.EditOpDelete: true,
+}
+
+var replayKinds = map[string]string{
+	domain.EditOpEdit:   "e",
+	domain.EditOpCreate: "c",
+	domain.EditOpRename: "r",
+	domain.EditOpDelete: "d",
+}
+
+type historyService struct {
+	editOpRepo domain.EditOpRepository
+	roomRepo   domain.RoomRepository
+}
+
+func NewHistoryService(editOpRepo domain.EditOpRepository, roomRepo domain.RoomRepository) domain.HistoryService {
+	return &historyService{
+		editOpRepo: editOpRepo,
+		roomRepo:   roomRepo,
+	}
+}
+
+// RecordEdits appends ops to the room's edit history. A nil uploader is
+// peer-cp, authenticated by its service signature.
+func (s *historyService) RecordEdits(ctx context.Context, roomID uuid.UUID, uploader *domain.User, ops []domain.EditOp) error {
+	room, err := s.roomRepo.GetRoom(ctx, roomID)
+	if err != nil {
+		return err
+	}
+	if uploader != nil && !isRoomMember(room, uploader.ID) {
+		return fmt.Errorf("%w: not an interviewer of this room", utils.ErrUnauthorized)
+	}
+
+	for i := range ops {
+		op := &ops[i]
+		if !editOpKinds[op.Kind] {
+			return fmt.Errorf("%w: unknown kind", utils.ErrInvalidEditOp)
+		}
+		if op.Path == "" || op.OccurredAt.IsZero() {
+			return fmt.Errorf("%w: a path and a time are required", utils.ErrInvalidEditOp)
+		}
+		if op.Position < 0 || op.Deleted < 0 {
+			return fmt.Errorf("%w: negative range", utils.ErrInvalidEditOp)
+		}
+		// Longer values than the columns hold would fail the whole batch
+		if utf8.RuneCountInString(op.Path) > 255 || utf8.RuneCountInString(op.NewPath) > 255 ||
+			utf8.RuneCountInString(op.AuthorName) > 255 || utf8.RuneCountInString(op.Language) > 32 ||
+			utf8.RuneCountInString(op.Instance) > 64 || utf8.RuneCountInString(op.AuthorID) > 64 {
+			return fmt.Errorf("%w: field too long", utils.ErrInvalidEditOp)
+		}
+		op.ID = uuid.New()
+		op.RoomID = roomID
+	}
+	if len(ops) == 0 {
+		return nil
+	}
+	return s.editOpRepo.CreateBatch(ctx, ops)
+}
+
+// DocumentAt rebuilds the room's files as they were at the given time
+func (s *historyService) DocumentAt(ctx context.Context, roomID uuid.UUID, user *domain.User, at time.Time) ([]domain.HistoryFile, error) {
+	if err := s.checkViewer(ctx, roomID, user); err != nil {
+		return nil, err
+	}
+
+	ops, err := s.editOpRepo.ListByRoom(ctx, roomID, &at)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string]*domain.HistoryFile)
+	for _, op := range ops {
+		applyEditOp(files, op)
+	}
+	return sortedFiles(files), nil
+}
+
+// Replay lays out the room's whole edit history for a player
+func (s *historyService) Replay(ctx context.Context, roomID uuid.UUID, user *domain.User) (*domain.Replay, error) {
+	if err := s.checkViewer(ctx, roomID, user); err != nil {
+		return nil, err
+	}
+
+	ops, err := s.editOpRepo.ListByRoom(ctx, roomID, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	replay := &domain.Replay{
+		Authors:   []domain.ReplayAuthor{},
+		Ops:       make([]domain.ReplayOp, 0, len(ops)),
+		Keyframes: []domain.ReplayKeyframe{},
+	}
+	if len(ops) == 0 {
+		return replay, nil
+	}
+	replay.StartedAt = ops[0].OccurredAt
+	replay.EndedAt = ops[len(ops)-1].OccurredAt
+
+	authors := make(map[string]int)
+	files := make(map[string]*domain.HistoryFile)
+	for i, op := range ops {
+		offset := op.OccurredAt.Sub(replay.StartedAt).Milliseconds()
+
+		if i%replayKeyframeInterval == 0 {
+			replay.Keyframes = append(replay.Keyframes, domain.ReplayKeyframe{
+				Index:  i,
+				Offset: offset,
+				Files:  sortedFiles(files),
+			})
+		}
+
+		author, ok := authors[op.AuthorID]
+		if !ok {
+			author = len(replay.Authors)
+			authors[op.AuthorID] = author
+			replay.Authors = append(replay.Authors, domain.ReplayAuthor{ID: op.AuthorID, Name: op.AuthorName})
+		}
+
+		replay.Ops = append(replay.Ops, domain.ReplayOp{
+			Offset:   offset,
+			Author:   author,
+			Kind:     replayKinds[op.Kind],
+			Path:     op.Path,
+			NewPath:  op.NewPath,
+			Language: op.Language,
+			Position: op.Position,
+			Deleted:  op.Deleted,
+			Inserted: op.Inserted,
+		})
+		applyEditOp(files, op)
+	}
+	return replay, nil
+}
+
+// checkViewer lets the room's interviewers and leads see its history
+func (s *historyService) checkViewer(ctx context.Context, roomID uuid.UUID, user *domain.User) error {
+	room, err := s.roomRepo.GetRoom(ctx, roomID)
+	if err != nil {
+		return err
+	}
+	if user.Role != "lead" && !isRoomMember(room, user.ID) {
+		return fmt.Errorf("%w: not an interviewer of this room", utils.ErrUnauthorized)
+	}
+	return nil
+}
+
+// applyEditOp replays one op. Ranges are clamped to the file, since ops from
+// several peer-cp instances may have been computed against slightly
+// different copies of it.
+func applyEditOp(files map[string]*domain.HistoryFile, op domain.EditOp) {
+	switch op.Kind {
+	case domain.EditOpCreate:
+		files[op.Path] = &domain.HistoryFile{Path: op.Path, Language: op.Language, Content: op.Inserted}
+
+	case domain.EditOpEdit:
+		file, ok := files[op.Path]
+		if !ok {
+			file = &domain.HistoryFile{Path: op.Path}
+			files[op.Path] = file
+		}
+		if op.Language != "" {
+			file.Language = op.Language
+		}
+
+		content := []rune(file.Content)
+		start := min(op.Position, len(content))
+		end := min(start+op.Deleted, len(content))
+		file.Content = string(content[:start]) + op.Inserted + string(content[end:])
+
+	case domain.EditOpRename:
+		file, ok := files[op.Path]
+		if !ok {
+			return
+		}
+		delete(files, op.Path)
+		file.Path = op.NewPath
+		files[op.NewPath] = file
+
+	case domain.EditOpDelete:
+		delete(files, op.Path)
+	}
+}
+
+func sortedFiles(files map[string]*domain.HistoryFile) []domain.HistoryFile {
+	sorted := make([]domain.HistoryFile, 0, len(files))
+	for _, file := range files {
+		sorted = append(sorted, *file)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Path < sorted[j].Path
+	})
+	return sorted
+}
@@ -0,0 +1,247 @@
+package service
+
+import (
+	"context"
+	"errors"
+
+	"github.com/elskow/codepair/core-cp/internal/domain"
+	"github.com/google/uuid"
+)
+
+type problemService struct {
+	problemRepo    domain.ProblemRepository
+	submissionRepo domain.SubmissionRepository
+	roomRepo       domain.RoomRepository
+}
+
+func NewProblemService(
+	problemRepo domain.ProblemRepository,
+	submissionRepo domain.SubmissionRepository,
+	roomRepo domain.RoomRepository,
+) domain.ProblemService {
+	return &problemService{
+		problemRepo:    problemRepo,
+		submissionRepo: submissionRepo,
+		roomRepo:       roomRepo,
+	}
+}
+
+func (s *problemService) CreateProblem(ctx context.Context, author *domain.User, problem *domain.Problem) error {
+	if problem.Difficulty == "" {
+		problem.Difficulty = "medium"
+	}
+	if !validDifficulty(problem.Difficulty) {
+		return errors.New("invalid difficulty")
+	}
+
+	problem.AuthorID = author.ID
+	for i := range problem.TestCases {
+		problem.TestCases[i].Position = i
+	}
+	return s.problemRepo.Create(ctx, problem)
+}
+
+func (s *problemService) GetProblem(ctx context.Context, problemID uuid.UUID) (*domain.Problem, error) {
+	return s.problemRepo.FindByID(ctx, problemID)
+}
+
+func (s *problemService) ListProblems(ctx context.Context, params domain.ListProblemsParams) ([]domain.Problem, error) {
+	return s.problemRepo.List(ctx, params)
+}
+
+func (s *problemService) UpdateProblem(ctx context.Context, problemID uuid.UUID, user *domain.User, update domain.ProblemUpdate) error {
+	if err := s.checkProblemOwner(ctx, problemID, user); err != nil {
+		return err
+	}
+
+	if update.Difficulty != nil && !validDifficulty(*update.Difficulty) {
+		return errors.New("invalid difficulty")
+	}
+
+	for i := range update.TestCases {
+		update.TestCases[i].Position = i
+	}
+
+	return s.problemRepo.Update(ctx, problemID, update)
+}
+
+func (s *problemService) DeleteProblem(ctx context.Context, problemID uuid.UUID, user *domain.User) error {
+	if err := s.checkProblemOwner(ctx, problemID, user); err != nil {
+		return err
+	}
+
+	return s.problemRepo.Delete(ctx, problemID)
+}
+
+func (s *problemService) SetRoomQuestions(ctx context.Context, roomID uuid.UUID, interviewerID uuid.UUID, problemIDs []uuid.UUID) error {
+	if _, err := s.memberRoom(ctx, roomID, interviewerID); err != nil {
+		return err
+	}
+
+	seen := make(map[uuid.UUID]bool, len(problemIDs))
+	for _, problemID := range problemIDs {
+		if seen[problemID] {
+			return errors.New("duplicate question")
+		}
+		seen[problemID] = true
+
+		if _, err := s.problemRepo.FindByID(ctx, problemID); err != nil {
+			return errors.New("problem not found")
+		}
+	}
+
+	return s.problemRepo.SetRoomQuestions(ctx, roomID, problemIDs)
+}
+
+func (s *problemService) ListRoomQuestions(ctx context.Context, roomID uuid.UUID, interviewerID uuid.UUID) ([]domain.Problem, error) {
+	if _, err := s.memberRoom(ctx, roomID, interviewerID); err != nil {
+		return nil, err
+	}
+
+	return s.problemRepo.ListRoomQuestions(ctx, roomID)
+}
+
+func (s *problemService) AttachProblem(ctx context.Context, roomID uuid.UUID, interviewerID uuid.UUID, problemID *uuid.UUID) error {
+	if _, err := s.memberRoom(ctx, roomID, interviewerID); err != nil {
+		return err
+	}
+
+	if problemID != nil {
+		if _, err := s.problemRepo.FindByID(ctx, *problemID); err != nil {
+			return errors.New("problem not found")
+		}
+	}
+
+	return s.roomRepo.SetProblem(ctx, roomID, problemID)
+}
+
+// GetRoomProblem returns the room's problem including hidden test cases
+func (s *problemService) GetRoomProblem(ctx context.Context, roomID uuid.UUID, interviewerID uuid.UUID) (*domain.Problem, error) {
+	room, err := s.memberRoom(ctx, roomID, interviewerID)
+	if err != nil {
+		return nil, err
+	}
+
+	if room.ProblemID == nil {
+		return nil, errors.New("no problem attached to this room")
+	}
+
+	return s.problemRepo.FindByID(ctx, *room.ProblemID)
+}
+
+// GetRoomProblemByToken returns the room's problem for token holders with
+// hidden test cases stripped
+func (s *problemService) GetRoomProblemByToken(ctx context.Context, token string) (*domain.Problem, error) {
+	room, err := s.roomRepo.FindByToken(ctx, token)
+	if err != nil {
+		return nil, errors.New("invalid token")
+	}
+
+	if room.ProblemID == nil {
+		return nil, errors.New("no problem attached to this room")
+	}
+
+	problem, err := s.problemRepo.FindByID(ctx, *room.ProblemID)
+	if err != nil {
+		return nil, err
+	}
+
+	visible := make([]domain.TestCase, 0, len(problem.TestCases))
+	for _, tc := range problem.TestCases {
+		if !tc.Hidden {
+			visible = append(visible, tc)
+		}
+	}
+	problem.TestCases = visible
+
+	return problem, nil
+}
+
+func (s *problemService) RecordSubmission(ctx context.Context, roomID uuid.UUID, interviewerID uuid.UUID, submission *domain.Submission) error {
+	room, err := s.memberRoom(ctx, roomID, interviewerID)
+	if err != nil {
+		return err
+	}
+
+	if room.ProblemID == nil || *room.ProblemID != submission.ProblemID {
+		return errors.New("submission does not match the room's problem")
+	}
+
+	problem, err := s.problemRepo.FindByID(ctx, submission.ProblemID)
+	if err != nil {
+		return err
+	}
+
+	testCases := make(map[uuid.UUID]domain.TestCase, len(problem.TestCases))
+	for _, tc := range problem.TestCases {
+		testCases[tc.ID] = tc
+	}
+
+	submission.RoomID = roomID
+	submission.SubmittedBy = interviewerID
+	submission.Passed = 0
+	submission.Total = len(submission.Results)
+	submission.DurationMs = 0
+	for i := range submission.Results {
+		result := &submission.Results[i]
+		tc, ok := testCases[result.TestCaseID]
+		if !ok {
+			return errors.New("result references an unknown test case")
+		}
+		result.Hidden = tc.Hidden
+		if result.Passed {
+			submission.Passed++
+		}
+		submission.DurationMs += result.DurationMs
+	}
+
+	return s.submissionRepo.Create(ctx, submission)
+}
+
+func (s *problemService) ListRoomSubmissions(ctx context.Context, roomID uuid.UUID, interviewerID uuid.UUID) ([]domain.Submission, error) {
+	if _, err := s.memberRoom(ctx, roomID, interviewerID); err != nil {
+		return nil, err
+	}
+	return s.submissionRepo.ListByRoom(ctx, roomID)
+}
+
+// ListProblemSubmissions lets interviewers compare candidates on the same
+// problem. Leads see every room, interviewers only their own.
+func (s *problemService) ListProblemSubmissions(ctx context.Context, problemID uuid.UUID, user *domain.User) ([]domain.Submission, error) {
+	if user.Role == "lead" {
+		return s.submissionRepo.ListByProblem(ctx, problemID, nil)
+	}
+	return s.submissionRepo.ListByProblem(ctx, problemID, &user.ID)
+}
+
+// memberRoom returns the room if the interviewer owns it or is on its panel
+func (s *problemService) memberRoom(ctx context.Context, roomID uuid.UUID, interviewerID uuid.UUID) (*domain.Room, error) {
+	room, err := s.roomRepo.GetRoom(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isRoomMember(room, interviewerID) {
+		return nil, errors.New("unauthorized: not an interviewer of this room")
+	}
+
+	return room, nil
+}
+
+// checkProblemOwner allows the author and lead interviewers to modify a problem
+func (s *problemService) checkProblemOwner(ctx context.Context, problemID uuid.UUID, user *domain.User) error {
+	problem, err := s.problemRepo.FindByID(ctx, problemID)
+	if err != nil {
+		return err
+	}
+
+	if problem.AuthorID != user.ID && user.Role != "lead" {
+		return errors.New("unauthorized: only the author or a lead can modify this problem")
+	}
+
+	return nil
+}
+
+func validDifficulty(difficulty string) bool {
+	return difficulty == "easy" || difficulty == "medium" || difficulty == "hard"
+}
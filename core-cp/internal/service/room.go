@@ -5,37 +5,92 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"errors"
+	"fmt"
+	"time"
 
 	"github.com/elskow/codepair/core-cp/internal/domain"
+	"github.com/elskow/codepair/core-cp/pkg/utils"
 	"github.com/google/uuid"
 )
 
 type roomService struct {
-	roomRepo domain.RoomRepository
+	roomRepo     domain.RoomRepository
+	templateRepo domain.RoomTemplateRepository
+	userRepo     domain.UserRepository
+	events       domain.RoomEventPublisher
 }
 
-func NewRoomService(roomRepo domain.RoomRepository) domain.RoomService {
+func NewRoomService(
+	roomRepo domain.RoomRepository,
+	templateRepo domain.RoomTemplateRepository,
+	userRepo domain.UserRepository,
+	events domain.RoomEventPublisher,
+) domain.RoomService {
 	return &roomService{
-		roomRepo: roomRepo,
+		roomRepo:     roomRepo,
+		templateRepo: templateRepo,
+		userRepo:     userRepo,
+		events:       events,
 	}
 }
 
-func (s *roomService) CreateRoom(ctx context.Context, interviewer *domain.User, candidateName string) (*domain.Room, error) {
-	// Generate random token for candidate access
-	tokenBytes := make([]byte, 32)
-	if _, err := rand.Read(tokenBytes); err != nil {
+func (s *roomService) CreateRoom(ctx context.Context, interviewer *domain.User, params domain.CreateRoomParams) (*domain.Room, error) {
+	token, err := generateRoomToken()
+	if err != nil {
 		return nil, err
 	}
-	token := base64.URLEncoding.EncodeToString(tokenBytes)
 
 	room := &domain.Room{
 		InterviewerID: interviewer.ID,
-		CandidateName: candidateName,
+		CandidateName: params.CandidateName,
 		Token:         token,
 		IsActive:      true,
 	}
 
-	if err := s.roomRepo.Create(ctx, room); err != nil {
+	var questionIDs []uuid.UUID
+	if params.TemplateID != nil {
+		template, err := s.templateRepo.FindByID(ctx, *params.TemplateID)
+		if err != nil {
+			return nil, errors.New("template not found")
+		}
+		if template.OwnerID != interviewer.ID && !template.Shared {
+			return nil, errors.New("unauthorized: template is not shared")
+		}
+
+		room.TemplateID = &template.ID
+		room.Duration = template.Duration
+		room.TechnicalStack = template.TechnicalStack
+		room.Description = template.Description
+		room.Rubric = template.Rubric
+		questionIDs = template.QuestionIDs
+		if len(questionIDs) > 0 {
+			// The first planned question is the one tests run against
+			room.ProblemID = &questionIDs[0]
+		}
+
+		for _, panelistID := range template.PanelistIDs {
+			if panelistID == interviewer.ID {
+				continue
+			}
+			panelist, err := s.userRepo.FindByID(ctx, panelistID)
+			if err != nil || !panelist.IsActive {
+				continue // Panelists removed since the template was written are skipped
+			}
+			room.Panelists = append(room.Panelists, *panelist)
+		}
+	}
+
+	if params.Duration != nil {
+		room.Duration = *params.Duration
+	}
+	if params.TechnicalStack != nil {
+		room.TechnicalStack = params.TechnicalStack
+	}
+	if params.Description != nil {
+		room.Description = *params.Description
+	}
+
+	if err := s.roomRepo.Create(ctx, room, questionIDs); err != nil {
 		return nil, err
 	}
 
@@ -46,6 +101,18 @@ func (s *roomService) GetRoom(ctx context.Context, roomID uuid.UUID) (*domain.Ro
 	return s.roomRepo.GetRoom(ctx, roomID)
 }
 
+// GetMemberRoom returns the room if the interviewer owns it or is on its panel
+func (s *roomService) GetMemberRoom(ctx context.Context, roomID uuid.UUID, interviewerID uuid.UUID) (*domain.Room, error) {
+	room, err := s.roomRepo.GetRoom(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	if !isRoomMember(room, interviewerID) {
+		return nil, fmt.Errorf("%w: not an interviewer of this room", utils.ErrUnauthorized)
+	}
+	return room, nil
+}
+
 func (s *roomService) ListRooms(ctx context.Context, interviewerID uuid.UUID, params domain.ListRoomsParams) ([]domain.Room, error) {
 	return s.roomRepo.ListRooms(ctx, interviewerID, params)
 }
@@ -64,7 +131,49 @@ func (s *roomService) UpdateRoomSettings(ctx context.Context, roomID uuid.UUID,
 		return errors.New("unauthorized: not the interviewer of this room")
 	}
 
-	return s.roomRepo.UpdateRoomSettings(ctx, roomID, settings)
+	if err := s.roomRepo.UpdateRoomSettings(ctx, roomID, settings); err != nil {
+		return err
+	}
+
+	updated, err := s.roomRepo.FindByID(ctx, roomID)
+	if err != nil {
+		return err
+	}
+	eventType := domain.RoomEventUpdated
+	if room.IsActive && !updated.IsActive {
+		eventType = domain.RoomEventEnded
+	}
+	s.publish(eventType, updated, func(event *domain.RoomEvent) {
+		event.Room = roomEventDetails(updated)
+	})
+	return nil
+}
+
+// SaveRoomNotes stores the notes peer-cp kept while the room was open. Notes
+// are not room settings peer-cp acts on, so no event is published.
+func (s *roomService) SaveRoomNotes(ctx context.Context, roomID uuid.UUID, notes string) error {
+	if _, err := s.roomRepo.FindByID(ctx, roomID); err != nil {
+		return errors.New("room not found")
+	}
+	return s.roomRepo.UpdateRoomSettings(ctx, roomID, domain.RoomSettings{Notes: &notes})
+}
+
+// SaveRemovedParticipants stores who interviewers removed from the room, so
+// they stay out after peer-cp forgets the room. A nil interviewer is peer-cp,
+// authenticated by its service signature.
+func (s *roomService) SaveRemovedParticipants(ctx context.Context, roomID uuid.UUID, interviewer *domain.User, removed []string) error {
+	room, err := s.roomRepo.GetRoom(ctx, roomID)
+	if err != nil {
+		return utils.ErrRoomNotFound
+	}
+	if interviewer != nil && !isRoomMember(room, interviewer.ID) {
+		return fmt.Errorf("%w: not an interviewer of this room", utils.ErrUnauthorized)
+	}
+
+	if removed == nil {
+		removed = []string{}
+	}
+	return s.roomRepo.UpdateRoomSettings(ctx, roomID, domain.RoomSettings{Removed: removed})
 }
 
 func (s *roomService) ValidateRoomToken(ctx context.Context, token string) (*domain.Room, error) {
@@ -80,6 +189,16 @@ func (s *roomService) ValidateRoomToken(ctx context.Context, token string) (*dom
 	return room, nil
 }
 
+// ValidateRoomAccess checks that a token is the one of the given room, so a
+// token for one room cannot be used to join another
+func (s *roomService) ValidateRoomAccess(ctx context.Context, roomID uuid.UUID, token string) (*domain.Room, error) {
+	room, err := s.roomRepo.FindByToken(ctx, token)
+	if err != nil || room.ID != roomID {
+		return nil, errors.New("invalid token")
+	}
+	return room, nil
+}
+
 func (s *roomService) EndInterview(ctx context.Context, roomID uuid.UUID, interviewerID uuid.UUID) error {
 	room, err := s.roomRepo.FindByID(ctx, roomID)
 	if err != nil {
@@ -90,7 +209,12 @@ func (s *roomService) EndInterview(ctx context.Context, roomID uuid.UUID, interv
 		return errors.New("unauthorized: not the interviewer of this room")
 	}
 
-	return s.roomRepo.SetActive(ctx, roomID, false)
+	if err := s.roomRepo.SetActive(ctx, roomID, false); err != nil {
+		return err
+	}
+
+	s.publish(domain.RoomEventEnded, room, nil)
+	return nil
 }
 
 func (s *roomService) DeleteRoom(ctx context.Context, roomID uuid.UUID, interviewerID uuid.UUID) error {
@@ -104,5 +228,165 @@ func (s *roomService) DeleteRoom(ctx context.Context, roomID uuid.UUID, intervie
 		return errors.New("unauthorized: not the interviewer of this room")
 	}
 
-	return s.roomRepo.Delete(ctx, roomID)
+	if err := s.roomRepo.Delete(ctx, roomID); err != nil {
+		return err
+	}
+
+	s.publish(domain.RoomEventDeleted, room, nil)
+	return nil
+}
+
+// RecordSessionQuality stores a participant's call quality summary, as
+// reported by peer-cp
+func (s *roomService) RecordSessionQuality(ctx context.Context, roomID uuid.UUID, quality *domain.SessionQuality) error {
+	room, err := s.roomRepo.FindByID(ctx, roomID)
+	if err != nil {
+		return errors.New("room not found")
+	}
+
+	quality.ID = uuid.New()
+	quality.RoomID = room.ID
+	return s.roomRepo.AddSessionQuality(ctx, quality)
+}
+
+func (s *roomService) ListSessionQuality(ctx context.Context, roomID uuid.UUID, interviewerID uuid.UUID) ([]domain.SessionQuality, error) {
+	room, err := s.roomRepo.GetRoom(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isRoomMember(room, interviewerID) {
+		return nil, errors.New("unauthorized: not an interviewer of this room")
+	}
+
+	return s.roomRepo.ListSessionQuality(ctx, roomID)
+}
+
+// RotateRoomToken replaces the candidate link of a room. Candidates who
+// joined with the old token are disconnected by peer-cp.
+func (s *roomService) RotateRoomToken(ctx context.Context, roomID uuid.UUID, interviewerID uuid.UUID) (string, error) {
+	room, err := s.roomRepo.FindByID(ctx, roomID)
+	if err != nil {
+		return "", err
+	}
+
+	if room.InterviewerID != interviewerID {
+		return "", errors.New("unauthorized: not the interviewer of this room")
+	}
+
+	token, err := generateRoomToken()
+	if err != nil {
+		return "", err
+	}
+	if err := s.roomRepo.SetToken(ctx, roomID, token); err != nil {
+		return "", err
+	}
+
+	// peer-cp fetches the new token itself, events are not meant to carry secrets
+	s.publish(domain.RoomEventTokenRotated, room, nil)
+	return token, nil
+}
+
+func (s *roomService) AddPanelist(ctx context.Context, roomID uuid.UUID, interviewerID uuid.UUID, panelistID uuid.UUID) error {
+	room, err := s.roomRepo.GetRoom(ctx, roomID)
+	if err != nil {
+		return err
+	}
+
+	if room.InterviewerID != interviewerID {
+		return errors.New("unauthorized: not the interviewer of this room")
+	}
+	if isRoomMember(room, panelistID) {
+		return errors.New("user is already an interviewer of this room")
+	}
+
+	panelist, err := s.userRepo.FindByID(ctx, panelistID)
+	if err != nil || !panelist.IsActive {
+		return errors.New("panelist not found")
+	}
+
+	if err := s.roomRepo.AddPanelist(ctx, roomID, panelist); err != nil {
+		return err
+	}
+
+	s.publish(domain.RoomEventParticipantAdded, room, func(event *domain.RoomEvent) {
+		event.Participant = roomParticipant(panelist)
+	})
+	return nil
+}
+
+// RemovePanelist takes an interviewer off the panel. peer-cp drops their
+// connections to the room.
+func (s *roomService) RemovePanelist(ctx context.Context, roomID uuid.UUID, interviewerID uuid.UUID, panelistID uuid.UUID) error {
+	room, err := s.roomRepo.GetRoom(ctx, roomID)
+	if err != nil {
+		return err
+	}
+
+	if room.InterviewerID != interviewerID {
+		return errors.New("unauthorized: not the interviewer of this room")
+	}
+
+	var panelist *domain.User
+	for i := range room.Panelists {
+		if room.Panelists[i].ID == panelistID {
+			panelist = &room.Panelists[i]
+			break
+		}
+	}
+	if panelist == nil {
+		return errors.New("user is not a panelist of this room")
+	}
+
+	if err := s.roomRepo.RemovePanelist(ctx, roomID, panelist); err != nil {
+		return err
+	}
+
+	s.publish(domain.RoomEventParticipantRemoved, room, func(event *domain.RoomEvent) {
+		event.Participant = roomParticipant(panelist)
+	})
+	return nil
+}
+
+// publish sends a room event to peer-cp, with fill adding the fields
+// specific to its type
+func (s *roomService) publish(eventType string, room *domain.Room, fill func(event *domain.RoomEvent)) {
+	event := domain.RoomEvent{
+		ID:         uuid.New(),
+		Type:       eventType,
+		RoomID:     room.ID,
+		OccurredAt: time.Now(),
+	}
+	if fill != nil {
+		fill(&event)
+	}
+	s.events.Publish(event)
+}
+
+func roomEventDetails(room *domain.Room) *domain.RoomEventDetails {
+	return &domain.RoomEventDetails{
+		CandidateName:  room.CandidateName,
+		IsActive:       room.IsActive,
+		ScheduledTime:  room.ScheduledTime,
+		Duration:       room.Duration,
+		TechnicalStack: room.TechnicalStack,
+		Description:    room.Description,
+	}
+}
+
+func roomParticipant(user *domain.User) *domain.RoomParticipant {
+	return &domain.RoomParticipant{
+		ID:    user.ID,
+		Email: user.Email,
+		Name:  user.Name,
+	}
+}
+
+// generateRoomToken returns a random token for candidate access
+func generateRoomToken() (string, error) {
+	tokenBytes := make([]byte, 32)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(tokenBytes), nil
 }
@@ -0,0 +1,115 @@
+package service
+
+import (
+	"context"
+	"errors"
+
+	"github.com/elskow/codepair/core-cp/internal/domain"
+	"github.com/google/uuid"
+)
+
+type templateService struct {
+	templateRepo domain.RoomTemplateRepository
+	problemRepo  domain.ProblemRepository
+	userRepo     domain.UserRepository
+}
+
+func NewTemplateService(
+	templateRepo domain.RoomTemplateRepository,
+	problemRepo domain.ProblemRepository,
+	userRepo domain.UserRepository,
+) domain.TemplateService {
+	return &templateService{
+		templateRepo: templateRepo,
+		problemRepo:  problemRepo,
+		userRepo:     userRepo,
+	}
+}
+
+// CreateTemplate stores a template for owner. Sharing makes it visible to the
+// whole team, which is every interviewer of the deployment, see RoomTemplate.
+func (s *templateService) CreateTemplate(ctx context.Context, owner *domain.User, template *domain.RoomTemplate) error {
+	if template.Shared && owner.Role != "lead" {
+		return errors.New("unauthorized: only lead interviewers can share templates")
+	}
+
+	if err := s.validateReferences(ctx, template.QuestionIDs, template.PanelistIDs); err != nil {
+		return err
+	}
+
+	template.OwnerID = owner.ID
+	return s.templateRepo.Create(ctx, template)
+}
+
+func (s *templateService) GetTemplate(ctx context.Context, templateID uuid.UUID, user *domain.User) (*domain.RoomTemplate, error) {
+	template, err := s.templateRepo.FindByID(ctx, templateID)
+	if err != nil {
+		return nil, err
+	}
+
+	if template.OwnerID != user.ID && !template.Shared {
+		return nil, errors.New("unauthorized: template is not shared")
+	}
+
+	return template, nil
+}
+
+func (s *templateService) ListTemplates(ctx context.Context, user *domain.User) ([]domain.RoomTemplate, error) {
+	return s.templateRepo.ListAccessible(ctx, user.ID)
+}
+
+func (s *templateService) UpdateTemplate(ctx context.Context, templateID uuid.UUID, user *domain.User, update domain.TemplateUpdate) error {
+	if err := s.checkTemplateOwner(ctx, templateID, user); err != nil {
+		return err
+	}
+
+	if update.Shared != nil && user.Role != "lead" {
+		return errors.New("unauthorized: only lead interviewers can share templates")
+	}
+
+	if err := s.validateReferences(ctx, update.QuestionIDs, update.PanelistIDs); err != nil {
+		return err
+	}
+
+	return s.templateRepo.Update(ctx, templateID, update)
+}
+
+func (s *templateService) DeleteTemplate(ctx context.Context, templateID uuid.UUID, user *domain.User) error {
+	if err := s.checkTemplateOwner(ctx, templateID, user); err != nil {
+		return err
+	}
+
+	return s.templateRepo.Delete(ctx, templateID)
+}
+
+// checkTemplateOwner allows the owner to modify a template, and leads to
+// modify any shared template
+func (s *templateService) checkTemplateOwner(ctx context.Context, templateID uuid.UUID, user *domain.User) error {
+	template, err := s.templateRepo.FindByID(ctx, templateID)
+	if err != nil {
+		return err
+	}
+
+	if template.OwnerID == user.ID || (template.Shared && user.Role == "lead") {
+		return nil
+	}
+
+	return errors.New("unauthorized: not the owner of this template")
+}
+
+func (s *templateService) validateReferences(ctx context.Context, questionIDs, panelistIDs []uuid.UUID) error {
+	for _, questionID := range questionIDs {
+		if _, err := s.problemRepo.FindByID(ctx, questionID); err != nil {
+			return errors.New("question not found")
+		}
+	}
+
+	for _, panelistID := range panelistIDs {
+		panelist, err := s.userRepo.FindByID(ctx, panelistID)
+		if err != nil || !panelist.IsActive {
+			return errors.New("panelist not found")
+		}
+	}
+
+	return nil
+}
@@ -12,4 +12,5 @@ var (
 	ErrRoomNotFound       = errors.New("room not found")
 	ErrUnauthorized       = errors.New("unauthorized")
 	ErrUserNotInRoom      = errors.New("user is not in room")
+	ErrInvalidEditOp      = errors.New("invalid edit op")
 )
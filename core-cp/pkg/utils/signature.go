@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"time"
+)
+
+// Headers carrying the signature of a request between core-cp and peer-cp
+const (
+	TimestampHeader   = "X-Codepair-Timestamp"
+	SignatureHeader   = "X-Codepair-Signature"
+	ContentHashHeader = "X-Codepair-Content-SHA256"
+	NonceHeader       = "X-Codepair-Nonce"
+)
+
+// MaxSignatureAge bounds how long a captured request can be replayed
+const MaxSignatureAge = 5 * time.Minute
+
+// SignPayload returns the hex HMAC-SHA256 of a request body and the unix
+// timestamp it was sent at, so a captured request cannot be replayed later
+func SignPayload(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyPayload reports whether signature was made by SignPayload with the
+// same secret, timestamp and body
+func VerifyPayload(secret string, timestamp int64, body []byte, signature string) bool {
+	expected := SignPayload(secret, timestamp, body)
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+// ServiceRequestPayload is what peer-cp signs for a call to an internal
+// route. The query is in its canonical encoding, and the room token is
+// covered so a replayed request cannot carry another one. The nonce is only
+// accepted once.
+func ServiceRequestPayload(method, path, query, contentHash, roomToken, nonce string) []byte {
+	return []byte(method + "\n" + path + "\n" + query + "\n" + contentHash + "\n" + roomToken + "\n" + nonce)
+}
@@ -0,0 +1,28 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignPayload(t *testing.T) {
+	body := []byte(`{"type":"room_ended"}`)
+	signature := SignPayload("secret", 1700000000, body)
+
+	assert.Equal(t, "c2a12f594e1493df45c491b7dfc70a82624d75d419fcb0b56680cf3db8185130", signature)
+	assert.NotEqual(t, signature, SignPayload("other_secret", 1700000000, body))
+	assert.NotEqual(t, signature, SignPayload("secret", 1700000001, body))
+}
+
+func TestVerifyPayload(t *testing.T) {
+	body := ServiceRequestPayload("GET", "/internal/rooms/1/validate", "", "e3b0c442", "token", "nonce")
+	signature := SignPayload("secret", 1700000000, body)
+
+	assert.True(t, VerifyPayload("secret", 1700000000, body, signature))
+	assert.False(t, VerifyPayload("secret", 1700000000, ServiceRequestPayload("GET", "/internal/rooms/1/validate", "", "e3b0c442", "other", "nonce"), signature))
+	assert.False(t, VerifyPayload("secret", 1700000000, ServiceRequestPayload("GET", "/internal/rooms/1/validate", "a=1", "e3b0c442", "token", "nonce"), signature))
+	assert.False(t, VerifyPayload("secret", 1700000000, ServiceRequestPayload("GET", "/internal/rooms/1/validate", "", "e3b0c442", "token", "other"), signature))
+	assert.False(t, VerifyPayload("other_secret", 1700000000, body, signature))
+	assert.False(t, VerifyPayload("secret", 1700000000, body, ""))
+}
@@ -0,0 +1,36 @@
+package bus
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// Message is an event published to one room on every peer-cp instance
+type Message struct {
+	Room    string          `json:"room"`
+	Channel string          `json:"channel"`          // Which kind of client the payload is for
+	Origin  string          `json:"origin"`           // Instance that published the message
+	Target  string          `json:"target,omitempty"` // Only this instance handles it when set
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// Bus relays room messages between instances and tracks which instance
+// hosts each room's media. Every instance sees every message, including its
+// own; handlers skip the ones they published.
+type Bus interface {
+	Publish(ctx context.Context, msg Message) error
+
+	// Subscribe delivers messages to handler, in publish order, until the bus
+	// is closed. It is called once.
+	Subscribe(handler func(Message)) error
+
+	// Claim makes owner the room's media host unless another owner's claim is
+	// still live, and returns the host. Claiming again renews the claim.
+	Claim(ctx context.Context, room, owner string, ttl time.Duration) (string, error)
+
+	// Release gives up owner's claim; a claim held by someone else is kept
+	Release(ctx context.Context, room, owner string) error
+
+	Close() error
+}
@@ -0,0 +1,102 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+const memoryQueueLength = 256
+
+// Memory is a bus for a single instance, or several servers in one process
+type Memory struct {
+	mu          sync.Mutex
+	subscribers []chan Message
+	claims      map[string]memoryClaim
+	closed      bool
+}
+
+type memoryClaim struct {
+	owner   string
+	expires time.Time
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		claims: make(map[string]memoryClaim),
+	}
+}
+
+func (m *Memory) Publish(ctx context.Context, msg Message) error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return errors.New("bus is closed")
+	}
+	subscribers := append([]chan Message(nil), m.subscribers...)
+	m.mu.Unlock()
+
+	for _, ch := range subscribers {
+		select {
+		case ch <- msg:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (m *Memory) Subscribe(handler func(Message)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return errors.New("bus is closed")
+	}
+
+	ch := make(chan Message, memoryQueueLength)
+	m.subscribers = append(m.subscribers, ch)
+	go func() {
+		for msg := range ch {
+			handler(msg)
+		}
+	}()
+	return nil
+}
+
+func (m *Memory) Claim(_ context.Context, room, owner string, ttl time.Duration) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if claim, ok := m.claims[room]; ok && claim.owner != owner && now.Before(claim.expires) {
+		return claim.owner, nil
+	}
+	m.claims[room] = memoryClaim{owner: owner, expires: now.Add(ttl)}
+	return owner, nil
+}
+
+func (m *Memory) Release(_ context.Context, room, owner string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if claim, ok := m.claims[room]; ok && claim.owner == owner {
+		delete(m.claims, room)
+	}
+	return nil
+}
+
+func (m *Memory) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+	for _, ch := range m.subscribers {
+		close(ch)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package bus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	redisChannel     = "codepair:rooms"
+	redisOwnerPrefix = "codepair:room-owner:"
+)
+
+// Only set the owner when the key is free or already ours, so a claim can be
+// renewed without racing another instance
+var claimScript = redis.NewScript(`
+local owner = redis.call('GET', KEYS[1])
+if not owner or owner == ARGV[1] then
+	redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+	return ARGV[1]
+end
+return owner
+`)
+
+var releaseScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// Redis relays messages over Redis pub/sub and keeps room owners as keys
+// that expire unless renewed
+type Redis struct {
+	client *redis.Client
+
+	mu     sync.Mutex
+	pubsub *redis.PubSub
+}
+
+// NewRedis connects to the server at url, e.g. redis://localhost:6379/0
+func NewRedis(ctx context.Context, url string) (*Redis, error) {
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis url: %w", err)
+	}
+
+	client := redis.NewClient(options)
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect to redis: %w", err)
+	}
+	return &Redis{client: client}, nil
+}
+
+func (r *Redis) Publish(ctx context.Context, msg Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return r.client.Publish(ctx, redisChannel, data).Err()
+}
+
+func (r *Redis) Subscribe(handler func(Message)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.pubsub != nil {
+		return errors.New("already subscribed")
+	}
+
+	pubsub := r.client.Subscribe(context.Background(), redisChannel)
+	if _, err := pubsub.Receive(context.Background()); err != nil {
+		pubsub.Close()
+		return fmt.Errorf("failed to subscribe: %w", err)
+	}
+	r.pubsub = pubsub
+
+	// The channel is closed when the pubsub is; go-redis reconnects and
+	// resubscribes on its own in between
+	go func() {
+		for delivery := range pubsub.Channel() {
+			var msg Message
+			if err := json.Unmarshal([]byte(delivery.Payload), &msg); err != nil {
+				continue
+			}
+			handler(msg)
+		}
+	}()
+	return nil
+}
+
+func (r *Redis) Claim(ctx context.Context, room, owner string, ttl time.Duration) (string, error) {
+	return claimScript.Run(ctx, r.client, []string{redisOwnerPrefix + room}, owner, ttl.Milliseconds()).Text()
+}
+
+func (r *Redis) Release(ctx context.Context, room, owner string) error {
+	return releaseScript.Run(ctx, r.client, []string{redisOwnerPrefix + room}, owner).Err()
+}
+
+func (r *Redis) Close() error {
+	r.mu.Lock()
+	if r.pubsub != nil {
+		r.pubsub.Close()
+	}
+	r.mu.Unlock()
+	return r.client.Close()
+}
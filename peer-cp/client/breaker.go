@@ -0,0 +1,58 @@
+package client
+
+import (
+	"sync"
+	"time"
+)
+
+// breaker stops calls to core after threshold consecutive failures. Once
+// cooldown has passed a single trial call is let through, and its outcome
+// closes or reopens the breaker.
+type breaker struct {
+	threshold int // 0 disables the breaker
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func (b *breaker) allow() bool {
+	if b.threshold <= 0 {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.threshold {
+		return true
+	}
+	if time.Since(b.openedAt) < b.cooldown || b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// record reports whether a call reached a healthy core. Rejections such as
+// a 401 count as healthy.
+func (b *breaker) record(healthy bool) {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	if healthy {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openedAt = time.Now()
+	}
+}
@@ -1,55 +1,582 @@
 package client
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math/rand"
+	"mime/multipart"
 	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
 	"time"
 )
 
+// ErrInvalidRoom means core no longer knows the room or its token, as
+// opposed to core being unreachable
+var ErrInvalidRoom = errors.New("invalid room or token")
+
+// ErrCoreUnavailable is returned without calling core while the circuit
+// breaker is open
+var ErrCoreUnavailable = errors.New("core is unavailable")
+
+// ErrNoServiceSecret means a call is only possible on core's internal routes
+// and no service secret is configured
+var ErrNoServiceSecret = errors.New("no service secret configured")
+
+// ErrNotRoomMember means core knows the interviewer but they neither own the
+// room nor sit on its panel
+var ErrNotRoomMember = errors.New("not an interviewer of this room")
+
+// ErrNoCredentials means a call needs either the service secret or an
+// interviewer's access token, and neither is at hand
+var ErrNoCredentials = errors.New("no service secret or interviewer token")
+
+// RoomTokenHeader carries a room token, which is kept out of URLs so it does
+// not end up in access logs
+const RoomTokenHeader = "X-Room-Token"
+
+// retryDelay is the wait before the first retry, doubled for each one after
+const retryDelay = 100 * time.Millisecond
+
+// Options tune how the client copes with a slow or failing core
+type Options struct {
+	CacheTTL         time.Duration // How long a room validation is reused
+	NegativeCacheTTL time.Duration // How long a rejected room token is remembered
+	DegradedTTL      time.Duration // How long past CacheTTL a validated room is still accepted while core is down, 0 disables
+	Retries          int           // Extra attempts for reads failing on a network error or a 5xx
+	BreakerThreshold int           // Consecutive failures that stop calls to core for BreakerCooldown, 0 disables
+	BreakerCooldown  time.Duration
+	ServiceSecret    string // Signs calls to core's internal routes. Without it the public routes are used, as for development.
+}
+
 type CoreClient struct {
-	baseURL    string
-	httpClient *http.Client
+	baseURL      string
+	options      Options
+	httpClient   *http.Client
+	uploadClient *http.Client // Artifact uploads can take far longer than API calls
+	breaker      *breaker
+	validations  *validationCache
+}
+
+// statusError is a response from core outside the 2xx range
+type statusError struct {
+	code int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected response from core: status %d", e.code)
 }
 
 type Room struct {
-	ID            string `json:"id"`
-	RoomID        string `json:"roomId"`
-	CandidateName string `json:"candidateName"`
-	IsActive      bool   `json:"isActive"`
-	Token         string `json:"token,omitempty"`
+	ID             string   `json:"id"`
+	RoomID         string   `json:"roomId"`
+	CandidateName  string   `json:"candidateName"`
+	IsActive       bool     `json:"isActive"`
+	Token          string   `json:"token,omitempty"` // Only from GetRoom
+	InterviewerIDs []string `json:"interviewerIds"`  // The owner and the panelists
+	Removed        []string `json:"removed"`         // Roster IDs interviewers removed from the interview
 }
 
-func NewCoreClient(baseURL string) *CoreClient {
+func NewCoreClient(baseURL string, options Options) *CoreClient {
 	return &CoreClient{
 		baseURL: baseURL,
+		options: options,
 		httpClient: &http.Client{
 			Timeout: 10 * time.Second,
 		},
+		uploadClient: &http.Client{
+			Timeout: 30 * time.Minute,
+		},
+		breaker: &breaker{
+			threshold: options.BreakerThreshold,
+			cooldown:  options.BreakerCooldown,
+		},
+		validations: newValidationCache(),
+	}
+}
+
+type User struct {
+	ID       string `json:"id"`
+	Email    string `json:"email"`
+	Name     string `json:"name"`
+	Role     string `json:"role"`
+	IsActive bool   `json:"isActive"`
+}
+
+type Problem struct {
+	ID          string            `json:"id"`
+	Title       string            `json:"title"`
+	Statement   string            `json:"statement"`
+	Difficulty  string            `json:"difficulty"`
+	Tags        []string          `json:"tags"`
+	StarterCode map[string]string `json:"starterCode"`
+	Harnesses   []Harness         `json:"harnesses"`
+	TestCases   []TestCase        `json:"testCases"`
+}
+
+type Harness struct {
+	Language     string `json:"language"`
+	SolutionFile string `json:"solutionFile"`
+	Code         string `json:"code"`
+}
+
+type TestCase struct {
+	ID             string `json:"id"`
+	Name           string `json:"name"`
+	Input          string `json:"input"`
+	ExpectedOutput string `json:"expectedOutput"`
+	Hidden         bool   `json:"hidden"`
+}
+
+type Submission struct {
+	ProblemID string       `json:"problemId"`
+	Language  string       `json:"language"`
+	Code      string       `json:"code"`
+	Results   []TestResult `json:"results"`
+}
+
+// Artifact describes a file produced during the interview, such as a recording
+type Artifact struct {
+	Kind        string
+	Participant string
+	FileName    string
+	ContentType string
+	ConsentedAt time.Time
+	StartedAt   time.Time
+	EndedAt     time.Time
+}
+
+// SessionQuality summarises a participant's media connection for one call
+type SessionQuality struct {
+	ClientID        string    `json:"clientId"`
+	Participant     string    `json:"participant"`
+	Interviewer     bool      `json:"interviewer"`
+	CandidateType   string    `json:"candidateType"`
+	Protocol        string    `json:"protocol"`
+	Samples         int       `json:"samples"`
+	PoorSamples     int       `json:"poorSamples"`
+	AvgRTTMs        float64   `json:"avgRttMs"`
+	MaxRTTMs        float64   `json:"maxRttMs"`
+	AvgJitterMs     float64   `json:"avgJitterMs"`
+	PacketLossPct   float64   `json:"packetLossPct"`
+	AvgInboundKbps  float64   `json:"avgInboundKbps"`
+	AvgOutboundKbps float64   `json:"avgOutboundKbps"`
+	JoinedAt        time.Time `json:"joinedAt"`
+	LeftAt          time.Time `json:"leftAt"`
+}
+
+// EditOp is one change to a room's editor files. Positions count Unicode
+// code points.
+type EditOp struct {
+	Instance   string    `json:"instance"`
+	Seq        int64     `json:"seq"`
+	Kind       string    `json:"kind"` // edit, create, rename or delete
+	Path       string    `json:"path"`
+	NewPath    string    `json:"newPath,omitempty"`
+	Language   string    `json:"language,omitempty"`
+	Position   int       `json:"position,omitempty"`
+	Deleted    int       `json:"deleted,omitempty"`
+	Inserted   string    `json:"inserted,omitempty"`
+	AuthorID   string    `json:"authorId"`
+	AuthorName string    `json:"authorName"`
+	OccurredAt time.Time `json:"occurredAt"`
+}
+
+type TestResult struct {
+	TestCaseID  string `json:"testCaseId"`
+	Passed      bool   `json:"passed"`
+	Status      string `json:"status"`
+	DurationMs  int64  `json:"durationMs"`
+	CPUTimeMs   int64  `json:"cpuTimeMs"`
+	MaxMemoryKB int64  `json:"maxMemoryKb"`
+}
+
+// GetCurrentUser resolves an interviewer's access token
+func (c *CoreClient) GetCurrentUser(authToken string) (*User, error) {
+	req, err := http.NewRequest(http.MethodGet, c.baseURL+"/auth/me", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+authToken)
+
+	var user User
+	if err := c.do(req, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// GetRoomProblem returns the room's problem with visible test cases only
+func (c *CoreClient) GetRoomProblem(token string) (*Problem, error) {
+	req, err := http.NewRequest(http.MethodGet, c.baseURL+"/rooms/problem", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set(RoomTokenHeader, token)
+
+	var problem Problem
+	if err := c.do(req, &problem); err != nil {
+		return nil, err
 	}
+	return &problem, nil
 }
 
-func (c *CoreClient) ValidateRoom(roomID, token string) (*Room, error) {
-	url := fmt.Sprintf("%s/rooms/join?token=%s", c.baseURL, token)
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+// GetRoomProblemAsInterviewer returns the room's problem including hidden test cases
+func (c *CoreClient) GetRoomProblemAsInterviewer(roomID, authToken string) (*Problem, error) {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/rooms/%s/problem", c.baseURL, url.PathEscape(roomID)), nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
+	req.Header.Set("Authorization", "Bearer "+authToken)
+
+	var problem Problem
+	if err := c.do(req, &problem); err != nil {
+		return nil, err
+	}
+	return &problem, nil
+}
+
+// GetProblem fetches a question from the question bank
+func (c *CoreClient) GetProblem(problemID, authToken string) (*Problem, error) {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/problems/%s", c.baseURL, url.PathEscape(problemID)), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+authToken)
+
+	var problem Problem
+	if err := c.do(req, &problem); err != nil {
+		return nil, err
+	}
+	return &problem, nil
+}
+
+// AttachProblem makes a problem the one the room's tests are run against
+func (c *CoreClient) AttachProblem(roomID, problemID, authToken string) error {
+	body, err := json.Marshal(map[string]string{"problemId": problemID})
+	if err != nil {
+		return fmt.Errorf("failed to encode request: %w", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/rooms/%s/problem", c.baseURL, url.PathEscape(roomID)), bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+authToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	return c.do(req, nil)
+}
+
+// SaveRoomNotes stores the interviewers' notes on the room. Without a
+// service secret they are saved as the given interviewer, which only works
+// for the room's owner.
+func (c *CoreClient) SaveRoomNotes(roomID, authToken, notes string) error {
+	if c.options.ServiceSecret == "" && authToken == "" {
+		return fmt.Errorf("failed to save the notes: %w", ErrNoCredentials)
+	}
+
+	body, err := json.Marshal(map[string]string{"notes": notes})
+	if err != nil {
+		return fmt.Errorf("failed to encode request: %w", err)
+	}
+
+	method, reqURL := http.MethodPatch, fmt.Sprintf("%s/rooms/%s/settings", c.baseURL, url.PathEscape(roomID))
+	if c.options.ServiceSecret != "" {
+		method, reqURL = http.MethodPut, fmt.Sprintf("%s/internal/rooms/%s/notes", c.baseURL, url.PathEscape(roomID))
+	}
+	req, err := http.NewRequest(method, reqURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.options.ServiceSecret != "" {
+		c.signRequest(req, body)
+	} else {
+		req.Header.Set("Authorization", "Bearer "+authToken)
+	}
+
+	return c.do(req, nil)
+}
+
+// SaveRemovedParticipants stores who interviewers removed from the room.
+// Without a service secret it is saved as the given interviewer.
+func (c *CoreClient) SaveRemovedParticipants(roomID, authToken string, removed []string) error {
+	if c.options.ServiceSecret == "" && authToken == "" {
+		return fmt.Errorf("failed to save the removed participants: %w", ErrNoCredentials)
+	}
+
+	body, err := json.Marshal(map[string][]string{"removed": append([]string{}, removed...)})
+	if err != nil {
+		return fmt.Errorf("failed to encode request: %w", err)
+	}
+
+	reqURL := fmt.Sprintf("%s/rooms/%s/removed", c.baseURL, url.PathEscape(roomID))
+	if c.options.ServiceSecret != "" {
+		reqURL = fmt.Sprintf("%s/internal/rooms/%s/removed", c.baseURL, url.PathEscape(roomID))
+	}
+	req, err := http.NewRequest(http.MethodPut, reqURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.options.ServiceSecret != "" {
+		c.signRequest(req, body)
+	} else {
+		req.Header.Set("Authorization", "Bearer "+authToken)
+	}
+
+	if err := c.do(req, nil); err != nil {
+		return err
+	}
+	// Joins are checked against the room's removed list
+	c.InvalidateRoom(roomID)
+	return nil
+}
+
+// CreateSubmission stores graded test results with the room
+func (c *CoreClient) CreateSubmission(roomID, authToken string, submission Submission) error {
+	body, err := json.Marshal(submission)
+	if err != nil {
+		return fmt.Errorf("failed to encode submission: %w", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/rooms/%s/submissions", c.baseURL, url.PathEscape(roomID)), bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+authToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	return c.do(req, nil)
+}
+
+// SaveSessionQuality stores a participant's call quality summary with the
+// room. Only peer-cp reports quality, so it needs the service secret.
+func (c *CoreClient) SaveSessionQuality(roomID string, quality SessionQuality) error {
+	if c.options.ServiceSecret == "" {
+		return ErrNoServiceSecret
+	}
+
+	body, err := json.Marshal(quality)
+	if err != nil {
+		return fmt.Errorf("failed to encode session quality: %w", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/internal/rooms/%s/quality", c.baseURL, url.PathEscape(roomID)), bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	c.signRequest(req, body)
+
+	return c.do(req, nil)
+}
+
+// SaveEditHistory appends ops to the room's edit history in core
+func (c *CoreClient) SaveEditHistory(roomID, authToken string, ops []EditOp) error {
+	if c.options.ServiceSecret == "" && authToken == "" {
+		return fmt.Errorf("failed to save the edit history: %w", ErrNoCredentials)
+	}
+
+	body, err := json.Marshal(map[string][]EditOp{"ops": ops})
+	if err != nil {
+		return fmt.Errorf("failed to encode edit history: %w", err)
+	}
+
+	reqURL := fmt.Sprintf("%s/rooms/%s/history", c.baseURL, url.PathEscape(roomID))
+	if c.options.ServiceSecret != "" {
+		reqURL = fmt.Sprintf("%s/internal/rooms/%s/history", c.baseURL, url.PathEscape(roomID))
+	}
+	req, err := http.NewRequest(http.MethodPost, reqURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.options.ServiceSecret != "" {
+		c.signRequest(req, body)
+	} else {
+		req.Header.Set("Authorization", "Bearer "+authToken)
+	}
+
+	return c.do(req, nil)
+}
+
+// UploadArtifact streams a file to core and registers it with the room.
+// Signed uploads write the form twice, once to hash it for the signature and
+// once to send it, so the file is never held in memory.
+func (c *CoreClient) UploadArtifact(roomID, authToken string, artifact Artifact, path string) error {
+	if c.options.ServiceSecret == "" && authToken == "" {
+		return fmt.Errorf("failed to upload the artifact: %w", ErrNoCredentials)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open artifact: %w", err)
+	}
+	defer file.Close()
+
+	boundary := multipart.NewWriter(io.Discard).Boundary()
+	hash := sha256.New()
+	if c.options.ServiceSecret != "" {
+		if err := writeArtifactForm(hash, boundary, artifact, file); err != nil {
+			return fmt.Errorf("failed to hash artifact: %w", err)
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to rewind artifact: %w", err)
+		}
+	}
+
+	body, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(writeArtifactForm(writer, boundary, artifact, file))
+	}()
+
+	reqURL := fmt.Sprintf("%s/rooms/%s/artifacts", c.baseURL, url.PathEscape(roomID))
+	if c.options.ServiceSecret != "" {
+		reqURL = fmt.Sprintf("%s/internal/rooms/%s/artifacts", c.baseURL, url.PathEscape(roomID))
+	}
+	req, err := http.NewRequest(http.MethodPost, reqURL, body)
+	if err != nil {
+		body.Close()
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "multipart/form-data; boundary="+boundary)
+	if c.options.ServiceSecret != "" {
+		c.signContentHash(req, hex.EncodeToString(hash.Sum(nil)))
+	} else {
+		req.Header.Set("Authorization", "Bearer "+authToken)
+	}
+
+	resp, err := c.uploadClient.Do(req)
+	if err != nil {
+		body.Close()
+		return fmt.Errorf("failed to upload artifact: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return &statusError{code: resp.StatusCode}
+	}
+	return nil
+}
+
+// writeArtifactForm writes the upload form of an artifact. The fields are
+// written in a fixed order so the same artifact always gives the same bytes.
+func writeArtifactForm(w io.Writer, boundary string, artifact Artifact, file io.Reader) error {
+	form := multipart.NewWriter(w)
+	if err := form.SetBoundary(boundary); err != nil {
+		return err
+	}
+
+	fields := [][2]string{
+		{"kind", artifact.Kind},
+		{"participant", artifact.Participant},
+	}
+	// Times that do not apply to the artifact are left out
+	for _, field := range []struct {
+		name  string
+		value time.Time
+	}{
+		{"consentedAt", artifact.ConsentedAt},
+		{"startedAt", artifact.StartedAt},
+		{"endedAt", artifact.EndedAt},
+	} {
+		if !field.value.IsZero() {
+			fields = append(fields, [2]string{field.name, field.value.Format(time.RFC3339)})
+		}
+	}
+	for _, field := range fields {
+		if err := form.WriteField(field[0], field[1]); err != nil {
+			return err
+		}
+	}
+
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename=%q`, artifact.FileName))
+	header.Set("Content-Type", artifact.ContentType)
+	part, err := form.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(part, file); err != nil {
+		return err
+	}
+	return form.Close()
+}
+
+// do sends a request to core and decodes the response into out. Reads are
+// retried with backoff while core fails.
+func (c *CoreClient) do(req *http.Request, out interface{}) error {
+	attempts := 1
+	if req.Method == http.MethodGet {
+		attempts += c.options.Retries
+	}
+
+	delay := retryDelay
+	for attempt := 1; ; attempt++ {
+		err := c.send(req, out)
+		if err == nil || attempt >= attempts || !retryable(err) {
+			return err
+		}
+		// Jitter keeps instances from retrying in lockstep
+		time.Sleep(delay/2 + time.Duration(rand.Int63n(int64(delay))))
+		delay *= 2
+		// Core accepts each signed nonce once
+		if req.Header.Get(NonceHeader) != "" {
+			c.signContentHash(req, req.Header.Get(ContentHashHeader))
+		}
+	}
+}
+
+func (c *CoreClient) send(req *http.Request, out interface{}) error {
+	if !c.breaker.allow() {
+		return ErrCoreUnavailable
+	}
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to send request: %w", err)
+		c.breaker.record(false)
+		return fmt.Errorf("failed to send request: %w", err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("invalid room or token: status %d", resp.StatusCode)
+	c.breaker.record(resp.StatusCode < 500)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &statusError{code: resp.StatusCode}
 	}
 
-	var room Room
-	if err := json.NewDecoder(resp.Body).Decode(&room); err != nil {
-		return nil, fmt.Errorf("failed to decode response: %w", err)
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
 	}
+	return nil
+}
+
+// Rejected reports whether core turned a request down as invalid, so sending
+// it again cannot succeed
+func Rejected(err error) bool {
+	var status *statusError
+	return errors.As(err, &status) &&
+		(status.code == http.StatusBadRequest || status.code == http.StatusRequestEntityTooLarge)
+}
 
-	return &room, nil
+// retryable reports whether a failed call may succeed if made again
+func retryable(err error) bool {
+	if errors.Is(err, ErrCoreUnavailable) {
+		return false
+	}
+	var status *statusError
+	if errors.As(err, &status) {
+		return status.code >= 500
+	}
+	return true
 }
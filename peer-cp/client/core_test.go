@@ -0,0 +1,186 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDoRetries(t *testing.T) {
+	tests := []struct {
+		name      string
+		method    string
+		retries   int
+		failures  int32 // Requests answered with a 500 before core recovers
+		status    int   // What core answers after
+		wantCalls int32
+		wantErr   bool
+	}{
+		{
+			name:      "read recovers within the retries",
+			method:    http.MethodGet,
+			retries:   2,
+			failures:  2,
+			status:    http.StatusOK,
+			wantCalls: 3,
+		},
+		{
+			name:      "read gives up after the retries",
+			method:    http.MethodGet,
+			retries:   1,
+			failures:  5,
+			status:    http.StatusOK,
+			wantCalls: 2,
+			wantErr:   true,
+		},
+		{
+			name:      "0 disables retries",
+			method:    http.MethodGet,
+			retries:   0,
+			failures:  1,
+			status:    http.StatusOK,
+			wantCalls: 1,
+			wantErr:   true,
+		},
+		{
+			name:      "a rejection is not retried",
+			method:    http.MethodGet,
+			retries:   2,
+			status:    http.StatusUnauthorized,
+			wantCalls: 1,
+			wantErr:   true,
+		},
+		{
+			name:      "writes are not retried",
+			method:    http.MethodPost,
+			retries:   2,
+			failures:  1,
+			status:    http.StatusOK,
+			wantCalls: 1,
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			core := newFakeCore(t, tt.status)
+			core.failFirst.Store(tt.failures)
+			c := NewCoreClient(core.URL, Options{Retries: tt.retries})
+
+			req, err := http.NewRequest(tt.method, core.URL+"/rooms/join", nil)
+			require.NoError(t, err)
+			err = c.do(req, nil)
+
+			assert.Equal(t, tt.wantErr, err != nil, "error: %v", err)
+			assert.Equal(t, tt.wantCalls, core.calls.Load())
+		})
+	}
+}
+
+func TestRetriesSignAgain(t *testing.T) {
+	var nonces []string
+	core := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonces = append(nonces, r.Header.Get(NonceHeader))
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer core.Close()
+	c := NewCoreClient(core.URL, Options{Retries: 1, ServiceSecret: "secret"})
+
+	_, err := c.GetRoom("r1")
+	assert.Error(t, err)
+	require.Len(t, nonces, 2)
+	assert.NotEqual(t, nonces[0], nonces[1], "core accepts each nonce once")
+}
+
+func TestBreaker(t *testing.T) {
+	type step struct {
+		status     int           // What core answers
+		wait       time.Duration // Before the call
+		wantCalled bool          // The call reached core
+		wantErr    error
+	}
+
+	tests := []struct {
+		name      string
+		threshold int
+		steps     []step
+	}{
+		{
+			name:      "opens after the threshold",
+			threshold: 2,
+			steps: []step{
+				{status: http.StatusInternalServerError, wantCalled: true},
+				{status: http.StatusInternalServerError, wantCalled: true},
+				{status: http.StatusOK, wantErr: ErrCoreUnavailable},
+			},
+		},
+		{
+			name:      "a trial call closes it after the cooldown",
+			threshold: 1,
+			steps: []step{
+				{status: http.StatusInternalServerError, wantCalled: true},
+				{status: http.StatusOK, wantErr: ErrCoreUnavailable},
+				{status: http.StatusOK, wait: 60 * time.Millisecond, wantCalled: true},
+				{status: http.StatusOK, wantCalled: true},
+			},
+		},
+		{
+			name:      "a failed trial call reopens it",
+			threshold: 1,
+			steps: []step{
+				{status: http.StatusInternalServerError, wantCalled: true},
+				{status: http.StatusInternalServerError, wait: 60 * time.Millisecond, wantCalled: true},
+				{status: http.StatusOK, wantErr: ErrCoreUnavailable},
+			},
+		},
+		{
+			name:      "rejections count as healthy",
+			threshold: 2,
+			steps: []step{
+				{status: http.StatusInternalServerError, wantCalled: true},
+				{status: http.StatusUnauthorized, wantCalled: true},
+				{status: http.StatusInternalServerError, wantCalled: true},
+				{status: http.StatusOK, wantCalled: true},
+			},
+		},
+		{
+			name:      "0 disables the breaker",
+			threshold: 0,
+			steps: []step{
+				{status: http.StatusInternalServerError, wantCalled: true},
+				{status: http.StatusInternalServerError, wantCalled: true},
+				{status: http.StatusInternalServerError, wantCalled: true},
+				{status: http.StatusOK, wantCalled: true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			core := newFakeCore(t, http.StatusOK)
+			c := NewCoreClient(core.URL, Options{
+				BreakerThreshold: tt.threshold,
+				BreakerCooldown:  50 * time.Millisecond,
+			})
+
+			for i, step := range tt.steps {
+				time.Sleep(step.wait)
+				core.status.Store(int32(step.status))
+				calls := core.calls.Load()
+
+				req, err := http.NewRequest(http.MethodGet, core.URL+"/auth/me", nil)
+				require.NoError(t, err)
+				err = c.do(req, nil)
+
+				assert.Equal(t, step.wantCalled, core.calls.Load() > calls, "step %d", i)
+				if step.wantErr != nil {
+					assert.ErrorIs(t, err, step.wantErr, "step %d", i)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package client
+
+import (
+	"crypto/hmac"
+	"errors"
+	"strconv"
+	"time"
+)
+
+var ErrInvalidSignature = errors.New("invalid event signature")
+
+// RoomEvent is a change to a room core tells peer-cp about
+type RoomEvent struct {
+	ID          string       `json:"id"`
+	Type        string       `json:"type"`
+	RoomID      string       `json:"roomId"`
+	Room        *RoomDetails `json:"room,omitempty"`
+	Participant *Participant `json:"participant,omitempty"` // On participant_added and participant_removed
+	OccurredAt  time.Time    `json:"occurredAt"`
+}
+
+// RoomDetails are the room settings shown during an interview
+type RoomDetails struct {
+	CandidateName  string     `json:"candidateName"`
+	IsActive       bool       `json:"isActive"`
+	ScheduledTime  *time.Time `json:"scheduledTime,omitempty"`
+	Duration       int        `json:"duration"` // in minutes
+	TechnicalStack []string   `json:"technicalStack,omitempty"`
+	Description    string     `json:"description,omitempty"`
+}
+
+// Participant is an interviewer added to or removed from a room's panel
+type Participant struct {
+	ID    string `json:"id"`
+	Email string `json:"email"`
+	Name  string `json:"name"`
+}
+
+// VerifyEventSignature checks that an event body was signed by core with the
+// shared secret within the allowed clock skew
+func VerifyEventSignature(secret, timestamp, signature string, body []byte) error {
+	sentAt, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if skew := time.Since(time.Unix(sentAt, 0)); skew > maxSignatureAge || skew < -maxSignatureAge {
+		return ErrInvalidSignature
+	}
+
+	expected := sign(secret, timestamp, body)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package client
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Headers carrying the signature of a request between core and peer-cp
+const (
+	TimestampHeader   = "X-Codepair-Timestamp"
+	SignatureHeader   = "X-Codepair-Signature"
+	ContentHashHeader = "X-Codepair-Content-SHA256"
+	NonceHeader       = "X-Codepair-Nonce"
+)
+
+// maxSignatureAge bounds how long a captured request can be replayed
+const maxSignatureAge = 5 * time.Minute
+
+// sign returns the hex HMAC-SHA256 of a payload and the unix timestamp it
+// was sent at, as core computes it
+func sign(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signRequest authenticates a call to core's internal routes, body is nil
+// for a request without one
+func (c *CoreClient) signRequest(req *http.Request, body []byte) {
+	sum := sha256.Sum256(body)
+	c.signContentHash(req, hex.EncodeToString(sum[:]))
+}
+
+// signContentHash signs a request whose body was hashed as it was written,
+// such as a streamed upload. Core accepts each nonce once, so a retried
+// request is signed again.
+func (c *CoreClient) signContentHash(req *http.Request, contentHash string) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	payload := req.Method + "\n" + req.URL.Path + "\n" + req.URL.Query().Encode() + "\n" + contentHash + "\n" +
+		req.Header.Get(RoomTokenHeader) + "\n" + hex.EncodeToString(nonce)
+
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(NonceHeader, hex.EncodeToString(nonce))
+	req.Header.Set(ContentHashHeader, contentHash)
+	req.Header.Set(SignatureHeader, sign(c.options.ServiceSecret, timestamp, []byte(payload)))
+}
@@ -0,0 +1,205 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+type validationKey struct {
+	roomID string
+	token  string
+}
+
+// validation is the outcome of validating a room token: the room, or
+// ErrInvalidRoom when core rejected the token
+type validation struct {
+	room      Room
+	err       error
+	fetchedAt time.Time
+}
+
+// validationCache remembers recent validations, so the editor, video, chat
+// and notes connections of one participant cost a single call to core
+type validationCache struct {
+	mu      sync.Mutex
+	entries map[validationKey]validation
+	group   singleflight.Group
+}
+
+func newValidationCache() *validationCache {
+	return &validationCache{entries: make(map[validationKey]validation)}
+}
+
+// ValidateRoom returns the room a token gives access to. Results are cached,
+// and while core is unreachable a room validated within DegradedTTL of its
+// cache expiry is still accepted.
+func (c *CoreClient) ValidateRoom(roomID, token string) (*Room, error) {
+	key := validationKey{roomID: roomID, token: token}
+
+	cached, found := c.validations.get(key)
+	if found && c.fresh(cached) {
+		return cached.result()
+	}
+
+	result, err, _ := c.validations.group.Do(roomID+"\x00"+token, func() (interface{}, error) {
+		room, err := c.fetchRoom(roomID, token)
+		if err == nil {
+			c.validations.put(key, validation{room: *room, fetchedAt: time.Now()}, c.retention())
+			return room, nil
+		}
+		if errors.Is(err, ErrInvalidRoom) {
+			c.validations.put(key, validation{err: err, fetchedAt: time.Now()}, c.retention())
+		}
+		return nil, err
+	})
+	if err == nil {
+		room := *result.(*Room)
+		return &room, nil
+	}
+
+	if !errors.Is(err, ErrInvalidRoom) && found && cached.err == nil &&
+		c.options.DegradedTTL > 0 && time.Since(cached.fetchedAt) < c.options.CacheTTL+c.options.DegradedTTL {
+		return cached.result()
+	}
+	return nil, err
+}
+
+// InvalidateRoom drops the cached validations of a room, so a change core
+// announced is picked up on the next join
+func (c *CoreClient) InvalidateRoom(roomID string) {
+	c.validations.mu.Lock()
+	defer c.validations.mu.Unlock()
+
+	for key := range c.validations.entries {
+		if key.roomID == roomID {
+			delete(c.validations.entries, key)
+		}
+	}
+}
+
+// GetRoom returns a room with its current token. It is only served to
+// peer-cp itself, so it needs the service secret, and it is not cached.
+func (c *CoreClient) GetRoom(roomID string) (*Room, error) {
+	if c.options.ServiceSecret == "" {
+		return nil, ErrNoServiceSecret
+	}
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/internal/rooms/%s", c.baseURL, url.PathEscape(roomID)), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	c.signRequest(req, nil)
+
+	var room Room
+	err = c.do(req, &room)
+	var status *statusError
+	if errors.As(err, &status) && status.code == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: status %d", ErrInvalidRoom, status.code)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &room, nil
+}
+
+// GetRoomAccess returns a room with its panel on behalf of one of its
+// interviewers. The public join route leaves the panel out, so this is how
+// the panel is checked without a service secret. It is not cached.
+func (c *CoreClient) GetRoomAccess(roomID, authToken string) (*Room, error) {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/rooms/%s/access", c.baseURL, url.PathEscape(roomID)), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+authToken)
+
+	var room Room
+	err = c.do(req, &room)
+	var status *statusError
+	switch {
+	case errors.As(err, &status) && status.code == http.StatusForbidden:
+		return nil, fmt.Errorf("%w: status %d", ErrNotRoomMember, status.code)
+	case errors.As(err, &status) && status.code == http.StatusNotFound:
+		return nil, fmt.Errorf("%w: status %d", ErrInvalidRoom, status.code)
+	case err != nil:
+		return nil, err
+	}
+	return &room, nil
+}
+
+func (c *CoreClient) fetchRoom(roomID, token string) (*Room, error) {
+	reqURL := c.baseURL + "/rooms/join"
+	if c.options.ServiceSecret != "" {
+		reqURL = fmt.Sprintf("%s/internal/rooms/%s/validate", c.baseURL, url.PathEscape(roomID))
+	}
+	req, err := http.NewRequest(http.MethodGet, reqURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set(RoomTokenHeader, token)
+	if c.options.ServiceSecret != "" {
+		c.signRequest(req, nil)
+	}
+
+	var room Room
+	err = c.do(req, &room)
+	var status *statusError
+	if errors.As(err, &status) && (status.code == http.StatusUnauthorized || status.code == http.StatusNotFound) {
+		return nil, fmt.Errorf("%w: status %d", ErrInvalidRoom, status.code)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The public route does not know which room is being joined
+	if room.ID != roomID {
+		return nil, fmt.Errorf("%w: token belongs to another room", ErrInvalidRoom)
+	}
+	return &room, nil
+}
+
+func (c *CoreClient) fresh(v validation) bool {
+	ttl := c.options.CacheTTL
+	if v.err != nil {
+		ttl = c.options.NegativeCacheTTL
+	}
+	return time.Since(v.fetchedAt) < ttl
+}
+
+// retention is how long an entry can still be of use, fresh or degraded
+func (c *CoreClient) retention() time.Duration {
+	return max(c.options.CacheTTL+c.options.DegradedTTL, c.options.NegativeCacheTTL)
+}
+
+func (v validation) result() (*Room, error) {
+	if v.err != nil {
+		return nil, v.err
+	}
+	room := v.room
+	return &room, nil
+}
+
+func (vc *validationCache) get(key validationKey) (validation, bool) {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+	v, ok := vc.entries[key]
+	return v, ok
+}
+
+// put stores a validation and drops the entries older than retention
+func (vc *validationCache) put(key validationKey, v validation, retention time.Duration) {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	for k, entry := range vc.entries {
+		if time.Since(entry.fetchedAt) > retention {
+			delete(vc.entries, k)
+		}
+	}
+	vc.entries[key] = v
+}
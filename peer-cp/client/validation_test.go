@@ -0,0 +1,202 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeCore answers requests with the status it is set to, and a room on
+// success. The first failFirst requests get a 500.
+type fakeCore struct {
+	*httptest.Server
+	status    atomic.Int32
+	failFirst atomic.Int32
+	calls     atomic.Int32
+}
+
+func newFakeCore(t *testing.T, status int) *fakeCore {
+	core := &fakeCore{}
+	core.status.Store(int32(status))
+	core.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := int(core.status.Load())
+		if core.calls.Add(1) <= core.failFirst.Load() {
+			status = http.StatusInternalServerError
+		}
+		w.WriteHeader(status)
+		if status == http.StatusOK {
+			json.NewEncoder(w).Encode(Room{ID: "r1", RoomID: "r1", CandidateName: "Cand", IsActive: true})
+		}
+	}))
+	t.Cleanup(core.Close)
+	return core
+}
+
+func TestValidateRoomCache(t *testing.T) {
+	tests := []struct {
+		name      string
+		options   Options
+		status    int
+		wait      time.Duration // Between the two validations
+		wantCalls int32
+		wantErr   error
+	}{
+		{
+			name:      "valid room is cached",
+			options:   Options{CacheTTL: time.Minute, NegativeCacheTTL: time.Minute},
+			status:    http.StatusOK,
+			wantCalls: 1,
+		},
+		{
+			name:      "valid room expires",
+			options:   Options{CacheTTL: time.Millisecond, NegativeCacheTTL: time.Minute},
+			status:    http.StatusOK,
+			wait:      5 * time.Millisecond,
+			wantCalls: 2,
+		},
+		{
+			name:      "rejected token is cached",
+			options:   Options{CacheTTL: time.Minute, NegativeCacheTTL: time.Minute},
+			status:    http.StatusUnauthorized,
+			wantCalls: 1,
+			wantErr:   ErrInvalidRoom,
+		},
+		{
+			name:      "rejected token expires on its own TTL",
+			options:   Options{CacheTTL: time.Minute, NegativeCacheTTL: time.Millisecond},
+			status:    http.StatusNotFound,
+			wait:      5 * time.Millisecond,
+			wantCalls: 2,
+			wantErr:   ErrInvalidRoom,
+		},
+		{
+			name:      "core failures are not cached",
+			options:   Options{CacheTTL: time.Minute, NegativeCacheTTL: time.Minute},
+			status:    http.StatusInternalServerError,
+			wantCalls: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			core := newFakeCore(t, tt.status)
+			c := NewCoreClient(core.URL, tt.options)
+
+			for i := 0; i < 2; i++ {
+				room, err := c.ValidateRoom("r1", "token")
+				switch {
+				case tt.wantErr != nil:
+					assert.ErrorIs(t, err, tt.wantErr)
+				case tt.status != http.StatusOK:
+					assert.Error(t, err)
+				default:
+					require.NoError(t, err)
+					assert.Equal(t, "r1", room.ID)
+				}
+				time.Sleep(tt.wait)
+			}
+			assert.Equal(t, tt.wantCalls, core.calls.Load())
+		})
+	}
+}
+
+func TestValidateRoomSingleflight(t *testing.T) {
+	release := make(chan struct{})
+	var calls atomic.Int32
+	core := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		<-release
+		json.NewEncoder(w).Encode(Room{ID: "r1", IsActive: true})
+	}))
+	defer core.Close()
+	c := NewCoreClient(core.URL, Options{CacheTTL: time.Minute, NegativeCacheTTL: time.Minute})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			room, err := c.ValidateRoom("r1", "token")
+			if assert.NoError(t, err) {
+				assert.Equal(t, "r1", room.ID)
+			}
+		}()
+	}
+
+	require.Eventually(t, func() bool { return calls.Load() == 1 }, time.Second, time.Millisecond)
+	time.Sleep(20 * time.Millisecond) // Lets the other validations join the call in flight
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+func TestValidateRoomDegraded(t *testing.T) {
+	tests := []struct {
+		name        string
+		degradedTTL time.Duration
+		status      int // What core answers once the cached room expired
+		wantRoom    bool
+		wantErr     error
+	}{
+		{
+			name:        "stale room while core is down",
+			degradedTTL: time.Minute,
+			status:      http.StatusServiceUnavailable,
+			wantRoom:    true,
+		},
+		{
+			name:        "0 disables the grace",
+			degradedTTL: 0,
+			status:      http.StatusServiceUnavailable,
+		},
+		{
+			name:        "core rejecting the token ends the grace",
+			degradedTTL: time.Minute,
+			status:      http.StatusUnauthorized,
+			wantErr:     ErrInvalidRoom,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			core := newFakeCore(t, http.StatusOK)
+			c := NewCoreClient(core.URL, Options{
+				CacheTTL:         time.Millisecond,
+				NegativeCacheTTL: time.Minute,
+				DegradedTTL:      tt.degradedTTL,
+			})
+
+			_, err := c.ValidateRoom("r1", "token")
+			require.NoError(t, err)
+			time.Sleep(5 * time.Millisecond)
+			core.status.Store(int32(tt.status))
+
+			room, err := c.ValidateRoom("r1", "token")
+			if tt.wantRoom {
+				require.NoError(t, err)
+				assert.Equal(t, "r1", room.ID)
+				return
+			}
+			assert.Nil(t, room)
+			assert.Error(t, err)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateRoomOtherRoom(t *testing.T) {
+	core := newFakeCore(t, http.StatusOK)
+	c := NewCoreClient(core.URL, Options{CacheTTL: time.Minute, NegativeCacheTTL: time.Minute})
+
+	_, err := c.ValidateRoom("r2", "token")
+	assert.ErrorIs(t, err, ErrInvalidRoom)
+}
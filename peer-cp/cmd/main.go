@@ -7,10 +7,14 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"github.com/elskow/codepair/peer-cp/bus"
 	"github.com/elskow/codepair/peer-cp/config"
 	"github.com/elskow/codepair/peer-cp/middleware"
+	"github.com/elskow/codepair/peer-cp/runner"
 	"github.com/elskow/codepair/peer-cp/server"
+	"github.com/elskow/codepair/peer-cp/turnserver"
 	"github.com/gofiber/contrib/fiberzap/v2"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
@@ -20,6 +24,9 @@ import (
 )
 
 func main() {
+	// Code runs re-execute this binary to set up their sandbox
+	runner.Init()
+
 	configFile := flag.String("config", "config.yaml", "Path to the config file")
 	flag.Parse()
 
@@ -50,16 +57,62 @@ func main() {
 		Logger: logger,
 	}))
 
-	srv := server.NewServer(app, logger, cfg)
+	var relay *turnserver.Server
+	if cfg.TURN.Enabled {
+		relay, err = turnserver.New(turnserver.Config{
+			ListenAddress: cfg.TURN.ListenAddress,
+			PublicIP:      cfg.TURN.PublicIP,
+			Realm:         cfg.TURN.Realm,
+			Secret:        cfg.TURN.Secret,
+			RelayMinPort:  cfg.TURN.RelayMinPort,
+			RelayMaxPort:  cfg.TURN.RelayMaxPort,
+		})
+		if err != nil {
+			logger.Fatal("Failed to start TURN server", zap.Error(err))
+		}
+		logger.Info("TURN server started", zap.String("address", cfg.TURN.ListenAddress))
+	}
+
+	// Rooms are shared with the other instances over the bus
+	var roomBus bus.Bus
+	switch cfg.Cluster.Bus {
+	case "redis":
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		roomBus, err = bus.NewRedis(ctx, cfg.Cluster.RedisURL)
+		cancel()
+		if err != nil {
+			logger.Fatal("Failed to connect to the room bus", zap.Error(err))
+		}
+		logger.Info("Joined cluster",
+			zap.String("instanceID", cfg.Cluster.InstanceID),
+			zap.String("advertiseURL", cfg.Cluster.AdvertiseURL))
+	default:
+		roomBus = bus.NewMemory()
+	}
+
+	srv, err := server.NewServer(app, logger, cfg, roomBus)
+	if err != nil {
+		logger.Fatal("Failed to create server", zap.Error(err))
+	}
 
-	app.Get("/editor/:roomId", websocket.New(srv.HandleEditorWS))
+	// Interviewers offer their access token as a subprotocol next to this one
+	wsConfig := websocket.Config{Subprotocols: []string{server.AuthProtocol}}
+	app.Get("/editor/:roomId", websocket.New(srv.HandleEditorWS, wsConfig))
 	app.Use("/editor/*", middleware.UpgradeWebSocket)
-	app.Get("/videochat/:roomId", websocket.New(srv.HandleVideoChatWS))
+	app.Get("/videochat/:roomId", websocket.New(srv.HandleVideoChatWS, wsConfig))
 	app.Use("/videochat/*", middleware.UpgradeWebSocket)
-	app.Get("/chat/:roomId", websocket.New(srv.HandleChatWS))
+	app.Get("/lobby/:roomId", websocket.New(srv.HandleLobbyWS, wsConfig))
+	app.Use("/lobby/*", middleware.UpgradeWebSocket)
+	app.Get("/chat/:roomId", websocket.New(srv.HandleChatWS, wsConfig))
 	app.Use("/chat/*", middleware.UpgradeWebSocket)
-	app.Get("/notes/:roomId", websocket.New(srv.HandleNotesWS))
+	app.Get("/notes/:roomId", websocket.New(srv.HandleNotesWS, wsConfig))
 	app.Use("/notes/*", middleware.UpgradeWebSocket)
+	app.Get("/session/:roomId", websocket.New(srv.HandleSessionWS, wsConfig))
+	app.Use("/session/*", middleware.UpgradeWebSocket)
+	app.Get("/workspace/:roomId/archive", srv.HandleWorkspaceArchive)
+	app.Get("/rooms/:roomId/roster", srv.HandleRoster)
+	app.Get("/admin/stats", middleware.RequireAdminToken(cfg.Stats.AdminToken), srv.HandleAdminStats)
+	app.Post("/internal/events", srv.HandleRoomEvent)
 
 	go func() {
 		logger.Info("Server starting", zap.String("address", cfg.Server.Address))
@@ -84,5 +137,15 @@ func main() {
 		logger.Fatal("Server forced to shutdown", zap.Error(err))
 	}
 
+	if err := roomBus.Close(); err != nil {
+		logger.Error("Failed to close room bus", zap.Error(err))
+	}
+
+	if relay != nil {
+		if err := relay.Close(); err != nil {
+			logger.Error("Failed to stop TURN server", zap.Error(err))
+		}
+	}
+
 	logger.Info("Server stopped gracefully")
 }
@@ -1,22 +1,95 @@
 package config
 
 import (
+	"errors"
+	"net"
+	"runtime"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/spf13/viper"
 )
 
+// ICEServer is a STUN or TURN server handed to clients and the SFU
+type ICEServer struct {
+	URLs       []string `mapstructure:"urls"`
+	Username   string   `mapstructure:"username"`
+	Credential string   `mapstructure:"credential"`
+}
+
 type Config struct {
 	Server struct {
 		Address          string        `mapstructure:"address"`
-		StunServerURL    string        `mapstructure:"stun_server_url"`
+		StunServerURL    string        `mapstructure:"stun_server_url"` // Used when ice_servers is empty
+		ICEServers       []ICEServer   `mapstructure:"ice_servers"`
 		CleanupInterval  time.Duration `mapstructure:"cleanup_interval"`
 		ValidateInterval time.Duration `mapstructure:"validate_interval"`
 		ShutdownTimeout  time.Duration `mapstructure:"shutdown_timeout"`
+		ResumeWindow     time.Duration `mapstructure:"resume_window"` // How long a dropped session can be resumed
+		ReplayBuffer     int           `mapstructure:"replay_buffer"` // Messages kept per session for resuming
+		WriteQueue       int           `mapstructure:"write_queue"`   // Messages queued per connection before the client is dropped
+		WriteTimeout     time.Duration `mapstructure:"write_timeout"`
+		IdleAfter        time.Duration `mapstructure:"idle_after"`    // Inactivity before a participant shows as idle on the roster
+		HistoryFlush     time.Duration `mapstructure:"history_flush"` // How often recorded edits are saved to core
 	} `mapstructure:"server"`
 	Core struct {
-		BaseURL string `mapstructure:"base_url"`
+		BaseURL          string        `mapstructure:"base_url"`
+		EventSecret      string        `mapstructure:"event_secret"`   // Signs room events from core, /internal/events is disabled when empty
+		ServiceSecret    string        `mapstructure:"service_secret"` // Signs calls to core's /internal routes
+		CacheTTL         time.Duration `mapstructure:"cache_ttl"`      // How long a room validation is reused
+		NegativeCacheTTL time.Duration `mapstructure:"negative_cache_ttl"`
+		DegradedTTL      time.Duration `mapstructure:"degraded_ttl"`      // Grace for validated rooms while core is down, disabled when zero
+		Retries          *int          `mapstructure:"retries"`           // 0 disables retries, 2 when unset
+		BreakerThreshold *int          `mapstructure:"breaker_threshold"` // 0 disables the breaker, 5 when unset
+		BreakerCooldown  time.Duration `mapstructure:"breaker_cooldown"`
 	} `mapstructure:"core"`
+	Runner struct {
+		Enabled              bool          `mapstructure:"enabled"` // Needs the language toolchains installed next to peer-cp
+		WorkDir              string        `mapstructure:"work_dir"`
+		Namespaces           *bool         `mapstructure:"namespaces"` // True when unset, disabling it needs unsafe
+		Unsafe               bool          `mapstructure:"unsafe"`     // Allows programs to run without namespaces, for development only
+		RootFS               string        `mapstructure:"rootfs"`     // Root programs see, the host's system directories when empty
+		Cgroup               string        `mapstructure:"cgroup"`     // Delegated cgroup v2 directory for memory and process limits
+		CompileTimeout       time.Duration `mapstructure:"compile_timeout"`
+		RunTimeout           time.Duration `mapstructure:"run_timeout"`
+		CPUTime              time.Duration `mapstructure:"cpu_time"`
+		MemoryLimitMB        int           `mapstructure:"memory_limit_mb"`
+		CompileMemoryLimitMB int           `mapstructure:"compile_memory_limit_mb"`
+		MaxProcesses         int           `mapstructure:"max_processes"`
+		OutputLimitKB        int           `mapstructure:"output_limit_kb"`
+		FileSizeKB           int           `mapstructure:"file_size_kb"`
+	} `mapstructure:"runner"`
+	TURN struct {
+		Enabled       bool          `mapstructure:"enabled"`
+		ListenAddress string        `mapstructure:"listen_address"`
+		PublicIP      string        `mapstructure:"public_ip"`
+		Realm         string        `mapstructure:"realm"`
+		Secret        string        `mapstructure:"secret"`
+		CredentialTTL time.Duration `mapstructure:"credential_ttl"`
+		RelayMinPort  uint16        `mapstructure:"relay_min_port"`
+		RelayMaxPort  uint16        `mapstructure:"relay_max_port"`
+		URLs          []string      `mapstructure:"urls"` // Advertised to clients, derived from public_ip when empty
+	} `mapstructure:"turn"`
+	Recording struct {
+		Enabled bool   `mapstructure:"enabled"`
+		Dir     string `mapstructure:"dir"`
+	} `mapstructure:"recording"`
+	SFU struct {
+		InitialBitrateKbps int `mapstructure:"initial_bitrate_kbps"` // Assumed downlink until feedback arrives
+		MinBitrateKbps     int `mapstructure:"min_bitrate_kbps"`
+		MaxBitrateKbps     int `mapstructure:"max_bitrate_kbps"`
+	} `mapstructure:"sfu"`
+	Stats struct {
+		Interval   time.Duration `mapstructure:"interval"`
+		AdminToken string        `mapstructure:"admin_token"` // /admin/stats is disabled when empty
+	} `mapstructure:"stats"`
+	Cluster struct {
+		InstanceID   string        `mapstructure:"instance_id"`   // Generated when empty
+		AdvertiseURL string        `mapstructure:"advertise_url"` // Where clients reach this instance, e.g. wss://peer-1.example.com
+		Bus          string        `mapstructure:"bus"`           // memory or redis
+		RedisURL     string        `mapstructure:"redis_url"`
+		OwnershipTTL time.Duration `mapstructure:"ownership_ttl"` // How long a room's media host is kept without renewal
+	} `mapstructure:"cluster"`
 }
 
 func LoadConfig(configFile string) (Config, error) {
@@ -41,6 +114,153 @@ func LoadConfig(configFile string) (Config, error) {
 	if config.Server.ShutdownTimeout <= 0 {
 		config.Server.ShutdownTimeout = 30 * time.Second // Default to 30 seconds
 	}
+	if config.Server.ResumeWindow <= 0 {
+		config.Server.ResumeWindow = 30 * time.Second
+	}
+	if config.Server.ReplayBuffer <= 0 {
+		config.Server.ReplayBuffer = 512
+	}
+	if config.Server.WriteQueue <= 0 {
+		config.Server.WriteQueue = 256
+	}
+	if config.Server.WriteTimeout <= 0 {
+		config.Server.WriteTimeout = 10 * time.Second
+	}
+	if config.Server.IdleAfter <= 0 {
+		config.Server.IdleAfter = time.Minute
+	}
+	if config.Server.HistoryFlush <= 0 {
+		config.Server.HistoryFlush = 5 * time.Second
+	}
+
+	if config.Core.CacheTTL <= 0 {
+		config.Core.CacheTTL = 30 * time.Second
+	}
+	if config.Core.NegativeCacheTTL <= 0 {
+		config.Core.NegativeCacheTTL = 10 * time.Second
+	}
+	if config.Core.Retries == nil {
+		config.Core.Retries = intPtr(2)
+	}
+	if config.Core.BreakerThreshold == nil {
+		config.Core.BreakerThreshold = intPtr(5)
+	}
+	if *config.Core.Retries < 0 || *config.Core.BreakerThreshold < 0 {
+		return Config{}, errors.New("core.retries and core.breaker_threshold cannot be negative")
+	}
+	if config.Core.BreakerCooldown <= 0 {
+		config.Core.BreakerCooldown = 30 * time.Second
+	}
+
+	if config.Runner.Namespaces == nil {
+		config.Runner.Namespaces = boolPtr(true)
+	}
+	if config.Runner.Enabled && !config.Runner.Unsafe {
+		// Without namespaces programs keep the network and see the host
+		if !*config.Runner.Namespaces {
+			return Config{}, errors.New("runner.namespaces can only be disabled with runner.unsafe")
+		}
+		if runtime.GOOS != "linux" {
+			return Config{}, errors.New("runner.namespaces needs Linux, set runner.unsafe to run programs without them")
+		}
+	}
+	if config.Runner.CompileTimeout <= 0 {
+		config.Runner.CompileTimeout = 30 * time.Second
+	}
+	if config.Runner.RunTimeout <= 0 {
+		config.Runner.RunTimeout = 10 * time.Second
+	}
+	if config.Runner.CPUTime <= 0 {
+		config.Runner.CPUTime = 5 * time.Second
+	}
+	if config.Runner.MemoryLimitMB <= 0 {
+		config.Runner.MemoryLimitMB = 256
+	}
+	if config.Runner.CompileMemoryLimitMB <= 0 {
+		config.Runner.CompileMemoryLimitMB = 1024
+	}
+	if config.Runner.MaxProcesses <= 0 {
+		config.Runner.MaxProcesses = 64
+	}
+	if config.Runner.OutputLimitKB <= 0 {
+		config.Runner.OutputLimitKB = 64
+	}
+	if config.Runner.FileSizeKB <= 0 {
+		config.Runner.FileSizeKB = 10 * 1024
+	}
+
+	if config.SFU.InitialBitrateKbps <= 0 {
+		config.SFU.InitialBitrateKbps = 1000
+	}
+	if config.SFU.MinBitrateKbps <= 0 {
+		config.SFU.MinBitrateKbps = 100
+	}
+	if config.SFU.MaxBitrateKbps <= 0 {
+		config.SFU.MaxBitrateKbps = 5000
+	}
+
+	if config.Stats.Interval <= 0 {
+		config.Stats.Interval = 5 * time.Second
+	}
+
+	if config.Cluster.Bus == "" {
+		config.Cluster.Bus = "memory"
+	}
+	if config.Cluster.Bus != "memory" && config.Cluster.Bus != "redis" {
+		return Config{}, errors.New("cluster.bus must be memory or redis")
+	}
+	if config.Cluster.Bus == "redis" {
+		if config.Cluster.RedisURL == "" || config.Cluster.AdvertiseURL == "" {
+			return Config{}, errors.New("cluster.redis_url and cluster.advertise_url are required with the redis bus")
+		}
+	}
+	if config.Cluster.InstanceID == "" {
+		config.Cluster.InstanceID = uuid.NewString()
+	}
+	if config.Cluster.OwnershipTTL <= 0 {
+		config.Cluster.OwnershipTTL = 30 * time.Second
+	}
+
+	if len(config.Server.ICEServers) == 0 && config.Server.StunServerURL != "" {
+		config.Server.ICEServers = []ICEServer{{URLs: []string{config.Server.StunServerURL}}}
+	}
+
+	if config.TURN.Enabled {
+		if config.TURN.Secret == "" || config.TURN.PublicIP == "" {
+			return Config{}, errors.New("turn.secret and turn.public_ip are required when turn is enabled")
+		}
+		if config.TURN.ListenAddress == "" {
+			config.TURN.ListenAddress = "0.0.0.0:3478"
+		}
+		if config.TURN.Realm == "" {
+			config.TURN.Realm = "codepair"
+		}
+		if config.TURN.CredentialTTL <= 0 {
+			config.TURN.CredentialTTL = 6 * time.Hour
+		}
+		if config.TURN.RelayMinPort == 0 || config.TURN.RelayMaxPort == 0 {
+			config.TURN.RelayMinPort, config.TURN.RelayMaxPort = 49152, 65535
+		}
+		if len(config.TURN.URLs) == 0 {
+			_, port, err := net.SplitHostPort(config.TURN.ListenAddress)
+			if err != nil {
+				return Config{}, err
+			}
+			config.TURN.URLs = []string{"turn:" + net.JoinHostPort(config.TURN.PublicIP, port) + "?transport=udp"}
+		}
+	}
+
+	if config.Recording.Dir == "" {
+		config.Recording.Dir = "recordings"
+	}
 
 	return config, nil
 }
+
+func intPtr(v int) *int {
+	return &v
+}
+
+func boolPtr(v bool) *bool {
+	return &v
+}
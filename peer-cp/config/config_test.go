@@ -0,0 +1,60 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadConfigCoreResilience(t *testing.T) {
+	tests := []struct {
+		name          string
+		core          string
+		wantRetries   int
+		wantThreshold int
+		wantErr       bool
+	}{
+		{
+			name:          "defaults when unset",
+			core:          "core:\n  base_url: http://core\n",
+			wantRetries:   2,
+			wantThreshold: 5,
+		},
+		{
+			name:          "0 disables",
+			core:          "core:\n  base_url: http://core\n  retries: 0\n  breaker_threshold: 0\n",
+			wantRetries:   0,
+			wantThreshold: 0,
+		},
+		{
+			name:          "set",
+			core:          "core:\n  base_url: http://core\n  retries: 4\n  breaker_threshold: 1\n",
+			wantRetries:   4,
+			wantThreshold: 1,
+		},
+		{
+			name:    "negative",
+			core:    "core:\n  base_url: http://core\n  retries: -1\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "config.yaml")
+			require.NoError(t, os.WriteFile(file, []byte(tt.core), 0o600))
+
+			cfg, err := LoadConfig(file)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantRetries, *cfg.Core.Retries)
+			assert.Equal(t, tt.wantThreshold, *cfg.Core.BreakerThreshold)
+		})
+	}
+}
@@ -0,0 +1,24 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// RequireAdminToken guards operator endpoints with a static bearer token.
+// The endpoints are disabled when no token is configured.
+func RequireAdminToken(token string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if token == "" {
+			return fiber.ErrNotFound
+		}
+
+		provided := strings.TrimPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			return fiber.ErrUnauthorized
+		}
+		return c.Next()
+	}
+}
@@ -0,0 +1,88 @@
+package runner
+
+// Language describes how to build and run a program in a given language.
+// Source is the file name the entry file is written to inside the sandbox.
+type Language struct {
+	Name    string
+	Source  string
+	Compile []string
+	Binary  string // What Compile writes next to the source
+	Run     []string
+	// Some runtimes reserve large virtual address ranges on start-up that
+	// they never touch. They get at least this much address space; a
+	// configured cgroup still holds them to the memory limit.
+	AddressSpaceMB int
+}
+
+var languages = map[string]Language{
+	"python": {
+		Name:   "python",
+		Source: "main.py",
+		Run:    []string{"python3", "main.py"},
+	},
+	"javascript": {
+		Name:           "javascript",
+		Source:         "main.js",
+		Run:            []string{"node", "main.js"},
+		AddressSpaceMB: 2048,
+	},
+	"ruby": {
+		Name:   "ruby",
+		Source: "main.rb",
+		Run:    []string{"ruby", "main.rb"},
+	},
+	"php": {
+		Name:   "php",
+		Source: "main.php",
+		Run:    []string{"php", "main.php"},
+	},
+	"go": {
+		Name:           "go",
+		Source:         "main.go",
+		Compile:        []string{"go", "build", "-o", "main", "main.go"},
+		Binary:         "main",
+		Run:            []string{"./main"},
+		AddressSpaceMB: 2048,
+	},
+	"c": {
+		Name:    "c",
+		Source:  "main.c",
+		Compile: []string{"gcc", "-O2", "-o", "main", "main.c", "-lm"},
+		Binary:  "main",
+		Run:     []string{"./main"},
+	},
+	"cpp": {
+		Name:    "cpp",
+		Source:  "main.cpp",
+		Compile: []string{"g++", "-O2", "-std=c++17", "-o", "main", "main.cpp"},
+		Binary:  "main",
+		Run:     []string{"./main"},
+	},
+	"rust": {
+		Name:    "rust",
+		Source:  "main.rs",
+		Compile: []string{"rustc", "-O", "-o", "main", "main.rs"},
+		Binary:  "main",
+		Run:     []string{"./main"},
+	},
+	"java": {
+		Name:           "java",
+		Source:         "Main.java",
+		Compile:        []string{"javac", "Main.java"},
+		Binary:         "Main.class",
+		Run:            []string{"java", "-Xmx256m", "Main"},
+		AddressSpaceMB: 4096,
+	},
+}
+
+// LookupLanguage returns the toolchain definition for a language
+func LookupLanguage(name string) (Language, bool) {
+	lang, ok := languages[name]
+	return lang, ok
+}
+
+// reserves reports whether path is where the entry file or the build output
+// goes, so no other workspace file may use it
+func (l Language) reserves(path string) bool {
+	return path == l.Source || l.Binary != "" && path == l.Binary
+}
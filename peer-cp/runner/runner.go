@@ -0,0 +1,349 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sandboxUID = 1000 // UID the program sees inside its user namespace
+
+	StatusOK           = "ok"
+	StatusCompileError = "compile_error"
+	StatusRuntimeError = "runtime_error"
+	StatusTimeout      = "timeout"
+	StatusOutputLimit  = "output_limit"
+)
+
+var (
+	ErrUnsupportedLanguage = errors.New("unsupported language")
+	ErrReservedPath        = errors.New("path is reserved for the entry file or build output")
+)
+
+// Limits are the quotas applied to every run
+type Limits struct {
+	CompileTimeout  time.Duration
+	RunTimeout      time.Duration
+	CPUTime         time.Duration
+	MemoryMB        int
+	CompileMemoryMB int // Compilers need more memory than the programs they build
+	OutputKB        int
+	FileSizeKB      int
+	Processes       int // Processes and threads a step may have at once
+}
+
+type Config struct {
+	WorkDir    string // Parent directory for per-run scratch directories, empty uses the OS default
+	Namespaces bool
+	RootFS     string // Root the program sees with namespaces, empty assembles one from the host's system directories
+	Cgroup     string // Delegated cgroup v2 directory steps are placed under, empty relies on rlimits alone
+	Limits     Limits
+}
+
+// stepLimits are what one compile or run step is held to
+type stepLimits struct {
+	CPUTime        time.Duration
+	MemoryMB       int // Memory actually used, enforced by the cgroup
+	AddressSpaceMB int // Virtual memory, enforced by rlimit
+	FileSizeKB     int
+	Processes      int
+}
+
+// compileLimits bounds a compiler. It is stopped by the compile timeout
+// rather than a CPU limit, since parallel builds use more CPU than wall time,
+// and it writes build archives larger than programs may.
+func compileLimits(lang Language, limits Limits) stepLimits {
+	return stepLimits{
+		MemoryMB:       limits.CompileMemoryMB,
+		AddressSpaceMB: addressSpace(lang, limits.CompileMemoryMB),
+		Processes:      limits.Processes,
+	}
+}
+
+func runLimits(lang Language, limits Limits) stepLimits {
+	return stepLimits{
+		CPUTime:        limits.CPUTime,
+		MemoryMB:       limits.MemoryMB,
+		AddressSpaceMB: addressSpace(lang, limits.MemoryMB),
+		FileSizeKB:     limits.FileSizeKB,
+		Processes:      limits.Processes,
+	}
+}
+
+// addressSpace is the virtual memory allowed for memoryMB of real memory,
+// raised for runtimes that reserve more than they use
+func addressSpace(lang Language, memoryMB int) int {
+	if memoryMB <= 0 {
+		return 0
+	}
+	return max(memoryMB, lang.AddressSpaceMB)
+}
+
+type File struct {
+	Path    string
+	Content string
+}
+
+// Request describes a single program execution. Entry names the file in Files
+// that holds the program; it is written to the language's source file name.
+type Request struct {
+	Language string
+	Entry    string
+	Files    []File
+	Stdin    string
+}
+
+type Result struct {
+	Status      string `json:"status"`
+	ExitCode    int    `json:"exitCode"`
+	DurationMs  int64  `json:"durationMs"`
+	CPUTimeMs   int64  `json:"cpuTimeMs"`
+	MaxMemoryKB int64  `json:"maxMemoryKb"`
+	Truncated   bool   `json:"truncated,omitempty"`
+}
+
+// OutputFunc receives program output as it is produced. Stream is "stdout" or "stderr".
+type OutputFunc func(stream string, data []byte)
+
+type Runner struct {
+	config Config
+}
+
+func New(config Config) *Runner {
+	return &Runner{config: config}
+}
+
+func (r *Runner) Run(ctx context.Context, req Request, onOutput OutputFunc) (*Result, error) {
+	results, err := r.RunBatch(ctx, req, []string{req.Stdin}, func(_ int, stream string, data []byte) {
+		if onOutput != nil {
+			onOutput(stream, data)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results[0], nil
+}
+
+// BatchOutputFunc receives output of the run with the given input index
+type BatchOutputFunc func(index int, stream string, data []byte)
+
+// RunBatch compiles the program once and runs it once per input. When the
+// build fails the compile result is returned as the only result. Every run
+// gets its own output quota.
+func (r *Runner) RunBatch(ctx context.Context, req Request, inputs []string, onOutput BatchOutputFunc) ([]*Result, error) {
+	lang, ok := LookupLanguage(req.Language)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedLanguage, req.Language)
+	}
+
+	dir, err := os.MkdirTemp(r.config.WorkDir, "codepair-run-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create work dir: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := writeFiles(dir, lang, req); err != nil {
+		return nil, err
+	}
+
+	if len(lang.Compile) > 0 {
+		sink := r.newSink(func(stream string, data []byte) {
+			if onOutput != nil {
+				onOutput(0, stream, data)
+			}
+		})
+		step, err := r.runStep(ctx, dir, lang.Compile, "", r.config.Limits.CompileTimeout, compileLimits(lang, r.config.Limits), sink)
+		if err != nil {
+			return nil, err
+		}
+		if step.Status != StatusOK {
+			if step.Status == StatusRuntimeError {
+				step.Status = StatusCompileError
+			}
+			return []*Result{step}, nil
+		}
+	}
+
+	limits := runLimits(lang, r.config.Limits)
+	results := make([]*Result, len(inputs))
+	for i, input := range inputs {
+		index := i
+		sink := r.newSink(func(stream string, data []byte) {
+			if onOutput != nil {
+				onOutput(index, stream, data)
+			}
+		})
+		results[i], err = r.runStep(ctx, dir, lang.Run, input, r.config.Limits.RunTimeout, limits, sink)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+func (r *Runner) newSink(onOutput OutputFunc) *outputSink {
+	return &outputSink{
+		remaining: r.config.Limits.OutputKB * 1024,
+		onOutput:  onOutput,
+	}
+}
+
+func writeFiles(dir string, lang Language, req Request) error {
+	entryFound := false
+	for _, file := range req.Files {
+		target := lang.Source
+		if file.Path != req.Entry {
+			target = filepath.Clean(filepath.FromSlash(file.Path))
+			if lang.reserves(filepath.ToSlash(target)) {
+				return fmt.Errorf("%w: %s", ErrReservedPath, file.Path)
+			}
+		} else {
+			entryFound = true
+		}
+
+		fullPath := filepath.Join(dir, target)
+		if !strings.HasPrefix(fullPath, dir+string(os.PathSeparator)) {
+			return fmt.Errorf("file path %q escapes the work dir", file.Path)
+		}
+		if err := os.MkdirAll(filepath.Dir(fullPath), 0o755); err != nil {
+			return fmt.Errorf("failed to create directory for %s: %w", file.Path, err)
+		}
+		if err := os.WriteFile(fullPath, []byte(file.Content), 0o644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", file.Path, err)
+		}
+	}
+
+	if !entryFound {
+		return fmt.Errorf("entry file %q not found", req.Entry)
+	}
+	return nil
+}
+
+// runStep runs one command in the sandbox under the given limits
+func (r *Runner) runStep(ctx context.Context, dir string, argv []string, stdin string, timeout time.Duration, limits stepLimits, sink *outputSink) (*Result, error) {
+	stepCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cmd, cleanup, err := r.sandboxCommand(stepCtx, dir, argv, limits)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sandbox %s: %w", argv[0], err)
+	}
+	defer cleanup()
+
+	cmd.Dir = dir
+	cmd.Env = []string{
+		"PATH=" + os.Getenv("PATH"),
+		"HOME=" + dir,
+		"TMPDIR=" + dir,
+		"GOCACHE=" + filepath.Join(dir, ".gocache"),
+		"GOPATH=" + filepath.Join(dir, ".gopath"),
+		"LANG=C.UTF-8",
+	}
+	cmd.Stdin = strings.NewReader(stdin)
+	cmd.Stdout = sink.writer("stdout", cancel)
+	cmd.Stderr = sink.writer("stderr", cancel)
+	cmd.Cancel = func() error {
+		killProcess(cmd)
+		return nil
+	}
+	cmd.WaitDelay = time.Second
+
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start %s: %w", argv[0], err)
+	}
+	waitErr := cmd.Wait()
+	duration := time.Since(start)
+
+	cpu, maxRSS := resourceUsage(cmd.ProcessState)
+	result := &Result{
+		Status:      StatusOK,
+		ExitCode:    -1,
+		DurationMs:  duration.Milliseconds(),
+		CPUTimeMs:   cpu.Milliseconds(),
+		MaxMemoryKB: maxRSS,
+		Truncated:   sink.isTruncated(),
+	}
+	if cmd.ProcessState != nil {
+		result.ExitCode = cmd.ProcessState.ExitCode()
+	}
+
+	switch {
+	case ctx.Err() != nil:
+		return nil, ctx.Err()
+	case result.Truncated:
+		result.Status = StatusOutputLimit
+	case errors.Is(stepCtx.Err(), context.DeadlineExceeded),
+		limits.CPUTime > 0 && cpu >= limits.CPUTime:
+		result.Status = StatusTimeout
+	case waitErr != nil:
+		var exitErr *exec.ExitError
+		if !errors.As(waitErr, &exitErr) {
+			return nil, fmt.Errorf("failed to run %s: %w", argv[0], waitErr)
+		}
+		result.Status = StatusRuntimeError
+	}
+
+	return result, nil
+}
+
+// outputSink forwards output from both streams and enforces the combined
+// output quota. Hitting the quota stops the program.
+type outputSink struct {
+	mu        sync.Mutex
+	remaining int
+	truncated bool
+	onOutput  OutputFunc
+}
+
+type streamWriter struct {
+	sink     *outputSink
+	stream   string
+	overflow func()
+}
+
+func (s *outputSink) writer(stream string, overflow func()) io.Writer {
+	return &streamWriter{sink: s, stream: stream, overflow: overflow}
+}
+
+func (s *outputSink) isTruncated() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.truncated
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	s := w.sink
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.truncated {
+		return len(p), nil
+	}
+
+	data := p
+	if len(data) > s.remaining {
+		data = data[:s.remaining]
+		s.truncated = true
+	}
+	s.remaining -= len(data)
+
+	if len(data) > 0 && s.onOutput != nil {
+		chunk := make([]byte, len(data))
+		copy(chunk, data)
+		s.onOutput(w.stream, chunk)
+	}
+	if s.truncated {
+		w.overflow()
+	}
+	return len(p), nil
+}
@@ -0,0 +1,136 @@
+package runner
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStepLimits(t *testing.T) {
+	limits := Limits{
+		CompileTimeout:  30 * time.Second,
+		CPUTime:         5 * time.Second,
+		MemoryMB:        256,
+		CompileMemoryMB: 1024,
+		FileSizeKB:      10 * 1024,
+		Processes:       64,
+	}
+
+	tests := []struct {
+		name     string
+		language string
+		compile  bool
+		limits   Limits
+		expected stepLimits
+	}{
+		{
+			name:     "run is held to the memory limit",
+			language: "python",
+			limits:   limits,
+			expected: stepLimits{CPUTime: 5 * time.Second, MemoryMB: 256, AddressSpaceMB: 256, FileSizeKB: 10 * 1024, Processes: 64},
+		},
+		{
+			name:     "runtime that reserves address space gets more of it",
+			language: "javascript",
+			limits:   limits,
+			expected: stepLimits{CPUTime: 5 * time.Second, MemoryMB: 256, AddressSpaceMB: 2048, FileSizeKB: 10 * 1024, Processes: 64},
+		},
+		{
+			name:     "java gets the most address space",
+			language: "java",
+			limits:   limits,
+			expected: stepLimits{CPUTime: 5 * time.Second, MemoryMB: 256, AddressSpaceMB: 4096, FileSizeKB: 10 * 1024, Processes: 64},
+		},
+		{
+			name:     "compile uses the compile memory and no CPU or file size limit",
+			language: "c",
+			compile:  true,
+			limits:   limits,
+			expected: stepLimits{MemoryMB: 1024, AddressSpaceMB: 1024, Processes: 64},
+		},
+		{
+			name:     "go build gets the runtime's address space",
+			language: "go",
+			compile:  true,
+			limits:   limits,
+			expected: stepLimits{MemoryMB: 1024, AddressSpaceMB: 2048, Processes: 64},
+		},
+		{
+			name:     "no memory limit leaves address space unlimited",
+			language: "javascript",
+			limits:   Limits{CPUTime: time.Second},
+			expected: stepLimits{CPUTime: time.Second},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lang, ok := LookupLanguage(tt.language)
+			assert.True(t, ok)
+
+			got := runLimits(lang, tt.limits)
+			if tt.compile {
+				got = compileLimits(lang, tt.limits)
+			}
+			assert.Equal(t, tt.expected, got)
+		})
+	}
+}
+
+func TestWriteFiles(t *testing.T) {
+	tests := []struct {
+		name     string
+		language string
+		files    []File
+		err      error
+	}{
+		{
+			name:     "entry is written to the source file",
+			language: "python",
+			files:    []File{{Path: "solution.py"}, {Path: "lib/util.py"}},
+		},
+		{
+			name:     "entry may already use the source name",
+			language: "python",
+			files:    []File{{Path: "main.py"}},
+		},
+		{
+			name:     "other file cannot take the source name",
+			language: "python",
+			files:    []File{{Path: "solution.py"}, {Path: "main.py"}},
+			err:      ErrReservedPath,
+		},
+		{
+			name:     "other file cannot take the source name in disguise",
+			language: "python",
+			files:    []File{{Path: "solution.py"}, {Path: "./lib/../main.py"}},
+			err:      ErrReservedPath,
+		},
+		{
+			name:     "other file cannot take the binary name",
+			language: "c",
+			files:    []File{{Path: "solution.c"}, {Path: "main"}},
+			err:      ErrReservedPath,
+		},
+		{
+			name:     "binary name is free for interpreted languages",
+			language: "python",
+			files:    []File{{Path: "solution.py"}, {Path: "main"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lang, ok := LookupLanguage(tt.language)
+			assert.True(t, ok)
+
+			err := writeFiles(t.TempDir(), lang, Request{Language: tt.language, Entry: tt.files[0].Path, Files: tt.files})
+			if tt.err != nil {
+				assert.ErrorIs(t, err, tt.err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
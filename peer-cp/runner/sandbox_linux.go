@@ -0,0 +1,435 @@
+//go:build linux
+
+package runner
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// initArg marks the runner binary re-executed as the sandbox's first process
+const initArg = "codepair-sandbox-init"
+
+// hostRoot is what the program sees of the host when no root is configured:
+// the toolchains and the few files of /etc they read, all read-only
+var hostRoot = []string{
+	"/bin", "/sbin", "/lib", "/lib32", "/lib64", "/usr",
+	"/etc/alternatives", "/etc/ld.so.cache", "/etc/ld.so.conf", "/etc/ld.so.conf.d", "/etc/localtime",
+}
+
+// devices are bound from the host into the sandbox's /dev
+var devices = []string{"null", "zero", "full", "random", "urandom"}
+
+// initSpec is what the sandbox's first process needs to set up the program
+type initSpec struct {
+	Namespaces bool       `json:"namespaces"`
+	Root       string     `json:"root"`   // Empty mount point the new root is built on
+	RootFS     string     `json:"rootfs"` // Directory whose entries make up the new root, the host's system directories when empty
+	Dir        string     `json:"dir"`    // Workspace, the only writable mount
+	Limits     stepLimits `json:"limits"`
+	Argv       []string   `json:"argv"`
+}
+
+// Init sets up the sandbox and execs the program when the process is the
+// runner's sandbox child, and returns otherwise. It must be the first thing
+// main does.
+func Init() {
+	if len(os.Args) < 3 || os.Args[1] != initArg {
+		return
+	}
+
+	var spec initSpec
+	err := json.Unmarshal([]byte(os.Args[2]), &spec)
+	if err == nil {
+		err = spec.exec()
+	}
+	fmt.Fprintf(os.Stderr, "sandbox: %v\n", err)
+	os.Exit(126)
+}
+
+// sandboxCommand starts argv through a re-executed copy of this binary,
+// which moves into the sandbox and applies the limits before exec'ing it.
+// With namespaces the program runs in fresh user, mount, PID, network, IPC
+// and UTS namespaces on a read-only root where only the workspace is
+// writable. The new network namespace only has a loopback interface that is
+// down, so the program has no network access. The program becomes PID 1 of
+// its namespace, so killing it tears down everything it spawned.
+func (r *Runner) sandboxCommand(ctx context.Context, dir string, argv []string, limits stepLimits) (*exec.Cmd, func(), error) {
+	spec := initSpec{
+		Namespaces: r.config.Namespaces,
+		RootFS:     r.config.RootFS,
+		Dir:        dir,
+		Limits:     limits,
+		Argv:       argv,
+	}
+
+	var cleanups []func()
+	cleanup := func() {
+		for i := len(cleanups) - 1; i >= 0; i-- {
+			cleanups[i]()
+		}
+	}
+
+	if spec.Namespaces {
+		// Only a mount point, the new root lives in the sandbox's mount namespace
+		spec.Root = dir + ".root"
+		if err := os.Mkdir(spec.Root, 0o700); err != nil {
+			return nil, nil, err
+		}
+		cleanups = append(cleanups, func() { os.Remove(spec.Root) })
+	}
+
+	encoded, err := json.Marshal(spec)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+
+	cmd := exec.CommandContext(ctx, "/proc/self/exe", initArg, string(encoded))
+	cmd.SysProcAttr = sandboxAttr(spec.Namespaces)
+
+	if r.config.Cgroup != "" {
+		group, err := newCgroup(r.config.Cgroup, limits)
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		cleanups = append(cleanups, group.remove)
+		cmd.SysProcAttr.UseCgroupFD = true
+		cmd.SysProcAttr.CgroupFD = group.fd
+	}
+
+	return cmd, cleanup, nil
+}
+
+func sandboxAttr(namespaces bool) *syscall.SysProcAttr {
+	if !namespaces {
+		return &syscall.SysProcAttr{
+			Setpgid:   true,
+			Pdeathsig: syscall.SIGKILL,
+		}
+	}
+
+	return &syscall.SysProcAttr{
+		Pdeathsig: syscall.SIGKILL,
+		Cloneflags: syscall.CLONE_NEWUSER |
+			syscall.CLONE_NEWNS |
+			syscall.CLONE_NEWPID |
+			syscall.CLONE_NEWNET |
+			syscall.CLONE_NEWIPC |
+			syscall.CLONE_NEWUTS,
+		UidMappings: []syscall.SysProcIDMap{
+			{ContainerID: sandboxUID, HostID: os.Getuid(), Size: 1},
+		},
+		GidMappings: []syscall.SysProcIDMap{
+			{ContainerID: sandboxUID, HostID: os.Getgid(), Size: 1},
+		},
+		GidMappingsEnableSetgroups: false,
+		// Lets the first process set up its mounts, it is cleared before
+		// the program starts
+		AmbientCaps: []uintptr{unix.CAP_SYS_ADMIN},
+	}
+}
+
+// exec runs in the sandbox's first process and replaces it with the program.
+// The limits come last, so this process is not held to them.
+func (spec initSpec) exec() error {
+	if spec.Namespaces {
+		if err := spec.pivot(); err != nil {
+			return err
+		}
+	}
+	if err := os.Chdir(spec.Dir); err != nil {
+		return err
+	}
+	path, err := exec.LookPath(spec.Argv[0])
+	if err != nil {
+		return err
+	}
+
+	if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0); err != nil {
+		return fmt.Errorf("failed to drop capabilities: %w", err)
+	}
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("failed to set no_new_privs: %w", err)
+	}
+	if err := spec.Limits.apply(spec.Namespaces); err != nil {
+		return err
+	}
+	return syscall.Exec(path, spec.Argv, os.Environ())
+}
+
+// pivot builds the new root on a tmpfs, binds the system directories
+// read-only and the workspace read-write at its host path, and switches to
+// it. The host's root is detached, so nothing else of the host is reachable.
+func (spec initSpec) pivot() error {
+	// Keep the mounts below from propagating back to the host
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("failed to make mounts private: %w", err)
+	}
+	root := spec.Root
+	if err := unix.Mount("tmpfs", root, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, "size=1m,mode=0755"); err != nil {
+		return fmt.Errorf("failed to mount the root: %w", err)
+	}
+
+	sources, err := spec.rootSources()
+	if err != nil {
+		return err
+	}
+	for target, source := range sources {
+		if err := bindReadOnly(source, filepath.Join(root, target)); err != nil {
+			return err
+		}
+	}
+
+	for _, device := range devices {
+		if err := bind("/dev/"+device, filepath.Join(root, "dev", device), unix.MS_NOSUID|unix.MS_NOEXEC); err != nil {
+			return err
+		}
+	}
+	for name, target := range map[string]string{"fd": "/proc/self/fd", "stdin": "/proc/self/fd/0", "stdout": "/proc/self/fd/1", "stderr": "/proc/self/fd/2"} {
+		if err := os.Symlink(target, filepath.Join(root, "dev", name)); err != nil {
+			return err
+		}
+	}
+
+	proc := filepath.Join(root, "proc")
+	if err := os.Mkdir(proc, 0o555); err != nil {
+		return err
+	}
+	if err := unix.Mount("proc", proc, "proc", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, ""); err != nil {
+		return fmt.Errorf("failed to mount /proc: %w", err)
+	}
+
+	if err := bind(spec.Dir, filepath.Join(root, spec.Dir), unix.MS_NOSUID|unix.MS_NODEV); err != nil {
+		return err
+	}
+
+	old := filepath.Join(root, ".old")
+	if err := os.Mkdir(old, 0o700); err != nil {
+		return err
+	}
+	if err := unix.Mount("", root, "", unix.MS_REMOUNT|unix.MS_RDONLY|unix.MS_NOSUID|unix.MS_NODEV, ""); err != nil {
+		return fmt.Errorf("failed to make the root read-only: %w", err)
+	}
+	if err := unix.PivotRoot(root, old); err != nil {
+		return fmt.Errorf("failed to pivot root: %w", err)
+	}
+	if err := os.Chdir("/"); err != nil {
+		return err
+	}
+	if err := unix.Unmount("/.old", unix.MNT_DETACH); err != nil {
+		return fmt.Errorf("failed to detach the host root: %w", err)
+	}
+	return nil
+}
+
+// rootSources maps paths in the new root to what is bound there
+func (spec initSpec) rootSources() (map[string]string, error) {
+	sources := make(map[string]string)
+	if spec.RootFS == "" {
+		for _, path := range hostRoot {
+			sources[path] = path
+		}
+		return sources, nil
+	}
+
+	entries, err := os.ReadDir(spec.RootFS)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the root filesystem: %w", err)
+	}
+	for _, entry := range entries {
+		switch entry.Name() {
+		case "dev", "proc":
+			continue // Set up by the sandbox
+		}
+		sources["/"+entry.Name()] = filepath.Join(spec.RootFS, entry.Name())
+	}
+	return sources, nil
+}
+
+// bindReadOnly binds source read-only at target. Missing sources are
+// skipped and symlinks are recreated, so merged /usr layouts keep working.
+func bindReadOnly(source, target string) error {
+	info, err := os.Lstat(source)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		link, err := os.Readlink(source)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return err
+		}
+		return os.Symlink(link, target)
+	}
+
+	if err := bind(source, target, 0); err != nil {
+		return err
+	}
+
+	// A remount inside a user namespace must keep the flags the host
+	// mount was locked with
+	var stat unix.Statfs_t
+	if err := unix.Statfs(target, &stat); err != nil {
+		return err
+	}
+	locked := uintptr(stat.Flags) & (unix.MS_NOEXEC | unix.MS_NOATIME | unix.MS_NODIRATIME | unix.MS_RELATIME)
+	flags := unix.MS_BIND | unix.MS_REMOUNT | unix.MS_RDONLY | unix.MS_NOSUID | unix.MS_NODEV | locked
+	if err := unix.Mount("", target, "", flags, ""); err != nil {
+		return fmt.Errorf("failed to make %s read-only: %w", source, err)
+	}
+	return nil
+}
+
+// bind binds source at target, creating the mount point
+func bind(source, target string, flags uintptr) error {
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+	if info.IsDir() {
+		err = os.MkdirAll(target, 0o755)
+	} else {
+		err = os.WriteFile(target, nil, 0o644)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := unix.Mount(source, target, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+		return fmt.Errorf("failed to bind %s: %w", source, err)
+	}
+	if flags != 0 {
+		if err := unix.Mount("", target, "", unix.MS_BIND|unix.MS_REMOUNT|flags, ""); err != nil {
+			return fmt.Errorf("failed to remount %s: %w", source, err)
+		}
+	}
+	return nil
+}
+
+// apply sets the rlimits of the sandbox's first process, which the program
+// inherits. The process limit is only set inside a user namespace: outside
+// one it counts every process and thread of the runner's own user. It does
+// not hold when that user is root, which is what the cgroup is for.
+func (l stepLimits) apply(namespaces bool) error {
+	set := func(resource int, value uint64) error {
+		if err := unix.Setrlimit(resource, &unix.Rlimit{Cur: value, Max: value}); err != nil {
+			return fmt.Errorf("failed to set rlimit %d: %w", resource, err)
+		}
+		return nil
+	}
+
+	if l.CPUTime > 0 {
+		if err := set(unix.RLIMIT_CPU, uint64((l.CPUTime+time.Second-1)/time.Second)); err != nil {
+			return err
+		}
+	}
+	if l.AddressSpaceMB > 0 {
+		if err := set(unix.RLIMIT_AS, uint64(l.AddressSpaceMB)<<20); err != nil {
+			return err
+		}
+	}
+	if l.FileSizeKB > 0 {
+		if err := set(unix.RLIMIT_FSIZE, uint64(l.FileSizeKB)<<10); err != nil {
+			return err
+		}
+	}
+	if l.Processes > 0 && namespaces {
+		if err := set(unix.RLIMIT_NPROC, uint64(l.Processes)); err != nil {
+			return err
+		}
+	}
+	return set(unix.RLIMIT_CORE, 0)
+}
+
+// cgroup is the cgroup v2 child one step runs in. It caps the memory the
+// step's processes actually use and how many there are, whatever they run as.
+type cgroup struct {
+	dir string
+	fd  int
+}
+
+func newCgroup(parent string, limits stepLimits) (*cgroup, error) {
+	dir, err := os.MkdirTemp(parent, "step-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cgroup: %w", err)
+	}
+
+	settings := map[string]string{}
+	if limits.MemoryMB > 0 {
+		settings["memory.max"] = strconv.Itoa(limits.MemoryMB << 20)
+		settings["memory.swap.max"] = "0"
+	}
+	if limits.Processes > 0 {
+		settings["pids.max"] = strconv.Itoa(limits.Processes)
+	}
+	for name, value := range settings {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(value), 0)
+		if errors.Is(err, os.ErrNotExist) && name == "memory.swap.max" {
+			continue // Kernel without swap accounting
+		}
+		if err != nil {
+			os.Remove(dir)
+			return nil, fmt.Errorf("failed to set %s: %w", name, err)
+		}
+	}
+
+	fd, err := unix.Open(dir, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		os.Remove(dir)
+		return nil, fmt.Errorf("failed to open cgroup: %w", err)
+	}
+	return &cgroup{dir: dir, fd: fd}, nil
+}
+
+// remove kills whatever is left in the cgroup and deletes it
+func (c *cgroup) remove() {
+	unix.Close(c.fd)
+	os.WriteFile(filepath.Join(c.dir, "cgroup.kill"), []byte("1"), 0)
+	for i := 0; i < 50; i++ {
+		if err := os.Remove(c.dir); err == nil || errors.Is(err, os.ErrNotExist) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func killProcess(cmd *exec.Cmd) {
+	if cmd.Process == nil {
+		return
+	}
+	// Covers the process group when namespaces are disabled
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	cmd.Process.Kill()
+}
+
+func resourceUsage(state *os.ProcessState) (cpu time.Duration, maxRSSKB int64) {
+	if state == nil {
+		return 0, 0
+	}
+	cpu = state.UserTime() + state.SystemTime()
+	if rusage, ok := state.SysUsage().(*syscall.Rusage); ok {
+		maxRSSKB = rusage.Maxrss // kilobytes on Linux
+	}
+	return cpu, maxRSSKB
+}
@@ -0,0 +1,104 @@
+//go:build linux
+
+package runner
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMain(m *testing.M) {
+	// The sandbox re-executes the test binary
+	Init()
+	os.Exit(m.Run())
+}
+
+func TestSandbox(t *testing.T) {
+	if err := exec.Command("unshare", "--user", "--map-root-user", "--mount", "--pid", "--fork", "true").Run(); err != nil {
+		t.Skip("user namespaces are not available:", err)
+	}
+
+	secret := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(secret, []byte("secret"), 0o600))
+
+	tests := []struct {
+		name     string
+		script   string
+		status   string
+		contains []string
+		excludes []string
+	}{
+		{
+			name:     "rlimits apply to the program",
+			script:   "cat /proc/self/limits",
+			status:   StatusOK,
+			contains: []string{"Max address space         268435456", "Max processes             16", "Max cpu time              2"},
+		},
+		{
+			name:     "host files outside the root are hidden",
+			script:   "cat " + secret,
+			status:   StatusRuntimeError,
+			excludes: []string{"secret"},
+		},
+		{
+			name:     "system directories are read-only",
+			script:   "touch /usr/pwned",
+			status:   StatusRuntimeError,
+			contains: []string{"Read-only file system"},
+		},
+		{
+			name:   "workspace is writable",
+			script: "echo hi > out.txt && cat out.txt",
+			status: StatusOK,
+		},
+		{
+			name:     "root is read-only",
+			script:   "touch /pwned",
+			status:   StatusRuntimeError,
+			contains: []string{"Read-only file system"},
+		},
+		{
+			name:     "program has no capabilities",
+			script:   "grep CapEff /proc/self/status",
+			status:   StatusOK,
+			contains: []string{"0000000000000000"},
+		},
+		{
+			name:     "program is PID 1 of its namespace",
+			script:   "echo $$",
+			status:   StatusOK,
+			contains: []string{"1\n"},
+		},
+	}
+
+	r := New(Config{WorkDir: t.TempDir(), Namespaces: true, Limits: Limits{OutputKB: 64}})
+	limits := stepLimits{CPUTime: 2 * time.Second, MemoryMB: 256, AddressSpaceMB: 256, FileSizeKB: 1024, Processes: 16}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := os.MkdirTemp(r.config.WorkDir, "step-")
+			require.NoError(t, err)
+
+			var output strings.Builder
+			sink := r.newSink(func(_ string, data []byte) { output.Write(data) })
+			result, err := r.runStep(context.Background(), dir, []string{"/bin/sh", "-c", tt.script}, "", 10*time.Second, limits, sink)
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.status, result.Status, output.String())
+			for _, s := range tt.contains {
+				assert.Contains(t, output.String(), s)
+			}
+			for _, s := range tt.excludes {
+				assert.NotContains(t, output.String(), s)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+//go:build !linux
+
+package runner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Init only has work to do on Linux
+func Init() {}
+
+// sandboxCommand only applies rlimits: namespaces and cgroups are Linux only,
+// so elsewhere programs are bound by rlimits and the wall clock timeout
+// alone. The limits are set by a tiny shell wrapper that execs the real
+// command, so they only apply to the program's process tree.
+func (r *Runner) sandboxCommand(ctx context.Context, dir string, argv []string, limits stepLimits) (*exec.Cmd, func(), error) {
+	if r.config.Cgroup != "" {
+		return nil, nil, errors.New("cgroups are only supported on Linux")
+	}
+
+	var script strings.Builder
+	if limits.CPUTime > 0 {
+		fmt.Fprintf(&script, "ulimit -t %d; ", int((limits.CPUTime+time.Second-1)/time.Second))
+	}
+	if limits.AddressSpaceMB > 0 {
+		fmt.Fprintf(&script, "ulimit -v %d; ", limits.AddressSpaceMB*1024)
+	}
+	if limits.FileSizeKB > 0 {
+		fmt.Fprintf(&script, "ulimit -f %d; ", limits.FileSizeKB)
+	}
+	if limits.Processes > 0 {
+		fmt.Fprintf(&script, "ulimit -u %d; ", limits.Processes)
+	}
+	script.WriteString(`exec "$@"`)
+
+	cmd := exec.CommandContext(ctx, "/bin/sh", append([]string{"-c", script.String(), "sh"}, argv...)...)
+	return cmd, func() {}, nil
+}
+
+func killProcess(cmd *exec.Cmd) {
+	if cmd.Process != nil {
+		cmd.Process.Kill()
+	}
+}
+
+func resourceUsage(state *os.ProcessState) (cpu time.Duration, maxRSSKB int64) {
+	if state == nil {
+		return 0, 0
+	}
+	return state.UserTime() + state.SystemTime(), 0
+}
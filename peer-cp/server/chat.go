@@ -1,9 +1,13 @@
 package server
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"time"
 
-	"github.com/gofiber/websocket/v2"
+	"github.com/elskow/codepair/peer-cp/client"
+	"go.uber.org/zap"
 )
 
 type ChatMessage struct {
@@ -15,7 +19,10 @@ type ChatMessage struct {
 }
 
 type ChatClient struct {
-	conn     *websocket.Conn
+	conn     Conn
+	token    string
+	user     *client.User // Resolved from the interviewer token, nil for candidates
+	id       string       // Roster ID
 	username string
 }
 
@@ -25,4 +32,74 @@ type ChatEvent struct {
 	Content  string        `json:"content,omitempty"`
 	Message  ChatMessage   `json:"message,omitempty"`
 	Messages []ChatMessage `json:"messages,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// handleChatEvent posts a chat message from a client to the room
+func (s *Server) handleChatEvent(ctx context.Context, room *Room, client *ChatClient, event ChatEvent) {
+	logger := s.getLogger(ctx)
+
+	switch event.Type {
+	case "chat":
+		if room.isMuted(client.id) {
+			if err := client.conn.WriteJSON(ChatEvent{Type: "error", Error: errMuted.Error()}); err != nil {
+				logger.Error("Failed to send chat error", zap.Error(err))
+			}
+			return
+		}
+
+		// The sender is who the connection authenticated as, whatever it claims
+		userName := client.username
+		if userName == "" {
+			userName = "Anonymous"
+		}
+
+		message := ChatMessage{
+			ID:        fmt.Sprintf("%d", time.Now().UnixNano()),
+			RoomID:    room.id,
+			UserName:  userName,
+			Content:   event.Content,
+			Timestamp: time.Now(),
+		}
+
+		s.deliverChat(room, message)
+
+		messageJSON, err := json.Marshal(message)
+		if err != nil {
+			logger.Error("Failed to marshal chat message", zap.Error(err))
+			return
+		}
+		s.publish(room.id, "", busChat, messageJSON)
+	}
+}
+
+// deliverChat adds a message to the room's history and sends it to the chat
+// clients connected here
+func (s *Server) deliverChat(room *Room, message ChatMessage) {
+	messageJSON, err := json.Marshal(ChatEvent{
+		Type:    "chat",
+		Message: message,
+	})
+	if err != nil {
+		s.logger.Error("Failed to marshal chat message", zap.Error(err))
+		return
+	}
+
+	header := parseHeader(messageJSON)
+
+	room.clientsMutex.Lock()
+	defer room.clientsMutex.Unlock()
+
+	if len(room.chatMessages) >= MaxChatHistory {
+		room.chatMessages = room.chatMessages[1:]
+	}
+	room.chatMessages = append(room.chatMessages, message)
+
+	for client := range room.chatClients {
+		if err := client.writeText(header, messageJSON); err != nil {
+			s.logger.Error("Failed to broadcast chat message",
+				zap.Error(err),
+				zap.String("roomID", room.id))
+		}
+	}
 }
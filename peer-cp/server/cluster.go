@@ -0,0 +1,428 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/elskow/codepair/peer-cp/bus"
+	"github.com/elskow/codepair/peer-cp/client"
+	"github.com/gofiber/websocket/v2"
+	"go.uber.org/zap"
+)
+
+// Bus channels, named after the clients a message is delivered to
+const (
+	busEditor             = "editor"
+	busEditorInterviewers = "editor_interviewers"
+	busChat               = "chat"
+	busNotes              = "notes"
+	busVideo              = "video"
+	busVideoInterviewers  = "video_interviewers"
+	busSyncRequest        = "sync_request" // A new local room asks for the state other instances hold
+	busSync               = "sync"
+	busRoomEvent          = "room_event" // A room event core sent to one of the instances
+	busPresence           = "presence"   // The participants an instance has in the room
+	busControls           = "controls"   // The room's controls after an interviewer changed them
+)
+
+const (
+	busTimeout    = 5 * time.Second
+	publishQueue  = 1024             // Messages a room can have waiting for the bus before new ones are dropped
+	publisherIdle = 30 * time.Second // How long a room's publisher waits for messages before it stops
+)
+
+// RoomSnapshot is the shared state of a room, sent to an instance that just
+// created its local copy
+type RoomSnapshot struct {
+	Files    []WorkspaceFile `json:"files,omitempty"`
+	Notes    string          `json:"notes,omitempty"`
+	Chat     []ChatMessage   `json:"chat,omitempty"`
+	Cursors  []EditorMessage `json:"cursors,omitempty"`
+	Controls *RoomControls   `json:"controls,omitempty"`
+}
+
+// MediaRedirectEvent tells a video client that the room's SFU runs on another
+// instance. The client reconnects to URL with the same query string.
+type MediaRedirectEvent struct {
+	Type string `json:"type"`
+	URL  string `json:"url"`
+}
+
+// getOrCreateRoom returns the local room, creating it on first join. A new
+// room starts with the removed list core keeps and asks the other instances
+// for the state they already hold. token is the room token the participant
+// was validated with.
+func (s *Server) getOrCreateRoom(roomID, token string, removed []string) *Room {
+	s.roomsMutex.Lock()
+	room, exists := s.rooms[roomID]
+	if !exists {
+		room = newRoom(roomID)
+		room.controls.Removed = append([]string{}, removed...)
+		s.rooms[roomID] = room
+	}
+	s.roomsMutex.Unlock()
+
+	room.validationMutex.Lock()
+	room.token = token
+	room.validationMutex.Unlock()
+
+	if !exists {
+		s.publish(roomID, "", busSyncRequest, nil)
+	}
+	return room
+}
+
+// publish sends an already marshalled payload to the room on the other
+// instances. Local clients are written to by the caller. Messages are queued
+// per room and sent in order, so a slow bus does not hold up the caller. A
+// room that falls publishQueue messages behind drops new ones.
+func (s *Server) publish(roomID, target, channel string, payload []byte) {
+	msg := bus.Message{
+		Room:    roomID,
+		Channel: channel,
+		Origin:  s.config.Cluster.InstanceID,
+		Target:  target,
+		Payload: payload,
+	}
+
+	s.publishersMutex.Lock()
+	defer s.publishersMutex.Unlock()
+
+	queue, exists := s.publishers[roomID]
+	if !exists {
+		queue = make(chan bus.Message, publishQueue)
+		s.publishers[roomID] = queue
+		go s.runPublisher(roomID, queue)
+	}
+
+	select {
+	case queue <- msg:
+	default:
+		s.logger.Error("Bus queue full, dropping room message",
+			zap.String("roomID", roomID),
+			zap.String("channel", channel))
+	}
+}
+
+// runPublisher sends a room's queued messages to the bus until none came for
+// publisherIdle
+func (s *Server) runPublisher(roomID string, queue chan bus.Message) {
+	idle := time.NewTimer(publisherIdle)
+	defer idle.Stop()
+
+	for {
+		select {
+		case msg := <-queue:
+			ctx, cancel := context.WithTimeout(context.Background(), busTimeout)
+			if err := s.bus.Publish(ctx, msg); err != nil {
+				s.logger.Error("Failed to publish room message",
+					zap.String("roomID", roomID),
+					zap.String("channel", msg.Channel),
+					zap.Error(err))
+			}
+			cancel()
+			idle.Reset(publisherIdle)
+
+		case <-idle.C:
+			// publish queues under the same lock, so nothing is left behind
+			s.publishersMutex.Lock()
+			if len(queue) > 0 {
+				s.publishersMutex.Unlock()
+				idle.Reset(publisherIdle)
+				continue
+			}
+			delete(s.publishers, roomID)
+			s.publishersMutex.Unlock()
+			return
+		}
+	}
+}
+
+// handleBusMessage delivers another instance's message to the clients of the
+// room connected here. Rooms nobody joined on this instance are skipped.
+func (s *Server) handleBusMessage(msg bus.Message) {
+	if msg.Origin == s.config.Cluster.InstanceID {
+		return
+	}
+	if msg.Target != "" && msg.Target != s.config.Cluster.InstanceID {
+		return
+	}
+
+	// Roster streams follow rooms nobody joined here
+	if msg.Channel == busPresence {
+		var entries []RosterEntry
+		if err := json.Unmarshal(msg.Payload, &entries); err != nil {
+			return
+		}
+		s.applyRemotePresence(msg.Room, msg.Origin, entries)
+		return
+	}
+
+	// Joins here check the removed list core keeps until the room opens
+	if msg.Channel == busControls {
+		s.coreClient.InvalidateRoom(msg.Room)
+	}
+
+	s.roomsMutex.RLock()
+	room, exists := s.rooms[msg.Room]
+	s.roomsMutex.RUnlock()
+	if !exists {
+		return
+	}
+
+	switch msg.Channel {
+	case busEditor:
+		var editorMsg EditorMessage
+		if err := json.Unmarshal(msg.Payload, &editorMsg); err == nil {
+			if err := room.applyRemoteEdit(editorMsg); err != nil {
+				s.logger.Warn("Failed to apply remote edit",
+					zap.String("roomID", msg.Room),
+					zap.String("type", editorMsg.Type),
+					zap.Error(err))
+			}
+			if editorMsg.Type == "cursor" {
+				s.sendFollowers(room, editorMsg)
+			}
+		}
+		s.deliverEditor(room, nil, msg.Payload)
+
+	case busEditorInterviewers:
+		s.deliverEditorInterviewers(room, msg.Payload)
+
+	case busChat:
+		var message ChatMessage
+		if err := json.Unmarshal(msg.Payload, &message); err != nil {
+			return
+		}
+		s.deliverChat(room, message)
+
+	case busNotes:
+		var notesMsg NotesMessage
+		if err := json.Unmarshal(msg.Payload, &notesMsg); err != nil {
+			return
+		}
+		if notesMsg.Type == "content" {
+			room.setNotes(notesMsg.Content)
+		}
+		s.deliverNotes(room, nil, msg.Payload)
+
+	case busControls:
+		var controls RoomControls
+		if err := json.Unmarshal(msg.Payload, &controls); err != nil {
+			return
+		}
+		s.changeControls(room, false, func(current *RoomControls) error {
+			*current = controls
+			return nil
+		})
+
+	case busVideo:
+		s.deliverVideo(room, nil, msg.Payload)
+
+	case busVideoInterviewers:
+		s.deliverVideoInterviewers(room, msg.Payload)
+
+	case busSyncRequest:
+		s.sendSnapshot(msg.Room, room, msg.Origin)
+		s.presenceMutex.Lock()
+		entries := localRoster(room)
+		s.presenceMutex.Unlock()
+		if len(entries) > 0 {
+			s.publishPresence(msg.Room, entries)
+		}
+
+	case busSync:
+		var snapshot RoomSnapshot
+		if err := json.Unmarshal(msg.Payload, &snapshot); err != nil {
+			return
+		}
+		s.applySnapshot(room, snapshot)
+
+	case busRoomEvent:
+		var event client.RoomEvent
+		if err := json.Unmarshal(msg.Payload, &event); err != nil {
+			return
+		}
+		s.applyRoomEvent(event)
+	}
+}
+
+// applyRemoteEdit replays a workspace change made on another instance
+func (r *Room) applyRemoteEdit(msg EditorMessage) error {
+	var err error
+	switch msg.Type {
+	case "code", "sync":
+		path := msg.Path
+		if path == "" {
+			path = DefaultFilePath
+		}
+		_, err = r.workspace.Update(path, msg.Language, msg.Code)
+	case "file_create":
+		_, err = r.workspace.Create(msg.Path, msg.Language, msg.Code)
+	case "file_rename":
+		err = r.workspace.Rename(msg.Path, msg.NewPath)
+	case "file_delete":
+		err = r.workspace.Delete(msg.Path)
+	case "cursor":
+		r.setCursor(msg)
+	case "cursor_remove":
+		r.removeCursor(msg.ClientID)
+	}
+	return err
+}
+
+func (s *Server) sendSnapshot(roomID string, room *Room, target string) {
+	room.clientsMutex.RLock()
+	snapshot := RoomSnapshot{
+		Files:   room.workspace.Files(),
+		Notes:   room.currentNotes,
+		Chat:    append([]ChatMessage(nil), room.chatMessages...),
+		Cursors: room.cursorsLocked(),
+	}
+	if !room.controls.isZero() {
+		controls := room.controls.clone()
+		snapshot.Controls = &controls
+	}
+	room.clientsMutex.RUnlock()
+
+	if len(snapshot.Files) == 0 && snapshot.Notes == "" && len(snapshot.Chat) == 0 && len(snapshot.Cursors) == 0 && snapshot.Controls == nil {
+		return
+	}
+
+	payload, err := json.Marshal(snapshot)
+	if err != nil {
+		s.logger.Error("Failed to marshal room snapshot", zap.Error(err))
+		return
+	}
+	s.publish(roomID, target, busSync, payload)
+}
+
+// applySnapshot fills in whatever the local room does not have yet and
+// resends it to the clients already connected here
+func (s *Server) applySnapshot(room *Room, snapshot RoomSnapshot) {
+	if len(snapshot.Files) > 0 && room.workspace.IsEmpty() {
+		for _, file := range snapshot.Files {
+			room.workspace.Update(file.Path, file.Language, file.Content)
+		}
+
+		room.clientsMutex.RLock()
+		for conn := range room.editorClients {
+			if err := s.sendWorkspaceSync(conn, room); err != nil {
+				s.logger.Error("Failed to send sync message", zap.Error(err))
+			}
+		}
+		room.clientsMutex.RUnlock()
+	}
+
+	if snapshot.Controls != nil {
+		s.changeControls(room, false, func(current *RoomControls) error {
+			// The other instances' removed list is at least as recent as
+			// the one a new room took from core
+			if current.onlyRemoved() {
+				*current = snapshot.Controls.clone()
+			}
+			return nil
+		})
+	}
+
+	room.clientsMutex.Lock()
+	defer room.clientsMutex.Unlock()
+
+	if snapshot.Notes != "" && room.currentNotes == "" {
+		room.currentNotes = snapshot.Notes
+		for conn := range room.notesClients {
+			if err := conn.WriteJSON(NotesMessage{Type: "sync", Content: snapshot.Notes}); err != nil {
+				s.logger.Error("Failed to send notes sync message", zap.Error(err))
+			}
+		}
+	}
+
+	if len(snapshot.Chat) > 0 && len(room.chatMessages) == 0 {
+		room.chatMessages = snapshot.Chat
+		for conn := range room.chatClients {
+			if err := conn.WriteJSON(ChatEvent{Type: "history", Messages: snapshot.Chat}); err != nil {
+				s.logger.Error("Failed to send chat history", zap.Error(err))
+			}
+		}
+	}
+
+	for _, cursor := range snapshot.Cursors {
+		if _, known := room.cursors[cursor.ClientID]; known {
+			continue
+		}
+		room.cursors[cursor.ClientID] = cursor
+		for conn := range room.editorClients {
+			if err := conn.WriteJSON(cursor); err != nil {
+				s.logger.Error("Failed to send cursor", zap.Error(err))
+			}
+		}
+	}
+}
+
+// mediaHost identifies this instance in media claims. With a shared bus it
+// is the address clients are redirected to.
+func (s *Server) mediaHost() string {
+	if s.config.Cluster.AdvertiseURL != "" {
+		return s.config.Cluster.AdvertiseURL
+	}
+	return s.config.Cluster.InstanceID
+}
+
+// claimMedia makes this instance the room's SFU unless another instance
+// already is, and returns the host that is
+func (s *Server) claimMedia(roomID string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), busTimeout)
+	defer cancel()
+	return s.bus.Claim(ctx, roomID, s.mediaHost(), s.config.Cluster.OwnershipTTL)
+}
+
+func (s *Server) releaseMedia(roomID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), busTimeout)
+	defer cancel()
+
+	if err := s.bus.Release(ctx, roomID, s.mediaHost()); err != nil {
+		s.logger.Error("Failed to release room media",
+			zap.String("roomID", roomID),
+			zap.Error(err))
+	}
+}
+
+// redirectMedia sends a video client to the instance hosting the room's SFU
+func (s *Server) redirectMedia(c Conn, roomID, host string) {
+	c.WriteJSON(MediaRedirectEvent{Type: "media_redirect", URL: host + "/videochat/" + roomID})
+	c.WriteMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, "Room media is hosted on another instance"))
+}
+
+// renewMediaClaims keeps the claims of rooms with a video call here alive
+func (s *Server) renewMediaClaims() {
+	ticker := time.NewTicker(s.config.Cluster.OwnershipTTL / 3)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.roomsMutex.RLock()
+		roomIDs := make([]string, 0, len(s.rooms))
+		for roomID, room := range s.rooms {
+			if len(room.webrtcClients) > 0 {
+				roomIDs = append(roomIDs, roomID)
+			}
+		}
+		s.roomsMutex.RUnlock()
+
+		for _, roomID := range roomIDs {
+			host, err := s.claimMedia(roomID)
+			if err != nil {
+				s.logger.Error("Failed to renew room media claim",
+					zap.String("roomID", roomID),
+					zap.Error(err))
+				continue
+			}
+			if host != s.mediaHost() {
+				s.logger.Warn("Room media claimed by another instance",
+					zap.String("roomID", roomID),
+					zap.String("host", host))
+			}
+		}
+	}
+}
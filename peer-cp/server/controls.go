@@ -0,0 +1,299 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+
+	"github.com/elskow/codepair/peer-cp/client"
+	"go.uber.org/zap"
+)
+
+var (
+	errNotInterviewer = errors.New("only interviewers can change the room controls")
+	errEditorLocked   = errors.New("the editor is locked")
+	errReadOnly       = errors.New("the editor is read-only for you")
+	errPaused         = errors.New("the session is paused")
+	errMuted          = errors.New("an interviewer muted you")
+	errRemoved        = errors.New("an interviewer removed you from the room")
+)
+
+// RoomControls are the restrictions interviewers put on a room. The server
+// enforces them, clients only show them.
+type RoomControls struct {
+	EditorLocked bool     `json:"editorLocked"` // Nobody can change the workspace
+	ReadOnly     bool     `json:"readOnly"`     // The candidate cannot change the workspace
+	Paused       bool     `json:"paused"`       // The candidate cannot change the workspace or run code
+	Muted        []string `json:"muted"`        // Roster IDs whose microphone and chat are silenced
+	Removed      []string `json:"removed"`      // Roster IDs kept out while the room is open
+}
+
+// clone copies the lists, which are never nil so clients always get arrays
+func (c RoomControls) clone() RoomControls {
+	c.Muted = append([]string{}, c.Muted...)
+	c.Removed = append([]string{}, c.Removed...)
+	return c
+}
+
+func (c RoomControls) isZero() bool {
+	return c.onlyRemoved() && len(c.Removed) == 0
+}
+
+// onlyRemoved reports whether the controls hold nothing but the removed list,
+// which a new room takes from core
+func (c RoomControls) onlyRemoved() bool {
+	return !c.EditorLocked && !c.ReadOnly && !c.Paused && len(c.Muted) == 0
+}
+
+// rosterID is the roster ID of a connection's user, see participant.identity
+func rosterID(user *client.User) string {
+	if user == nil {
+		return roleCandidate
+	}
+	return user.ID
+}
+
+func (r *Room) isMuted(id string) bool {
+	r.clientsMutex.RLock()
+	defer r.clientsMutex.RUnlock()
+	return slices.Contains(r.controls.Muted, id)
+}
+
+// removedFrom reports whether an interviewer removed the user from the room.
+// A room open here has the latest controls, otherwise the list core keeps
+// is used.
+func (s *Server) removedFrom(roomID string, validRoom *client.Room, user *client.User) bool {
+	s.roomsMutex.RLock()
+	room, exists := s.rooms[roomID]
+	s.roomsMutex.RUnlock()
+	if !exists {
+		return slices.Contains(validRoom.Removed, rosterID(user))
+	}
+
+	room.clientsMutex.RLock()
+	defer room.clientsMutex.RUnlock()
+	return slices.Contains(room.controls.Removed, rosterID(user))
+}
+
+// authorizeEditorMessage enforces the room controls on a message from c.
+// Interviewers are only held back by a locked editor.
+func (s *Server) authorizeEditorMessage(c Conn, room *Room, msg *EditorMessage) error {
+	room.clientsMutex.RLock()
+	editorClient, ok := room.editorClients[c]
+	controls := room.controls
+	room.clientsMutex.RUnlock()
+	interviewer := ok && editorClient.user != nil
+
+	switch msg.Type {
+	case "code", "file_create", "file_rename", "file_delete", "load_question":
+		switch {
+		case controls.EditorLocked:
+			return errEditorLocked
+		case interviewer:
+			return nil
+		case controls.Paused:
+			return errPaused
+		case controls.ReadOnly:
+			return errReadOnly
+		}
+
+		// Only interviewers change the language of an existing file
+		if msg.Type == "code" && msg.Language != "" {
+			path := msg.Path
+			if path == "" {
+				path = DefaultFilePath
+			}
+			if path, err := cleanFilePath(path); err == nil {
+				if _, exists := room.workspace.Get(path); exists {
+					msg.Language = ""
+				}
+			}
+		}
+
+	case "run", "run_tests":
+		if !interviewer && controls.Paused {
+			return errPaused
+		}
+	}
+	return nil
+}
+
+// handleControl applies a control message. Only interviewers send them.
+func (s *Server) handleControl(c Conn, room *Room, msg EditorMessage) error {
+	room.clientsMutex.RLock()
+	editorClient, ok := room.editorClients[c]
+	room.clientsMutex.RUnlock()
+	if !ok || editorClient.user == nil {
+		return errNotInterviewer
+	}
+
+	if msg.Type == "set_language" {
+		return s.setLanguage(c, room, msg)
+	}
+
+	target := msg.ClientID
+	err := s.changeControls(room, true, func(controls *RoomControls) error {
+		switch msg.Type {
+		case "lock_editor", "unlock_editor":
+			controls.EditorLocked = msg.Type == "lock_editor"
+		case "read_only", "read_write":
+			controls.ReadOnly = msg.Type == "read_only"
+		case "pause", "resume":
+			controls.Paused = msg.Type == "pause"
+		case "mute", "remove":
+			if target == "" {
+				return errors.New(msg.Type + " needs a clientId")
+			}
+			if target == editorClient.id {
+				return errors.New("you cannot " + msg.Type + " yourself")
+			}
+			if msg.Type == "mute" && !slices.Contains(controls.Muted, target) {
+				controls.Muted = append(controls.Muted, target)
+			}
+			if msg.Type == "remove" && !slices.Contains(controls.Removed, target) {
+				controls.Removed = append(controls.Removed, target)
+			}
+		case "unmute":
+			controls.Muted = slices.DeleteFunc(controls.Muted, func(id string) bool { return id == target })
+		case "readmit":
+			controls.Removed = slices.DeleteFunc(controls.Removed, func(id string) bool { return id == target })
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.logger.Info("Room controls changed",
+		zap.String("roomID", room.id),
+		zap.String("control", msg.Type),
+		zap.String("target", target),
+		zap.String("by", editorClient.name))
+
+	if msg.Type == "remove" || msg.Type == "readmit" {
+		s.saveRemoved(room, editorClient.authToken)
+	}
+	return nil
+}
+
+// saveRemoved stores the room's removed list in core, so removed participants
+// stay out after the room closes here and on instances without it open
+func (s *Server) saveRemoved(room *Room, authToken string) {
+	room.removedMutex.Lock()
+	defer room.removedMutex.Unlock()
+
+	room.clientsMutex.RLock()
+	removed := room.controls.clone().Removed
+	room.clientsMutex.RUnlock()
+
+	if err := s.coreClient.SaveRemovedParticipants(room.id, authToken, removed); err != nil {
+		s.logger.Error("Failed to save removed participants",
+			zap.String("roomID", room.id),
+			zap.Error(err))
+	}
+}
+
+// setLanguage changes the language of a file for everyone
+func (s *Server) setLanguage(c Conn, room *Room, msg EditorMessage) error {
+	if msg.Language == "" {
+		return errors.New("set_language needs a language")
+	}
+	path := msg.Path
+	if path == "" {
+		path = DefaultFilePath
+	}
+
+	var file WorkspaceFile
+	if err := s.editWorkspace(room, c, func() ([]client.EditOp, error) {
+		var previous WorkspaceFile
+		var err error
+		file, previous, err = room.workspace.SetLanguage(path, msg.Language)
+		return replaceOps(file, previous), err
+	}); err != nil {
+		return err
+	}
+
+	s.broadcastEditor(room, nil, fileSyncMessage(file))
+	return nil
+}
+
+// changeControls applies change to the room's controls, enforces the result
+// on the clients here and sends it to the editor clients. A local change is
+// published to the other instances.
+func (s *Server) changeControls(room *Room, local bool, change func(*RoomControls) error) error {
+	room.controlsMutex.Lock()
+	defer room.controlsMutex.Unlock()
+
+	room.clientsMutex.Lock()
+	before := room.controls
+	after := before.clone()
+	if err := change(&after); err != nil {
+		room.clientsMutex.Unlock()
+		return err
+	}
+	room.controls = after
+	room.clientsMutex.Unlock()
+
+	s.enforceControls(room, before, after)
+
+	message, err := json.Marshal(EditorMessage{Type: "controls", Controls: &after})
+	if err != nil {
+		return err
+	}
+	s.deliverEditor(room, nil, message)
+
+	if local {
+		payload, err := json.Marshal(after)
+		if err != nil {
+			return err
+		}
+		s.publish(room.id, "", busControls, payload)
+	}
+	return nil
+}
+
+// enforceControls disconnects the participants that were just removed and
+// silences or restores the microphones of the ones whose mute changed
+func (s *Server) enforceControls(room *Room, before, after RoomControls) {
+	for _, id := range after.Removed {
+		if slices.Contains(before.Removed, id) {
+			continue
+		}
+		s.disconnectClients(room,
+			RoomEndedEvent{Type: "removed", Reason: "An interviewer removed you from the interview"},
+			closeRemoved, "Removed",
+			func(_ string, user *client.User) bool {
+				return rosterID(user) == id
+			})
+	}
+
+	s.roomsMutex.RLock()
+	defer s.roomsMutex.RUnlock()
+
+	for _, wc := range room.webrtcClients {
+		muted := slices.Contains(after.Muted, rosterID(wc.user))
+		if wc.muted.Swap(muted) == muted {
+			continue
+		}
+		event := "unmuted"
+		if muted {
+			event = "muted"
+		}
+		if err := wc.sendJSON(map[string]interface{}{"type": event}); err != nil {
+			s.logger.Error("Failed to send mute state", zap.Error(err))
+		}
+	}
+}
+
+// sendControls tells a client that just joined the editor what interviewers
+// restricted
+func (s *Server) sendControls(c Conn, room *Room) error {
+	room.clientsMutex.RLock()
+	controls := room.controls.clone()
+	room.clientsMutex.RUnlock()
+
+	if controls.isZero() {
+		return nil
+	}
+	return c.WriteJSON(EditorMessage{Type: "controls", Controls: &controls})
+}
@@ -0,0 +1,490 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/elskow/codepair/peer-cp/bus"
+	"github.com/elskow/codepair/peer-cp/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeConn records what the server writes to a client
+type fakeConn struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (f *fakeConn) WriteMessage(messageType int, data []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.messages = append(f.messages, string(data))
+	return nil
+}
+
+func (f *fakeConn) WriteJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return f.WriteMessage(0, data)
+}
+
+func (f *fakeConn) Close() error { return nil }
+
+func (f *fakeConn) writeText(_ messageHeader, data []byte) error {
+	return f.WriteMessage(0, data)
+}
+
+func (f *fakeConn) written() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.messages...)
+}
+
+// newControlsRoom opens a room with an interviewer and a candidate in the
+// editor
+func newControlsRoom(s *Server, controls RoomControls) (room *Room, interviewer, candidate *fakeConn) {
+	room = newRoom("r1")
+	room.controls = controls
+	interviewer, candidate = &fakeConn{}, &fakeConn{}
+	room.editorClients[interviewer] = &EditorClient{conn: interviewer, authToken: "a", user: &client.User{ID: "u1"}, id: "u1"}
+	room.editorClients[candidate] = &EditorClient{conn: candidate, id: roleCandidate}
+
+	s.rooms = map[string]*Room{room.id: room}
+	s.bus = bus.NewMemory()
+	return room, interviewer, candidate
+}
+
+func TestAuthorizeEditorMessage(t *testing.T) {
+	tests := []struct {
+		name         string
+		controls     RoomControls
+		interviewer  bool
+		unregistered bool // The connection left the editor meanwhile
+		msg          EditorMessage
+		want         error
+		language     string // Language left on the message
+	}{
+		{
+			name: "candidate edits an open editor",
+			msg:  EditorMessage{Type: "code", Path: "main.py", Code: "x"},
+		},
+		{
+			name:     "locked editor holds back the candidate",
+			controls: RoomControls{EditorLocked: true},
+			msg:      EditorMessage{Type: "code", Path: "main.py", Code: "x"},
+			want:     errEditorLocked,
+		},
+		{
+			name:        "locked editor holds back interviewers too",
+			controls:    RoomControls{EditorLocked: true},
+			interviewer: true,
+			msg:         EditorMessage{Type: "file_create", Path: "b.py"},
+			want:        errEditorLocked,
+		},
+		{
+			name:     "read-only editor holds back the candidate",
+			controls: RoomControls{ReadOnly: true},
+			msg:      EditorMessage{Type: "file_rename", Path: "main.py", NewPath: "a.py"},
+			want:     errReadOnly,
+		},
+		{
+			name:        "read-only editor lets interviewers edit",
+			controls:    RoomControls{ReadOnly: true},
+			interviewer: true,
+			msg:         EditorMessage{Type: "code", Path: "main.py", Code: "x"},
+		},
+		{
+			name:         "connection no longer in the editor counts as the candidate",
+			controls:     RoomControls{ReadOnly: true},
+			interviewer:  true,
+			unregistered: true,
+			msg:          EditorMessage{Type: "code", Path: "main.py", Code: "x"},
+			want:         errReadOnly,
+		},
+		{
+			name:     "pause holds back the candidate's edits",
+			controls: RoomControls{Paused: true},
+			msg:      EditorMessage{Type: "file_delete", Path: "main.py"},
+			want:     errPaused,
+		},
+		{
+			name:     "pause holds back loading a question",
+			controls: RoomControls{Paused: true},
+			msg:      EditorMessage{Type: "load_question", QuestionID: "q1"},
+			want:     errPaused,
+		},
+		{
+			name:        "pause lets interviewers load a question",
+			controls:    RoomControls{Paused: true},
+			interviewer: true,
+			msg:         EditorMessage{Type: "load_question", QuestionID: "q1"},
+		},
+		{
+			name:     "pause holds back the candidate's runs",
+			controls: RoomControls{Paused: true},
+			msg:      EditorMessage{Type: "run", Path: "main.py"},
+			want:     errPaused,
+		},
+		{
+			name:        "pause lets interviewers run",
+			controls:    RoomControls{Paused: true},
+			interviewer: true,
+			msg:         EditorMessage{Type: "run_tests", Path: "main.py"},
+		},
+		{
+			name:     "read-only editor lets the candidate run",
+			controls: RoomControls{ReadOnly: true},
+			msg:      EditorMessage{Type: "run", Path: "main.py"},
+		},
+		{
+			name:     "locked editor lets the candidate run",
+			controls: RoomControls{EditorLocked: true},
+			msg:      EditorMessage{Type: "run_tests", Path: "main.py"},
+		},
+		{
+			name: "candidate cannot change the language of a file",
+			msg:  EditorMessage{Type: "code", Path: "main.py", Language: "go", Code: "x"},
+		},
+		{
+			name:     "candidate picks the language of a new file",
+			msg:      EditorMessage{Type: "code", Path: "new.go", Language: "go", Code: "x"},
+			language: "go",
+		},
+		{
+			name:        "interviewer changes the language of a file",
+			interviewer: true,
+			msg:         EditorMessage{Type: "code", Path: "main.py", Language: "go", Code: "x"},
+			language:    "go",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer()
+			room, interviewer, candidate := newControlsRoom(s, tt.controls)
+			_, err := room.workspace.Update("main.py", "python", "print(1)")
+			require.NoError(t, err)
+
+			var conn Conn = candidate
+			if tt.interviewer {
+				conn = interviewer
+			}
+			if tt.unregistered {
+				delete(room.editorClients, conn)
+			}
+
+			msg := tt.msg
+			err = s.authorizeEditorMessage(conn, room, &msg)
+			if tt.want != nil {
+				assert.ErrorIs(t, err, tt.want)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.language, msg.Language)
+		})
+	}
+}
+
+func TestHandleControl(t *testing.T) {
+	tests := []struct {
+		name        string
+		controls    RoomControls
+		interviewer bool
+		msg         EditorMessage
+		want        error
+		fails       bool // Rejected for another reason
+		after       RoomControls
+		saved       []string // Removed list saved to core, nil when nothing is saved
+	}{
+		{
+			name:     "candidate cannot unlock the editor",
+			controls: RoomControls{EditorLocked: true},
+			msg:      EditorMessage{Type: "unlock_editor"},
+			want:     errNotInterviewer,
+			after:    RoomControls{EditorLocked: true},
+		},
+		{
+			name:     "candidate cannot lift read-only",
+			controls: RoomControls{ReadOnly: true},
+			msg:      EditorMessage{Type: "read_write"},
+			want:     errNotInterviewer,
+			after:    RoomControls{ReadOnly: true},
+		},
+		{
+			name:     "candidate cannot resume",
+			controls: RoomControls{Paused: true},
+			msg:      EditorMessage{Type: "resume"},
+			want:     errNotInterviewer,
+			after:    RoomControls{Paused: true},
+		},
+		{
+			name:  "candidate cannot remove an interviewer",
+			msg:   EditorMessage{Type: "remove", ClientID: "u1"},
+			want:  errNotInterviewer,
+			after: RoomControls{},
+		},
+		{
+			name:  "candidate cannot change the language",
+			msg:   EditorMessage{Type: "set_language", Path: "main.py", Language: "go"},
+			want:  errNotInterviewer,
+			after: RoomControls{},
+		},
+		{
+			name:        "interviewer locks the editor",
+			interviewer: true,
+			msg:         EditorMessage{Type: "lock_editor"},
+			after:       RoomControls{EditorLocked: true},
+		},
+		{
+			name:        "interviewer makes the editor read-only",
+			interviewer: true,
+			msg:         EditorMessage{Type: "read_only"},
+			after:       RoomControls{ReadOnly: true},
+		},
+		{
+			name:        "interviewer pauses",
+			interviewer: true,
+			msg:         EditorMessage{Type: "pause"},
+			after:       RoomControls{Paused: true},
+		},
+		{
+			name:        "interviewer mutes the candidate",
+			interviewer: true,
+			msg:         EditorMessage{Type: "mute", ClientID: roleCandidate},
+			after:       RoomControls{Muted: []string{roleCandidate}},
+		},
+		{
+			name:        "mute needs a target",
+			interviewer: true,
+			msg:         EditorMessage{Type: "mute"},
+			fails:       true,
+			after:       RoomControls{},
+		},
+		{
+			name:        "interviewer cannot remove themselves",
+			interviewer: true,
+			msg:         EditorMessage{Type: "remove", ClientID: "u1"},
+			fails:       true,
+			after:       RoomControls{},
+		},
+		{
+			name:        "removal is saved to core",
+			interviewer: true,
+			msg:         EditorMessage{Type: "remove", ClientID: roleCandidate},
+			after:       RoomControls{Removed: []string{roleCandidate}},
+			saved:       []string{roleCandidate},
+		},
+		{
+			name:        "readmission is saved to core",
+			controls:    RoomControls{Removed: []string{roleCandidate, "u2"}},
+			interviewer: true,
+			msg:         EditorMessage{Type: "readmit", ClientID: roleCandidate},
+			after:       RoomControls{Removed: []string{"u2"}},
+			saved:       []string{"u2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				mu    sync.Mutex
+				saved [][]string
+			)
+			core := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var body struct {
+					Removed []string `json:"removed"`
+				}
+				assert.Equal(t, "/internal/rooms/r1/removed", r.URL.Path)
+				assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+				mu.Lock()
+				saved = append(saved, body.Removed)
+				mu.Unlock()
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			defer core.Close()
+
+			s := newTestServer()
+			s.coreClient = client.NewCoreClient(core.URL, client.Options{ServiceSecret: "secret"})
+			room, interviewer, candidate := newControlsRoom(s, tt.controls.clone())
+
+			var conn Conn = candidate
+			if tt.interviewer {
+				conn = interviewer
+			}
+
+			err := s.handleControl(conn, room, tt.msg)
+			switch {
+			case tt.want != nil:
+				assert.ErrorIs(t, err, tt.want)
+			case tt.fails:
+				assert.Error(t, err)
+			default:
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.after.clone(), room.controls.clone())
+
+			mu.Lock()
+			defer mu.Unlock()
+			if tt.saved == nil {
+				assert.Empty(t, saved)
+				return
+			}
+			assert.Equal(t, [][]string{tt.saved}, saved)
+		})
+	}
+}
+
+func TestHandleEditorMessageTypes(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  EditorMessage
+	}{
+		{name: "sync", msg: EditorMessage{Type: "sync", Path: "main.py", Code: "x"}},
+		{name: "workspace", msg: EditorMessage{Type: "workspace", Files: []WorkspaceFile{{Path: "a.py"}}}},
+		{name: "controls", msg: EditorMessage{Type: "controls", Controls: &RoomControls{}}},
+		{name: "question loaded", msg: EditorMessage{Type: "question_loaded", QuestionID: "q1"}},
+		{name: "error", msg: EditorMessage{Type: "error", Error: "boom"}},
+		{name: "no type", msg: EditorMessage{Code: "x"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer()
+			room, interviewer, candidate := newControlsRoom(s, RoomControls{EditorLocked: true})
+
+			s.handleEditorMessage(context.Background(), candidate, room.id, tt.msg)
+
+			assert.Empty(t, interviewer.written(), "nothing is relayed")
+			assert.Equal(t, RoomControls{EditorLocked: true}, room.controls)
+
+			written := candidate.written()
+			require.Len(t, written, 1)
+			var reply EditorMessage
+			require.NoError(t, json.Unmarshal([]byte(written[0]), &reply))
+			assert.Equal(t, "error", reply.Type)
+		})
+	}
+}
+
+func TestRemoveDisconnects(t *testing.T) {
+	tests := []struct {
+		name string
+		join func(room *Room, conn Conn, user *client.User)
+	}{
+		{
+			name: "editor",
+			join: func(room *Room, conn Conn, user *client.User) {
+				room.editorClients[conn] = &EditorClient{conn: conn, user: user, id: rosterID(user)}
+			},
+		},
+		{
+			name: "chat",
+			join: func(room *Room, conn Conn, user *client.User) {
+				room.chatClients[conn] = &ChatClient{conn: conn, user: user, id: rosterID(user)}
+			},
+		},
+		{
+			name: "notes",
+			join: func(room *Room, conn Conn, user *client.User) {
+				room.notesClients[conn] = &NotesClient{conn: conn, user: user}
+			},
+		},
+		{
+			name: "lobby",
+			join: func(room *Room, conn Conn, user *client.User) {
+				room.lobbyClients[conn] = &WebRTCClient{conn: conn, user: user}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			core := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			defer core.Close()
+
+			s := newTestServer()
+			s.coreClient = client.NewCoreClient(core.URL, client.Options{ServiceSecret: "secret"})
+			room, interviewer, _ := newControlsRoom(s, RoomControls{})
+
+			removed, kept := &fakeConn{}, &fakeConn{}
+			tt.join(room, removed, nil)
+			tt.join(room, kept, &client.User{ID: "u2"})
+
+			require.NoError(t, s.handleControl(interviewer, room, EditorMessage{Type: "remove", ClientID: roleCandidate}))
+
+			// Editor clients get the new controls as well
+			written := removed.written()
+			require.GreaterOrEqual(t, len(written), 2, "the removed event and the close frame")
+			assert.Contains(t, written[0], `"type":"removed"`)
+			for _, message := range kept.written() {
+				assert.NotContains(t, message, `"type":"removed"`)
+			}
+		})
+	}
+}
+
+func TestHandleNotesMessage(t *testing.T) {
+	tests := []struct {
+		name        string
+		interviewer bool
+		msg         NotesMessage
+		notes       string // Notes left in the room
+		rejected    bool   // The sender gets an error back
+	}{
+		{
+			name:        "interviewer writes",
+			interviewer: true,
+			msg:         NotesMessage{Type: "content", Content: "strong"},
+			notes:       "strong",
+		},
+		{
+			name:     "candidate writes",
+			msg:      NotesMessage{Type: "content", Content: "strong"},
+			rejected: true,
+		},
+		{
+			name:        "unknown type",
+			interviewer: true,
+			msg:         NotesMessage{Type: "sync", Content: "strong"},
+			rejected:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer()
+			room, _, _ := newControlsRoom(s, RoomControls{})
+			sender, reader := &fakeConn{}, &fakeConn{}
+			room.notesClients[sender] = &NotesClient{conn: sender}
+			if tt.interviewer {
+				room.notesClients[sender].user = &client.User{ID: "u1"}
+			}
+			room.notesClients[reader] = &NotesClient{conn: reader, user: &client.User{ID: "u2"}}
+
+			s.handleNotesMessage(context.Background(), sender, room.id, tt.msg)
+
+			assert.Equal(t, tt.notes, room.currentNotes)
+			if !tt.rejected {
+				assert.Empty(t, sender.written())
+				assert.Len(t, reader.written(), 1)
+				return
+			}
+			assert.Empty(t, reader.written())
+			written := sender.written()
+			require.Len(t, written, 1)
+			var reply NotesMessage
+			require.NoError(t, json.Unmarshal([]byte(written[0]), &reply))
+			assert.Equal(t, "error", reply.Type)
+			assert.NotEmpty(t, reply.Error)
+		})
+	}
+}
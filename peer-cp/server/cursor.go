@@ -0,0 +1,146 @@
+package server
+
+import (
+	"errors"
+	"hash/fnv"
+
+	"go.uber.org/zap"
+)
+
+// cursorColors are handed out by participant so everyone sees the same color
+// for the same person
+var cursorColors = []string{
+	"#e6194b", "#3cb44b", "#4363d8", "#f58231",
+	"#911eb4", "#42d4f4", "#f032e6", "#9a6324",
+}
+
+var errFollowNotAllowed = errors.New("only interviewers can follow a participant")
+
+// Selection is a range in a file, from where it was started to where the
+// cursor is now
+type Selection struct {
+	Anchor Cursor `json:"anchor"`
+	Head   Cursor `json:"head"`
+}
+
+func cursorColor(id string) string {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return cursorColors[h.Sum32()%uint32(len(cursorColors))]
+}
+
+// stampCursor fills in who a cursor belongs to. What the client claims is
+// replaced, so nobody can move someone else's cursor.
+func (c *EditorClient) stampCursor(msg *EditorMessage) {
+	msg.ClientID = c.id
+	msg.Name = c.name
+	msg.Color = cursorColor(c.id)
+	if msg.Path == "" {
+		msg.Path = DefaultFilePath
+	}
+}
+
+// setCursor remembers a participant's latest cursor for clients that join later
+func (r *Room) setCursor(msg EditorMessage) {
+	r.clientsMutex.Lock()
+	defer r.clientsMutex.Unlock()
+
+	r.cursors[msg.ClientID] = msg
+}
+
+// removeCursor forgets a participant's cursor and stops everyone following it
+func (r *Room) removeCursor(id string) {
+	r.clientsMutex.Lock()
+	defer r.clientsMutex.Unlock()
+
+	delete(r.cursors, id)
+	for _, client := range r.editorClients {
+		if client.following == id {
+			client.following = ""
+		}
+	}
+}
+
+// cursorsLocked lists the known cursors. The caller holds clientsMutex.
+func (r *Room) cursorsLocked() []EditorMessage {
+	cursors := make([]EditorMessage, 0, len(r.cursors))
+	for _, cursor := range r.cursors {
+		cursors = append(cursors, cursor)
+	}
+	return cursors
+}
+
+// sendCursors shows a client that just joined where everyone else is
+func (s *Server) sendCursors(c Conn, room *Room) error {
+	room.clientsMutex.RLock()
+	cursors := room.cursorsLocked()
+	room.clientsMutex.RUnlock()
+
+	for _, cursor := range cursors {
+		if err := c.WriteJSON(cursor); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// follow makes an interviewer's view track a participant's cursor. The
+// interviewer is sent the participant's cursor right away and again as a
+// follow message on every move. An empty target stops following.
+func (s *Server) follow(c Conn, room *Room, target string) error {
+	room.clientsMutex.Lock()
+	client, ok := room.editorClients[c]
+	if !ok || client.user == nil {
+		room.clientsMutex.Unlock()
+		return errFollowNotAllowed
+	}
+	client.following = target
+	cursor, known := room.cursors[target]
+	room.clientsMutex.Unlock()
+
+	if target == "" {
+		return c.WriteJSON(EditorMessage{Type: "unfollow"})
+	}
+	if !known {
+		cursor = EditorMessage{ClientID: target}
+	}
+	cursor.Type = "follow"
+	return c.WriteJSON(cursor)
+}
+
+// sendFollowers moves the view of everyone following the cursor's owner
+func (s *Server) sendFollowers(room *Room, cursor EditorMessage) {
+	cursor.Type = "follow"
+
+	room.clientsMutex.RLock()
+	defer room.clientsMutex.RUnlock()
+
+	for conn, client := range room.editorClients {
+		if client.following != cursor.ClientID {
+			continue
+		}
+		if err := conn.WriteJSON(cursor); err != nil {
+			s.logger.Error("Failed to send followed cursor", zap.Error(err))
+		}
+	}
+}
+
+// leaveCursor removes the cursor of a participant whose last editor client
+// here has left
+func (s *Server) leaveCursor(room *Room, id string) {
+	room.clientsMutex.RLock()
+	for _, client := range room.editorClients {
+		if client.id == id {
+			room.clientsMutex.RUnlock()
+			return
+		}
+	}
+	_, known := room.cursors[id]
+	room.clientsMutex.RUnlock()
+	if !known {
+		return
+	}
+
+	room.removeCursor(id)
+	s.broadcastEditor(room, nil, EditorMessage{Type: "cursor_remove", ClientID: id})
+}
@@ -2,18 +2,33 @@ package server
 
 import (
 	"context"
-	"encoding/json"
+	"fmt"
 
-	"github.com/gofiber/websocket/v2"
+	"github.com/elskow/codepair/peer-cp/client"
 	"go.uber.org/zap"
 )
 
 type EditorMessage struct {
-	Type     string `json:"type"`
-	Code     string `json:"code,omitempty"`
-	Language string `json:"language,omitempty"`
-	Cursor   Cursor `json:"cursor,omitempty"`
-	Chat     string `json:"chat,omitempty"`
+	Type       string          `json:"type"`
+	Code       string          `json:"code,omitempty"`
+	Language   string          `json:"language,omitempty"`
+	Cursor     Cursor          `json:"cursor,omitempty"`
+	Selection  *Selection      `json:"selection,omitempty"`
+	ClientID   string          `json:"clientId,omitempty"` // Roster ID of the participant a cursor belongs to or a control targets
+	Name       string          `json:"name,omitempty"`
+	Color      string          `json:"color,omitempty"`
+	Chat       string          `json:"chat,omitempty"`
+	Path       string          `json:"path,omitempty"`
+	NewPath    string          `json:"newPath,omitempty"`
+	Files      []WorkspaceFile `json:"files,omitempty"`
+	Stdin      string          `json:"stdin,omitempty"`
+	Hidden     bool            `json:"hidden,omitempty"` // Hidden tests, or a hidden tab on a visibility signal
+	Size       int             `json:"size,omitempty"`   // Characters pasted
+	Hash       string          `json:"hash,omitempty"`   // Hash of the pasted text
+	Controls   *RoomControls   `json:"controls,omitempty"`
+	QuestionID string          `json:"questionId,omitempty"`
+	Title      string          `json:"title,omitempty"`
+	Error      string          `json:"error,omitempty"`
 }
 
 type Cursor struct {
@@ -21,7 +36,48 @@ type Cursor struct {
 	Column int `json:"column"`
 }
 
-func (s *Server) handleEditorMessage(ctx context.Context, c *websocket.Conn, roomID string, msg EditorMessage) {
+// sendWorkspaceSync sends the workspace tree followed by one sync message per file.
+// The default file goes last so single-file clients end up showing it.
+func (s *Server) sendWorkspaceSync(c Conn, room *Room) error {
+	if room.workspace.IsEmpty() {
+		return nil
+	}
+
+	if err := c.WriteJSON(EditorMessage{
+		Type:  "workspace",
+		Files: room.workspace.Tree(),
+	}); err != nil {
+		return err
+	}
+
+	var defaultFile *WorkspaceFile
+	for _, file := range room.workspace.Files() {
+		if file.Path == DefaultFilePath {
+			f := file
+			defaultFile = &f
+			continue
+		}
+		if err := c.WriteJSON(fileSyncMessage(file)); err != nil {
+			return err
+		}
+	}
+
+	if defaultFile != nil {
+		return c.WriteJSON(fileSyncMessage(*defaultFile))
+	}
+	return nil
+}
+
+func fileSyncMessage(file WorkspaceFile) EditorMessage {
+	return EditorMessage{
+		Type:     "sync",
+		Path:     file.Path,
+		Code:     file.Content,
+		Language: file.Language,
+	}
+}
+
+func (s *Server) handleEditorMessage(ctx context.Context, c Conn, roomID string, msg EditorMessage) {
 	logger := s.getLogger(ctx)
 
 	s.roomsMutex.RLock()
@@ -33,35 +89,145 @@ func (s *Server) handleEditorMessage(ctx context.Context, c *websocket.Conn, roo
 		return
 	}
 
+	if err := s.authorizeEditorMessage(c, room, &msg); err != nil {
+		s.sendEditorError(c, msg.Path, err)
+		return
+	}
+
+	var err error
 	switch msg.Type {
 	case "code":
-		room.currentCode = msg.Code
-		room.language = msg.Language
-		logger.Debug("Code updated",
-			zap.String("roomID", roomID),
-			zap.String("language", msg.Language))
+		if msg.Path == "" {
+			msg.Path = DefaultFilePath
+		}
+		var file WorkspaceFile
+		if err = s.editWorkspace(room, c, func() ([]client.EditOp, error) {
+			var previous WorkspaceFile
+			var err error
+			file, previous, err = room.workspace.Replace(msg.Path, msg.Language, msg.Code)
+			return replaceOps(file, previous), err
+		}); err == nil {
+			msg.Path = file.Path
+			msg.Language = file.Language
+			logger.Debug("Code updated",
+				zap.String("roomID", roomID),
+				zap.String("path", file.Path),
+				zap.String("language", file.Language))
+		}
+
+	case "file_create":
+		var file WorkspaceFile
+		if err = s.editWorkspace(room, c, func() ([]client.EditOp, error) {
+			var err error
+			file, err = room.workspace.Create(msg.Path, msg.Language, msg.Code)
+			return replaceOps(file, WorkspaceFile{}), err
+		}); err == nil {
+			msg.Path = file.Path
+			logger.Debug("File created",
+				zap.String("roomID", roomID),
+				zap.String("path", file.Path))
+		}
+
+	case "file_rename":
+		if err = s.editWorkspace(room, c, func() ([]client.EditOp, error) {
+			return []client.EditOp{{Kind: editOpRename, Path: msg.Path, NewPath: msg.NewPath}},
+				room.workspace.Rename(msg.Path, msg.NewPath)
+		}); err == nil {
+			logger.Debug("File renamed",
+				zap.String("roomID", roomID),
+				zap.String("path", msg.Path),
+				zap.String("newPath", msg.NewPath))
+		}
+
+	case "file_delete":
+		if err = s.editWorkspace(room, c, func() ([]client.EditOp, error) {
+			return []client.EditOp{{Kind: editOpDelete, Path: msg.Path}}, room.workspace.Delete(msg.Path)
+		}); err == nil {
+			logger.Debug("File deleted",
+				zap.String("roomID", roomID),
+				zap.String("path", msg.Path))
+		}
+
+	case "run":
+		// Run events are broadcast by startRun, the request itself is not
+		if err := s.startRun(ctx, roomID, room, msg); err != nil {
+			s.sendEditorError(c, msg.Path, err)
+		}
+		return
+
+	case "run_tests":
+		if err := s.startTests(ctx, c, roomID, room, msg); err != nil {
+			s.sendEditorError(c, msg.Path, err)
+		}
+		return
+
+	case "load_question":
+		if err := s.loadQuestion(ctx, c, roomID, room, msg); err != nil {
+			s.sendEditorError(c, "", err)
+		}
+		return
 
 	case "cursor":
+		room.clientsMutex.RLock()
+		editorClient, ok := room.editorClients[c]
+		room.clientsMutex.RUnlock()
+		if !ok {
+			return
+		}
+		editorClient.stampCursor(&msg)
+		room.setCursor(msg)
+		s.sendFollowers(room, msg)
 		logger.Debug("Cursor position updated",
 			zap.String("roomID", roomID),
+			zap.String("clientID", msg.ClientID),
 			zap.Int("line", msg.Cursor.Line),
 			zap.Int("column", msg.Cursor.Column))
+
+	case "paste", "visibility", "blur", "focus":
+		s.recordIntegrity(c, room, msg)
+		return
+
+	case "lock_editor", "unlock_editor", "read_only", "read_write", "pause", "resume",
+		"mute", "unmute", "remove", "readmit", "set_language":
+		if err := s.handleControl(c, room, msg); err != nil {
+			s.sendEditorError(c, msg.Path, err)
+		}
+		return
+
+	case "follow", "unfollow":
+		target := msg.ClientID
+		if msg.Type == "unfollow" {
+			target = ""
+		}
+		if err := s.follow(c, room, target); err != nil {
+			s.sendEditorError(c, "", err)
+		}
+		return
+
+	default:
+		// Everything else, sync and controls included, only comes from the server
+		s.sendEditorError(c, msg.Path, fmt.Errorf("unknown editor message type %q", msg.Type))
+		return
 	}
 
-	messageJSON, err := json.Marshal(msg)
 	if err != nil {
-		logger.Error("Failed to marshal message", zap.Error(err))
+		logger.Debug("Rejected editor message",
+			zap.String("roomID", roomID),
+			zap.String("type", msg.Type),
+			zap.Error(err))
+		s.sendEditorError(c, msg.Path, err)
 		return
 	}
 
-	room.clientsMutex.RLock()
-	for client := range room.editorClients {
-		if client != c {
-			err := client.WriteMessage(websocket.TextMessage, messageJSON)
-			if err != nil {
-				logger.Error("Failed to broadcast message", zap.Error(err))
-			}
-		}
+	s.broadcastEditor(room, c, msg)
+}
+
+func (s *Server) sendEditorError(c Conn, path string, err error) {
+	if writeErr := c.WriteJSON(EditorMessage{
+		Type:  "error",
+		Path:  path,
+		Error: err.Error(),
+	}); writeErr != nil {
+		s.logger.Error("Failed to send editor error", zap.Error(writeErr))
 	}
-	room.clientsMutex.RUnlock()
 }
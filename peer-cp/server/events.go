@@ -0,0 +1,191 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/elskow/codepair/peer-cp/client"
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+)
+
+// Room event types sent by core
+const (
+	roomEventUpdated            = "room_updated"
+	roomEventEnded              = "room_ended"
+	roomEventDeleted            = "room_deleted"
+	roomEventTokenRotated       = "token_rotated"
+	roomEventParticipantAdded   = "participant_added"
+	roomEventParticipantRemoved = "participant_removed"
+)
+
+// seenEventTTL is how long an event ID is remembered. Core retries a failed
+// delivery for a few seconds, and the bus relays an event once.
+const seenEventTTL = 10 * time.Minute
+
+// RoomUpdateEvent tells clients about a change to the room's settings or
+// interview panel
+type RoomUpdateEvent struct {
+	Type        string              `json:"type"`
+	Room        *client.RoomDetails `json:"room,omitempty"`
+	Participant *client.Participant `json:"participant,omitempty"`
+}
+
+// HandleRoomEvent receives a signed room event from core, applies it to the
+// room if it is hosted here and passes it on to the other instances
+func (s *Server) HandleRoomEvent(c *fiber.Ctx) error {
+	secret := s.config.Core.EventSecret
+	if secret == "" {
+		return fiber.ErrNotFound
+	}
+
+	// Fiber reuses the body buffer once the handler returns
+	body := append([]byte(nil), c.Body()...)
+	if err := client.VerifyEventSignature(secret,
+		c.Get(client.TimestampHeader), c.Get(client.SignatureHeader), body); err != nil {
+		s.logger.Warn("Rejected room event", zap.String("ip", c.IP()), zap.Error(err))
+		return fiber.ErrUnauthorized
+	}
+
+	var event client.RoomEvent
+	if err := json.Unmarshal(body, &event); err != nil || event.ID == "" || event.RoomID == "" {
+		return fiber.ErrBadRequest
+	}
+
+	if s.applyRoomEvent(event) {
+		s.publish(event.RoomID, "", busRoomEvent, body)
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// applyRoomEvent makes a room change take effect in the live session. It
+// returns false for an event that was already applied.
+func (s *Server) applyRoomEvent(event client.RoomEvent) bool {
+	if !s.markEventSeen(event.ID) {
+		return false
+	}
+
+	// Joins after the change have to be validated against core again, which
+	// also picks up a changed panel
+	s.coreClient.InvalidateRoom(event.RoomID)
+
+	s.roomsMutex.RLock()
+	room, exists := s.rooms[event.RoomID]
+	s.roomsMutex.RUnlock()
+	if !exists {
+		return true
+	}
+
+	s.logger.Info("Applying room event",
+		zap.String("roomID", event.RoomID),
+		zap.String("type", event.Type))
+
+	switch event.Type {
+	case roomEventEnded:
+		// Ending saves the room's state back to core, so it runs in the
+		// background rather than holding up other events
+		go s.endRoom(event.RoomID, room, reasonInterviewEnded)
+
+	case roomEventDeleted:
+		go s.endRoom(event.RoomID, room, reasonRoomDeleted)
+
+	case roomEventTokenRotated:
+		// The event does not carry the new token, it is fetched from core
+		go s.rotateToken(event.RoomID, room)
+
+	case roomEventParticipantRemoved:
+		if event.Participant != nil {
+			s.disconnectClients(room,
+				RoomEndedEvent{Type: "access_revoked", Reason: "You were removed from the interview panel"},
+				closeAccessRevoked, "Access revoked",
+				func(_ string, user *client.User) bool {
+					return user != nil && user.ID == event.Participant.ID
+				})
+		}
+		s.deliverRoomUpdate(room, RoomUpdateEvent{Type: event.Type, Participant: event.Participant})
+
+	case roomEventUpdated:
+		s.deliverRoomUpdate(room, RoomUpdateEvent{Type: event.Type, Room: event.Room})
+
+	case roomEventParticipantAdded:
+		s.deliverRoomUpdate(room, RoomUpdateEvent{Type: event.Type, Participant: event.Participant})
+
+	default:
+		s.logger.Warn("Unknown room event type", zap.String("type", event.Type))
+	}
+	return true
+}
+
+// rotateToken disconnects the candidates who joined with a room link that
+// was replaced. Interviewers keep their seat, anyone else has to use the new
+// link. Without a service secret the new token cannot be fetched, so every
+// candidate has to join again.
+func (s *Server) rotateToken(roomID string, room *Room) {
+	newToken := ""
+	validRoom, err := s.coreClient.GetRoom(roomID)
+	switch {
+	case err == nil:
+		newToken = validRoom.Token
+	case !errors.Is(err, client.ErrNoServiceSecret):
+		s.logger.Error("Failed to fetch the rotated room token",
+			zap.String("roomID", roomID),
+			zap.Error(err))
+	}
+
+	// An empty token skips re-validation until the next join sets it again
+	room.validationMutex.Lock()
+	room.token = newToken
+	room.validationMutex.Unlock()
+
+	s.disconnectClients(room,
+		RoomEndedEvent{Type: "access_revoked", Reason: "The room link was changed"},
+		closeAccessRevoked, "Access revoked",
+		func(token string, user *client.User) bool {
+			return user == nil && (newToken == "" || token != newToken)
+		})
+}
+
+// markEventSeen records an event ID, returning false if it was already seen
+func (s *Server) markEventSeen(id string) bool {
+	s.eventsMutex.Lock()
+	defer s.eventsMutex.Unlock()
+
+	if _, seen := s.seenEvents[id]; seen {
+		return false
+	}
+
+	now := time.Now()
+	for seenID, seenAt := range s.seenEvents {
+		if now.Sub(seenAt) > seenEventTTL {
+			delete(s.seenEvents, seenID)
+		}
+	}
+	s.seenEvents[id] = now
+	return true
+}
+
+// deliverRoomUpdate writes an update to every client of the room connected here
+func (s *Server) deliverRoomUpdate(room *Room, update RoomUpdateEvent) {
+	message, err := json.Marshal(update)
+	if err != nil {
+		s.logger.Error("Failed to marshal room update", zap.Error(err))
+		return
+	}
+
+	header := parseHeader(message)
+
+	room.clientsMutex.RLock()
+	for conn := range room.editorClients {
+		conn.writeText(header, message)
+	}
+	for conn := range room.chatClients {
+		conn.writeText(header, message)
+	}
+	for conn := range room.notesClients {
+		conn.writeText(header, message)
+	}
+	room.clientsMutex.RUnlock()
+
+	s.deliverVideo(room, nil, message)
+}
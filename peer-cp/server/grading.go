@@ -0,0 +1,261 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/elskow/codepair/peer-cp/client"
+	"github.com/elskow/codepair/peer-cp/runner"
+	"go.uber.org/zap"
+)
+
+const harnessEntryPath = ".codepair/harness"
+
+// TestEvent reports test progress on the editor channel. Events about hidden
+// test cases are only delivered to interviewers.
+type TestEvent struct {
+	Type           string         `json:"type"`
+	RunID          string         `json:"runId"`
+	TestCaseID     string         `json:"testCaseId,omitempty"`
+	Name           string         `json:"name,omitempty"`
+	Hidden         bool           `json:"hidden,omitempty"`
+	Passed         bool           `json:"passed"`
+	Input          string         `json:"input,omitempty"`
+	ExpectedOutput string         `json:"expectedOutput,omitempty"`
+	ActualOutput   string         `json:"actualOutput,omitempty"`
+	Result         *runner.Result `json:"result,omitempty"`
+	PassedCount    int            `json:"passedCount,omitempty"`
+	Total          int            `json:"total,omitempty"`
+	Error          string         `json:"error,omitempty"`
+}
+
+// startTests runs the room problem's test cases against the entry file.
+// Candidates get visible tests only; interviewers may include hidden ones,
+// in which case the graded results are stored with the room in core.
+func (s *Server) startTests(ctx context.Context, c Conn, roomID string, room *Room, msg EditorMessage) error {
+	logger := s.getLogger(ctx)
+
+	room.clientsMutex.RLock()
+	editorClient, ok := room.editorClients[c]
+	room.clientsMutex.RUnlock()
+	if !ok {
+		return errors.New("editor client not found")
+	}
+
+	if msg.Hidden && editorClient.user == nil {
+		return errors.New("only interviewers can run hidden tests")
+	}
+
+	file, language, err := s.resolveEntry(room, msg)
+	if err != nil {
+		return err
+	}
+
+	var problem *client.Problem
+	if editorClient.user != nil {
+		problem, err = s.coreClient.GetRoomProblemAsInterviewer(roomID, editorClient.authToken)
+	} else {
+		problem, err = s.coreClient.GetRoomProblem(editorClient.token)
+	}
+	if err != nil {
+		logger.Error("Failed to load room problem", zap.String("roomID", roomID), zap.Error(err))
+		return errors.New("no problem is attached to this room")
+	}
+
+	tests := make([]client.TestCase, 0, len(problem.TestCases))
+	for _, tc := range problem.TestCases {
+		if !tc.Hidden || msg.Hidden {
+			tests = append(tests, tc)
+		}
+	}
+	if len(tests) == 0 {
+		return errors.New("the problem has no test cases")
+	}
+
+	req := runner.Request{
+		Language: language,
+		Entry:    file.Path,
+		Files:    runnerFiles(room.workspace.Files()),
+	}
+	if harness, ok := findHarness(problem, language); ok {
+		req = harnessRequest(req, file, harness)
+	}
+
+	if err := room.acquireRun(); err != nil {
+		return err
+	}
+
+	runID := fmt.Sprintf("%d", time.Now().UnixNano())
+	visibleTotal := 0
+	for _, tc := range tests {
+		if !tc.Hidden {
+			visibleTotal++
+		}
+	}
+	s.broadcastEditor(room, nil, TestEvent{Type: "tests_started", RunID: runID, Total: visibleTotal})
+
+	logger.Info("Test run started",
+		zap.String("roomID", roomID),
+		zap.String("runID", runID),
+		zap.Int("tests", len(tests)),
+		zap.Bool("hidden", msg.Hidden))
+
+	go func() {
+		defer room.releaseRun()
+
+		events, results := s.gradeTests(req, tests)
+		visiblePassed, passed := 0, 0
+
+		for _, event := range events {
+			event.RunID = runID
+			if event.Passed {
+				passed++
+				if !event.Hidden {
+					visiblePassed++
+				}
+			}
+
+			if event.Hidden {
+				s.broadcastEditorInterviewers(room, event)
+			} else {
+				s.broadcastEditor(room, nil, event)
+			}
+		}
+
+		s.broadcastEditor(room, nil, TestEvent{
+			Type:        "tests_finished",
+			RunID:       runID,
+			Passed:      visiblePassed == visibleTotal,
+			PassedCount: visiblePassed,
+			Total:       visibleTotal,
+		})
+
+		if !msg.Hidden {
+			return
+		}
+
+		s.broadcastEditorInterviewers(room, TestEvent{
+			Type:        "grading_finished",
+			RunID:       runID,
+			Hidden:      true,
+			Passed:      passed == len(tests),
+			PassedCount: passed,
+			Total:       len(tests),
+		})
+
+		submission := client.Submission{
+			ProblemID: problem.ID,
+			Language:  language,
+			Code:      file.Content,
+			Results:   results,
+		}
+		if err := s.coreClient.CreateSubmission(roomID, editorClient.authToken, submission); err != nil {
+			logger.Error("Failed to store graded submission",
+				zap.String("roomID", roomID),
+				zap.String("runID", runID),
+				zap.Error(err))
+		}
+	}()
+
+	return nil
+}
+
+// gradeTests builds the program once and runs it against every test case
+func (s *Server) gradeTests(req runner.Request, tests []client.TestCase) ([]TestEvent, []client.TestResult) {
+	inputs := make([]string, len(tests))
+	for i, tc := range tests {
+		inputs[i] = tc.Input
+	}
+
+	stdout := make([]bytes.Buffer, len(tests))
+	runResults, err := s.runner.RunBatch(context.Background(), req, inputs, func(index int, stream string, data []byte) {
+		if stream == "stdout" {
+			stdout[index].Write(data)
+		}
+	})
+
+	events := make([]TestEvent, len(tests))
+	results := make([]client.TestResult, len(tests))
+
+	for i, tc := range tests {
+		events[i] = TestEvent{
+			Type:       "test_result",
+			TestCaseID: tc.ID,
+			Name:       tc.Name,
+			Hidden:     tc.Hidden,
+		}
+		results[i] = client.TestResult{TestCaseID: tc.ID}
+
+		if err != nil {
+			events[i].Error = err.Error()
+			results[i].Status = runner.StatusRuntimeError
+			continue
+		}
+
+		// A failed build yields a single result that applies to every test
+		result := runResults[0]
+		if len(runResults) == len(tests) {
+			result = runResults[i]
+		}
+		events[i].Result = result
+
+		actual := stdout[i].String()
+		events[i].Passed = len(runResults) == len(tests) &&
+			result.Status == runner.StatusOK &&
+			normalizeOutput(actual) == normalizeOutput(tc.ExpectedOutput)
+		if !tc.Hidden {
+			events[i].Input = tc.Input
+			events[i].ExpectedOutput = tc.ExpectedOutput
+			events[i].ActualOutput = actual
+		}
+
+		results[i].Passed = events[i].Passed
+		results[i].Status = result.Status
+		results[i].DurationMs = result.DurationMs
+		results[i].CPUTimeMs = result.CPUTimeMs
+		results[i].MaxMemoryKB = result.MaxMemoryKB
+	}
+
+	return events, results
+}
+
+func findHarness(problem *client.Problem, language string) (client.Harness, bool) {
+	for _, harness := range problem.Harnesses {
+		if harness.Language == language {
+			return harness, true
+		}
+	}
+	return client.Harness{}, false
+}
+
+// harnessRequest makes the harness the program entry point and moves the
+// candidate's entry file to the file name the harness imports
+func harnessRequest(req runner.Request, entry WorkspaceFile, harness client.Harness) runner.Request {
+	files := make([]runner.File, 0, len(req.Files)+1)
+	for _, f := range req.Files {
+		if f.Path != entry.Path && f.Path != harness.SolutionFile {
+			files = append(files, f)
+		}
+	}
+	files = append(files,
+		runner.File{Path: harness.SolutionFile, Content: entry.Content},
+		runner.File{Path: harnessEntryPath, Content: harness.Code},
+	)
+
+	req.Files = files
+	req.Entry = harnessEntryPath
+	return req
+}
+
+// normalizeOutput ignores line ending style and trailing whitespace
+func normalizeOutput(output string) string {
+	lines := strings.Split(strings.ReplaceAll(output, "\r\n", "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t")
+	}
+	return strings.TrimRight(strings.Join(lines, "\n"), "\n")
+}
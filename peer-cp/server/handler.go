@@ -2,65 +2,81 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
+	"github.com/elskow/codepair/peer-cp/client"
 	"github.com/gofiber/websocket/v2"
 	"github.com/pion/webrtc/v4"
 	"go.uber.org/zap"
 	"golang.org/x/net/context"
 )
 
-func (s *Server) HandleEditorWS(c *websocket.Conn) {
-	defer c.Close()
-
-	ctx := context.WithValue(context.Background(), "requestID", c.Params("requestId"))
-	logger := s.getLogger(ctx)
-
-	roomID := c.Params("roomId")
-	token := c.Query("token")
+// participant is a connection whose room token has been validated
+type participant struct {
+	roomID    string
+	token     string
+	room      *client.Room
+	authToken string       // Interviewer access token, empty for candidates
+	user      *client.User // Resolved from authToken
+}
 
+// authenticateParticipant validates the room token and resolves the optional
+// interviewer token. A rejected interviewer token leaves the participant
+// without interviewer privileges, an interviewer from outside the panel is
+// turned away.
+func (s *Server) authenticateParticipant(logger *zap.Logger, roomID, token, authToken string) (*participant, error) {
 	validRoom, err := s.validateRoom(roomID, token)
 	if err != nil {
-		logger.Error("Room validation failed", zap.Error(err))
-		return
+		return nil, err
 	}
 
 	if !validRoom.IsActive {
-		logger.Error("Room is not active")
-		return
+		return nil, fmt.Errorf("room is not active")
 	}
 
-	client := &EditorClient{
-		conn: c,
+	user, err := s.authenticateInterviewer(validRoom, authToken)
+	if errors.Is(err, errNotOnPanel) {
+		return nil, err
+	}
+	if err != nil {
+		logger.Warn("Joining without interviewer privileges", zap.Error(err))
+		authToken = ""
 	}
 
-	s.roomsMutex.Lock()
-	localRoom, exists := s.rooms[roomID]
-	if !exists {
-		localRoom = newRoom()
-		s.rooms[roomID] = localRoom
+	if s.removedFrom(roomID, validRoom, user) {
+		return nil, errRemoved
 	}
-	s.roomsMutex.Unlock()
 
-	localRoom.clientsMutex.Lock()
-	localRoom.editorClients[c] = client
-	localRoom.clientsMutex.Unlock()
+	return &participant{
+		roomID:    roomID,
+		token:     token,
+		room:      validRoom,
+		authToken: authToken,
+		user:      user,
+	}, nil
+}
 
-	logger.Info("Editor client connected", zap.String("roomID", roomID))
+func (s *Server) HandleEditorWS(c *websocket.Conn) {
+	defer c.Close()
 
-	// Send current code state to new client
-	if localRoom.currentCode != "" {
-		syncMessage := EditorMessage{
-			Type:     "sync",
-			Code:     localRoom.currentCode,
-			Language: localRoom.language,
-		}
-		if err := c.WriteJSON(syncMessage); err != nil {
-			logger.Error("Failed to send sync message", zap.Error(err))
-		}
+	ctx := context.WithValue(context.Background(), "requestID", c.Params("requestId"))
+	logger := s.getLogger(ctx)
+
+	roomID := c.Params("roomId")
+	p, err := s.authenticateParticipant(logger, roomID, c.Query("token"), bearerToken(c))
+	if err != nil {
+		logger.Error("Room validation failed", zap.Error(err))
+		return
 	}
 
+	out := s.newOutbox(c, s.config.Server.WriteQueue)
+	defer out.stop()
+
+	localRoom := s.joinEditor(ctx, out, p)
+
 	// Handle incoming messages
 	for {
 		var msg EditorMessage
@@ -72,22 +88,64 @@ func (s *Server) HandleEditorWS(c *websocket.Conn) {
 			break
 		}
 
-		s.handleEditorMessage(ctx, c, roomID, msg)
+		s.touchPresence(localRoom, p)
+		s.handleEditorMessage(ctx, out, roomID, msg)
 	}
 
-	// Cleanup when client disconnects
+	s.leaveEditor(ctx, localRoom, out, p)
+}
+
+// joinEditor adds the connection to the room's editor clients and sends it
+// the current workspace
+func (s *Server) joinEditor(ctx context.Context, c Conn, p *participant) *Room {
+	logger := s.getLogger(ctx)
+
+	id, name, _ := p.identity()
+	client := &EditorClient{
+		conn:      c,
+		token:     p.token,
+		authToken: p.authToken,
+		user:      p.user,
+		id:        id,
+		name:      name,
+	}
+
+	localRoom := s.getOrCreateRoom(p.roomID, p.token, p.room.Removed)
+
 	localRoom.clientsMutex.Lock()
-	delete(localRoom.editorClients, c)
+	localRoom.editorClients[c] = client
 	localRoom.clientsMutex.Unlock()
 
-	s.roomsMutex.Lock()
-	if len(localRoom.editorClients) == 0 && len(localRoom.webrtcClients) == 0 {
-		delete(s.rooms, roomID)
-		logger.Info("Room closed", zap.String("roomID", roomID))
+	logger.Info("Editor client connected", zap.String("roomID", p.roomID))
+
+	// Send current workspace state to new client
+	if err := s.sendWorkspaceSync(c, localRoom); err != nil {
+		logger.Error("Failed to send sync message", zap.Error(err))
+	}
+	if err := s.sendCursors(c, localRoom); err != nil {
+		logger.Error("Failed to send cursors", zap.Error(err))
+	}
+	if err := s.sendControls(c, localRoom); err != nil {
+		logger.Error("Failed to send room controls", zap.Error(err))
 	}
-	s.roomsMutex.Unlock()
 
-	logger.Info("Editor client disconnected", zap.String("roomID", roomID))
+	s.enterPresence(localRoom, p, channelEditor)
+	if err := s.sendRoster(c, p.roomID); err != nil {
+		logger.Error("Failed to send roster", zap.Error(err))
+	}
+	return localRoom
+}
+
+func (s *Server) leaveEditor(ctx context.Context, localRoom *Room, c Conn, p *participant) {
+	localRoom.clientsMutex.Lock()
+	delete(localRoom.editorClients, c)
+	localRoom.clientsMutex.Unlock()
+
+	id, _, _ := p.identity()
+	s.leaveCursor(localRoom, id)
+	s.exitPresence(localRoom, p, channelEditor)
+	s.closeRoomIfEmpty(ctx, localRoom)
+	s.getLogger(ctx).Info("Editor client disconnected", zap.String("roomID", localRoom.id))
 }
 
 func (s *Server) HandleVideoChatWS(c *websocket.Conn) {
@@ -103,45 +161,111 @@ func (s *Server) HandleVideoChatWS(c *websocket.Conn) {
 		zap.String("roomID", roomID),
 		zap.String("tokenPresent", fmt.Sprintf("%t", token != "")))
 
-	validRoom, err := s.validateRoom(roomID, token)
+	p, err := s.authenticateParticipant(logger, roomID, token, bearerToken(c))
 	if err != nil {
 		logger.Error("Room validation failed",
 			zap.String("roomID", roomID),
 			zap.Error(err))
+		c.WriteMessage(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, "Room is not active"))
 		return
 	}
 
-	if !validRoom.IsActive {
-		logger.Error("Room is not active",
-			zap.String("roomID", roomID))
-		c.WriteMessage(websocket.CloseMessage,
-			websocket.FormatCloseMessage(websocket.CloseNormalClosure, "Room is not active"))
+	out := s.newOutbox(c, s.config.Server.WriteQueue)
+	defer out.stop()
+
+	// Every participant's media has to go through the same SFU
+	if host, redirect := s.mediaRedirect(ctx, roomID); redirect {
+		s.redirectMedia(out, roomID, host)
+		return
+	}
+
+	localRoom, client, err := s.joinVideo(ctx, out, p, c.Query("clientId"))
+	if err != nil {
+		logger.Error("Failed to join video chat", zap.Error(err))
 		return
 	}
 
+	for {
+		_, msg, err := c.ReadMessage()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				logger.Info("WebSocket closed normally")
+			} else {
+				logger.Error("WebSocket error", zap.Error(err))
+			}
+			break
+		}
+
+		s.handleVideoSignal(ctx, localRoom, client, msg)
+	}
+
+	s.leaveVideo(localRoom, client, p)
+}
+
+// mediaRedirect reports whether the room's media is hosted on another
+// instance, and which one
+func (s *Server) mediaRedirect(ctx context.Context, roomID string) (string, bool) {
+	host, err := s.claimMedia(roomID)
+	if err != nil {
+		s.getLogger(ctx).Warn("Failed to claim room media, hosting it here", zap.Error(err))
+		return "", false
+	}
+	if host == s.mediaHost() {
+		return "", false
+	}
+
+	s.getLogger(ctx).Info("Redirecting video client to the room's media host",
+		zap.String("roomID", roomID),
+		zap.String("host", host))
+	return host, true
+}
+
+// joinVideo creates the participant's peer connection and adds it to the
+// room's video clients
+func (s *Server) joinVideo(ctx context.Context, c Conn, p *participant, clientID string) (*Room, *WebRTCClient, error) {
+	logger := s.getLogger(ctx)
+	roomID := p.roomID
+
+	if clientID == "" {
+		clientID = fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+
 	ctx, cancel := context.WithCancel(ctx)
 	client := &WebRTCClient{
 		conn:       c,
 		candidates: make([]webrtc.ICECandidateInit, 0),
 		ctx:        ctx,
 		cancel:     cancel,
+		clientID:   clientID,
+		token:      p.token,
+		name:       p.room.CandidateName,
+		authToken:  p.authToken,
+		user:       p.user,
+
+		trackLabels:   make(map[string]string),
+		subscriptions: make(map[string]*downTrack),
+	}
+	if p.user != nil {
+		client.name = p.user.Name
+		if client.name == "" {
+			client.name = p.user.Email
+		}
 	}
-	defer cancel()
 
-	pc, err := s.createPeerConnection()
+	conn, err := s.createPeerConnection()
 	if err != nil {
-		logger.Error("Failed to create peer connection", zap.Error(err))
-		return
+		cancel()
+		return nil, nil, fmt.Errorf("failed to create peer connection: %w", err)
 	}
+	pc := conn.pc
 	client.pc = pc
+	client.quality = newQualityMonitor(conn.stats)
+	client.estimator = conn.estimator
 
+	localRoom := s.getOrCreateRoom(roomID, p.token, p.room.Removed)
+	client.muted.Store(localRoom.isMuted(rosterID(p.user)))
 	s.roomsMutex.Lock()
-	localRoom, exists := s.rooms[roomID]
-	if !exists {
-		localRoom = newRoom()
-		s.rooms[roomID] = localRoom
-	}
-	clientID := c.Query("clientId")
 	localRoom.peerConns[clientID] = pc
 	localRoom.webrtcClients[c] = client
 	s.roomsMutex.Unlock()
@@ -158,10 +282,7 @@ func (s *Server) HandleVideoChatWS(c *websocket.Conn) {
 			"candidate": candidateJSON,
 		}
 
-		client.writeMutex.Lock()
-		defer client.writeMutex.Unlock()
-
-		if err := c.WriteJSON(msg); err != nil {
+		if err := client.sendJSON(msg); err != nil {
 			logger.Error("Failed to send ICE candidate", zap.Error(err))
 		}
 	})
@@ -171,65 +292,20 @@ func (s *Server) HandleVideoChatWS(c *websocket.Conn) {
 		s.logger.Info("Received track",
 			zap.String("roomID", roomID),
 			zap.String("trackID", track.ID()),
+			zap.String("rid", track.RID()),
 			zap.String("kind", track.Kind().String()))
 
-		// Create a local track to forward the received track
-		localTrack, err := webrtc.NewTrackLocalStaticRTP(track.Codec().RTPCodecCapability, track.ID(), track.StreamID())
+		published, layer, created, err := localRoom.publish(client, track)
 		if err != nil {
-			s.logger.Error("Failed to create local track", zap.Error(err))
+			s.logger.Error("Failed to publish track", zap.Error(err))
 			return
 		}
 
-		// Add the local track to all other peers
-		s.roomsMutex.RLock()
-		if room, exists := s.rooms[roomID]; exists {
-			for _, otherClient := range room.webrtcClients {
-				if otherClient.conn != c {
-					sender, err := otherClient.pc.AddTrack(localTrack)
-					if err != nil {
-						s.logger.Error("Failed to add track to peer", zap.Error(err))
-						continue
-					}
-
-					go func(ctx context.Context) {
-						rtcpBuf := make([]byte, 1500)
-						for {
-							select {
-							case <-ctx.Done():
-								return
-							default:
-								if _, _, rtcpErr := sender.Read(rtcpBuf); rtcpErr != nil {
-									return
-								}
-							}
-						}
-					}(client.ctx)
-				}
-			}
+		// Offer the new track to everyone already in the room
+		if created {
+			go s.signalPeers(localRoom)
 		}
-		s.roomsMutex.RUnlock()
-
-		// Read incoming track data and forward it
-		go func(ctx context.Context) {
-			rtpBuf := make([]byte, 1500)
-			for {
-				select {
-				case <-ctx.Done():
-					return
-				default:
-					n, _, err := track.Read(rtpBuf)
-					if err != nil {
-						s.logger.Error("Failed to read from track", zap.Error(err))
-						return
-					}
-
-					if _, err = localTrack.Write(rtpBuf[:n]); err != nil {
-						s.logger.Error("Failed to write to local track", zap.Error(err))
-						return
-					}
-				}
-			}
-		}(client.ctx)
+		s.forwardLayer(roomID, localRoom, published, layer)
 	})
 
 	// State change handling
@@ -239,60 +315,115 @@ func (s *Server) HandleVideoChatWS(c *websocket.Conn) {
 			zap.String("state", state.String()))
 	})
 
-	for {
-		_, msg, err := c.ReadMessage()
-		if err != nil {
-			if websocket.IsCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
-				logger.Info("WebSocket closed normally")
-			} else {
-				logger.Error("WebSocket error", zap.Error(err))
-			}
-			break
+	// Clients should build their peer connection with these servers
+	if err := s.sendICEConfig(client); err != nil {
+		logger.Error("Failed to send ICE config", zap.Error(err))
+	}
+
+	if p.user != nil {
+		if err := s.sendLobbyResults(localRoom, client); err != nil {
+			logger.Error("Failed to send lobby results", zap.Error(err))
 		}
+	}
+
+	go s.monitorQuality(roomID, localRoom, client)
+	go s.allocateBandwidth(client)
+
+	// Late joiners are asked for consent if the room is already being recorded
+	if localRoom.activeRecording() != nil {
+		s.broadcastRecordingState(roomID, localRoom)
+	}
+
+	s.enterPresence(localRoom, p, presenceVideo)
+	return localRoom, client, nil
+}
+
+// handleVideoSignal applies one signaling message from a video client
+func (s *Server) handleVideoSignal(ctx context.Context, localRoom *Room, client *WebRTCClient, msg []byte) {
+	logger := s.getLogger(ctx)
+	roomID := localRoom.id
+
+	var signal map[string]interface{}
+	if err := json.Unmarshal(msg, &signal); err != nil {
+		logger.Error("Failed to parse signal", zap.Error(err))
+		return
+	}
 
-		var signal map[string]interface{}
-		if err := json.Unmarshal(msg, &signal); err != nil {
-			logger.Error("Failed to parse signal", zap.Error(err))
-			continue
+	if signalType, _ := signal["type"].(string); strings.HasPrefix(signalType, "recording_") {
+		if err := s.handleRecordingSignal(roomID, localRoom, client, signalType, signal); err != nil {
+			client.sendJSON(RecordingEvent{Type: "recording_error", Error: err.Error()})
 		}
+		return
+	}
 
-		// Handle SDP first
-		if sdp, ok := signal["sdp"].(map[string]interface{}); ok {
-			if err := s.handleSDP(ctx, client, sdp); err != nil {
-				logger.Error("Failed to handle SDP", zap.Error(err))
-				continue
-			}
+	if signalType, _ := signal["type"].(string); signalType == "ice_config" {
+		if err := s.sendICEConfig(client); err != nil {
+			logger.Error("Failed to send ICE config", zap.Error(err))
+		}
+		return
+	}
 
-			// Process stored candidates after SDP is set
-			for _, candidate := range client.candidates {
-				if err := client.pc.AddICECandidate(candidate); err != nil {
-					logger.Error("Failed to add stored ICE candidate", zap.Error(err))
-				}
-			}
-			client.candidates = nil // Clear stored candidates
-		} else if candidate, ok := signal["candidate"].(map[string]interface{}); ok {
-			if err := s.handleICECandidate(ctx, client, candidate); err != nil {
-				logger.Error("Failed to handle ICE candidate", zap.Error(err))
-			}
+	if signalType, _ := signal["type"].(string); signalType == "track_info" || strings.HasPrefix(signalType, "screen_share_") {
+		if err := s.handleTrackSignal(localRoom, client, signalType, signal); err != nil {
+			client.sendJSON(map[string]interface{}{"type": "track_error", "error": err.Error()})
 		}
+		return
+	}
 
-		// Broadcast to other clients in room
-		s.broadcastToRoom(roomID, c, msg)
+	if _, ok := signal["sdp"]; ok {
+		desc, err := parseSessionDescription(signal)
+		if err != nil {
+			logger.Error("Failed to parse SDP", zap.Error(err))
+			return
+		}
+		if err := s.handleSDP(client.ctx, localRoom, client, desc); err != nil {
+			logger.Error("Failed to handle SDP", zap.Error(err))
+		}
+	} else if candidate, ok := signal["candidate"].(map[string]interface{}); ok {
+		if err := s.handleICECandidate(client.ctx, client, candidate); err != nil {
+			logger.Error("Failed to handle ICE candidate", zap.Error(err))
+		}
 	}
+}
+
+// leaveVideo closes the participant's peer connection and withdraws its
+// tracks from everyone else
+func (s *Server) leaveVideo(localRoom *Room, client *WebRTCClient, p *participant) {
+	roomID := localRoom.id
+	client.cancel()
+	s.exitPresence(localRoom, p, presenceVideo)
 
-	// Cleanup
 	s.roomsMutex.Lock()
+	remaining := 0
 	if localRoom, exists := s.rooms[roomID]; exists {
-		if client, ok := localRoom.webrtcClients[c]; ok {
-			client.cancel()
-		}
-		delete(localRoom.webrtcClients, c)
-		delete(localRoom.peerConns, clientID)
-		if len(localRoom.editorClients) == 0 && len(localRoom.webrtcClients) == 0 {
+		delete(localRoom.webrtcClients, client.conn)
+		delete(localRoom.peerConns, client.clientID)
+		remaining = len(localRoom.webrtcClients)
+		if localRoom.empty() {
 			delete(s.rooms, roomID)
+			s.saveHistoryLater(localRoom)
+			s.saveIntegrityLater(localRoom)
 		}
 	}
 	s.roomsMutex.Unlock()
+
+	s.saveQualitySummary(roomID, client)
+	client.pc.Close()
+	client.unsubscribeAll()
+	localRoom.unpublishClient(client.clientID, "")
+	s.signalPeers(localRoom)
+	if remaining == 0 {
+		s.releaseMedia(roomID)
+	}
+
+	if recording := localRoom.activeRecording(); recording != nil {
+		recording.closeParticipant(client.clientID)
+		if remaining == 0 {
+			s.stopRecording(roomID, localRoom)
+		} else {
+			s.broadcastRecordingState(roomID, localRoom)
+		}
+	}
 }
 
 func (s *Server) HandleChatWS(c *websocket.Conn) {
@@ -302,118 +433,81 @@ func (s *Server) HandleChatWS(c *websocket.Conn) {
 	logger := s.getLogger(ctx)
 
 	roomID := c.Params("roomId")
-	token := c.Query("token")
-
-	validRoom, err := s.validateRoom(roomID, token)
+	p, err := s.authenticateParticipant(logger, roomID, c.Query("token"), bearerToken(c))
 	if err != nil {
 		logger.Error("Room validation failed", zap.Error(err))
 		return
 	}
 
-	if !validRoom.IsActive {
-		logger.Error("Room is not active")
-		return
+	out := s.newOutbox(c, s.config.Server.WriteQueue)
+	defer out.stop()
+
+	localRoom, client := s.joinChat(ctx, out, p)
+
+	// Handle incoming messages
+	for {
+		var event ChatEvent
+		err := c.ReadJSON(&event)
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				logger.Error("WebSocket error", zap.Error(err))
+			}
+			break
+		}
+
+		s.touchPresence(localRoom, p)
+		s.handleChatEvent(ctx, localRoom, client, event)
 	}
 
+	s.leaveChat(ctx, localRoom, out, p)
+}
+
+// joinChat adds the connection to the room's chat clients and sends it the
+// chat history
+func (s *Server) joinChat(ctx context.Context, c Conn, p *participant) (*Room, *ChatClient) {
+	logger := s.getLogger(ctx)
+
+	id, name, _ := p.identity()
 	client := &ChatClient{
 		conn:     c,
-		username: validRoom.CandidateName,
+		token:    p.token,
+		user:     p.user,
+		id:       id,
+		username: name,
 	}
 
-	s.roomsMutex.Lock()
-	localRoom, exists := s.rooms[roomID]
-	if !exists {
-		localRoom = newRoom()
-		s.rooms[roomID] = localRoom
-	}
-	s.roomsMutex.Unlock()
+	localRoom := s.getOrCreateRoom(p.roomID, p.token, p.room.Removed)
 
 	localRoom.clientsMutex.Lock()
 	localRoom.chatClients[c] = client
+	history := localRoom.chatMessages
 	localRoom.clientsMutex.Unlock()
 
-	logger.Info("Chat client connected", zap.String("roomID", roomID))
+	logger.Info("Chat client connected", zap.String("roomID", p.roomID))
 
 	// Send chat history to new client
-	if len(localRoom.chatMessages) > 0 {
+	if len(history) > 0 {
 		historyEvent := ChatEvent{
 			Type:     "history",
-			Messages: localRoom.chatMessages,
+			Messages: history,
 		}
 		if err := c.WriteJSON(historyEvent); err != nil {
 			logger.Error("Failed to send chat history", zap.Error(err))
 		}
 	}
 
-	// Handle incoming messages
-	for {
-		var event ChatEvent
-		err := c.ReadJSON(&event)
-		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				logger.Error("WebSocket error", zap.Error(err))
-			}
-			break
-		}
-
-		switch event.Type {
-		case "chat":
-			if event.UserName == "" || event.UserName == "Anonymous" {
-				event.UserName = client.username
-				if event.UserName == "" {
-					event.UserName = "Anonymous"
-				}
-			}
-
-			message := ChatMessage{
-				ID:        fmt.Sprintf("%d", time.Now().UnixNano()),
-				RoomID:    roomID,
-				UserName:  event.UserName,
-				Content:   event.Content,
-				Timestamp: time.Now(),
-			}
-
-			broadcastEvent := ChatEvent{
-				Type:    "chat",
-				Message: message,
-			}
-
-			messageJSON, err := json.Marshal(broadcastEvent)
-			if err != nil {
-				logger.Error("Failed to marshal chat message", zap.Error(err))
-				continue
-			}
-
-			localRoom.clientsMutex.Lock()
-			if len(localRoom.chatMessages) >= MaxChatHistory {
-				localRoom.chatMessages = localRoom.chatMessages[1:]
-			}
-			localRoom.chatMessages = append(localRoom.chatMessages, message)
-
-			for client := range localRoom.chatClients {
-				if err := client.WriteMessage(websocket.TextMessage, messageJSON); err != nil {
-					logger.Error("Failed to broadcast chat message",
-						zap.Error(err),
-						zap.String("roomID", roomID))
-				}
-			}
-			localRoom.clientsMutex.Unlock()
-		}
-	}
+	s.enterPresence(localRoom, p, channelChat)
+	return localRoom, client
+}
 
-	// Cleanup when client disconnects
+func (s *Server) leaveChat(ctx context.Context, localRoom *Room, c Conn, p *participant) {
 	localRoom.clientsMutex.Lock()
 	delete(localRoom.chatClients, c)
 	localRoom.clientsMutex.Unlock()
 
-	s.roomsMutex.Lock()
-	if len(localRoom.editorClients) == 0 && len(localRoom.webrtcClients) == 0 && len(localRoom.chatClients) == 0 {
-		delete(s.rooms, roomID)
-		logger.Info("Room closed", zap.String("roomID", roomID))
-	}
-	s.roomsMutex.Unlock()
-
-	logger.Info("Chat client disconnected", zap.String("roomID", roomID))
+	s.exitPresence(localRoom, p, channelChat)
+	s.closeRoomIfEmpty(ctx, localRoom)
+	s.getLogger(ctx).Info("Chat client disconnected", zap.String("roomID", localRoom.id))
 }
 
 func (s *Server) HandleNotesWS(c *websocket.Conn) {
@@ -423,76 +517,106 @@ func (s *Server) HandleNotesWS(c *websocket.Conn) {
 	logger := s.getLogger(ctx)
 
 	roomID := c.Params("roomId")
-	token := c.Query("token")
-
-	validRoom, err := s.validateRoom(roomID, token)
+	p, err := s.authenticateParticipant(logger, roomID, c.Query("token"), bearerToken(c))
 	if err != nil {
 		logger.Error("Room validation failed", zap.Error(err))
 		return
 	}
 
-	if !validRoom.IsActive {
-		logger.Error("Room is not active")
-		return
+	out := s.newOutbox(c, s.config.Server.WriteQueue)
+	defer out.stop()
+
+	localRoom := s.joinNotes(ctx, out, p)
+
+	// Handle incoming messages
+	for {
+		var msg NotesMessage
+		err := c.ReadJSON(&msg)
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				logger.Error("WebSocket error", zap.Error(err))
+			}
+			break
+		}
+
+		s.touchPresence(localRoom, p)
+		s.handleNotesMessage(ctx, out, roomID, msg)
 	}
 
+	s.leaveNotes(ctx, localRoom, out, p)
+}
+
+// joinNotes adds the connection to the room's notes clients and sends it the
+// current notes
+func (s *Server) joinNotes(ctx context.Context, c Conn, p *participant) *Room {
+	logger := s.getLogger(ctx)
+
 	client := &NotesClient{
-		conn: c,
+		conn:  c,
+		token: p.token,
+		user:  p.user,
 	}
 
-	s.roomsMutex.Lock()
-	localRoom, exists := s.rooms[roomID]
-	if !exists {
-		localRoom = newRoom()
-		s.rooms[roomID] = localRoom
-	}
-	s.roomsMutex.Unlock()
+	localRoom := s.getOrCreateRoom(p.roomID, p.token, p.room.Removed)
 
 	localRoom.clientsMutex.Lock()
 	localRoom.notesClients[c] = client
+	notes := localRoom.currentNotes
 	localRoom.clientsMutex.Unlock()
 
-	logger.Info("Notes client connected", zap.String("roomID", roomID))
+	logger.Info("Notes client connected", zap.String("roomID", p.roomID))
 
 	// Send current notes state to new client
-	if localRoom.currentNotes != "" {
+	if notes != "" {
 		syncMessage := NotesMessage{
 			Type:    "sync",
-			Content: localRoom.currentNotes,
+			Content: notes,
 		}
 		if err := c.WriteJSON(syncMessage); err != nil {
 			logger.Error("Failed to send notes sync message", zap.Error(err))
 		}
 	}
 
-	// Handle incoming messages
-	for {
-		var msg NotesMessage
-		err := c.ReadJSON(&msg)
-		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				logger.Error("WebSocket error", zap.Error(err))
-			}
-			break
-		}
-
-		s.handleNotesMessage(ctx, c, roomID, msg)
-	}
+	s.enterPresence(localRoom, p, channelNotes)
+	return localRoom
+}
 
-	// Cleanup when client disconnects
+func (s *Server) leaveNotes(ctx context.Context, localRoom *Room, c Conn, p *participant) {
 	localRoom.clientsMutex.Lock()
 	delete(localRoom.notesClients, c)
 	localRoom.clientsMutex.Unlock()
 
+	s.exitPresence(localRoom, p, channelNotes)
+	s.closeRoomIfEmpty(ctx, localRoom)
+	s.getLogger(ctx).Info("Notes client disconnected", zap.String("roomID", localRoom.id))
+}
+
+// closeRoomIfEmpty forgets the room once its last client has left
+func (s *Server) closeRoomIfEmpty(ctx context.Context, localRoom *Room) {
 	s.roomsMutex.Lock()
-	if len(localRoom.editorClients) == 0 &&
-		len(localRoom.webrtcClients) == 0 &&
-		len(localRoom.chatClients) == 0 &&
-		len(localRoom.notesClients) == 0 {
-		delete(s.rooms, roomID)
-		logger.Info("Room closed", zap.String("roomID", roomID))
+	defer s.roomsMutex.Unlock()
+
+	if localRoom.empty() && s.rooms[localRoom.id] == localRoom {
+		delete(s.rooms, localRoom.id)
+		s.saveHistoryLater(localRoom)
+		s.saveIntegrityLater(localRoom)
+		s.getLogger(ctx).Info("Room closed", zap.String("roomID", localRoom.id))
 	}
-	s.roomsMutex.Unlock()
+}
+
+// empty reports whether the room has no clients left. The caller holds
+// roomsMutex, which guards the video clients.
+func (r *Room) empty() bool {
+	r.clientsMutex.RLock()
+	defer r.clientsMutex.RUnlock()
+	return r.emptyLocked()
+}
 
-	logger.Info("Notes client disconnected", zap.String("roomID", roomID))
+// emptyLocked is empty for callers already holding clientsMutex
+func (r *Room) emptyLocked() bool {
+	return len(r.editorClients) == 0 &&
+		len(r.chatClients) == 0 &&
+		len(r.notesClients) == 0 &&
+		len(r.lobbyClients) == 0 &&
+		len(r.webrtcClients) == 0
 }
@@ -0,0 +1,310 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+	"unicode/utf8"
+
+	"github.com/elskow/codepair/peer-cp/client"
+	"go.uber.org/zap"
+)
+
+// Edit op kinds, as core stores them
+const (
+	editOpEdit   = "edit"
+	editOpCreate = "create"
+	editOpRename = "rename"
+	editOpDelete = "delete"
+)
+
+const (
+	historyBatchOps   = 500       // Ops per request to core
+	historyBatchBytes = 1 << 20   // Encoded request body, core only hashes bodies up to 1 MiB
+	maxInsertedBytes  = 128 << 10 // Text per op, which JSON escaping can make six times longer
+	maxPendingOps     = 20000     // Ops kept per room while core cannot be reached
+)
+
+// editWorkspace applies a change made through c to the room's workspace and
+// appends the ops it returns to the room's edit history. Splices only replay
+// in the order they were made, so changes are applied one at a time. Remote
+// edits are recorded by the instance that applied them.
+func (s *Server) editWorkspace(room *Room, c Conn, change func() ([]client.EditOp, error)) error {
+	var authorID, authorName string
+	room.clientsMutex.RLock()
+	if editorClient, ok := room.editorClients[c]; ok {
+		authorID, authorName = editorClient.id, editorClient.name
+	}
+	room.clientsMutex.RUnlock()
+
+	room.historyMutex.Lock()
+	defer room.historyMutex.Unlock()
+
+	ops, err := change()
+	if err != nil {
+		return err
+	}
+
+	for _, op := range ops {
+		// The workspace already accepted the paths, this only normalises them
+		if path, err := cleanFilePath(op.Path); err == nil {
+			op.Path = path
+		}
+		if path, err := cleanFilePath(op.NewPath); err == nil {
+			op.NewPath = path
+		}
+
+		room.history = append(room.history, s.stampOps(splitOp(op), authorID, authorName)...)
+	}
+
+	if len(room.history) > maxPendingOps {
+		s.logger.Warn("Too much unsaved edit history, recording the workspace instead",
+			zap.String("roomID", room.id),
+			zap.Int("ops", len(room.history)))
+		room.history = s.resyncOps(room)
+	}
+	return nil
+}
+
+func (s *Server) stampOps(ops []client.EditOp, authorID, authorName string) []client.EditOp {
+	for i := range ops {
+		ops[i].Instance = s.config.Cluster.InstanceID
+		ops[i].Seq = s.editSeq.Add(1)
+		ops[i].AuthorID = authorID
+		ops[i].AuthorName = authorName
+		ops[i].OccurredAt = time.Now()
+	}
+	return ops
+}
+
+// resyncOps replaces the room's unsaved history with the workspace as it is
+// now. The files the history touched that are gone are deleted and every
+// file is created whole, so a replay still ends with the right files, only
+// the steps in between are lost. The caller holds historyMutex.
+func (s *Server) resyncOps(room *Room) []client.EditOp {
+	files := room.workspace.Files()
+	current := make(map[string]bool, len(files))
+	for _, file := range files {
+		current[file.Path] = true
+	}
+
+	var ops []client.EditOp
+	deleted := make(map[string]bool)
+	for _, op := range room.history {
+		for _, path := range []string{op.Path, op.NewPath} {
+			if path != "" && !current[path] && !deleted[path] {
+				deleted[path] = true
+				ops = append(ops, client.EditOp{Kind: editOpDelete, Path: path})
+			}
+		}
+	}
+	for _, file := range files {
+		ops = append(ops, splitOp(replaceOps(file, WorkspaceFile{})[0])...)
+	}
+	return s.stampOps(ops, "", "")
+}
+
+// replaceOps describes the change between two versions of a file as the
+// smallest single splice. A new file is recorded whole.
+func replaceOps(file, previous WorkspaceFile) []client.EditOp {
+	if previous.Path == "" {
+		return []client.EditOp{{
+			Kind:     editOpCreate,
+			Path:     file.Path,
+			Language: file.Language,
+			Inserted: file.Content,
+		}}
+	}
+
+	position, deleted, inserted := spliceDiff(previous.Content, file.Content)
+	language := ""
+	if file.Language != previous.Language {
+		language = file.Language
+	}
+	if deleted == 0 && inserted == "" && language == "" {
+		return nil
+	}
+
+	return []client.EditOp{{
+		Kind:     editOpEdit,
+		Path:     file.Path,
+		Language: language,
+		Position: position,
+		Deleted:  deleted,
+		Inserted: inserted,
+	}}
+}
+
+// splitOp cuts an op inserting more than maxInsertedBytes into several, so
+// that any op fits in a request to core. Each part inserts where the one
+// before it ended.
+func splitOp(op client.EditOp) []client.EditOp {
+	if len(op.Inserted) <= maxInsertedBytes {
+		return []client.EditOp{op}
+	}
+
+	ops := make([]client.EditOp, 0, len(op.Inserted)/maxInsertedBytes+1)
+	for text := op.Inserted; text != ""; {
+		// Parts end on a code point boundary
+		n := min(maxInsertedBytes, len(text))
+		for n < len(text) && !utf8.RuneStart(text[n]) {
+			n--
+		}
+
+		part := op
+		part.Inserted = text[:n]
+		if len(ops) > 0 {
+			previous := ops[len(ops)-1]
+			part.Kind = editOpEdit
+			part.Language = ""
+			part.Position = previous.Position + utf8.RuneCountInString(previous.Inserted)
+			part.Deleted = 0
+		}
+		ops = append(ops, part)
+		text = text[n:]
+	}
+	return ops
+}
+
+// spliceDiff finds the range of old that new replaces, in code points. Code
+// updates carry the whole file, but a keystroke only changes a small part.
+func spliceDiff(old, new string) (position, deleted int, inserted string) {
+	a, b := []rune(old), []rune(new)
+
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	return prefix, len(a) - prefix - suffix, string(b[prefix : len(b)-suffix])
+}
+
+// flushHistory saves every room's recorded edits to core on the flush
+// interval, along with the last edits of closed rooms core could not take
+func (s *Server) flushHistory() {
+	ticker := time.NewTicker(s.config.Server.HistoryFlush)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.roomsMutex.RLock()
+		rooms := make([]*Room, 0, len(s.rooms))
+		for _, room := range s.rooms {
+			rooms = append(rooms, room)
+		}
+		s.roomsMutex.RUnlock()
+
+		for _, room := range rooms {
+			s.saveHistory(room, false)
+		}
+		for _, room := range s.unsavedRooms() {
+			s.saveHistory(room, true)
+		}
+	}
+}
+
+// saveHistoryLater saves a closed room's last edits without holding up the
+// caller. Shutdown waits for it.
+func (s *Server) saveHistoryLater(room *Room) {
+	s.uploads.Add(1)
+	go func() {
+		defer s.uploads.Done()
+		s.saveHistory(room, true)
+	}()
+}
+
+// saveHistory sends the room's recorded edits to core in batches. Ops core
+// did not take are kept for the next flush, which retries closed rooms too.
+// They are only dropped when core rejects them, when nothing is left to
+// authenticate a closed room's with, or on shutdown.
+func (s *Server) saveHistory(room *Room, closed bool) {
+	room.historySaveMutex.Lock()
+	defer room.historySaveMutex.Unlock()
+
+	room.historyMutex.Lock()
+	pending := room.history
+	room.history = nil
+	room.historyMutex.Unlock()
+
+	authToken := s.interviewerToken(room)
+	for len(pending) > 0 {
+		batch := nextHistoryBatch(pending)
+		err := s.coreClient.SaveEditHistory(room.id, authToken, batch)
+		if client.Rejected(err) {
+			s.logger.Error("Core rejected edit history, dropping it",
+				zap.String("roomID", room.id),
+				zap.Int("ops", len(batch)),
+				zap.Int64("firstSeq", batch[0].Seq),
+				zap.Error(err))
+			pending = pending[len(batch):]
+			continue
+		}
+		if err != nil {
+			if s.isShuttingDown() || closed && errors.Is(err, client.ErrNoCredentials) {
+				s.logger.Error("Failed to save edit history, dropping it",
+					zap.String("roomID", room.id),
+					zap.Int("ops", len(pending)),
+					zap.Int64("firstSeq", pending[0].Seq),
+					zap.Error(err))
+				break
+			}
+			s.logger.Warn("Failed to save edit history, retrying later",
+				zap.String("roomID", room.id),
+				zap.Int("ops", len(pending)),
+				zap.Error(err))
+
+			room.historyMutex.Lock()
+			room.history = append(pending, room.history...)
+			room.historyMutex.Unlock()
+			if closed {
+				s.keepUnsaved(room, true)
+			}
+			return
+		}
+		pending = pending[len(batch):]
+	}
+	if closed {
+		s.keepUnsaved(room, false)
+	}
+}
+
+// keepUnsaved adds a closed room to the ones flushHistory retries, or
+// removes it once its edits are saved
+func (s *Server) keepUnsaved(room *Room, unsaved bool) {
+	s.unsavedMutex.Lock()
+	defer s.unsavedMutex.Unlock()
+	if unsaved {
+		s.unsaved[room] = struct{}{}
+	} else {
+		delete(s.unsaved, room)
+	}
+}
+
+func (s *Server) unsavedRooms() []*Room {
+	s.unsavedMutex.Lock()
+	defer s.unsavedMutex.Unlock()
+	rooms := make([]*Room, 0, len(s.unsaved))
+	for room := range s.unsaved {
+		rooms = append(rooms, room)
+	}
+	return rooms
+}
+
+// nextHistoryBatch takes as many ops as fit in one request, at least one.
+// Ops are measured as they are encoded, since core bounds the request body.
+func nextHistoryBatch(ops []client.EditOp) []client.EditOp {
+	size := len(`{"ops":[]}`)
+	for i, op := range ops {
+		encoded, err := json.Marshal(op)
+		if err == nil {
+			size += len(encoded) + 1 // And its comma
+		}
+		if i > 0 && (i == historyBatchOps || size > historyBatchBytes) {
+			return ops[:i]
+		}
+	}
+	return ops
+}
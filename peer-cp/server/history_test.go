@@ -0,0 +1,225 @@
+package server
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/elskow/codepair/peer-cp/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplaceOps(t *testing.T) {
+	file := func(content string) WorkspaceFile {
+		return WorkspaceFile{Path: "main.py", Language: "python", Content: content}
+	}
+
+	tests := []struct {
+		name     string
+		previous WorkspaceFile
+		file     WorkspaceFile
+		want     []client.EditOp
+	}{
+		{
+			name: "new file is recorded whole",
+			file: file("print(1)"),
+			want: []client.EditOp{{Kind: editOpCreate, Path: "main.py", Language: "python", Inserted: "print(1)"}},
+		},
+		{
+			name:     "unchanged file records nothing",
+			previous: file("print(1)"),
+			file:     file("print(1)"),
+		},
+		{
+			name:     "keystroke",
+			previous: file("print(1)"),
+			file:     file("print(12)"),
+			want:     []client.EditOp{{Kind: editOpEdit, Path: "main.py", Position: 7, Inserted: "2"}},
+		},
+		{
+			name:     "deletion",
+			previous: file("print(12)"),
+			file:     file("print(1)"),
+			want:     []client.EditOp{{Kind: editOpEdit, Path: "main.py", Position: 7, Deleted: 1}},
+		},
+		{
+			name:     "changes far apart are one splice",
+			previous: file("abcdef"),
+			file:     file("Xbcdeg"),
+			want:     []client.EditOp{{Kind: editOpEdit, Path: "main.py", Position: 0, Deleted: 6, Inserted: "Xbcdeg"}},
+		},
+		{
+			name:     "positions count code points",
+			previous: file("héllo"),
+			file:     file("héllo wörld"),
+			want:     []client.EditOp{{Kind: editOpEdit, Path: "main.py", Position: 5, Inserted: " wörld"}},
+		},
+		{
+			name:     "repeated text is not matched twice",
+			previous: file("aa"),
+			file:     file("aaa"),
+			want:     []client.EditOp{{Kind: editOpEdit, Path: "main.py", Position: 2, Inserted: "a"}},
+		},
+		{
+			name:     "language change alone",
+			previous: file("x"),
+			file:     WorkspaceFile{Path: "main.py", Language: "javascript", Content: "x"},
+			want:     []client.EditOp{{Kind: editOpEdit, Path: "main.py", Language: "javascript", Position: 1}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, replaceOps(tt.file, tt.previous))
+		})
+	}
+}
+
+func TestSplitOp(t *testing.T) {
+	large := strings.Repeat("é", maxInsertedBytes) // Twice the limit in bytes
+
+	tests := []struct {
+		name  string
+		op    client.EditOp
+		parts int
+	}{
+		{
+			name:  "small op is kept",
+			op:    client.EditOp{Kind: editOpEdit, Path: "a", Position: 3, Deleted: 2, Inserted: "xy"},
+			parts: 1,
+		},
+		{
+			name:  "large edit",
+			op:    client.EditOp{Kind: editOpEdit, Path: "a", Position: 3, Deleted: 2, Inserted: large},
+			parts: 2,
+		},
+		{
+			name:  "large new file, cut on a code point boundary",
+			op:    client.EditOp{Kind: editOpCreate, Path: "a", Language: "go", Inserted: "x" + large},
+			parts: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parts := splitOp(tt.op)
+			require.Len(t, parts, tt.parts)
+
+			// The first part stands for the op, the rest append to it
+			assert.Equal(t, tt.op.Kind, parts[0].Kind)
+			assert.Equal(t, tt.op.Language, parts[0].Language)
+			assert.Equal(t, tt.op.Deleted, parts[0].Deleted)
+
+			var inserted strings.Builder
+			position := tt.op.Position
+			for i, part := range parts {
+				assert.LessOrEqual(t, len(part.Inserted), maxInsertedBytes)
+				assert.Equal(t, position, part.Position)
+				if i > 0 {
+					assert.Equal(t, editOpEdit, part.Kind)
+					assert.Zero(t, part.Deleted)
+					assert.Empty(t, part.Language)
+				}
+				position += len([]rune(part.Inserted))
+				inserted.WriteString(part.Inserted)
+			}
+			assert.Equal(t, tt.op.Inserted, inserted.String())
+		})
+	}
+}
+
+func TestNextHistoryBatch(t *testing.T) {
+	ops := func(n int, inserted string) []client.EditOp {
+		ops := make([]client.EditOp, n)
+		for i := range ops {
+			ops[i] = client.EditOp{Kind: editOpEdit, Path: "main.py", Inserted: inserted}
+		}
+		return ops
+	}
+	// Control characters take six bytes each once encoded
+	escaped := strings.Repeat("\x01", 64<<10)
+
+	tests := []struct {
+		name      string
+		ops       []client.EditOp
+		want      int
+		oversized bool
+	}{
+		{
+			name: "everything fits",
+			ops:  ops(10, "x"),
+			want: 10,
+		},
+		{
+			name: "bounded by op count",
+			ops:  ops(historyBatchOps+10, "x"),
+			want: historyBatchOps,
+		},
+		{
+			name: "bounded by encoded size, not text length",
+			ops:  ops(10, escaped),
+			want: 2,
+		},
+		{
+			name: "parts of a split op fit a request each",
+			ops:  splitOp(client.EditOp{Kind: editOpEdit, Path: "main.py", Inserted: strings.Repeat("\x01", 3*maxInsertedBytes)}),
+			want: 1,
+		},
+		{
+			name:      "an op larger than a request still goes alone",
+			ops:       ops(2, strings.Repeat("x", historyBatchBytes)),
+			want:      1,
+			oversized: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			batch := nextHistoryBatch(tt.ops)
+			require.Len(t, batch, tt.want)
+
+			if !tt.oversized {
+				body, err := json.Marshal(map[string][]client.EditOp{"ops": batch})
+				require.NoError(t, err)
+				assert.LessOrEqual(t, len(body), historyBatchBytes)
+			}
+		})
+	}
+}
+
+func TestEditWorkspaceResync(t *testing.T) {
+	s := newTestServer()
+	room := &Room{id: "r1", workspace: newWorkspace()}
+	_, err := room.workspace.Create("main.py", "python", "print()")
+	require.NoError(t, err)
+
+	// Core saved old.py before it became unreachable, then old.py was
+	// deleted among more edits than are kept
+	saved := map[string]string{"main.py": "print()", "old.py": "x"}
+	room.history = append(room.history, client.EditOp{Kind: editOpDelete, Path: "old.py"})
+	for len(room.history) < maxPendingOps {
+		room.history = append(room.history, client.EditOp{Kind: editOpEdit, Path: "main.py"})
+	}
+
+	require.NoError(t, s.editWorkspace(room, nil, func() ([]client.EditOp, error) {
+		file, err := room.workspace.Create("new.py", "python", "1")
+		return replaceOps(file, WorkspaceFile{}), err
+	}))
+	require.Less(t, len(room.history), maxPendingOps)
+
+	// Replaying the history on what core saved gives the workspace
+	for _, op := range room.history {
+		switch op.Kind {
+		case editOpCreate:
+			saved[op.Path] = op.Inserted
+		case editOpEdit:
+			saved[op.Path] += op.Inserted
+		case editOpDelete:
+			delete(saved, op.Path)
+		default:
+			t.Fatalf("unexpected %s op", op.Kind)
+		}
+	}
+	assert.Equal(t, map[string]string{"main.py": "print()", "new.py": "1"}, saved)
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"time"
+
+	"github.com/elskow/codepair/peer-cp/turnserver"
+	"github.com/pion/webrtc/v4"
+)
+
+// ICEConfigEvent delivers the ICE servers a client should use. TURN
+// credentials are issued per participant and expire after TTL seconds;
+// clients send ice_config again to refresh them.
+type ICEConfigEvent struct {
+	Type       string             `json:"type"`
+	ICEServers []webrtc.ICEServer `json:"iceServers"`
+	TTL        int64              `json:"ttl,omitempty"`
+}
+
+func (s *Server) staticICEServers() []webrtc.ICEServer {
+	servers := make([]webrtc.ICEServer, 0, len(s.config.Server.ICEServers))
+	for _, server := range s.config.Server.ICEServers {
+		servers = append(servers, webrtc.ICEServer{
+			URLs:       server.URLs,
+			Username:   server.Username,
+			Credential: server.Credential,
+		})
+	}
+	return servers
+}
+
+// iceConfig builds the configured ICE servers plus the embedded TURN relay
+// with fresh credentials for the participant
+func (s *Server) iceConfig(clientID string) (ICEConfigEvent, error) {
+	event := ICEConfigEvent{
+		Type:       "ice_config",
+		ICEServers: s.staticICEServers(),
+	}
+
+	if !s.config.TURN.Enabled {
+		return event, nil
+	}
+
+	ttl := s.config.TURN.CredentialTTL
+	username, password, err := turnserver.NewCredentials(s.config.TURN.Secret, clientID, ttl)
+	if err != nil {
+		return event, err
+	}
+
+	event.ICEServers = append(event.ICEServers, webrtc.ICEServer{
+		URLs:       s.config.TURN.URLs,
+		Username:   username,
+		Credential: password,
+	})
+	event.TTL = int64(ttl / time.Second)
+	return event, nil
+}
+
+func (s *Server) sendICEConfig(c *WebRTCClient) error {
+	event, err := s.iceConfig(c.clientID)
+	if err != nil {
+		return err
+	}
+	return c.sendJSON(event)
+}
@@ -0,0 +1,287 @@
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/elskow/codepair/peer-cp/client"
+	"go.uber.org/zap"
+)
+
+// Integrity signals, as they appear on the timeline
+const (
+	integrityPaste   = "paste"
+	integrityHidden  = "hidden"
+	integrityVisible = "visible"
+	integrityBlur    = "blur"
+	integrityFocus   = "focus"
+)
+
+const (
+	largePasteChars    = 200  // Pastes at least this long count as large
+	maxPasteHash       = 128  // Longest source hash kept, a hex SHA-512
+	maxIntegrityEvents = 5000 // Timeline entries kept per room, oldest dropped first
+)
+
+// IntegrityEvent is one paste or change of focus by the candidate
+type IntegrityEvent struct {
+	Type          string    `json:"type"`
+	At            time.Time `json:"at"`
+	ParticipantID string    `json:"participantId"`
+	Path          string    `json:"path,omitempty"`
+	Size          int       `json:"size,omitempty"` // Pasted characters
+	Hash          string    `json:"hash,omitempty"` // Hash of the pasted text, as the client computed it
+	Large         bool      `json:"large,omitempty"`
+	AwayMs        int64     `json:"awayMs,omitempty"` // How long the candidate was away, on coming back
+}
+
+// IntegritySummary counts a participant's integrity signals. It is only part
+// of the roster interviewers are served.
+type IntegritySummary struct {
+	Pastes      int        `json:"pastes"`
+	PastedChars int        `json:"pastedChars"`
+	LargePastes int        `json:"largePastes"`
+	TabSwitches int        `json:"tabSwitches"` // Times the tab was hidden
+	Blurs       int        `json:"blurs"`       // Times the window lost focus
+	AwayMs      int64      `json:"awayMs"`      // Time spent away, up to the current absence
+	AwaySince   *time.Time `json:"awaySince,omitempty"`
+}
+
+// IntegrityReport is the integrity artifact saved when the interview ends
+type IntegrityReport struct {
+	RoomID       string                      `json:"roomId"`
+	Participants map[string]IntegritySummary `json:"participants"`
+	Events       []IntegrityEvent            `json:"events"`
+}
+
+// integrity is what a participant did here. A tab switch usually also blurs
+// the window, so the participant is away until both are back.
+type integrity struct {
+	summary   IntegritySummary
+	hidden    bool
+	blurred   bool
+	awaySince time.Time
+}
+
+// merge adds the signals another instance saw from the same participant
+func (s *IntegritySummary) merge(other IntegritySummary) {
+	s.Pastes += other.Pastes
+	s.PastedChars += other.PastedChars
+	s.LargePastes += other.LargePastes
+	s.TabSwitches += other.TabSwitches
+	s.Blurs += other.Blurs
+	s.AwayMs += other.AwayMs
+	if other.AwaySince != nil && (s.AwaySince == nil || other.AwaySince.Before(*s.AwaySince)) {
+		s.AwaySince = other.AwaySince
+	}
+}
+
+// recordIntegrity adds a candidate's paste or focus change to the room's
+// timeline. Nothing is sent back, the candidate's editor carries on as usual.
+// Interviewers paste and switch tabs as part of the job, so theirs are ignored.
+func (s *Server) recordIntegrity(c Conn, room *Room, msg EditorMessage) {
+	room.clientsMutex.RLock()
+	editorClient, ok := room.editorClients[c]
+	room.clientsMutex.RUnlock()
+	if !ok || editorClient.user != nil {
+		return
+	}
+
+	event := IntegrityEvent{At: time.Now(), ParticipantID: editorClient.id}
+	switch msg.Type {
+	case "paste":
+		if msg.Size < 0 || len(msg.Hash) > maxPasteHash {
+			s.logger.Debug("Ignored invalid paste signal", zap.String("roomID", room.id))
+			return
+		}
+		event.Type = integrityPaste
+		event.Path = msg.Path
+		if path, err := cleanFilePath(msg.Path); err == nil {
+			event.Path = path
+		}
+		event.Size = msg.Size
+		event.Hash = msg.Hash
+		event.Large = msg.Size >= largePasteChars
+	case "visibility":
+		event.Type = integrityVisible
+		if msg.Hidden {
+			event.Type = integrityHidden
+		}
+	case "blur":
+		event.Type = integrityBlur
+	case "focus":
+		event.Type = integrityFocus
+	}
+
+	s.changePresence(room.id, room, true, func() {
+		state, ok := room.integrity[event.ParticipantID]
+		if !ok {
+			state = &integrity{}
+			room.integrity[event.ParticipantID] = state
+		}
+		if !state.apply(&event) {
+			return
+		}
+
+		room.integrityEvents = append(room.integrityEvents, event)
+		if dropped := len(room.integrityEvents) - maxIntegrityEvents; dropped > 0 {
+			room.integrityEvents = room.integrityEvents[dropped:]
+		}
+	})
+}
+
+// apply counts event. Repeats of the current focus state are not recorded.
+func (i *integrity) apply(event *IntegrityEvent) bool {
+	wasAway := i.hidden || i.blurred
+
+	switch event.Type {
+	case integrityPaste:
+		i.summary.Pastes++
+		i.summary.PastedChars += event.Size
+		if event.Large {
+			i.summary.LargePastes++
+		}
+		return true
+	case integrityHidden:
+		if i.hidden {
+			return false
+		}
+		i.hidden = true
+		i.summary.TabSwitches++
+	case integrityVisible:
+		if !i.hidden {
+			return false
+		}
+		i.hidden = false
+	case integrityBlur:
+		if i.blurred {
+			return false
+		}
+		i.blurred = true
+		i.summary.Blurs++
+	case integrityFocus:
+		if !i.blurred {
+			return false
+		}
+		i.blurred = false
+	}
+
+	switch away := i.hidden || i.blurred; {
+	case away && !wasAway:
+		i.awaySince = event.At
+		awaySince := event.At
+		i.summary.AwaySince = &awaySince
+	case !away && wasAway:
+		event.AwayMs = event.At.Sub(i.awaySince).Milliseconds()
+		i.summary.AwayMs += event.AwayMs
+		i.summary.AwaySince = nil
+	}
+	return true
+}
+
+// withoutIntegrity strips the integrity signals from roster entries sent to
+// editor clients, which include the candidate's
+func withoutIntegrity(entries []RosterEntry) []RosterEntry {
+	stripped := make([]RosterEntry, len(entries))
+	for i, entry := range entries {
+		entry.Integrity = nil
+		stripped[i] = entry
+	}
+	return stripped
+}
+
+// integrityChanged reports whether any participant's signals differ between
+// two rosters
+func integrityChanged(before, after []RosterEntry) bool {
+	previous := make(map[string]*IntegritySummary, len(before))
+	for _, entry := range before {
+		previous[entry.ID] = entry.Integrity
+	}
+	for _, entry := range after {
+		if !sameIntegrity(previous[entry.ID], entry.Integrity) {
+			return true
+		}
+	}
+	return false
+}
+
+func sameIntegrity(a, b *IntegritySummary) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	x, y := *a, *b
+	if (x.AwaySince == nil) != (y.AwaySince == nil) || x.AwaySince != nil && !x.AwaySince.Equal(*y.AwaySince) {
+		return false
+	}
+	x.AwaySince, y.AwaySince = nil, nil
+	return x == y
+}
+
+// saveIntegrityLater saves the integrity timeline of a room closed without
+// being ended, which would otherwise go with it. Shutdown waits for it.
+func (s *Server) saveIntegrityLater(room *Room) {
+	s.uploads.Add(1)
+	go func() {
+		defer s.uploads.Done()
+		if err := s.uploadIntegrity(room.id, room, s.interviewerToken(room)); err != nil {
+			s.logger.Error("Failed to save integrity timeline",
+				zap.String("roomID", room.id),
+				zap.Error(err))
+		}
+	}()
+}
+
+// uploadIntegrity saves the room's integrity timeline as an artifact. The
+// events it saves are taken off the room, so closing a room that was just
+// ended does not save them twice. They are put back if the upload fails.
+func (s *Server) uploadIntegrity(roomID string, room *Room, authToken string) (err error) {
+	s.presenceMutex.Lock()
+	report := IntegrityReport{
+		RoomID:       roomID,
+		Participants: make(map[string]IntegritySummary, len(room.integrity)),
+		Events:       room.integrityEvents,
+	}
+	room.integrityEvents = nil
+	for id, state := range room.integrity {
+		report.Participants[id] = state.summary
+	}
+	s.presenceMutex.Unlock()
+	if len(report.Events) == 0 {
+		return nil
+	}
+
+	defer func() {
+		if err != nil {
+			s.presenceMutex.Lock()
+			room.integrityEvents = append(report.Events, room.integrityEvents...)
+			s.presenceMutex.Unlock()
+		}
+	}()
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp("", "integrity-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return s.coreClient.UploadArtifact(roomID, authToken, client.Artifact{
+		Kind:        "integrity",
+		FileName:    "integrity-" + roomID + ".json",
+		ContentType: "application/json",
+		EndedAt:     time.Now(),
+	}, file.Name())
+}
@@ -0,0 +1,241 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/elskow/codepair/peer-cp/client"
+	"github.com/gofiber/websocket/v2"
+	"go.uber.org/zap"
+)
+
+// Close codes telling clients not to reconnect with the same credentials
+const (
+	closeRoomEnded     = 4000 // The interview is over
+	closeAccessRevoked = 4001 // The room token was rotated or the interviewer left the panel
+	closeRemoved       = 4002 // An interviewer removed the participant
+)
+
+const (
+	reasonInterviewEnded = "The interview has ended"
+	reasonRoomDeleted    = "The room no longer exists"
+)
+
+// RoomEndedEvent is the last message every client receives before the server
+// closes its connection. It is also sent, as access_revoked, to the clients
+// that lose access to a room that goes on.
+type RoomEndedEvent struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+// revalidateRooms checks every room against core on the validate interval
+// and ends the ones that were ended or deleted there
+func (s *Server) revalidateRooms() {
+	ticker := time.NewTicker(s.config.Server.ValidateInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.roomsMutex.RLock()
+		rooms := make(map[string]*Room, len(s.rooms))
+		for roomID, room := range s.rooms {
+			rooms[roomID] = room
+		}
+		s.roomsMutex.RUnlock()
+
+		for roomID, room := range rooms {
+			room.validationMutex.Lock()
+			token := room.token
+			room.validationMutex.Unlock()
+			if token == "" {
+				continue
+			}
+
+			validRoom, err := s.coreClient.ValidateRoom(roomID, token)
+			switch {
+			case errors.Is(err, client.ErrInvalidRoom):
+				s.endRoom(roomID, room, reasonRoomDeleted)
+			case err != nil:
+				// Keep the room open while core cannot be reached
+				s.logger.Warn("Failed to re-validate room",
+					zap.String("roomID", roomID),
+					zap.Error(err))
+			case !validRoom.IsActive:
+				s.endRoom(roomID, room, reasonInterviewEnded)
+			}
+		}
+	}
+}
+
+// endRoom saves the room's final state, tells every client the interview is
+// over and disconnects them. Each connection's own cleanup runs as its read
+// loop fails.
+func (s *Server) endRoom(roomID string, room *Room, reason string) {
+	room.validationMutex.Lock()
+	if room.ended {
+		room.validationMutex.Unlock()
+		return
+	}
+	room.ended = true
+	room.validationMutex.Unlock()
+
+	s.logger.Info("Ending room", zap.String("roomID", roomID), zap.String("reason", reason))
+
+	// Interviewer credentials are only at hand while they are connected
+	s.saveHistory(room, true)
+	s.flushRoomState(roomID, room)
+	s.stopRecording(roomID, room)
+
+	s.disconnectClients(room, RoomEndedEvent{Type: "room_ended", Reason: reason}, closeRoomEnded, "Room ended",
+		func(string, *client.User) bool { return true })
+
+	// Anyone joining later gets a fresh room, if core lets them in at all
+	s.roomsMutex.Lock()
+	if s.rooms[roomID] == room {
+		delete(s.rooms, roomID)
+	}
+	s.roomsMutex.Unlock()
+}
+
+// disconnectClients sends event to the clients match selects and closes their
+// connections with code
+func (s *Server) disconnectClients(room *Room, event interface{}, code int, text string, match func(token string, user *client.User) bool) {
+	message, err := json.Marshal(event)
+	if err != nil {
+		s.logger.Error("Failed to marshal disconnect event", zap.Error(err))
+		return
+	}
+	closeMessage := websocket.FormatCloseMessage(code, text)
+
+	room.clientsMutex.RLock()
+	var conns []Conn
+	for conn, ec := range room.editorClients {
+		if match(ec.token, ec.user) {
+			conns = append(conns, conn)
+		}
+	}
+	for conn, cc := range room.chatClients {
+		if match(cc.token, cc.user) {
+			conns = append(conns, conn)
+		}
+	}
+	for conn, nc := range room.notesClients {
+		if match(nc.token, nc.user) {
+			conns = append(conns, conn)
+		}
+	}
+	// Participants still running the pre-join check
+	for conn, lc := range room.lobbyClients {
+		if match(lc.token, lc.user) {
+			conns = append(conns, conn)
+		}
+	}
+	room.clientsMutex.RUnlock()
+
+	for _, conn := range conns {
+		conn.WriteMessage(websocket.TextMessage, message)
+		conn.WriteMessage(websocket.CloseMessage, closeMessage)
+		conn.Close()
+	}
+
+	s.roomsMutex.RLock()
+	var videoClients []*WebRTCClient
+	for _, wc := range room.webrtcClients {
+		if match(wc.token, wc.user) {
+			videoClients = append(videoClients, wc)
+		}
+	}
+	s.roomsMutex.RUnlock()
+
+	for _, wc := range videoClients {
+		wc.conn.WriteMessage(websocket.TextMessage, message)
+		wc.conn.WriteMessage(websocket.CloseMessage, closeMessage)
+		wc.conn.Close()
+	}
+}
+
+// flushRoomState saves the final workspace and the integrity timeline as
+// artifacts and the interview notes on the room. Everything goes up with the
+// service credential, or with a connected interviewer's when there is none.
+func (s *Server) flushRoomState(roomID string, room *Room) {
+	authToken := s.interviewerToken(room)
+
+	room.clientsMutex.RLock()
+	notes := room.currentNotes
+	room.clientsMutex.RUnlock()
+
+	if notes != "" {
+		if err := s.coreClient.SaveRoomNotes(roomID, authToken, notes); err != nil {
+			s.logger.Error("Failed to save room notes",
+				zap.String("roomID", roomID),
+				zap.Error(err))
+		}
+	}
+
+	if err := s.uploadIntegrity(roomID, room, authToken); err != nil {
+		s.logger.Error("Failed to save integrity timeline",
+			zap.String("roomID", roomID),
+			zap.Error(err))
+	}
+
+	if room.workspace.IsEmpty() {
+		return
+	}
+	if err := s.uploadWorkspace(roomID, room, authToken); err != nil {
+		s.logger.Error("Failed to save final workspace",
+			zap.String("roomID", roomID),
+			zap.Error(err))
+	}
+}
+
+func (s *Server) uploadWorkspace(roomID string, room *Room, authToken string) error {
+	archive, err := room.workspace.Archive()
+	if err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp("", "workspace-*.zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.Write(archive)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return s.coreClient.UploadArtifact(roomID, authToken, client.Artifact{
+		Kind:        "workspace",
+		FileName:    "workspace-" + roomID + ".zip",
+		ContentType: "application/zip",
+		EndedAt:     time.Now(),
+	}, file.Name())
+}
+
+// interviewerToken returns the access token of any interviewer connected to
+// the room's editor or video call
+func (s *Server) interviewerToken(room *Room) string {
+	room.clientsMutex.RLock()
+	for _, ec := range room.editorClients {
+		if ec.user != nil && ec.authToken != "" {
+			room.clientsMutex.RUnlock()
+			return ec.authToken
+		}
+	}
+	room.clientsMutex.RUnlock()
+
+	s.roomsMutex.RLock()
+	defer s.roomsMutex.RUnlock()
+	for _, wc := range room.webrtcClients {
+		if wc.user != nil && wc.authToken != "" {
+			return wc.authToken
+		}
+	}
+	return ""
+}
@@ -0,0 +1,509 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/websocket/v2"
+	"github.com/pion/webrtc/v4"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+)
+
+const (
+	lobbyChannelLabel   = "lobby"
+	lobbyConnectTimeout = 15 * time.Second // The loopback must be up by then or the client cannot reach the SFU
+	lobbyPings          = 10
+	lobbyPingInterval   = 100 * time.Millisecond
+	lobbyPingTimeout    = 2 * time.Second
+	lobbyProbeDuration  = 3 * time.Second // How long bulk data is looped back
+	lobbyChunkSize      = 16 * 1024
+	lobbyMaxBuffered    = 1024 * 1024 // Sending pauses while this much is queued
+)
+
+// Looped back throughput below which the call is rated poor or fair. A camera
+// and a screen share together need about 1.5 Mbps in each direction.
+const (
+	lobbyPoorKbps = 300
+	lobbyFairKbps = 1500
+)
+
+const (
+	connectivityUDP     = "udp"
+	connectivityTCP     = "tcp"
+	connectivityTURN    = "turn"
+	connectivityFailed  = "failed"
+	connectivityUnknown = "unknown"
+)
+
+// LobbyResult is the outcome of a participant's pre-join check. Connectivity
+// is how media reached the SFU: directly over UDP or TCP, through the TURN
+// relay, or not at all.
+type LobbyResult struct {
+	ClientID       string         `json:"clientId"`
+	Participant    string         `json:"participant"`
+	Connectivity   string         `json:"connectivity"`
+	NeedsTURN      bool           `json:"needsTurn"`
+	Level          string         `json:"level"`
+	RTTMs          float64        `json:"rttMs"`
+	ThroughputKbps float64        `json:"throughputKbps"`
+	CandidatePair  *CandidatePair `json:"candidatePair,omitempty"`
+	Error          string         `json:"error,omitempty"`
+	Timestamp      time.Time      `json:"timestamp"`
+}
+
+// LobbyEvent delivers a check result to the participant who ran it and to the
+// interviewers in the room
+type LobbyEvent struct {
+	Type   string      `json:"type"`
+	Result LobbyResult `json:"result"`
+}
+
+// lobbyPing is sent on the loopback channel and echoed back unchanged
+type lobbyPing struct {
+	Type   string `json:"type"`
+	Seq    int    `json:"seq"`
+	SentAt int64  `json:"sentAt"` // Unix nanoseconds
+}
+
+type lobbyEcho struct {
+	seq int
+	rtt time.Duration
+}
+
+// lobbyProbe is the server end of the loopback data channel
+type lobbyProbe struct {
+	opened   chan *webrtc.DataChannel
+	openOnce sync.Once
+	echoes   chan lobbyEcho
+	drained  chan struct{} // Signalled when the send buffer runs low
+	echoed   atomic.Uint64 // Bulk bytes received back
+}
+
+func newLobbyProbe() *lobbyProbe {
+	return &lobbyProbe{
+		opened:  make(chan *webrtc.DataChannel, 1),
+		echoes:  make(chan lobbyEcho, lobbyPings),
+		drained: make(chan struct{}, 1),
+	}
+}
+
+func (p *lobbyProbe) attach(dc *webrtc.DataChannel) {
+	if dc.Label() != lobbyChannelLabel {
+		return
+	}
+
+	dc.SetBufferedAmountLowThreshold(lobbyMaxBuffered / 2)
+	dc.OnBufferedAmountLow(func() {
+		select {
+		case p.drained <- struct{}{}:
+		default:
+		}
+	})
+
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		if !msg.IsString {
+			p.echoed.Add(uint64(len(msg.Data)))
+			return
+		}
+
+		var ping lobbyPing
+		if err := json.Unmarshal(msg.Data, &ping); err != nil || ping.Type != "ping" {
+			return
+		}
+		select {
+		case p.echoes <- lobbyEcho{seq: ping.Seq, rtt: time.Since(time.Unix(0, ping.SentAt))}:
+		default:
+		}
+	})
+
+	dc.OnOpen(func() {
+		p.openOnce.Do(func() { p.opened <- dc })
+	})
+}
+
+// measureRTT returns the median round trip of the echoed pings in
+// milliseconds, or zero if none came back
+func (p *lobbyProbe) measureRTT(ctx context.Context, dc *webrtc.DataChannel) float64 {
+	rtts := make([]float64, 0, lobbyPings)
+
+	for seq := 0; seq < lobbyPings; seq++ {
+		ping, err := json.Marshal(lobbyPing{Type: "ping", Seq: seq, SentAt: time.Now().UnixNano()})
+		if err != nil {
+			return 0
+		}
+		if err := dc.SendText(string(ping)); err != nil {
+			break
+		}
+
+		timeout := time.After(lobbyPingTimeout)
+	wait:
+		for {
+			select {
+			case echo := <-p.echoes:
+				// Late echoes of earlier pings are skipped
+				if echo.seq == seq {
+					rtts = append(rtts, float64(echo.rtt)/float64(time.Millisecond))
+					break wait
+				}
+			case <-timeout:
+				break wait
+			case <-ctx.Done():
+				return 0
+			}
+		}
+
+		time.Sleep(lobbyPingInterval)
+	}
+
+	if len(rtts) == 0 {
+		return 0
+	}
+	sort.Float64s(rtts)
+	return rtts[len(rtts)/2]
+}
+
+// measureThroughput sends bulk data for lobbyProbeDuration and returns the
+// rate it came back at in kbps. The loopback is limited by the slower of the
+// client's uplink and downlink.
+func (p *lobbyProbe) measureThroughput(ctx context.Context, dc *webrtc.DataChannel) float64 {
+	chunk := make([]byte, lobbyChunkSize)
+	start := time.Now()
+	deadline := start.Add(lobbyProbeDuration)
+
+	for time.Now().Before(deadline) {
+		if dc.BufferedAmount() > lobbyMaxBuffered {
+			select {
+			case <-p.drained:
+			case <-time.After(time.Until(deadline)):
+			case <-ctx.Done():
+				return 0
+			}
+			continue
+		}
+		if err := dc.Send(chunk); err != nil {
+			break
+		}
+	}
+
+	// Echoes still in flight at the deadline are not counted
+	return float64(p.echoed.Load()) * 8 / 1000 / time.Since(start).Seconds()
+}
+
+// HandleLobbyWS runs a pre-join network check. The client signals as on
+// /videochat, opens a "lobby" data channel and echoes back everything it
+// receives on it. The server measures the loopback, reports the result to
+// the client and the room's interviewers, then closes the connection.
+func (s *Server) HandleLobbyWS(c *websocket.Conn) {
+	defer c.Close()
+
+	ctx := context.WithValue(context.Background(), "requestID", c.Params("requestId"))
+	logger := s.getLogger(ctx)
+
+	roomID := c.Params("roomId")
+	token := c.Query("token")
+
+	validRoom, err := s.validateRoom(roomID, token)
+	if err != nil {
+		logger.Error("Room validation failed",
+			zap.String("roomID", roomID),
+			zap.Error(err))
+		return
+	}
+
+	if !validRoom.IsActive {
+		logger.Error("Room is not active",
+			zap.String("roomID", roomID))
+		c.WriteMessage(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, "Room is not active"))
+		return
+	}
+
+	authToken := bearerToken(c)
+	user, err := s.authenticateInterviewer(validRoom, authToken)
+	if errors.Is(err, errNotOnPanel) {
+		logger.Error("Lobby check rejected", zap.String("roomID", roomID), zap.Error(err))
+		c.WriteMessage(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "Not an interviewer of this room"))
+		return
+	}
+	if err != nil {
+		logger.Warn("Running lobby check without interviewer privileges", zap.Error(err))
+		authToken = ""
+	}
+	if s.removedFrom(roomID, validRoom, user) {
+		logger.Info("Lobby check rejected", zap.String("roomID", roomID), zap.Error(errRemoved))
+		c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(closeRemoved, "Removed"))
+		return
+	}
+
+	clientID := c.Query("clientId")
+	if clientID == "" {
+		clientID = fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+
+	out := s.newOutbox(c, s.config.Server.WriteQueue)
+	defer out.stop()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	conn, err := s.createPeerConnection()
+	if err != nil {
+		logger.Error("Failed to create peer connection", zap.Error(err))
+		return
+	}
+	pc := conn.pc
+	defer pc.Close()
+
+	client := &WebRTCClient{
+		conn:       out,
+		pc:         pc,
+		candidates: make([]webrtc.ICECandidateInit, 0),
+		ctx:        ctx,
+		cancel:     cancel,
+		clientID:   clientID,
+		token:      token,
+		name:       validRoom.CandidateName,
+		authToken:  authToken,
+		user:       user,
+	}
+	if user != nil {
+		client.name = user.Name
+		if client.name == "" {
+			client.name = user.Email
+		}
+	}
+
+	// The dashboard shows the candidate as waiting in the lobby meanwhile
+	p := &participant{
+		roomID:    roomID,
+		token:     token,
+		room:      validRoom,
+		authToken: authToken,
+		user:      user,
+	}
+	localRoom := s.getOrCreateRoom(roomID, token, validRoom.Removed)
+	localRoom.clientsMutex.Lock()
+	localRoom.lobbyClients[out] = client
+	localRoom.clientsMutex.Unlock()
+	s.enterPresence(localRoom, p, presenceLobby)
+
+	probe := newLobbyProbe()
+	pc.OnDataChannel(probe.attach)
+	pc.OnICECandidate(func(ice *webrtc.ICECandidate) {
+		if ice == nil {
+			return
+		}
+		if err := client.sendJSON(map[string]interface{}{
+			"type":      "ice_candidate",
+			"candidate": ice.ToJSON(),
+		}); err != nil {
+			logger.Error("Failed to send ICE candidate", zap.Error(err))
+		}
+	})
+
+	// The check should use the same servers the call will
+	if err := s.sendICEConfig(client); err != nil {
+		logger.Error("Failed to send ICE config", zap.Error(err))
+	}
+
+	go func() {
+		result := s.runLobbyCheck(client, probe)
+		if ctx.Err() != nil {
+			return // The client left before the check finished
+		}
+		pc.Close()
+		s.reportLobbyResult(roomID, client, result)
+
+		client.conn.WriteMessage(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, "Lobby check complete"))
+	}()
+
+	for {
+		_, msg, err := c.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				logger.Error("WebSocket error", zap.Error(err))
+			}
+			break
+		}
+
+		var signal map[string]interface{}
+		if err := json.Unmarshal(msg, &signal); err != nil {
+			logger.Error("Failed to parse signal", zap.Error(err))
+			continue
+		}
+
+		if signalType, _ := signal["type"].(string); signalType == "ice_config" {
+			if err := s.sendICEConfig(client); err != nil {
+				logger.Error("Failed to send ICE config", zap.Error(err))
+			}
+			continue
+		}
+
+		if _, ok := signal["sdp"]; ok {
+			desc, err := parseSessionDescription(signal)
+			if err != nil {
+				logger.Error("Failed to parse SDP", zap.Error(err))
+				continue
+			}
+			client.negotiationMutex.Lock()
+			err = s.applySDP(ctx, client, desc)
+			client.negotiationMutex.Unlock()
+			if err != nil {
+				logger.Error("Failed to handle SDP", zap.Error(err))
+			}
+		} else if candidate, ok := signal["candidate"].(map[string]interface{}); ok {
+			if err := s.handleICECandidate(ctx, client, candidate); err != nil {
+				logger.Error("Failed to handle ICE candidate", zap.Error(err))
+			}
+		}
+	}
+
+	localRoom.clientsMutex.Lock()
+	delete(localRoom.lobbyClients, out)
+	localRoom.clientsMutex.Unlock()
+
+	s.exitPresence(localRoom, p, presenceLobby)
+	s.closeRoomIfEmpty(ctx, localRoom)
+}
+
+// runLobbyCheck waits for the loopback channel and measures it. A client
+// that cannot connect within lobbyConnectTimeout gets a failed result.
+func (s *Server) runLobbyCheck(c *WebRTCClient, probe *lobbyProbe) LobbyResult {
+	result := LobbyResult{
+		ClientID:     c.clientID,
+		Participant:  c.name,
+		Connectivity: connectivityFailed,
+		Level:        qualityPoor,
+	}
+
+	var dc *webrtc.DataChannel
+	select {
+	case dc = <-probe.opened:
+	case <-time.After(lobbyConnectTimeout):
+		result.Error = "could not connect to the media server"
+		result.Timestamp = time.Now()
+		return result
+	case <-c.ctx.Done():
+		return result
+	}
+
+	result.RTTMs = probe.measureRTT(c.ctx, dc)
+	result.ThroughputKbps = probe.measureThroughput(c.ctx, dc)
+
+	pair, iceRTT := selectedCandidatePair(c.pc)
+	if result.RTTMs == 0 {
+		result.RTTMs = iceRTT // The client did not echo the pings
+	}
+	result.CandidatePair = pair
+	result.Connectivity = connectivity(pair)
+	result.NeedsTURN = result.Connectivity == connectivityTURN
+	result.Level = lobbyLevel(result)
+	result.Timestamp = time.Now()
+	return result
+}
+
+// connectivity names the route of the client's side of the pair; a relay
+// candidate is an address on the TURN server
+func connectivity(pair *CandidatePair) string {
+	switch {
+	case pair == nil:
+		return connectivityUnknown
+	case pair.Remote == webrtc.ICECandidateTypeRelay.String():
+		return connectivityTURN
+	case strings.EqualFold(pair.Protocol, "tcp"):
+		return connectivityTCP
+	default:
+		return connectivityUDP
+	}
+}
+
+func lobbyLevel(result LobbyResult) string {
+	switch {
+	case result.RTTMs > poorRTTMs || result.ThroughputKbps < lobbyPoorKbps:
+		return qualityPoor
+	case result.RTTMs > fairRTTMs || result.ThroughputKbps < lobbyFairKbps:
+		return qualityFair
+	default:
+		return qualityGood
+	}
+}
+
+// reportLobbyResult sends the result to the participant and to the
+// interviewers already in the video call. The room keeps it for
+// interviewers who join later.
+func (s *Server) reportLobbyResult(roomID string, c *WebRTCClient, result LobbyResult) {
+	event := LobbyEvent{Type: "lobby_result", Result: result}
+	if err := c.sendJSON(event); err != nil {
+		s.logger.Error("Failed to send lobby result", zap.Error(err))
+	}
+
+	room := s.getOrCreateRoom(roomID, c.token, nil)
+	room.lobbyMutex.Lock()
+	room.lobbyResults[result.ClientID] = result
+	room.lobbyMutex.Unlock()
+
+	s.sendToInterviewers(room, event)
+
+	s.logger.Info("Lobby check finished",
+		zap.String("roomID", roomID),
+		zap.String("clientID", result.ClientID),
+		zap.String("connectivity", result.Connectivity),
+		zap.Float64("rttMs", result.RTTMs),
+		zap.Float64("throughputKbps", result.ThroughputKbps))
+}
+
+// sendLobbyResults catches an interviewer up on the checks run so far
+func (s *Server) sendLobbyResults(room *Room, c *WebRTCClient) error {
+	room.lobbyMutex.Lock()
+	results := make([]LobbyResult, 0, len(room.lobbyResults))
+	for _, result := range room.lobbyResults {
+		results = append(results, result)
+	}
+	room.lobbyMutex.Unlock()
+
+	for _, result := range results {
+		if err := c.sendJSON(LobbyEvent{Type: "lobby_result", Result: result}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendToInterviewers sends a message to the interviewers in the video call,
+// on this instance and the others
+func (s *Server) sendToInterviewers(room *Room, v interface{}) {
+	message, err := json.Marshal(v)
+	if err != nil {
+		s.logger.Error("Failed to marshal video event", zap.Error(err))
+		return
+	}
+	s.deliverVideoInterviewers(room, message)
+	s.publish(room.id, "", busVideoInterviewers, message)
+}
+
+func (s *Server) deliverVideoInterviewers(room *Room, message []byte) {
+	header := parseHeader(message)
+
+	s.roomsMutex.RLock()
+	defer s.roomsMutex.RUnlock()
+
+	for _, wc := range room.webrtcClients {
+		if wc.user == nil {
+			continue
+		}
+		if err := wc.conn.writeText(header, message); err != nil {
+			s.logger.Error("Failed to send event to interviewer",
+				zap.String("clientID", wc.clientID),
+				zap.Error(err))
+		}
+	}
+}
@@ -3,22 +3,29 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 
-	"github.com/gofiber/websocket/v2"
+	"github.com/elskow/codepair/peer-cp/client"
 	"go.uber.org/zap"
 )
 
 type NotesClient struct {
-	conn *websocket.Conn
+	conn  Conn
+	token string
+	user  *client.User // Resolved from the interviewer token, nil for candidates
 }
 
 type NotesMessage struct {
 	Type    string `json:"type"`
 	Content string `json:"content,omitempty"`
 	HTML    string `json:"html,omitempty"`
+	Error   string `json:"error,omitempty"`
 }
 
-func (s *Server) handleNotesMessage(ctx context.Context, c *websocket.Conn, roomID string, msg NotesMessage) {
+var errNotesReadOnly = errors.New("only interviewers can edit the notes")
+
+func (s *Server) handleNotesMessage(ctx context.Context, c Conn, roomID string, msg NotesMessage) {
 	logger := s.getLogger(ctx)
 
 	s.roomsMutex.RLock()
@@ -30,10 +37,25 @@ func (s *Server) handleNotesMessage(ctx context.Context, c *websocket.Conn, room
 		return
 	}
 
+	room.clientsMutex.RLock()
+	notesClient, ok := room.notesClients[c]
+	room.clientsMutex.RUnlock()
+
 	switch msg.Type {
 	case "content":
-		room.currentNotes = msg.Content
+		// Notes are the panel's, candidates only read them
+		if !ok || notesClient.user == nil {
+			logger.Warn("Rejected notes from a candidate", zap.String("roomID", roomID))
+			s.sendNotesError(c, errNotesReadOnly)
+			return
+		}
+		room.setNotes(msg.Content)
 		logger.Debug("Notes updated", zap.String("roomID", roomID))
+
+	default:
+		// Sync only comes from the server
+		s.sendNotesError(c, fmt.Errorf("unknown notes message type %q", msg.Type))
+		return
 	}
 
 	messageJSON, err := json.Marshal(msg)
@@ -42,14 +64,37 @@ func (s *Server) handleNotesMessage(ctx context.Context, c *websocket.Conn, room
 		return
 	}
 
+	s.deliverNotes(room, c, messageJSON)
+	s.publish(roomID, "", busNotes, messageJSON)
+}
+
+func (s *Server) sendNotesError(c Conn, err error) {
+	if writeErr := c.WriteJSON(NotesMessage{
+		Type:  "error",
+		Error: err.Error(),
+	}); writeErr != nil {
+		s.logger.Error("Failed to send notes error", zap.Error(writeErr))
+	}
+}
+
+func (r *Room) setNotes(content string) {
+	r.clientsMutex.Lock()
+	r.currentNotes = content
+	r.clientsMutex.Unlock()
+}
+
+// deliverNotes sends a message to the notes clients connected here except exclude
+func (s *Server) deliverNotes(room *Room, exclude Conn, message []byte) {
+	header := parseHeader(message)
+
 	room.clientsMutex.RLock()
+	defer room.clientsMutex.RUnlock()
+
 	for client := range room.notesClients {
-		if client != c {
-			err := client.WriteMessage(websocket.TextMessage, messageJSON)
-			if err != nil {
-				logger.Error("Failed to broadcast notes message", zap.Error(err))
+		if client != exclude {
+			if err := client.writeText(header, message); err != nil {
+				s.logger.Error("Failed to broadcast notes message", zap.Error(err))
 			}
 		}
 	}
-	room.clientsMutex.RUnlock()
 }
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gofiber/websocket/v2"
+)
+
+var (
+	errOutboxFull   = errors.New("write queue full")
+	errOutboxClosed = errors.New("connection closed")
+)
+
+// outbox queues a connection's outgoing messages and writes them from a
+// goroutine of its own, so a slow client holds up neither the room nor the
+// sender. A newer code or cursor update for the same file or participant
+// takes the place of one still queued, and a client that falls further behind
+// than the queue allows is disconnected.
+type outbox struct {
+	conn    socket
+	limit   int
+	timeout time.Duration
+
+	mu      sync.Mutex
+	queue   []outgoing
+	closing bool // Close was called, the queue is written out first
+	closed  bool
+
+	wake chan struct{}
+	done chan struct{}
+}
+
+type outgoing struct {
+	messageType int
+	data        []byte
+	key         string // A newer message with the same key replaces this one
+}
+
+// socket is the connection an outbox writes to
+type socket interface {
+	WriteMessage(messageType int, data []byte) error
+	SetWriteDeadline(t time.Time) error
+	UnderlyingConn() net.Conn
+}
+
+// messageHeader is the part of an outgoing message the server looks at
+type messageHeader struct {
+	Type     string `json:"type"`
+	Path     string `json:"path"`
+	ClientID string `json:"clientId"`
+}
+
+func parseHeader(data []byte) messageHeader {
+	var header messageHeader
+	json.Unmarshal(data, &header)
+	return header
+}
+
+// coalesceKey identifies the messages a newer one makes obsolete: code
+// updates carry the whole file, and only the latest cursor matters
+func (h messageHeader) coalesceKey() string {
+	switch h.Type {
+	case "code", "cursor":
+		return h.Type + "\x00" + h.Path + "\x00" + h.ClientID
+	}
+	return ""
+}
+
+func (s *Server) newOutbox(conn socket, limit int) *outbox {
+	o := &outbox{
+		conn:    conn,
+		limit:   limit,
+		timeout: s.config.Server.WriteTimeout,
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	go o.run()
+	return o
+}
+
+func (o *outbox) WriteMessage(messageType int, data []byte) error {
+	if messageType == websocket.TextMessage {
+		return o.writeText(parseHeader(data), data)
+	}
+	return o.push(messageType, data, "")
+}
+
+func (o *outbox) writeText(header messageHeader, data []byte) error {
+	return o.push(websocket.TextMessage, data, header.coalesceKey())
+}
+
+func (o *outbox) WriteJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return o.WriteMessage(websocket.TextMessage, data)
+}
+
+// Close writes out what is queued and then closes the connection. It does
+// not wait, as it is called with room locks held.
+func (o *outbox) Close() error {
+	o.mu.Lock()
+	o.closing = true
+	o.mu.Unlock()
+
+	o.signal()
+	return nil
+}
+
+// stop drops what is still queued and waits for the writer. Handlers call
+// it before returning, since the connection is reused after that.
+func (o *outbox) stop() {
+	o.mu.Lock()
+	o.closed = true
+	o.queue = nil
+	o.mu.Unlock()
+
+	o.signal()
+	o.disconnect()
+	<-o.done
+}
+
+// disconnect fails the connection's pending read and write. fasthttp only
+// closes a hijacked connection once the handler returns, so Close on it
+// would not stop the reader.
+func (o *outbox) disconnect() {
+	o.conn.UnderlyingConn().SetDeadline(time.Now())
+}
+
+func (o *outbox) push(messageType int, data []byte, key string) error {
+	o.mu.Lock()
+	if o.closed || o.closing {
+		o.mu.Unlock()
+		return errOutboxClosed
+	}
+
+	// Replaced in place, an update that keeps changing is not held back
+	// behind what was queued after it
+	if key != "" {
+		for i := range o.queue {
+			if o.queue[i].key == key {
+				o.queue[i].data = data
+				o.mu.Unlock()
+				return nil
+			}
+		}
+	}
+
+	if len(o.queue) >= o.limit {
+		o.closed = true
+		o.queue = nil
+		o.mu.Unlock()
+
+		// The reader notices and cleans the client up
+		o.disconnect()
+		return errOutboxFull
+	}
+
+	o.queue = append(o.queue, outgoing{messageType: messageType, data: data, key: key})
+	o.mu.Unlock()
+
+	o.signal()
+	return nil
+}
+
+func (o *outbox) signal() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (o *outbox) run() {
+	defer close(o.done)
+
+	for range o.wake {
+		for {
+			o.mu.Lock()
+			if o.closed {
+				o.mu.Unlock()
+				return
+			}
+			if len(o.queue) == 0 {
+				closing := o.closing
+				o.closed = closing
+				o.mu.Unlock()
+
+				if closing {
+					o.disconnect()
+					return
+				}
+				break
+			}
+			next := o.queue[0]
+			o.queue = o.queue[1:]
+			o.mu.Unlock()
+
+			o.conn.SetWriteDeadline(time.Now().Add(o.timeout))
+			if err := o.conn.WriteMessage(next.messageType, next.data); err != nil {
+				o.mu.Lock()
+				o.closed = true
+				o.queue = nil
+				o.mu.Unlock()
+
+				o.disconnect()
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/gofiber/websocket/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutboxCoalescing(t *testing.T) {
+	const (
+		codeA1  = `{"type":"code","path":"a.py","code":"1"}`
+		codeA2  = `{"type":"code","path":"a.py","code":"2"}`
+		codeA3  = `{"type":"code","path":"a.py","code":"3"}`
+		codeB   = `{"type":"code","path":"b.py","code":"1"}`
+		cursor1 = `{"type":"cursor","clientId":"u1","cursor":{"line":1}}`
+		cursor2 = `{"type":"cursor","clientId":"u1","cursor":{"line":2}}`
+		cursorC = `{"type":"cursor","clientId":"candidate","cursor":{"line":1}}`
+		chat1   = `{"type":"chat","content":"hi"}`
+		chat2   = `{"type":"chat","content":"hi"}`
+		control = `{"type":"controls"}`
+	)
+
+	tests := []struct {
+		name  string
+		limit int
+		sent  []string
+		want  []string
+		full  bool // The last message overflowed the queue
+	}{
+		{
+			name:  "distinct messages keep their order",
+			limit: 8,
+			sent:  []string{codeA1, chat1, cursor1, control},
+			want:  []string{codeA1, chat1, cursor1, control},
+		},
+		{
+			name:  "code update takes the queued one's place",
+			limit: 8,
+			sent:  []string{codeA1, chat1, codeA2},
+			want:  []string{codeA2, chat1},
+		},
+		{
+			name:  "repeated updates stay ahead of later messages",
+			limit: 8,
+			sent:  []string{codeA1, chat1, codeA2, control, codeA3},
+			want:  []string{codeA3, chat1, control},
+		},
+		{
+			name:  "code for other files is kept",
+			limit: 8,
+			sent:  []string{codeA1, codeB, codeA2},
+			want:  []string{codeA2, codeB},
+		},
+		{
+			name:  "cursor update takes the queued one's place",
+			limit: 8,
+			sent:  []string{cursor1, cursorC, control, cursor2},
+			want:  []string{cursor2, cursorC, control},
+		},
+		{
+			name:  "other messages are never coalesced",
+			limit: 8,
+			sent:  []string{chat1, chat2},
+			want:  []string{chat1, chat2},
+		},
+		{
+			name:  "coalescing does not count against the limit",
+			limit: 2,
+			sent:  []string{codeA1, chat1, codeA2, codeA3},
+			want:  []string{codeA3, chat1},
+		},
+		{
+			name:  "falling behind the limit disconnects",
+			limit: 2,
+			sent:  []string{codeA1, chat1, control},
+			full:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			socket := newFakeSocket(t)
+			// Not started, so everything sent stays queued
+			o := &outbox{
+				conn:  socket,
+				limit: tt.limit,
+				wake:  make(chan struct{}, 1),
+				done:  make(chan struct{}),
+			}
+
+			var err error
+			for _, message := range tt.sent {
+				err = o.WriteMessage(websocket.TextMessage, []byte(message))
+			}
+			if tt.full {
+				assert.ErrorIs(t, err, errOutboxFull)
+				assert.Empty(t, o.queue)
+				return
+			}
+			require.NoError(t, err)
+
+			go o.run()
+			require.NoError(t, o.Close())
+			<-o.done
+			assert.Equal(t, tt.want, socket.written())
+		})
+	}
+}
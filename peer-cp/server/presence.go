@@ -0,0 +1,501 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+)
+
+// Roster roles and states
+const (
+	roleInterviewer = "interviewer"
+	roleCandidate   = "candidate"
+
+	presenceActive = "active"
+	presenceIdle   = "idle"
+)
+
+// Channels a participant can be present on besides the session channels
+const (
+	presenceVideo = "video"
+	presenceLobby = "lobby"
+)
+
+// rosterKeepAlive is how often a roster stream is written to when nothing changes
+const rosterKeepAlive = 15 * time.Second
+
+// RosterEntry is a participant of a room, across all of their connections
+type RosterEntry struct {
+	ID           string    `json:"id"` // User ID of an interviewer, "candidate" otherwise
+	Name         string    `json:"name"`
+	Role         string    `json:"role"`
+	Channels     []string  `json:"channels"`
+	JoinedAt     time.Time `json:"joinedAt"`
+	LastActiveAt time.Time `json:"lastActiveAt"`
+	State        string    `json:"state"`
+
+	Integrity *IntegritySummary `json:"integrity,omitempty"` // Candidate only, left out of what editor clients get
+}
+
+// PresenceEvent tells editor clients who joined, left or changed state. A
+// client gets the whole roster when it joins.
+type PresenceEvent struct {
+	Type        string        `json:"type"`
+	Participant *RosterEntry  `json:"participant,omitempty"`
+	Roster      []RosterEntry `json:"roster,omitempty"`
+}
+
+// presence is a participant's connections to a room on this instance
+type presence struct {
+	entry    RosterEntry
+	channels map[string]int // Open connections per channel
+	idle     bool
+}
+
+// remoteRoster is the part of a room's roster another instance holds
+type remoteRoster struct {
+	entries    []RosterEntry
+	receivedAt time.Time
+}
+
+// identity is how the participant shows up in the roster. Participants
+// without an interviewer token are the candidate.
+func (p *participant) identity() (id, name, role string) {
+	if p.user == nil {
+		return roleCandidate, p.room.CandidateName, roleCandidate
+	}
+	name = p.user.Name
+	if name == "" {
+		name = p.user.Email
+	}
+	return p.user.ID, name, roleInterviewer
+}
+
+// enterPresence records that the participant opened a connection on channel
+func (s *Server) enterPresence(room *Room, p *participant, channel string) {
+	id, name, role := p.identity()
+	now := time.Now()
+
+	s.changePresence(room.id, room, true, func() {
+		entry, ok := room.presence[id]
+		if !ok {
+			entry = &presence{
+				entry:    RosterEntry{ID: id, Name: name, Role: role, JoinedAt: now},
+				channels: make(map[string]int),
+			}
+			room.presence[id] = entry
+		}
+		entry.channels[channel]++
+		entry.entry.LastActiveAt = now
+		entry.idle = false
+	})
+}
+
+// exitPresence records that the participant closed a connection on channel
+func (s *Server) exitPresence(room *Room, p *participant, channel string) {
+	id, _, _ := p.identity()
+
+	s.changePresence(room.id, room, true, func() {
+		entry, ok := room.presence[id]
+		if !ok {
+			return
+		}
+		entry.channels[channel]--
+		if entry.channels[channel] <= 0 {
+			delete(entry.channels, channel)
+		}
+		if len(entry.channels) == 0 {
+			delete(room.presence, id)
+		}
+	})
+}
+
+// touchPresence marks the participant active. Only a participant coming
+// back from idle changes the roster.
+func (s *Server) touchPresence(room *Room, p *participant) {
+	id, _, _ := p.identity()
+	now := time.Now()
+
+	s.presenceMutex.Lock()
+	entry, ok := room.presence[id]
+	idle := ok && entry.idle
+	if ok && !idle {
+		entry.entry.LastActiveAt = now
+	}
+	s.presenceMutex.Unlock()
+	if !idle {
+		return
+	}
+
+	s.changePresence(room.id, room, true, func() {
+		entry.entry.LastActiveAt = now
+		entry.idle = false
+	})
+}
+
+// changePresence applies change to the presence of a room and tells the
+// room's editor clients and roster streams about the difference. room is
+// nil for a room with no clients here. A local change is published to the
+// other instances.
+func (s *Server) changePresence(roomID string, room *Room, local bool, change func()) {
+	s.presenceMutex.Lock()
+	before := s.rosterLocked(roomID, room)
+	change()
+	after := s.rosterLocked(roomID, room)
+	var snapshot []RosterEntry
+	if local && room != nil {
+		snapshot = localRoster(room)
+	}
+	watchers := make([]chan struct{}, 0, len(s.rosterWatchers[roomID]))
+	for watcher := range s.rosterWatchers[roomID] {
+		watchers = append(watchers, watcher)
+	}
+	s.presenceMutex.Unlock()
+
+	events := diffRoster(before, after)
+	if len(events) == 0 && !integrityChanged(before, after) {
+		return
+	}
+
+	if room != nil {
+		for _, event := range events {
+			participant := *event.Participant
+			participant.Integrity = nil
+			event.Participant = &participant
+
+			message, err := json.Marshal(event)
+			if err != nil {
+				s.logger.Error("Failed to marshal presence event", zap.Error(err))
+				continue
+			}
+			s.deliverEditor(room, nil, message)
+		}
+	}
+
+	for _, watcher := range watchers {
+		select {
+		case watcher <- struct{}{}:
+		default:
+		}
+	}
+
+	if local {
+		s.publishPresence(roomID, snapshot)
+	}
+}
+
+func (s *Server) publishPresence(roomID string, entries []RosterEntry) {
+	if entries == nil {
+		entries = []RosterEntry{}
+	}
+	payload, err := json.Marshal(entries)
+	if err != nil {
+		s.logger.Error("Failed to marshal presence", zap.Error(err))
+		return
+	}
+	s.publish(roomID, "", busPresence, payload)
+}
+
+// applyRemotePresence replaces what another instance holds of a room's roster
+func (s *Server) applyRemotePresence(roomID, instanceID string, entries []RosterEntry) {
+	s.roomsMutex.RLock()
+	room := s.rooms[roomID]
+	s.roomsMutex.RUnlock()
+
+	s.changePresence(roomID, room, false, func() {
+		rosters, ok := s.remotePresence[roomID]
+		if !ok {
+			rosters = make(map[string]remoteRoster)
+			s.remotePresence[roomID] = rosters
+		}
+		if len(entries) == 0 {
+			delete(rosters, instanceID)
+		} else {
+			rosters[instanceID] = remoteRoster{entries: entries, receivedAt: time.Now()}
+		}
+		if len(rosters) == 0 {
+			delete(s.remotePresence, roomID)
+		}
+	})
+}
+
+// roster returns the participants of a room on every instance
+func (s *Server) roster(roomID string) []RosterEntry {
+	s.roomsMutex.RLock()
+	room := s.rooms[roomID]
+	s.roomsMutex.RUnlock()
+
+	s.presenceMutex.Lock()
+	defer s.presenceMutex.Unlock()
+	return s.rosterLocked(roomID, room)
+}
+
+// rosterLocked merges the local and remote entries of a participant, who may
+// be connected to several instances. The caller holds presenceMutex.
+func (s *Server) rosterLocked(roomID string, room *Room) []RosterEntry {
+	merged := make(map[string]*RosterEntry)
+	add := func(entry RosterEntry) {
+		existing, ok := merged[entry.ID]
+		if !ok {
+			entry.Channels = slices.Clone(entry.Channels)
+			if entry.Integrity != nil {
+				integrity := *entry.Integrity
+				entry.Integrity = &integrity
+			}
+			merged[entry.ID] = &entry
+			return
+		}
+		for _, channel := range entry.Channels {
+			if !slices.Contains(existing.Channels, channel) {
+				existing.Channels = append(existing.Channels, channel)
+			}
+		}
+		if entry.JoinedAt.Before(existing.JoinedAt) {
+			existing.JoinedAt = entry.JoinedAt
+		}
+		if entry.LastActiveAt.After(existing.LastActiveAt) {
+			existing.LastActiveAt = entry.LastActiveAt
+		}
+		if entry.State == presenceActive {
+			existing.State = presenceActive
+		}
+		if entry.Integrity != nil {
+			if existing.Integrity == nil {
+				existing.Integrity = &IntegritySummary{}
+			}
+			existing.Integrity.merge(*entry.Integrity)
+		}
+	}
+
+	if room != nil {
+		for _, entry := range localRoster(room) {
+			add(entry)
+		}
+	}
+	for _, remote := range s.remotePresence[roomID] {
+		for _, entry := range remote.entries {
+			add(entry)
+		}
+	}
+
+	roster := make([]RosterEntry, 0, len(merged))
+	for _, entry := range merged {
+		slices.Sort(entry.Channels)
+		roster = append(roster, *entry)
+	}
+	slices.SortFunc(roster, func(a, b RosterEntry) int {
+		if c := a.JoinedAt.Compare(b.JoinedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+	return roster
+}
+
+// localRoster lists the participants connected here. The caller holds
+// presenceMutex.
+func localRoster(room *Room) []RosterEntry {
+	entries := make([]RosterEntry, 0, len(room.presence))
+	for _, p := range room.presence {
+		entry := p.entry
+		entry.Channels = make([]string, 0, len(p.channels))
+		for channel := range p.channels {
+			entry.Channels = append(entry.Channels, channel)
+		}
+		slices.Sort(entry.Channels)
+		entry.State = presenceActive
+		if p.idle {
+			entry.State = presenceIdle
+		}
+		if state, ok := room.integrity[entry.ID]; ok {
+			summary := state.summary
+			entry.Integrity = &summary
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// diffRoster turns two rosters into the events between them
+func diffRoster(before, after []RosterEntry) []PresenceEvent {
+	previous := make(map[string]RosterEntry, len(before))
+	for _, entry := range before {
+		previous[entry.ID] = entry
+	}
+
+	var events []PresenceEvent
+	for _, entry := range after {
+		entry := entry
+		old, existed := previous[entry.ID]
+		delete(previous, entry.ID)
+		switch {
+		case !existed:
+			events = append(events, PresenceEvent{Type: "presence_join", Participant: &entry})
+		case old.State != entry.State || old.Name != entry.Name || !slices.Equal(old.Channels, entry.Channels):
+			events = append(events, PresenceEvent{Type: "presence_update", Participant: &entry})
+		}
+	}
+	for _, entry := range before {
+		if _, left := previous[entry.ID]; left {
+			entry := entry
+			events = append(events, PresenceEvent{Type: "presence_leave", Participant: &entry})
+		}
+	}
+	return events
+}
+
+// sendRoster sends the whole roster to a client that just joined the editor
+func (s *Server) sendRoster(c Conn, roomID string) error {
+	return c.WriteJSON(PresenceEvent{Type: "roster", Roster: withoutIntegrity(s.roster(roomID))})
+}
+
+// sweepPresence marks participants idle, republishes this instance's part of
+// every roster and drops the parts of instances that stopped publishing
+func (s *Server) sweepPresence() {
+	idleAfter := s.config.Server.IdleAfter
+	ticker := time.NewTicker(idleAfter / 4)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.roomsMutex.RLock()
+		rooms := make([]*Room, 0, len(s.rooms))
+		for _, room := range s.rooms {
+			rooms = append(rooms, room)
+		}
+		s.roomsMutex.RUnlock()
+
+		for _, room := range rooms {
+			s.presenceMutex.Lock()
+			var idle []*presence
+			for _, p := range room.presence {
+				if !p.idle && time.Since(p.entry.LastActiveAt) > idleAfter {
+					idle = append(idle, p)
+				}
+			}
+			snapshot := localRoster(room)
+			s.presenceMutex.Unlock()
+
+			if len(idle) > 0 {
+				s.changePresence(room.id, room, true, func() {
+					for _, p := range idle {
+						p.idle = true
+					}
+				})
+			} else if len(snapshot) > 0 {
+				s.publishPresence(room.id, snapshot)
+			}
+		}
+
+		s.presenceMutex.Lock()
+		var stale []string
+		for roomID, rosters := range s.remotePresence {
+			for _, remote := range rosters {
+				if time.Since(remote.receivedAt) > idleAfter {
+					stale = append(stale, roomID)
+					break
+				}
+			}
+		}
+		s.presenceMutex.Unlock()
+
+		for _, roomID := range stale {
+			s.roomsMutex.RLock()
+			room := s.rooms[roomID]
+			s.roomsMutex.RUnlock()
+
+			s.changePresence(roomID, room, false, func() {
+				for instanceID, remote := range s.remotePresence[roomID] {
+					if time.Since(remote.receivedAt) > idleAfter {
+						delete(s.remotePresence[roomID], instanceID)
+					}
+				}
+				if len(s.remotePresence[roomID]) == 0 {
+					delete(s.remotePresence, roomID)
+				}
+			})
+		}
+	}
+}
+
+// HandleRoster lists who is connected to a room, for the interviewer
+// dashboard. It needs the room token and an interviewer access token. With
+// Accept: text/event-stream the roster is streamed again on every change.
+func (s *Server) HandleRoster(c *fiber.Ctx) error {
+	roomID := c.Params("roomId")
+	token := c.Get("X-Room-Token", c.Query("token"))
+
+	validRoom, err := s.validateRoom(roomID, token)
+	if err != nil {
+		return fiber.ErrUnauthorized
+	}
+	if !validRoom.IsActive {
+		return fiber.NewError(fiber.StatusForbidden, "room is not active")
+	}
+
+	user, err := s.authenticateInterviewer(validRoom, strings.TrimPrefix(c.Get(fiber.HeaderAuthorization), "Bearer "))
+	if err != nil || user == nil {
+		return fiber.ErrUnauthorized
+	}
+
+	if !strings.Contains(c.Get(fiber.HeaderAccept), "text/event-stream") {
+		return c.JSON(fiber.Map{"roster": s.roster(roomID)})
+	}
+
+	watcher := make(chan struct{}, 1)
+	s.presenceMutex.Lock()
+	if s.rosterWatchers[roomID] == nil {
+		s.rosterWatchers[roomID] = make(map[chan struct{}]struct{})
+	}
+	s.rosterWatchers[roomID][watcher] = struct{}{}
+	s.presenceMutex.Unlock()
+
+	c.Set(fiber.HeaderContentType, "text/event-stream")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer func() {
+			s.presenceMutex.Lock()
+			delete(s.rosterWatchers[roomID], watcher)
+			if len(s.rosterWatchers[roomID]) == 0 {
+				delete(s.rosterWatchers, roomID)
+			}
+			s.presenceMutex.Unlock()
+		}()
+
+		keepAlive := time.NewTicker(rosterKeepAlive)
+		defer keepAlive.Stop()
+
+		changed := true
+		for {
+			if changed {
+				data, err := json.Marshal(s.roster(roomID))
+				if err != nil {
+					s.logger.Error("Failed to marshal roster", zap.Error(err))
+					return
+				}
+				fmt.Fprintf(w, "event: roster\ndata: %s\n\n", data)
+			} else {
+				// Also notices a dashboard that went away
+				fmt.Fprint(w, ": keep-alive\n\n")
+			}
+			if err := w.Flush(); err != nil {
+				return
+			}
+
+			select {
+			case <-watcher:
+				changed = true
+			case <-keepAlive.C:
+				changed = false
+			case <-s.shuttingDown:
+				return
+			}
+		}
+	})
+	return nil
+}
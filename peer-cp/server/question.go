@@ -0,0 +1,99 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sort"
+
+	"github.com/elskow/codepair/peer-cp/client"
+	"go.uber.org/zap"
+)
+
+const statementFilePath = "README.md"
+
+// loadQuestion replaces the live editor content with a question's starter code
+// and statement for everyone in the room. Only interviewers may do this.
+func (s *Server) loadQuestion(ctx context.Context, c Conn, roomID string, room *Room, msg EditorMessage) error {
+	logger := s.getLogger(ctx)
+
+	room.clientsMutex.RLock()
+	editorClient, ok := room.editorClients[c]
+	room.clientsMutex.RUnlock()
+	if !ok {
+		return errors.New("editor client not found")
+	}
+
+	if editorClient.user == nil {
+		return errors.New("only interviewers can load questions")
+	}
+	if msg.QuestionID == "" {
+		return errors.New("questionId is required")
+	}
+
+	problem, err := s.coreClient.GetProblem(msg.QuestionID, editorClient.authToken)
+	if err != nil {
+		logger.Error("Failed to load question",
+			zap.String("roomID", roomID),
+			zap.String("questionID", msg.QuestionID),
+			zap.Error(err))
+		return errors.New("question not found")
+	}
+
+	language := msg.Language
+	if language == "" {
+		if current, ok := room.workspace.Get(DefaultFilePath); ok {
+			language = current.Language
+		}
+	}
+	starter, ok := problem.StarterCode[language]
+	if !ok && msg.Language == "" && len(problem.StarterCode) > 0 {
+		// Fall back to the first language the question ships starter code for
+		languages := make([]string, 0, len(problem.StarterCode))
+		for lang := range problem.StarterCode {
+			languages = append(languages, lang)
+		}
+		sort.Strings(languages)
+		language = languages[0]
+		starter = problem.StarterCode[language]
+	}
+
+	var code, statement WorkspaceFile
+	if err := s.editWorkspace(room, c, func() ([]client.EditOp, error) {
+		var previousCode, previousStatement WorkspaceFile
+		var err error
+		if code, previousCode, err = room.workspace.Replace(DefaultFilePath, language, starter); err != nil {
+			return nil, err
+		}
+		if statement, previousStatement, err = room.workspace.Replace(statementFilePath, "markdown", problem.Statement); err != nil {
+			return nil, err
+		}
+		return append(replaceOps(code, previousCode), replaceOps(statement, previousStatement)...), nil
+	}); err != nil {
+		return err
+	}
+
+	// Tests run against the question that is currently loaded
+	if err := s.coreClient.AttachProblem(roomID, problem.ID, editorClient.authToken); err != nil {
+		logger.Warn("Failed to attach question to room",
+			zap.String("roomID", roomID),
+			zap.String("questionID", problem.ID),
+			zap.Error(err))
+	}
+
+	s.broadcastEditor(room, nil, EditorMessage{
+		Type:       "question_loaded",
+		QuestionID: problem.ID,
+		Title:      problem.Title,
+		Language:   language,
+		Files:      room.workspace.Tree(),
+	})
+	s.broadcastEditor(room, nil, fileSyncMessage(statement))
+	s.broadcastEditor(room, nil, fileSyncMessage(code))
+
+	logger.Info("Question loaded",
+		zap.String("roomID", roomID),
+		zap.String("questionID", problem.ID),
+		zap.String("language", language))
+
+	return nil
+}
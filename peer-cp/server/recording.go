@@ -0,0 +1,506 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elskow/codepair/peer-cp/client"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media/h264writer"
+	"github.com/pion/webrtc/v4/pkg/media/ivfwriter"
+	"github.com/pion/webrtc/v4/pkg/media/oggwriter"
+	"go.uber.org/zap"
+)
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+const (
+	pendingUploadSuffix = ".upload.json" // Details of a recording not uploaded yet, next to the file
+	uploadRetryInterval = 30 * time.Second
+	maxUploadAttempts   = 10 // A couple of hours with the backoff
+)
+
+// RecordingEvent is sent on the video channel whenever the recording state or
+// a participant's consent changes
+type RecordingEvent struct {
+	Type      string   `json:"type"`
+	Recording bool     `json:"recording"`
+	StartedAt string   `json:"startedAt,omitempty"`
+	Consented []string `json:"consented"` // Client IDs being recorded
+	Pending   []string `json:"pending"`   // Client IDs that have not consented
+	Error     string   `json:"error,omitempty"`
+}
+
+type rtpWriter interface {
+	WriteRTP(packet *rtp.Packet) error
+	Close() error
+}
+
+type trackFile struct {
+	writer      rtpWriter
+	ssrc        webrtc.SSRC // Simulcast layer the file follows
+	path        string
+	participant string
+	contentType string
+	consentedAt time.Time
+	startedAt   time.Time
+	endedAt     time.Time
+}
+
+// Recording writes the media of every consenting participant to one file per
+// track. Only participants who sent recording_consent are ever written.
+type Recording struct {
+	mu        sync.Mutex
+	dir       string
+	authToken string // Interviewer who started the recording, used to upload artifacts
+	startedAt time.Time
+	tracks    map[string]*trackFile // keyed by client ID and track ID
+	skipped   map[string]bool       // Tracks with a codec that cannot be recorded
+	closed    []*trackFile
+	segments  int // Numbers files so re-consenting never overwrites an earlier one
+}
+
+func newRecording(baseDir, roomID, authToken string) (*Recording, error) {
+	startedAt := time.Now()
+	dir := filepath.Join(baseDir, roomID, startedAt.UTC().Format("20060102T150405Z"))
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create recording directory: %w", err)
+	}
+
+	return &Recording{
+		dir:       dir,
+		authToken: authToken,
+		startedAt: startedAt,
+		tracks:    make(map[string]*trackFile),
+		skipped:   make(map[string]bool),
+	}, nil
+}
+
+// writeRTP records a packet from a participant's track. It reports whether a
+// new file was opened, so the caller can ask the sender for a keyframe. For
+// simulcast tracks only a layer allowed to open the file is recorded, and the
+// file keeps following that layer.
+func (r *Recording) writeRTP(participant *WebRTCClient, track *webrtc.TrackRemote, buf []byte, canOpen bool) (bool, error) {
+	consentedAt, ok := participant.consentTime()
+	if !ok {
+		return false, nil
+	}
+
+	key := participant.clientID + "/" + track.ID()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.tracks == nil || r.skipped[key] {
+		return false, nil
+	}
+
+	opened := false
+	file, exists := r.tracks[key]
+	if exists && file.ssrc != track.SSRC() {
+		return false, nil
+	}
+	if !exists {
+		if !canOpen {
+			return false, nil
+		}
+		var err error
+		file, err = r.openTrack(participant, track)
+		if err != nil {
+			r.skipped[key] = true
+			return false, err
+		}
+		file.consentedAt = consentedAt
+		r.tracks[key] = file
+		opened = true
+	}
+
+	packet := &rtp.Packet{}
+	if err := packet.Unmarshal(buf); err != nil {
+		return opened, fmt.Errorf("failed to parse RTP packet: %w", err)
+	}
+	if err := file.writer.WriteRTP(packet); err != nil {
+		return opened, fmt.Errorf("failed to write RTP packet: %w", err)
+	}
+	return opened, nil
+}
+
+func (r *Recording) openTrack(participant *WebRTCClient, track *webrtc.TrackRemote) (*trackFile, error) {
+	codec := track.Codec()
+	r.segments++
+	name := fmt.Sprintf("%s-%s-%d", participant.clientID, track.ID(), r.segments)
+	base := filepath.Join(r.dir, unsafeFileChars.ReplaceAllString(name, "_"))
+
+	file := &trackFile{
+		ssrc:        track.SSRC(),
+		participant: participant.name,
+		startedAt:   time.Now(),
+	}
+
+	var err error
+	switch strings.ToLower(codec.MimeType) {
+	case strings.ToLower(webrtc.MimeTypeVP8), strings.ToLower(webrtc.MimeTypeAV1):
+		file.path = base + ".ivf"
+		file.contentType = "video/x-ivf"
+		file.writer, err = ivfwriter.New(file.path, ivfwriter.WithCodec(codec.MimeType))
+	case strings.ToLower(webrtc.MimeTypeH264):
+		file.path = base + ".h264"
+		file.contentType = "video/h264"
+		file.writer, err = h264writer.New(file.path)
+	case strings.ToLower(webrtc.MimeTypeOpus):
+		file.path = base + ".ogg"
+		file.contentType = "audio/ogg"
+		file.writer, err = oggwriter.New(file.path, codec.ClockRate, codec.Channels)
+	default:
+		return nil, fmt.Errorf("recording %s is not supported", codec.MimeType)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create recording file: %w", err)
+	}
+	return file, nil
+}
+
+// closeParticipant finishes the files of a participant who left or withdrew consent
+func (r *Recording) closeParticipant(clientID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	prefix := clientID + "/"
+	for key, file := range r.tracks {
+		if strings.HasPrefix(key, prefix) {
+			r.closeTrack(key, file)
+		}
+	}
+}
+
+func (r *Recording) closeTrack(key string, file *trackFile) {
+	file.writer.Close()
+	file.endedAt = time.Now()
+	r.closed = append(r.closed, file)
+	delete(r.tracks, key)
+}
+
+// stop closes every open file and returns all files written
+func (r *Recording) stop() []*trackFile {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for key, file := range r.tracks {
+		r.closeTrack(key, file)
+	}
+	r.tracks = nil
+	return r.closed
+}
+
+// consentTime reports when the client agreed to be recorded
+func (c *WebRTCClient) consentTime() (time.Time, bool) {
+	c.consentMutex.Lock()
+	defer c.consentMutex.Unlock()
+	return c.consentedAt, !c.consentedAt.IsZero()
+}
+
+func (c *WebRTCClient) setConsent(consent bool) {
+	c.consentMutex.Lock()
+	defer c.consentMutex.Unlock()
+
+	if !consent {
+		c.consentedAt = time.Time{}
+	} else if c.consentedAt.IsZero() {
+		c.consentedAt = time.Now()
+	}
+}
+
+// handleRecordingSignal processes recording control messages from the video
+// channel. Only interviewers can start or stop a recording; every participant
+// decides on their own consent.
+func (s *Server) handleRecordingSignal(roomID string, room *Room, c *WebRTCClient, signalType string, signal map[string]interface{}) error {
+	switch signalType {
+	case "recording_consent":
+		consent, _ := signal["consent"].(bool)
+		c.setConsent(consent)
+		if !consent {
+			if recording := room.activeRecording(); recording != nil {
+				recording.closeParticipant(c.clientID)
+			}
+		}
+
+	case "recording_start":
+		if c.user == nil {
+			return errors.New("only interviewers can start a recording")
+		}
+		if !s.config.Recording.Enabled {
+			return errors.New("recording is disabled")
+		}
+
+		room.recordingMutex.Lock()
+		if room.recording != nil {
+			room.recordingMutex.Unlock()
+			return errors.New("the room is already being recorded")
+		}
+		recording, err := newRecording(s.config.Recording.Dir, roomID, c.authToken)
+		if err != nil {
+			room.recordingMutex.Unlock()
+			return err
+		}
+		room.recording = recording
+		room.recordingMutex.Unlock()
+
+		s.logger.Info("Recording started", zap.String("roomID", roomID), zap.String("by", c.user.Email))
+
+	case "recording_stop":
+		if c.user == nil {
+			return errors.New("only interviewers can stop a recording")
+		}
+		if !s.stopRecording(roomID, room) {
+			return errors.New("the room is not being recorded")
+		}
+	}
+
+	s.broadcastRecordingState(roomID, room)
+	return nil
+}
+
+func (r *Room) activeRecording() *Recording {
+	r.recordingMutex.RLock()
+	defer r.recordingMutex.RUnlock()
+	return r.recording
+}
+
+// recordRTP tees a forwarded packet into the room recording, if there is one.
+// primary marks the layer a new file should be recorded from.
+func (s *Server) recordRTP(room *Room, c *WebRTCClient, track *webrtc.TrackRemote, buf []byte, primary bool) {
+	recording := room.activeRecording()
+	if recording == nil {
+		return
+	}
+
+	opened, err := recording.writeRTP(c, track, buf, primary)
+	if err != nil {
+		s.logger.Warn("Failed to record track",
+			zap.String("clientID", c.clientID),
+			zap.String("trackID", track.ID()),
+			zap.Error(err))
+	}
+
+	// A video file can only start at a keyframe
+	if opened && track.Kind() == webrtc.RTPCodecTypeVideo {
+		if err := c.pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())}}); err != nil {
+			s.logger.Warn("Failed to request keyframe", zap.Error(err))
+		}
+	}
+}
+
+// stopRecording finishes the room recording and uploads the files to core in
+// the background. Files are removed locally once core has stored them.
+func (s *Server) stopRecording(roomID string, room *Room) bool {
+	room.recordingMutex.Lock()
+	recording := room.recording
+	room.recording = nil
+	room.recordingMutex.Unlock()
+
+	if recording == nil {
+		return false
+	}
+
+	files := recording.stop()
+	s.logger.Info("Recording stopped", zap.String("roomID", roomID), zap.Int("files", len(files)))
+
+	s.uploads.Add(1)
+	go func() {
+		defer s.uploads.Done()
+		s.uploadRecording(roomID, recording, files)
+	}()
+	return true
+}
+
+func (s *Server) uploadRecording(roomID string, recording *Recording, files []*trackFile) {
+	for _, file := range files {
+		upload := &pendingUpload{
+			RoomID: roomID,
+			Artifact: client.Artifact{
+				Kind:        "recording",
+				Participant: file.participant,
+				FileName:    filepath.Base(file.path),
+				ContentType: file.contentType,
+				ConsentedAt: file.consentedAt,
+				StartedAt:   file.startedAt,
+				EndedAt:     file.endedAt,
+			},
+			path:      file.path,
+			authToken: recording.authToken,
+		}
+		if err := upload.save(); err != nil {
+			s.logger.Warn("Failed to keep recording details, a restart loses its retries",
+				zap.String("path", file.path),
+				zap.Error(err))
+		}
+		s.upload(upload)
+	}
+}
+
+// pendingUpload is a recorded track core has not taken yet. Its details are
+// kept next to the file, so a restart retries it as well.
+type pendingUpload struct {
+	RoomID   string          `json:"roomId"`
+	Artifact client.Artifact `json:"artifact"`
+
+	path      string
+	authToken string // Interviewer who started the recording, empty after a restart
+	attempts  int
+	retryAt   time.Time
+}
+
+func (u *pendingUpload) save() error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(u.path+pendingUploadSuffix, data, 0o640)
+}
+
+// remove deletes the file and its details, and the recording's directory
+// once nothing else is left in it
+func (u *pendingUpload) remove() {
+	os.Remove(u.path)
+	os.Remove(u.path + pendingUploadSuffix)
+	os.Remove(filepath.Dir(u.path))
+}
+
+// upload sends a recorded track to core, or queues it for retryUploads. The
+// token of an interviewer still in the room is preferred over the one of the
+// interviewer who started the recording, which may have expired. With a
+// service secret the signed route is used and neither is needed.
+func (s *Server) upload(u *pendingUpload) {
+	authToken := u.authToken
+	s.roomsMutex.RLock()
+	room, exists := s.rooms[u.RoomID]
+	s.roomsMutex.RUnlock()
+	if exists {
+		if token := s.interviewerToken(room); token != "" {
+			authToken = token
+		}
+	}
+
+	err := s.coreClient.UploadArtifact(u.RoomID, authToken, u.Artifact, u.path)
+	if err == nil {
+		u.remove()
+		return
+	}
+
+	u.attempts++
+	if client.Rejected(err) || errors.Is(err, fs.ErrNotExist) || u.attempts >= maxUploadAttempts {
+		s.logger.Error("Failed to upload recording, deleting it",
+			zap.String("roomID", u.RoomID),
+			zap.String("path", u.path),
+			zap.Int("attempts", u.attempts),
+			zap.Error(err))
+		u.remove()
+		return
+	}
+
+	u.retryAt = time.Now().Add(uploadRetryInterval << min(u.attempts-1, 6))
+	s.logger.Warn("Failed to upload recording, retrying later",
+		zap.String("roomID", u.RoomID),
+		zap.String("path", u.path),
+		zap.Time("retryAt", u.retryAt),
+		zap.Error(err))
+
+	s.pendingMutex.Lock()
+	s.pendingUploads = append(s.pendingUploads, u)
+	s.pendingMutex.Unlock()
+}
+
+// retryUploads sends the recordings core did not take once they are due. The
+// ones a previous run left behind are picked up first.
+func (s *Server) retryUploads() {
+	s.queueLeftoverUploads()
+
+	ticker := time.NewTicker(uploadRetryInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now()
+		s.pendingMutex.Lock()
+		var due, waiting []*pendingUpload
+		for _, u := range s.pendingUploads {
+			if now.Before(u.retryAt) {
+				waiting = append(waiting, u)
+			} else {
+				due = append(due, u)
+			}
+		}
+		s.pendingUploads = waiting
+		s.pendingMutex.Unlock()
+
+		for _, u := range due {
+			// Whatever is left is retried after the restart
+			if s.isShuttingDown() {
+				return
+			}
+			s.upload(u)
+		}
+	}
+}
+
+// queueLeftoverUploads queues the recordings whose details are still on disk
+func (s *Server) queueLeftoverUploads() {
+	paths, err := filepath.Glob(filepath.Join(s.config.Recording.Dir, "*", "*", "*"+pendingUploadSuffix))
+	if err != nil {
+		s.logger.Error("Failed to look for recordings to upload", zap.Error(err))
+		return
+	}
+
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		u := &pendingUpload{path: strings.TrimSuffix(path, pendingUploadSuffix)}
+		if err := json.Unmarshal(data, u); err != nil {
+			s.logger.Warn("Skipping unreadable recording details", zap.String("path", path), zap.Error(err))
+			continue
+		}
+
+		s.pendingMutex.Lock()
+		s.pendingUploads = append(s.pendingUploads, u)
+		s.pendingMutex.Unlock()
+	}
+	if len(paths) > 0 {
+		s.logger.Info("Recordings left from an earlier run queued for upload", zap.Int("files", len(paths)))
+	}
+}
+
+func (s *Server) broadcastRecordingState(roomID string, room *Room) {
+	event := RecordingEvent{
+		Type:      "recording_state",
+		Consented: make([]string, 0),
+		Pending:   make([]string, 0),
+	}
+
+	if recording := room.activeRecording(); recording != nil {
+		event.Recording = true
+		event.StartedAt = recording.startedAt.Format(time.RFC3339)
+	}
+
+	s.roomsMutex.RLock()
+	for _, wc := range room.webrtcClients {
+		if _, ok := wc.consentTime(); ok {
+			event.Consented = append(event.Consented, wc.clientID)
+		} else {
+			event.Pending = append(event.Pending, wc.clientID)
+		}
+	}
+	s.roomsMutex.RUnlock()
+
+	s.broadcastVideoEvent(roomID, nil, event)
+}
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/elskow/codepair/peer-cp/config"
+	"github.com/elskow/codepair/peer-cp/runner"
+	"go.uber.org/zap"
+)
+
+// RunEvent is sent on the editor channel while a program runs
+type RunEvent struct {
+	Type     string         `json:"type"`
+	RunID    string         `json:"runId"`
+	Path     string         `json:"path,omitempty"`
+	Language string         `json:"language,omitempty"`
+	Stream   string         `json:"stream,omitempty"`
+	Data     string         `json:"data,omitempty"`
+	Result   *runner.Result `json:"result,omitempty"`
+	Error    string         `json:"error,omitempty"`
+}
+
+func newRunner(config config.Config) *runner.Runner {
+	cfg := config.Runner
+	if !cfg.Enabled {
+		return nil
+	}
+	return runner.New(runner.Config{
+		WorkDir:    cfg.WorkDir,
+		Namespaces: *cfg.Namespaces,
+		RootFS:     cfg.RootFS,
+		Cgroup:     cfg.Cgroup,
+		Limits: runner.Limits{
+			CompileTimeout:  cfg.CompileTimeout,
+			RunTimeout:      cfg.RunTimeout,
+			CPUTime:         cfg.CPUTime,
+			MemoryMB:        cfg.MemoryLimitMB,
+			CompileMemoryMB: cfg.CompileMemoryLimitMB,
+			OutputKB:        cfg.OutputLimitKB,
+			FileSizeKB:      cfg.FileSizeKB,
+			Processes:       cfg.MaxProcesses,
+		},
+	})
+}
+
+// startRun compiles and runs the room's entry file and streams the output to
+// every editor client. Only one run per room is allowed at a time.
+func (s *Server) startRun(ctx context.Context, roomID string, room *Room, msg EditorMessage) error {
+	logger := s.getLogger(ctx)
+
+	file, language, err := s.resolveEntry(room, msg)
+	if err != nil {
+		return err
+	}
+
+	if err := room.acquireRun(); err != nil {
+		return err
+	}
+
+	req := runner.Request{
+		Language: language,
+		Entry:    file.Path,
+		Files:    runnerFiles(room.workspace.Files()),
+		Stdin:    msg.Stdin,
+	}
+
+	runID := fmt.Sprintf("%d", time.Now().UnixNano())
+	s.broadcastEditor(room, nil, RunEvent{
+		Type:     "run_started",
+		RunID:    runID,
+		Path:     file.Path,
+		Language: language,
+	})
+
+	logger.Info("Run started",
+		zap.String("roomID", roomID),
+		zap.String("runID", runID),
+		zap.String("language", language))
+
+	go func() {
+		defer room.releaseRun()
+
+		result, err := s.runner.Run(context.Background(), req, func(stream string, data []byte) {
+			s.broadcastEditor(room, nil, RunEvent{
+				Type:   "run_output",
+				RunID:  runID,
+				Stream: stream,
+				Data:   string(data),
+			})
+		})
+
+		exit := RunEvent{
+			Type:   "run_exit",
+			RunID:  runID,
+			Result: result,
+		}
+		if err != nil {
+			logger.Error("Run failed",
+				zap.String("roomID", roomID),
+				zap.String("runID", runID),
+				zap.Error(err))
+			exit.Error = err.Error()
+		} else {
+			logger.Info("Run finished",
+				zap.String("roomID", roomID),
+				zap.String("runID", runID),
+				zap.String("status", result.Status),
+				zap.Int("exitCode", result.ExitCode),
+				zap.Int64("durationMs", result.DurationMs))
+		}
+		s.broadcastEditor(room, nil, exit)
+	}()
+
+	return nil
+}
+
+// resolveEntry picks the file to run and its language
+func (s *Server) resolveEntry(room *Room, msg EditorMessage) (WorkspaceFile, string, error) {
+	if s.runner == nil {
+		return WorkspaceFile{}, "", errors.New("code execution is disabled")
+	}
+
+	entry := msg.Path
+	if entry == "" {
+		entry = DefaultFilePath
+	}
+	file, ok := room.workspace.Get(entry)
+	if !ok {
+		return WorkspaceFile{}, "", fmt.Errorf("file %q not found", entry)
+	}
+
+	language := msg.Language
+	if language == "" {
+		language = file.Language
+	}
+	if _, ok := runner.LookupLanguage(language); !ok {
+		return WorkspaceFile{}, "", fmt.Errorf("running %q code is not supported", language)
+	}
+
+	return file, language, nil
+}
+
+func runnerFiles(files []WorkspaceFile) []runner.File {
+	result := make([]runner.File, len(files))
+	for i, f := range files {
+		result[i] = runner.File{Path: f.Path, Content: f.Content}
+	}
+	return result
+}
+
+func (r *Room) acquireRun() error {
+	r.runMutex.Lock()
+	defer r.runMutex.Unlock()
+
+	if r.running {
+		return errors.New("a run is already in progress")
+	}
+	r.running = true
+	return nil
+}
+
+func (r *Room) releaseRun() {
+	r.runMutex.Lock()
+	r.running = false
+	r.runMutex.Unlock()
+}
+
+// broadcastEditor sends a message to every editor client in the room except
+// exclude, on this instance and the others
+func (s *Server) broadcastEditor(room *Room, exclude Conn, v interface{}) {
+	message, err := json.Marshal(v)
+	if err != nil {
+		s.logger.Error("Failed to marshal editor message", zap.Error(err))
+		return
+	}
+	s.deliverEditor(room, exclude, message)
+	s.publish(room.id, "", busEditor, message)
+}
+
+// broadcastEditorInterviewers sends a message to authenticated interviewers only
+func (s *Server) broadcastEditorInterviewers(room *Room, v interface{}) {
+	message, err := json.Marshal(v)
+	if err != nil {
+		s.logger.Error("Failed to marshal editor message", zap.Error(err))
+		return
+	}
+	s.deliverEditorInterviewers(room, message)
+	s.publish(room.id, "", busEditorInterviewers, message)
+}
+
+// deliverEditor writes a message to the editor clients connected here
+func (s *Server) deliverEditor(room *Room, exclude Conn, message []byte) {
+	header := parseHeader(message)
+
+	room.clientsMutex.RLock()
+	defer room.clientsMutex.RUnlock()
+
+	for conn := range room.editorClients {
+		if conn == exclude {
+			continue
+		}
+		if err := conn.writeText(header, message); err != nil {
+			s.logger.Error("Failed to broadcast editor message", zap.Error(err))
+		}
+	}
+}
+
+func (s *Server) deliverEditorInterviewers(room *Room, message []byte) {
+	header := parseHeader(message)
+
+	room.clientsMutex.RLock()
+	defer room.clientsMutex.RUnlock()
+
+	for conn, client := range room.editorClients {
+		if client.user == nil {
+			continue
+		}
+		if err := conn.writeText(header, message); err != nil {
+			s.logger.Error("Failed to send editor message to interviewer", zap.Error(err))
+		}
+	}
+}
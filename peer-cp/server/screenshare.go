@@ -0,0 +1,103 @@
+package server
+
+import (
+	"errors"
+
+	"github.com/pion/webrtc/v4"
+	"go.uber.org/zap"
+)
+
+// trackLabel returns the label the client announced for a track. Unlabelled
+// tracks are assumed to come from the camera or microphone.
+func (c *WebRTCClient) trackLabel(trackID string, kind webrtc.RTPCodecType) string {
+	c.labelsMutex.Lock()
+	defer c.labelsMutex.Unlock()
+
+	if label, ok := c.trackLabels[trackID]; ok {
+		return label
+	}
+	if kind == webrtc.RTPCodecTypeAudio {
+		return TrackLabelMicrophone
+	}
+	return TrackLabelCamera
+}
+
+func (c *WebRTCClient) setTrackLabel(trackID, label string) {
+	c.labelsMutex.Lock()
+	defer c.labelsMutex.Unlock()
+	c.trackLabels[trackID] = label
+}
+
+func validTrackLabel(label string) bool {
+	return label == TrackLabelCamera || label == TrackLabelScreen || label == TrackLabelMicrophone
+}
+
+// findWebRTCClient looks up a video participant by client ID
+func (s *Server) findWebRTCClient(room *Room, clientID string) *WebRTCClient {
+	s.roomsMutex.RLock()
+	defer s.roomsMutex.RUnlock()
+
+	for _, wc := range room.webrtcClients {
+		if wc.clientID == clientID {
+			return wc
+		}
+	}
+	return nil
+}
+
+// handleTrackSignal processes track labels and screen share controls. Any
+// participant labels their own tracks; only interviewers can ask someone
+// else to share their screen or end a share.
+func (s *Server) handleTrackSignal(room *Room, c *WebRTCClient, signalType string, signal map[string]interface{}) error {
+	switch signalType {
+	case "track_info":
+		trackID, _ := signal["trackId"].(string)
+		label, _ := signal["label"].(string)
+		if trackID == "" || !validTrackLabel(label) {
+			return errors.New("track_info needs a trackId and a camera, screen or microphone label")
+		}
+
+		// Labels may arrive before or after the track itself
+		c.setTrackLabel(trackID, label)
+		if room.relabel(c.clientID+"/"+trackID, label) {
+			s.signalPeers(room)
+		}
+		return nil
+
+	case "screen_share_request", "screen_share_stop":
+		if c.user == nil {
+			return errors.New("only interviewers can control screen sharing")
+		}
+
+		targetID, _ := signal["target"].(string)
+		target := s.findWebRTCClient(room, targetID)
+		if target == nil {
+			return errors.New("participant not found")
+		}
+
+		if signalType == "screen_share_request" {
+			return target.sendJSON(map[string]interface{}{
+				"type": "screen_share_requested",
+				"from": c.name,
+			})
+		}
+
+		// Withdraw the share from everyone right away, the publisher is told
+		// to stop capturing
+		if room.unpublishClient(target.clientID, TrackLabelScreen) == 0 {
+			return errors.New("participant is not sharing their screen")
+		}
+		s.signalPeers(room)
+
+		s.logger.Info("Screen share stopped by interviewer",
+			zap.String("clientID", target.clientID),
+			zap.String("by", c.name))
+
+		return target.sendJSON(map[string]interface{}{
+			"type": "screen_share_stopped",
+			"by":   c.name,
+		})
+	}
+
+	return errors.New("unknown track signal")
+}
@@ -2,12 +2,18 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/elskow/codepair/peer-cp/bus"
 	"github.com/elskow/codepair/peer-cp/client"
 	"github.com/elskow/codepair/peer-cp/config"
+	"github.com/elskow/codepair/peer-cp/runner"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/websocket/v2"
 	"github.com/pion/webrtc/v4"
@@ -20,21 +26,55 @@ const (
 
 // EditorClient represents a client connected to the editor
 type EditorClient struct {
-	conn *websocket.Conn
+	conn      Conn
+	token     string
+	authToken string       // Interviewer access token, empty for candidates
+	user      *client.User // Resolved from authToken
+	id        string       // Roster ID
+	name      string
+	following string // Roster ID of the participant whose cursor the view tracks
 }
 
 // Room represents a shared room for collaboration
 type Room struct {
-	editorClients map[*websocket.Conn]*EditorClient
-	webrtcClients map[*websocket.Conn]*WebRTCClient
-	chatClients   map[*websocket.Conn]*ChatClient
-	notesClients  map[*websocket.Conn]*NotesClient
+	id            string
+	editorClients map[Conn]*EditorClient
+	webrtcClients map[Conn]*WebRTCClient
+	chatClients   map[Conn]*ChatClient
+	notesClients  map[Conn]*NotesClient
+	lobbyClients  map[Conn]*WebRTCClient // Pre-join checks in progress
 	clientsMutex  sync.RWMutex
-	currentCode   string
-	language      string
+	workspace     *Workspace
+	runMutex      sync.Mutex
+	running       bool
 	chatMessages  []ChatMessage
 	currentNotes  string
+	cursors       map[string]EditorMessage // Latest cursor by roster ID
+	controls      RoomControls
+	controlsMutex sync.Mutex // Applies control changes one at a time, taken before the other locks
+	removedMutex  sync.Mutex // Saves the removed list to core one at a time
 	peerConns     map[string]*webrtc.PeerConnection
+
+	recordingMutex sync.RWMutex
+	recording      *Recording
+
+	tracksMutex     sync.RWMutex
+	publishedTracks map[string]*publishedTrack
+
+	lobbyMutex   sync.Mutex
+	lobbyResults map[string]LobbyResult // Latest pre-join check per client ID
+
+	presence        map[string]*presence  // Participants connected here by roster ID, guarded by the server's presenceMutex
+	integrity       map[string]*integrity // Candidate's paste and focus signals by roster ID, guarded likewise
+	integrityEvents []IntegrityEvent      // Integrity timeline, guarded likewise
+
+	validationMutex sync.Mutex
+	token           string // Room token of the latest participant, used to re-validate the room
+	ended           bool
+
+	historyMutex     sync.Mutex
+	history          []client.EditOp // Recorded edits not saved to core yet
+	historySaveMutex sync.Mutex      // Keeps the edits of one room in order on their way to core
 }
 
 type Server struct {
@@ -44,22 +84,83 @@ type Server struct {
 	logger     *zap.Logger
 	config     config.Config
 	coreClient *client.CoreClient
+	runner     *runner.Runner
+	uploads    sync.WaitGroup // Recording uploads still in flight
+	bus        bus.Bus        // Shares rooms with the other instances
+
+	eventsMutex sync.Mutex
+	seenEvents  map[string]time.Time // Room events applied recently, as both core and the bus deliver them
+
+	sessionsMutex sync.Mutex
+	sessions      map[string]*session // Multiplexed sessions by resume token
+
+	presenceMutex  sync.Mutex
+	remotePresence map[string]map[string]remoteRoster    // Roster parts other instances hold, by room and instance
+	rosterWatchers map[string]map[chan struct{}]struct{} // Roster streams by room
+
+	shuttingDown chan struct{} // Closed by Shutdown, ends long-lived responses
+
+	pendingMutex   sync.Mutex
+	pendingUploads []*pendingUpload // Recordings core did not take yet, see retryUploads
+
+	publishersMutex sync.Mutex
+	publishers      map[string]chan bus.Message // Bus messages waiting to be published, by room
+
+	unsavedMutex sync.Mutex
+	unsaved      map[*Room]struct{} // Closed rooms whose last edits core has not taken yet
+
+	editSeq atomic.Int64 // Orders the edits recorded here
 }
 
-func NewServer(app *fiber.App, logger *zap.Logger, config config.Config) *Server {
+func NewServer(app *fiber.App, logger *zap.Logger, config config.Config, roomBus bus.Bus) (*Server, error) {
+	coreClient := client.NewCoreClient(config.Core.BaseURL, client.Options{
+		CacheTTL:         config.Core.CacheTTL,
+		NegativeCacheTTL: config.Core.NegativeCacheTTL,
+		DegradedTTL:      config.Core.DegradedTTL,
+		Retries:          *config.Core.Retries,
+		BreakerThreshold: *config.Core.BreakerThreshold,
+		BreakerCooldown:  config.Core.BreakerCooldown,
+		ServiceSecret:    config.Core.ServiceSecret,
+	})
+
 	server := &Server{
 		app:        app,
 		rooms:      make(map[string]*Room),
 		logger:     logger,
 		config:     config,
-		coreClient: client.NewCoreClient(config.Core.BaseURL),
+		coreClient: coreClient,
+		runner:     newRunner(config),
+		bus:        roomBus,
+		seenEvents: make(map[string]time.Time),
+		sessions:   make(map[string]*session),
+
+		remotePresence: make(map[string]map[string]remoteRoster),
+		rosterWatchers: make(map[string]map[chan struct{}]struct{}),
+		shuttingDown:   make(chan struct{}),
+		unsaved:        make(map[*Room]struct{}),
+		publishers:     make(map[string]chan bus.Message),
+	}
+	// Seqs stay unique across restarts of an instance with a fixed ID
+	server.editSeq.Store(time.Now().UnixNano())
+
+	if err := roomBus.Subscribe(server.handleBusMessage); err != nil {
+		return nil, fmt.Errorf("failed to subscribe to the room bus: %w", err)
 	}
 
 	go server.cleanupInactiveClients()
-	return server
+	go server.revalidateRooms()
+	go server.renewMediaClaims()
+	go server.sweepPresence()
+	go server.flushHistory()
+	if config.Recording.Enabled {
+		go server.retryUploads()
+	}
+	return server, nil
 }
 
 func (s *Server) Shutdown(ctx context.Context) error {
+	close(s.shuttingDown)
+
 	s.roomsMutex.Lock()
 	defer s.roomsMutex.Unlock()
 
@@ -77,12 +178,22 @@ func (s *Server) Shutdown(ctx context.Context) error {
 		for _, pc := range room.peerConns {
 			pc.Close()
 		}
+		if len(room.webrtcClients) > 0 {
+			s.releaseMedia(roomID)
+		}
 		room.clientsMutex.Unlock()
+		s.stopRecording(roomID, room)
+		s.saveHistoryLater(room)
+		s.saveIntegrityLater(room)
 		s.logger.Info("Room closed during shutdown", zap.String("roomID", roomID))
 	}
+	for _, room := range s.unsavedRooms() {
+		s.saveHistoryLater(room)
+	}
 
 	shutdownErr := make(chan error, 1)
 	go func() {
+		s.uploads.Wait()
 		shutdownErr <- s.app.Shutdown()
 	}()
 
@@ -94,6 +205,15 @@ func (s *Server) Shutdown(ctx context.Context) error {
 	}
 }
 
+func (s *Server) isShuttingDown() bool {
+	select {
+	case <-s.shuttingDown:
+		return true
+	default:
+		return false
+	}
+}
+
 func (s *Server) getLogger(ctx context.Context) *zap.Logger {
 	if requestID, ok := ctx.Value("requestID").(string); ok {
 		return s.logger.With(zap.String("requestID", requestID))
@@ -101,14 +221,23 @@ func (s *Server) getLogger(ctx context.Context) *zap.Logger {
 	return s.logger
 }
 
-func newRoom() *Room {
+func newRoom(id string) *Room {
 	return &Room{
-		editorClients: make(map[*websocket.Conn]*EditorClient),
-		webrtcClients: make(map[*websocket.Conn]*WebRTCClient),
-		chatClients:   make(map[*websocket.Conn]*ChatClient),
-		notesClients:  make(map[*websocket.Conn]*NotesClient),
+		id:            id,
+		editorClients: make(map[Conn]*EditorClient),
+		webrtcClients: make(map[Conn]*WebRTCClient),
+		chatClients:   make(map[Conn]*ChatClient),
+		notesClients:  make(map[Conn]*NotesClient),
+		lobbyClients:  make(map[Conn]*WebRTCClient),
+		workspace:     newWorkspace(),
 		chatMessages:  make([]ChatMessage, 0),
+		cursors:       make(map[string]EditorMessage),
 		peerConns:     make(map[string]*webrtc.PeerConnection),
+
+		publishedTracks: make(map[string]*publishedTrack),
+		lobbyResults:    make(map[string]LobbyResult),
+		presence:        make(map[string]*presence),
+		integrity:       make(map[string]*integrity),
 	}
 }
 
@@ -142,6 +271,69 @@ func (s *Server) validateRoom(roomID, token string) (*client.Room, error) {
 	return room, nil
 }
 
+// AuthProtocol is the WebSocket subprotocol the server speaks. Browsers cannot
+// set headers on a WebSocket, so interviewers offer their access token as a
+// second subprotocol, "bearer.<token>", which is never selected. Tokens are
+// kept out of URLs, which end up in access logs.
+const AuthProtocol = "codepair"
+
+// secWebSocketProtocol is how the request header is keyed once fasthttp
+// normalizes it
+const secWebSocketProtocol = "Sec-Websocket-Protocol"
+
+var errNotOnPanel = errors.New("not an interviewer of this room")
+
+// bearerToken returns the interviewer access token a WebSocket was opened
+// with, from its Authorization header or its subprotocols
+func bearerToken(c *websocket.Conn) string {
+	if token, ok := strings.CutPrefix(c.Headers(fiber.HeaderAuthorization), "Bearer "); ok {
+		return token
+	}
+	for _, protocol := range strings.Split(c.Headers(secWebSocketProtocol), ",") {
+		if token, ok := strings.CutPrefix(strings.TrimSpace(protocol), "bearer."); ok {
+			return token
+		}
+	}
+	return ""
+}
+
+// authenticateInterviewer resolves the optional interviewer access token sent
+// alongside the room token. Candidates only have the room token. Interviewers
+// have to own the room or sit on its panel.
+func (s *Server) authenticateInterviewer(room *client.Room, authToken string) (*client.User, error) {
+	if authToken == "" {
+		return nil, nil
+	}
+
+	user, err := s.coreClient.GetCurrentUser(authToken)
+	if err != nil {
+		return nil, fmt.Errorf("interviewer authentication failed: %w", err)
+	}
+
+	if !user.IsActive {
+		return nil, fmt.Errorf("interviewer account is not active")
+	}
+
+	// Without a service secret the room comes from the public join route,
+	// which leaves the panel out, so core checks it for the interviewer
+	if s.config.Core.ServiceSecret == "" {
+		_, err := s.coreClient.GetRoomAccess(room.ID, authToken)
+		if errors.Is(err, client.ErrNotRoomMember) {
+			return nil, errNotOnPanel
+		}
+		if err != nil {
+			return nil, fmt.Errorf("interviewer authentication failed: %w", err)
+		}
+		return user, nil
+	}
+
+	if !slices.Contains(room.InterviewerIDs, user.ID) {
+		return nil, errNotOnPanel
+	}
+
+	return user, nil
+}
+
 func (s *Server) cleanupInactiveClients() {
 	ticker := time.NewTicker(s.config.Server.CleanupInterval)
 	defer ticker.Stop()
@@ -153,27 +345,17 @@ func (s *Server) cleanupInactiveClients() {
 			continue // Skip if no rooms
 		}
 
-		roomsToProcess := make([]struct {
-			id   string
-			room *Room
-		}, 0, len(s.rooms))
-
-		for id, room := range s.rooms {
-			roomsToProcess = append(roomsToProcess, struct {
-				id   string
-				room *Room
-			}{id, room})
+		roomsToProcess := make([]*Room, 0, len(s.rooms))
+		for _, room := range s.rooms {
+			roomsToProcess = append(roomsToProcess, room)
 		}
 		s.roomsMutex.RUnlock()
 
-		emptyRooms := make([]string, 0)
-		for _, rp := range roomsToProcess {
-			room := rp.room
-			roomID := rp.id
-
+		emptyRooms := make([]*Room, 0)
+		for _, room := range roomsToProcess {
 			room.clientsMutex.Lock()
 
-			allClients := make([]*websocket.Conn, 0)
+			allClients := make([]Conn, 0)
 			for conn := range room.editorClients {
 				allClients = append(allClients, conn)
 			}
@@ -212,11 +394,8 @@ func (s *Server) cleanupInactiveClients() {
 				}
 			}
 
-			if len(room.editorClients) == 0 &&
-				len(room.webrtcClients) == 0 &&
-				len(room.chatClients) == 0 &&
-				len(room.notesClients) == 0 {
-				emptyRooms = append(emptyRooms, roomID)
+			if room.emptyLocked() {
+				emptyRooms = append(emptyRooms, room)
 			}
 
 			room.clientsMutex.Unlock()
@@ -224,9 +403,15 @@ func (s *Server) cleanupInactiveClients() {
 
 		if len(emptyRooms) > 0 {
 			s.roomsMutex.Lock()
-			for _, roomID := range emptyRooms {
-				delete(s.rooms, roomID)
-				s.logger.Info("Removed empty room", zap.String("roomID", roomID))
+			for _, room := range emptyRooms {
+				// Someone may have joined since the room was checked
+				if s.rooms[room.id] != room || !room.empty() {
+					continue
+				}
+				s.saveHistoryLater(room)
+				s.saveIntegrityLater(room)
+				delete(s.rooms, room.id)
+				s.logger.Info("Removed empty room", zap.String("roomID", room.id))
 			}
 			s.roomsMutex.Unlock()
 		}
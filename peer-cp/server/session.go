@@ -0,0 +1,527 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/websocket/v2"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+)
+
+// Conn is a client's connection to one channel of a room: either a WebSocket
+// of its own or a channel of a multiplexed session
+type Conn interface {
+	WriteMessage(messageType int, data []byte) error
+	WriteJSON(v interface{}) error
+	Close() error
+
+	// writeText writes a text message whose header the caller parsed, so a
+	// broadcast parses it once for all its recipients
+	writeText(header messageHeader, data []byte) error
+}
+
+// Session channels. The session channel carries the session's own messages.
+const (
+	channelSession   = "session"
+	channelEditor    = "editor"
+	channelChat      = "chat"
+	channelNotes     = "notes"
+	channelSignaling = "signaling"
+)
+
+var sessionChannels = []string{channelEditor, channelChat, channelNotes, channelSignaling}
+
+var errSessionClosed = errors.New("session closed")
+
+// Envelope frames every message on a session socket. Payload is the message
+// the channel's own endpoint would carry, and Type repeats its type. Seq
+// numbers the messages sent on the session, and is what a client resumes from.
+// It is shared by the channels rather than kept per channel: they arrive over
+// one socket in one order, and a replay has to keep that order, such as a
+// controls change ahead of the code it rejected. The per-channel endpoints
+// have no resume, their clients get the full state again when they reconnect.
+type Envelope struct {
+	Channel string          `json:"channel"`
+	Type    string          `json:"type"`
+	Seq     uint64          `json:"seq,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// SessionEvent is sent on the session channel
+type SessionEvent struct {
+	Type        string   `json:"type"`
+	Channels    []string `json:"channels,omitempty"`    // Channels joined, on ready
+	ResumeToken string   `json:"resumeToken,omitempty"` // Passed back as resume when reconnecting, on ready
+	Resumed     bool     `json:"resumed,omitempty"`     // The missed messages were replayed, on ready
+	Channel     string   `json:"channel,omitempty"`     // Channel a message was rejected on, on error
+	Error       string   `json:"error,omitempty"`
+}
+
+// session multiplexes a participant's channels over one WebSocket. It
+// outlives the socket for the resume window, buffering what is sent
+// meanwhile, so a client that reconnects with the resume token gets exactly
+// the messages it missed.
+type session struct {
+	server      *Server
+	ctx         context.Context
+	resumeToken string
+	participant *participant
+	joined      []string
+
+	writeMutex  sync.Mutex
+	out         *outbox       // Nil while the client is away
+	seq         uint64        // Sequence number of the last message sent
+	replay      []sentMessage // Latest messages sent, oldest first
+	closed      bool
+	detachTimer *time.Timer
+
+	editor, chat, notes, signaling *sessionChannel
+	chatClient                     *ChatClient
+	videoClient                    *WebRTCClient
+
+	endOnce sync.Once
+}
+
+type sentMessage struct {
+	seq  uint64
+	data []byte
+}
+
+// sessionChannel is the Conn of one channel of a session. Pings, close
+// frames and Close apply to the whole session, since a participant is
+// disconnected as a whole.
+type sessionChannel struct {
+	session *session
+	name    string
+	room    *Room // Room the channel joined
+}
+
+func (c *sessionChannel) WriteMessage(messageType int, data []byte) error {
+	if messageType != websocket.TextMessage {
+		return c.session.writeFrame(messageType, data)
+	}
+
+	return c.writeText(parseHeader(data), data)
+}
+
+func (c *sessionChannel) writeText(header messageHeader, data []byte) error {
+	return c.session.send(c.name, header, data)
+}
+
+func (c *sessionChannel) WriteJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.WriteMessage(websocket.TextMessage, data)
+}
+
+func (c *sessionChannel) Close() error {
+	return c.session.close()
+}
+
+func (s *session) channel(name string) *sessionChannel {
+	return &sessionChannel{session: s, name: name}
+}
+
+// send numbers a message and keeps it for replay. While the client is away
+// it is only kept.
+func (s *session) send(channel string, header messageHeader, payload []byte) error {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	if s.closed {
+		return errSessionClosed
+	}
+
+	data, err := json.Marshal(Envelope{
+		Channel: channel,
+		Type:    header.Type,
+		Seq:     s.seq + 1,
+		Payload: payload,
+	})
+	if err != nil {
+		return err
+	}
+	s.seq++
+
+	s.replay = append(s.replay, sentMessage{seq: s.seq, data: data})
+	if len(s.replay) > s.server.config.Server.ReplayBuffer {
+		s.replay = s.replay[1:]
+	}
+
+	if s.out == nil {
+		return nil
+	}
+	key := header.coalesceKey()
+	if key != "" {
+		key = channel + "\x00" + key
+	}
+	return s.out.push(websocket.TextMessage, data, key)
+}
+
+func (s *session) writeFrame(messageType int, data []byte) error {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	// A closed session cannot be resumed
+	if messageType == websocket.CloseMessage {
+		s.closed = true
+	}
+	if s.out == nil {
+		return nil
+	}
+	return s.out.push(messageType, data, "")
+}
+
+func (s *session) close() error {
+	s.writeMutex.Lock()
+	s.closed = true
+	out := s.out
+	s.writeMutex.Unlock()
+
+	if out != nil {
+		// The session ends once its reader notices
+		return out.Close()
+	}
+	go s.server.endSession(s)
+	return nil
+}
+
+// attach makes out the session's socket and replays the messages sent after
+// seq. It fails if some of them are no longer buffered.
+func (s *session) attach(out *outbox, after uint64) bool {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	if s.closed || after > s.seq {
+		return false
+	}
+	if after < s.seq && (len(s.replay) == 0 || s.replay[0].seq > after+1) {
+		return false
+	}
+
+	if s.detachTimer != nil {
+		s.detachTimer.Stop()
+		s.detachTimer = nil
+	}
+	// The client gave up on its old socket before the server noticed
+	if s.out != nil {
+		s.out.Close()
+	}
+	s.out = out
+
+	for _, message := range s.replay {
+		if message.seq <= after {
+			continue
+		}
+		if err := out.push(websocket.TextMessage, message.data, ""); err != nil {
+			break // The reader detaches again and the client can retry
+		}
+	}
+	return true
+}
+
+func (s *session) sendEvent(event SessionEvent) error {
+	return s.channel(channelSession).WriteJSON(event)
+}
+
+// parseChannels reads the channels query parameter, a comma separated list
+// that defaults to every channel
+func parseChannels(query string) ([]string, error) {
+	if query == "" {
+		return sessionChannels, nil
+	}
+
+	var channels []string
+	for _, name := range strings.Split(query, ",") {
+		name = strings.TrimSpace(name)
+		known := false
+		for _, channel := range sessionChannels {
+			known = known || channel == name
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown channel %q", name)
+		}
+		channels = append(channels, name)
+	}
+	return channels, nil
+}
+
+// HandleSessionWS serves the editor, chat, notes and signaling channels of a
+// participant over a single WebSocket. The room token is validated once for
+// all of them, and each channel behaves like its own endpoint. A client that
+// lost its socket reconnects with resume and seq, the resume token and the
+// last sequence number it received.
+func (s *Server) HandleSessionWS(c *websocket.Conn) {
+	defer c.Close()
+
+	ctx := context.WithValue(context.Background(), "requestID", c.Params("requestId"))
+	logger := s.getLogger(ctx)
+
+	roomID := c.Params("roomId")
+	channels, err := parseChannels(c.Query("channels"))
+	if err != nil {
+		c.WriteMessage(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseUnsupportedData, err.Error()))
+		return
+	}
+
+	p, err := s.authenticateParticipant(logger, roomID, c.Query("token"), bearerToken(c))
+	if err != nil {
+		logger.Error("Room validation failed", zap.Error(err))
+		c.WriteMessage(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "Room validation failed"))
+		return
+	}
+
+	// The queue has room for a full replay on top of the usual backlog
+	out := s.newOutbox(c, s.config.Server.WriteQueue+s.config.Server.ReplayBuffer)
+	defer out.stop()
+
+	sess := s.resumeSession(ctx, out, p, c.Query("resume"), c.Query("seq"))
+	if sess == nil {
+		sess = s.openSession(ctx, out, p, channels, c.Query("clientId"))
+	}
+
+	s.readSession(sess, c)
+	s.detachSession(sess, out)
+}
+
+// openSession starts a session and joins its channels
+func (s *Server) openSession(ctx context.Context, out *outbox, p *participant, channels []string, clientID string) *session {
+	logger := s.getLogger(ctx)
+
+	sess := &session{
+		server:      s,
+		ctx:         ctx,
+		resumeToken: uuid.NewString(),
+		participant: p,
+		out:         out,
+	}
+	s.sessionsMutex.Lock()
+	s.sessions[sess.resumeToken] = sess
+	s.sessionsMutex.Unlock()
+
+	for _, name := range channels {
+		channel := sess.channel(name)
+		switch name {
+		case channelEditor:
+			channel.room = s.joinEditor(ctx, channel, p)
+			sess.editor = channel
+		case channelChat:
+			channel.room, sess.chatClient = s.joinChat(ctx, channel, p)
+			sess.chat = channel
+		case channelNotes:
+			channel.room = s.joinNotes(ctx, channel, p)
+			sess.notes = channel
+		case channelSignaling:
+			// The client opens the video chat endpoint of the media host instead
+			if host, redirect := s.mediaRedirect(ctx, p.roomID); redirect {
+				channel.WriteJSON(MediaRedirectEvent{Type: "media_redirect", URL: host + "/videochat/" + p.roomID})
+				continue
+			}
+			var err error
+			channel.room, sess.videoClient, err = s.joinVideo(ctx, channel, p, clientID)
+			if err != nil {
+				logger.Error("Failed to join video chat", zap.Error(err))
+				channel.WriteJSON(SessionEvent{Type: "error", Channel: name, Error: "failed to join video chat"})
+				continue
+			}
+			sess.signaling = channel
+		}
+		sess.joined = append(sess.joined, name)
+	}
+
+	if err := sess.sendEvent(SessionEvent{
+		Type:        "ready",
+		Channels:    sess.joined,
+		ResumeToken: sess.resumeToken,
+	}); err != nil {
+		logger.Error("Failed to send session ready", zap.Error(err))
+	}
+	return sess
+}
+
+// resumeSession reattaches a session the client lost its socket to. It
+// returns nil when there is nothing to resume, and the client then gets a
+// new session with the full state.
+func (s *Server) resumeSession(ctx context.Context, out *outbox, p *participant, resumeToken, seq string) *session {
+	if resumeToken == "" {
+		return nil
+	}
+	logger := s.getLogger(ctx)
+
+	s.sessionsMutex.Lock()
+	sess, exists := s.sessions[resumeToken]
+	s.sessionsMutex.Unlock()
+	if !exists {
+		logger.Info("Session to resume not found", zap.String("roomID", p.roomID))
+		return nil
+	}
+	// The resume token alone does not hand over a session, its participant
+	// has to come back. The session is left to its owner.
+	if !sess.participant.is(p) {
+		logger.Warn("Session to resume belongs to another participant", zap.String("roomID", p.roomID))
+		return nil
+	}
+
+	after, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil || !sess.attach(out, after) {
+		logger.Info("Session cannot be resumed, starting over",
+			zap.String("roomID", p.roomID),
+			zap.String("seq", seq))
+		s.endSession(sess)
+		return nil
+	}
+
+	logger.Info("Session resumed",
+		zap.String("roomID", p.roomID),
+		zap.Uint64("seq", after))
+	if err := sess.sendEvent(SessionEvent{
+		Type:        "ready",
+		Channels:    sess.joined,
+		ResumeToken: sess.resumeToken,
+		Resumed:     true,
+	}); err != nil {
+		logger.Error("Failed to send session ready", zap.Error(err))
+	}
+	return sess
+}
+
+// is reports whether two connections come from the same participant of the
+// same room, as the roster identifies them
+func (p *participant) is(other *participant) bool {
+	id, _, role := p.identity()
+	otherID, _, otherRole := other.identity()
+	return p.roomID == other.roomID && id == otherID && role == otherRole
+}
+
+// readSession routes the client's messages to their channels until the
+// socket drops
+func (s *Server) readSession(sess *session, c *websocket.Conn) {
+	ctx := sess.ctx
+	logger := s.getLogger(ctx)
+	roomID := sess.participant.roomID
+
+	for {
+		_, data, err := c.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				logger.Error("WebSocket error", zap.Error(err))
+			}
+			return
+		}
+
+		var envelope Envelope
+		if err := json.Unmarshal(data, &envelope); err != nil {
+			sess.sendEvent(SessionEvent{Type: "error", Error: "invalid envelope"})
+			continue
+		}
+
+		// A message without a payload is just its type
+		payload := []byte(envelope.Payload)
+		if len(payload) == 0 {
+			payload, _ = json.Marshal(map[string]string{"type": envelope.Type})
+		}
+
+		switch {
+		case envelope.Channel == channelEditor && sess.editor != nil:
+			var msg EditorMessage
+			if err := json.Unmarshal(payload, &msg); err != nil {
+				sess.sendEvent(SessionEvent{Type: "error", Channel: envelope.Channel, Error: "invalid payload"})
+				continue
+			}
+			s.touchPresence(sess.editor.room, sess.participant)
+			s.handleEditorMessage(ctx, sess.editor, roomID, msg)
+
+		case envelope.Channel == channelChat && sess.chat != nil:
+			var event ChatEvent
+			if err := json.Unmarshal(payload, &event); err != nil {
+				sess.sendEvent(SessionEvent{Type: "error", Channel: envelope.Channel, Error: "invalid payload"})
+				continue
+			}
+			s.touchPresence(sess.chat.room, sess.participant)
+			s.handleChatEvent(ctx, sess.chat.room, sess.chatClient, event)
+
+		case envelope.Channel == channelNotes && sess.notes != nil:
+			var msg NotesMessage
+			if err := json.Unmarshal(payload, &msg); err != nil {
+				sess.sendEvent(SessionEvent{Type: "error", Channel: envelope.Channel, Error: "invalid payload"})
+				continue
+			}
+			s.touchPresence(sess.notes.room, sess.participant)
+			s.handleNotesMessage(ctx, sess.notes, roomID, msg)
+
+		case envelope.Channel == channelSignaling && sess.signaling != nil:
+			s.handleVideoSignal(ctx, sess.signaling.room, sess.videoClient, payload)
+
+		default:
+			sess.sendEvent(SessionEvent{Type: "error", Channel: envelope.Channel, Error: "channel not joined"})
+		}
+	}
+}
+
+// detachSession keeps the session in its rooms for the resume window once
+// the client's socket has dropped. A session closed by the server ends now.
+func (s *Server) detachSession(sess *session, out *outbox) {
+	sess.writeMutex.Lock()
+	if sess.out != out {
+		// Already resumed on another socket
+		sess.writeMutex.Unlock()
+		return
+	}
+	sess.out = nil
+	closed := sess.closed
+	if !closed {
+		sess.detachTimer = time.AfterFunc(s.config.Server.ResumeWindow, func() {
+			s.endSession(sess)
+		})
+	}
+	sess.writeMutex.Unlock()
+
+	if closed {
+		s.endSession(sess)
+	}
+}
+
+// endSession removes the session's channels from their rooms
+func (s *Server) endSession(sess *session) {
+	sess.endOnce.Do(func() {
+		sess.writeMutex.Lock()
+		sess.closed = true
+		out := sess.out
+		if sess.detachTimer != nil {
+			sess.detachTimer.Stop()
+		}
+		sess.writeMutex.Unlock()
+		if out != nil {
+			out.Close()
+		}
+
+		s.sessionsMutex.Lock()
+		delete(s.sessions, sess.resumeToken)
+		s.sessionsMutex.Unlock()
+
+		ctx := sess.ctx
+		if sess.signaling != nil {
+			s.leaveVideo(sess.signaling.room, sess.videoClient, sess.participant)
+		}
+		if sess.notes != nil {
+			s.leaveNotes(ctx, sess.notes.room, sess.notes, sess.participant)
+		}
+		if sess.chat != nil {
+			s.leaveChat(ctx, sess.chat.room, sess.chat, sess.participant)
+		}
+		if sess.editor != nil {
+			s.leaveEditor(ctx, sess.editor.room, sess.editor, sess.participant)
+		}
+	})
+}
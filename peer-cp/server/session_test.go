@@ -0,0 +1,171 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elskow/codepair/peer-cp/bus"
+	"github.com/elskow/codepair/peer-cp/client"
+	"github.com/elskow/codepair/peer-cp/config"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// fakeSocket records what an outbox writes
+type fakeSocket struct {
+	mu       sync.Mutex
+	messages []string
+	conn     net.Conn
+}
+
+func newFakeSocket(t *testing.T) *fakeSocket {
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	return &fakeSocket{conn: local}
+}
+
+func (f *fakeSocket) WriteMessage(messageType int, data []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.messages = append(f.messages, string(data))
+	return nil
+}
+
+func (f *fakeSocket) SetWriteDeadline(time.Time) error { return nil }
+
+func (f *fakeSocket) UnderlyingConn() net.Conn { return f.conn }
+
+func (f *fakeSocket) written() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.messages...)
+}
+
+func newTestServer() *Server {
+	var cfg config.Config
+	cfg.Server.ReplayBuffer = 8
+	cfg.Server.WriteQueue = 8
+	cfg.Server.WriteTimeout = time.Second
+	cfg.Server.ResumeWindow = time.Minute
+	return &Server{
+		logger:     zap.NewNop(),
+		config:     cfg,
+		sessions:   make(map[string]*session),
+		publishers: make(map[string]chan bus.Message),
+	}
+}
+
+func TestResumeSession(t *testing.T) {
+	room := &client.Room{ID: "r1", CandidateName: "Cand"}
+	candidate := &participant{roomID: "r1", room: room}
+	interviewer := &participant{roomID: "r1", room: room, authToken: "a", user: &client.User{ID: "u1"}}
+
+	tests := []struct {
+		name    string
+		owner   *participant
+		resumer *participant
+		seq     string
+		lost    bool // The first message fell out of the replay buffer
+		resumed bool
+		kept    bool // The session is still there to resume afterwards
+	}{
+		{
+			name:    "candidate",
+			owner:   candidate,
+			resumer: &participant{roomID: "r1", room: room},
+			seq:     "1",
+			resumed: true,
+			kept:    true,
+		},
+		{
+			name:    "interviewer with a new access token",
+			owner:   interviewer,
+			resumer: &participant{roomID: "r1", room: room, authToken: "b", user: &client.User{ID: "u1"}},
+			seq:     "1",
+			resumed: true,
+			kept:    true,
+		},
+		{
+			name:    "another interviewer",
+			owner:   interviewer,
+			resumer: &participant{roomID: "r1", room: room, user: &client.User{ID: "u2"}},
+			seq:     "1",
+			kept:    true,
+		},
+		{
+			name:    "candidate with an interviewer's token",
+			owner:   interviewer,
+			resumer: candidate,
+			seq:     "1",
+			kept:    true,
+		},
+		{
+			name:    "interviewer with the candidate's token",
+			owner:   candidate,
+			resumer: interviewer,
+			seq:     "1",
+			kept:    true,
+		},
+		{
+			name:    "same interviewer in another room",
+			owner:   interviewer,
+			resumer: &participant{roomID: "r2", room: room, user: &client.User{ID: "u1"}},
+			seq:     "1",
+			kept:    true,
+		},
+		{
+			name:    "messages no longer buffered",
+			owner:   candidate,
+			resumer: candidate,
+			seq:     "0",
+			lost:    true,
+		},
+		{
+			name:    "seq ahead of the session",
+			owner:   candidate,
+			resumer: candidate,
+			seq:     "5",
+		},
+		{
+			name:    "invalid seq",
+			owner:   candidate,
+			resumer: candidate,
+			seq:     "one",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer()
+			sess := &session{
+				server:      s,
+				ctx:         context.Background(),
+				resumeToken: "resume",
+				participant: tt.owner,
+				seq:         1,
+				replay:      []sentMessage{{seq: 1, data: []byte(`{"seq":1}`)}},
+			}
+			if tt.lost {
+				sess.seq, sess.replay = 2, []sentMessage{{seq: 2, data: []byte(`{"seq":2}`)}}
+			}
+			s.sessions[sess.resumeToken] = sess
+
+			out := s.newOutbox(newFakeSocket(t), 8)
+			defer out.stop()
+
+			got := s.resumeSession(context.Background(), out, tt.resumer, "resume", tt.seq)
+			assert.Equal(t, tt.resumed, got != nil)
+			_, kept := s.sessions["resume"]
+			assert.Equal(t, tt.kept, kept)
+			if !tt.resumed {
+				assert.Nil(t, sess.out, "the socket must not be attached")
+			}
+		})
+	}
+}
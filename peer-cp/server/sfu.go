@@ -0,0 +1,375 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"go.uber.org/zap"
+)
+
+const (
+	TrackLabelCamera     = "camera"
+	TrackLabelScreen     = "screen"
+	TrackLabelMicrophone = "microphone"
+
+	MaxPublishedTracks = 4 // Per participant, e.g. camera, microphone, screen and screen audio
+)
+
+// publishedTrack is a participant's track that the SFU forwards to everyone
+// else. A simulcast track has one layer per encoding the publisher sends.
+type publishedTrack struct {
+	key       string // Publisher client ID and remote track ID
+	id        string
+	streamID  string
+	kind      webrtc.RTPCodecType
+	codec     webrtc.RTPCodecCapability
+	label     string // Guarded by the room's tracksMutex
+	publisher *WebRTCClient
+	stopped   atomic.Bool // Set when the track is withdrawn while the publisher still sends it
+
+	layersMutex sync.RWMutex
+	layers      []*simulcastLayer
+	downTracks  map[string]*downTrack // By subscriber client ID
+}
+
+// TrackInfo tells subscribers who published a forwarded track and what it shows
+type TrackInfo struct {
+	TrackID     string `json:"trackId"`
+	StreamID    string `json:"streamId"`
+	PublisherID string `json:"publisherId"`
+	Publisher   string `json:"publisher"`
+	Kind        string `json:"kind"`
+	Label       string `json:"label"`
+}
+
+// TracksEvent lists every published track in the room. It is sent after
+// each renegotiation so clients can lay out camera and screen tracks.
+type TracksEvent struct {
+	Type   string      `json:"type"`
+	Tracks []TrackInfo `json:"tracks"`
+}
+
+// publish registers a remote track in the room. Further simulcast encodings
+// of a track join it as layers; created reports whether the track is new.
+func (r *Room) publish(publisher *WebRTCClient, remote *webrtc.TrackRemote) (track *publishedTrack, layer *simulcastLayer, created bool, err error) {
+	key := publisher.clientID + "/" + remote.ID()
+
+	r.tracksMutex.Lock()
+	defer r.tracksMutex.Unlock()
+
+	if track, ok := r.publishedTracks[key]; ok && !track.stopped.Load() {
+		return track, track.addLayer(remote), false, nil
+	}
+
+	count := 0
+	for _, t := range r.publishedTracks {
+		if t.publisher == publisher {
+			count++
+		}
+	}
+	if count >= MaxPublishedTracks {
+		return nil, nil, false, fmt.Errorf("participants can publish at most %d tracks", MaxPublishedTracks)
+	}
+
+	track = &publishedTrack{
+		key:        key,
+		id:         remote.ID(),
+		streamID:   remote.StreamID(),
+		kind:       remote.Kind(),
+		codec:      remote.Codec().RTPCodecCapability,
+		label:      publisher.trackLabel(remote.ID(), remote.Kind()),
+		publisher:  publisher,
+		downTracks: make(map[string]*downTrack),
+	}
+	layer = track.addLayer(remote)
+	r.publishedTracks[key] = track
+	return track, layer, true, nil
+}
+
+// unpublish withdraws a track unless it was already replaced by a newer one
+// with the same ID
+func (r *Room) unpublish(track *publishedTrack) {
+	r.tracksMutex.Lock()
+	track.stopped.Store(true)
+	if r.publishedTracks[track.key] == track {
+		delete(r.publishedTracks, track.key)
+	}
+	r.tracksMutex.Unlock()
+}
+
+// unpublishClient removes the tracks a participant published. An empty label
+// removes all of them.
+func (r *Room) unpublishClient(clientID, label string) int {
+	r.tracksMutex.Lock()
+	defer r.tracksMutex.Unlock()
+
+	removed := 0
+	for key, track := range r.publishedTracks {
+		if track.publisher.clientID == clientID && (label == "" || track.label == label) {
+			track.stopped.Store(true)
+			delete(r.publishedTracks, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// relabel updates the label of a published track and reports whether it changed
+func (r *Room) relabel(key, label string) bool {
+	r.tracksMutex.Lock()
+	defer r.tracksMutex.Unlock()
+
+	track, ok := r.publishedTracks[key]
+	if !ok || track.label == label {
+		return false
+	}
+	track.label = label
+	return true
+}
+
+func (r *Room) trackInfos() []TrackInfo {
+	r.tracksMutex.RLock()
+	defer r.tracksMutex.RUnlock()
+
+	infos := make([]TrackInfo, 0, len(r.publishedTracks))
+	for _, track := range r.publishedTracks {
+		infos = append(infos, TrackInfo{
+			TrackID:     track.id,
+			StreamID:    track.streamID,
+			PublisherID: track.publisher.clientID,
+			Publisher:   track.publisher.name,
+			Kind:        track.kind.String(),
+			Label:       track.label,
+		})
+	}
+	return infos
+}
+
+func (r *Room) tracksSnapshot() map[string]*publishedTrack {
+	r.tracksMutex.RLock()
+	defer r.tracksMutex.RUnlock()
+
+	tracks := make(map[string]*publishedTrack, len(r.publishedTracks))
+	for key, track := range r.publishedTracks {
+		tracks[key] = track
+	}
+	return tracks
+}
+
+// forwardLayer copies packets from one layer of a published track to the
+// subscribers watching it. The track is withdrawn once its last layer ends.
+func (s *Server) forwardLayer(roomID string, room *Room, track *publishedTrack, layer *simulcastLayer) {
+	defer func() {
+		if track.removeLayer(layer) == 0 {
+			room.unpublish(track)
+			s.signalPeers(room)
+		}
+	}()
+
+	rtpBuf := make([]byte, 1500)
+	for {
+		select {
+		case <-track.publisher.ctx.Done():
+			return
+		default:
+		}
+		if track.stopped.Load() {
+			return
+		}
+
+		n, _, err := layer.remote.Read(rtpBuf)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				s.logger.Error("Failed to read from track", zap.String("roomID", roomID), zap.Error(err))
+			}
+			return
+		}
+
+		packet := &rtp.Packet{}
+		if err := packet.Unmarshal(rtpBuf[:n]); err != nil {
+			s.logger.Warn("Failed to parse RTP packet", zap.String("roomID", roomID), zap.Error(err))
+			continue
+		}
+		layer.measure(n)
+
+		if track.kind == webrtc.RTPCodecTypeAudio && track.publisher.muted.Load() {
+			continue
+		}
+
+		// Padding only probes the publisher's uplink
+		if len(packet.Payload) > 0 {
+			keyframe := track.kind == webrtc.RTPCodecTypeVideo && isKeyframe(track.codec.MimeType, packet.Payload)
+			for _, d := range track.downTracksSnapshot() {
+				// ErrClosedPipe only means a subscriber went away mid-write
+				if err := d.writeRTP(layer, packet, keyframe); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+					s.logger.Warn("Failed to forward packet",
+						zap.String("roomID", roomID),
+						zap.String("subscriber", d.subscriber.clientID),
+						zap.Error(err))
+				}
+			}
+		}
+
+		s.recordRTP(room, track.publisher, layer.remote, rtpBuf[:n], track.topLayer() == layer)
+	}
+}
+
+// signalPeers brings every participant's subscriptions in line with the
+// room's published tracks and tells them what each track is
+func (s *Server) signalPeers(room *Room) {
+	s.roomsMutex.RLock()
+	clients := make([]*WebRTCClient, 0, len(room.webrtcClients))
+	for _, wc := range room.webrtcClients {
+		clients = append(clients, wc)
+	}
+	s.roomsMutex.RUnlock()
+
+	event := TracksEvent{Type: "tracks", Tracks: room.trackInfos()}
+	for _, wc := range clients {
+		if err := s.negotiate(room, wc); err != nil {
+			s.logger.Error("Failed to renegotiate",
+				zap.String("clientID", wc.clientID),
+				zap.Error(err))
+		}
+		if err := wc.sendJSON(event); err != nil {
+			s.logger.Error("Failed to send track list",
+				zap.String("clientID", wc.clientID),
+				zap.Error(err))
+		}
+	}
+}
+
+// negotiate updates the client's subscriptions and sends a server offer when
+// they changed. While the client is mid-negotiation the update is deferred
+// until its answer arrives.
+func (s *Server) negotiate(room *Room, c *WebRTCClient) error {
+	c.negotiationMutex.Lock()
+	defer c.negotiationMutex.Unlock()
+
+	if c.pc.ConnectionState() == webrtc.PeerConnectionStateClosed {
+		return nil
+	}
+
+	// The client always makes the first offer; subscriptions follow once it is applied
+	if c.pc.RemoteDescription() == nil || c.pc.SignalingState() != webrtc.SignalingStateStable {
+		c.negotiationPending = true
+		return nil
+	}
+
+	changed, err := s.syncSubscriptions(room, c)
+	if err != nil {
+		return err
+	}
+	if !changed && !c.negotiationPending {
+		return nil
+	}
+	c.negotiationPending = false
+
+	offer, err := c.pc.CreateOffer(nil)
+	if err != nil {
+		return fmt.Errorf("failed to create offer: %w", err)
+	}
+	if err := c.pc.SetLocalDescription(offer); err != nil {
+		return fmt.Errorf("failed to set local description: %w", err)
+	}
+
+	return c.sendJSON(map[string]interface{}{
+		"type": "offer",
+		"sdp":  offer.SDP,
+	})
+}
+
+// syncSubscriptions adds a down track for every published track the client
+// is missing and removes those that were withdrawn. Callers hold
+// negotiationMutex.
+func (s *Server) syncSubscriptions(room *Room, c *WebRTCClient) (bool, error) {
+	tracks := room.tracksSnapshot()
+	changed := false
+
+	for key, d := range c.subscriptions {
+		if track, ok := tracks[key]; ok && track == d.track {
+			continue
+		}
+		d.track.removeDownTrack(c.clientID)
+		if err := c.pc.RemoveTrack(d.sender); err != nil {
+			return changed, fmt.Errorf("failed to remove track %s: %w", key, err)
+		}
+		delete(c.subscriptions, key)
+		changed = true
+	}
+
+	for key, track := range tracks {
+		if track.publisher == c {
+			continue
+		}
+		if _, ok := c.subscriptions[key]; ok {
+			continue
+		}
+
+		d, err := newDownTrack(track, c)
+		if err != nil {
+			return changed, err
+		}
+		sender, err := c.pc.AddTrack(d.local)
+		if err != nil {
+			return changed, fmt.Errorf("failed to add track %s: %w", key, err)
+		}
+		d.sender = sender
+		c.subscriptions[key] = d
+		track.addDownTrack(d)
+		changed = true
+
+		go s.readSubscriberRTCP(d)
+
+		if err := d.requestKeyframe(); err != nil {
+			s.logger.Warn("Failed to request keyframe", zap.String("track", key), zap.Error(err))
+		}
+	}
+
+	return changed, nil
+}
+
+// unsubscribeAll detaches a departing client from every track it watched
+func (c *WebRTCClient) unsubscribeAll() {
+	c.negotiationMutex.Lock()
+	defer c.negotiationMutex.Unlock()
+
+	for key, d := range c.subscriptions {
+		d.track.removeDownTrack(c.clientID)
+		delete(c.subscriptions, key)
+	}
+}
+
+// parseSessionDescription accepts both {"sdp": {"type", "sdp"}} and the flat
+// {"type": "offer", "sdp": "v=0..."} form browsers send
+func parseSessionDescription(signal map[string]interface{}) (webrtc.SessionDescription, error) {
+	var desc webrtc.SessionDescription
+
+	switch sdp := signal["sdp"].(type) {
+	case string:
+		sdpType, _ := signal["type"].(string)
+		desc.Type = webrtc.NewSDPType(sdpType)
+		desc.SDP = sdp
+	case map[string]interface{}:
+		sdpJSON, err := json.Marshal(sdp)
+		if err != nil {
+			return desc, fmt.Errorf("failed to marshal SDP: %w", err)
+		}
+		if err := json.Unmarshal(sdpJSON, &desc); err != nil {
+			return desc, fmt.Errorf("failed to parse SDP: %w", err)
+		}
+	default:
+		return desc, errors.New("missing SDP")
+	}
+
+	if desc.Type != webrtc.SDPTypeOffer && desc.Type != webrtc.SDPTypeAnswer {
+		return desc, fmt.Errorf("unsupported SDP type %q", desc.Type)
+	}
+	return desc, nil
+}
@@ -0,0 +1,480 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+	"go.uber.org/zap"
+)
+
+const (
+	layerWindow          = time.Second            // How often layer bitrates are measured
+	keyframeRequestGap   = 500 * time.Millisecond // Limits keyframe requests sent upstream per layer
+	allocationInterval   = time.Second            // How often subscribers' layers are reassigned
+	audioReserveBps      = 64_000                 // Kept back for each audio subscription
+	layerSwitchHeadroom  = 1.2                    // Moving to another layer needs this much spare bandwidth
+	rembTimeout          = 5 * time.Second        // REMB older than this falls back to the TWCC estimate
+	rtcpReadBufferLength = 1500
+)
+
+// simulcastLayer is one encoding of a published track. Tracks sent without
+// simulcast have a single layer with an empty RID.
+type simulcastLayer struct {
+	rid    string
+	remote *webrtc.TrackRemote
+
+	bitrate             atomic.Uint64 // Bits per second over the last window
+	lastPacket          atomic.Int64  // Unix nanoseconds
+	lastKeyframeRequest atomic.Int64  // Unix nanoseconds
+
+	windowStart time.Time // Only touched by the layer's reader
+	windowBytes uint64
+}
+
+// measure accounts a received packet towards the layer's bitrate
+func (l *simulcastLayer) measure(size int) {
+	now := time.Now()
+	l.lastPacket.Store(now.UnixNano())
+
+	if l.windowStart.IsZero() {
+		l.windowStart = now
+	}
+	l.windowBytes += uint64(size)
+	if elapsed := now.Sub(l.windowStart); elapsed >= layerWindow {
+		l.bitrate.Store(uint64(float64(l.windowBytes*8) / elapsed.Seconds()))
+		l.windowStart = now
+		l.windowBytes = 0
+	}
+}
+
+// activeBitrate is zero for layers the publisher stopped sending, which
+// browsers do when their uplink cannot carry every encoding
+func (l *simulcastLayer) activeBitrate() uint64 {
+	if time.Since(time.Unix(0, l.lastPacket.Load())) > 2*layerWindow {
+		return 0
+	}
+	return l.bitrate.Load()
+}
+
+func (t *publishedTrack) addLayer(remote *webrtc.TrackRemote) *simulcastLayer {
+	layer := &simulcastLayer{rid: remote.RID(), remote: remote}
+
+	t.layersMutex.Lock()
+	t.layers = append(t.layers, layer)
+	t.layersMutex.Unlock()
+	return layer
+}
+
+// removeLayer drops a layer whose reader ended and returns how many are left
+func (t *publishedTrack) removeLayer(layer *simulcastLayer) int {
+	t.layersMutex.Lock()
+	defer t.layersMutex.Unlock()
+
+	for i, l := range t.layers {
+		if l == layer {
+			t.layers = append(t.layers[:i], t.layers[i+1:]...)
+			break
+		}
+	}
+	return len(t.layers)
+}
+
+func (t *publishedTrack) layer(rid string) *simulcastLayer {
+	t.layersMutex.RLock()
+	defer t.layersMutex.RUnlock()
+
+	for _, l := range t.layers {
+		if l.rid == rid {
+			return l
+		}
+	}
+	return nil
+}
+
+// layersByBitrate returns the layers the publisher is sending, lowest first.
+// Before any bitrate is known every layer is returned in arrival order.
+func (t *publishedTrack) layersByBitrate() []*simulcastLayer {
+	t.layersMutex.RLock()
+	all := append([]*simulcastLayer(nil), t.layers...)
+	t.layersMutex.RUnlock()
+
+	active := make([]*simulcastLayer, 0, len(all))
+	for _, l := range all {
+		if l.activeBitrate() > 0 {
+			active = append(active, l)
+		}
+	}
+	if len(active) == 0 {
+		return all
+	}
+
+	sort.SliceStable(active, func(i, j int) bool {
+		return active[i].activeBitrate() < active[j].activeBitrate()
+	})
+	return active
+}
+
+// topLayer is the best layer the publisher is sending, used for recordings
+func (t *publishedTrack) topLayer() *simulcastLayer {
+	layers := t.layersByBitrate()
+	if len(layers) == 0 {
+		return nil
+	}
+	return layers[len(layers)-1]
+}
+
+func (t *publishedTrack) simulcast() bool {
+	t.layersMutex.RLock()
+	defer t.layersMutex.RUnlock()
+	return len(t.layers) > 1 || (len(t.layers) == 1 && t.layers[0].rid != "")
+}
+
+// requestKeyframe asks the publisher for a keyframe on one layer. Requests
+// from many subscribers are merged so the publisher is not flooded.
+func (t *publishedTrack) requestKeyframe(rid string) error {
+	if t.kind != webrtc.RTPCodecTypeVideo {
+		return nil
+	}
+
+	layer := t.layer(rid)
+	if layer == nil {
+		return nil
+	}
+
+	now := time.Now().UnixNano()
+	last := layer.lastKeyframeRequest.Load()
+	if now-last < int64(keyframeRequestGap) || !layer.lastKeyframeRequest.CompareAndSwap(last, now) {
+		return nil
+	}
+
+	return t.publisher.pc.WriteRTCP([]rtcp.Packet{
+		&rtcp.PictureLossIndication{MediaSSRC: uint32(layer.remote.SSRC())},
+	})
+}
+
+func (t *publishedTrack) addDownTrack(d *downTrack) {
+	t.layersMutex.Lock()
+	t.downTracks[d.subscriber.clientID] = d
+	t.layersMutex.Unlock()
+}
+
+func (t *publishedTrack) removeDownTrack(clientID string) {
+	t.layersMutex.Lock()
+	delete(t.downTracks, clientID)
+	t.layersMutex.Unlock()
+}
+
+func (t *publishedTrack) downTracksSnapshot() []*downTrack {
+	t.layersMutex.RLock()
+	defer t.layersMutex.RUnlock()
+
+	downTracks := make([]*downTrack, 0, len(t.downTracks))
+	for _, d := range t.downTracks {
+		downTracks = append(downTracks, d)
+	}
+	return downTracks
+}
+
+// downTrack is one subscriber's copy of a published track. For simulcast
+// tracks it follows the layer that fits the subscriber's bandwidth and only
+// switches at keyframes, rewriting sequence numbers and timestamps so the
+// subscriber sees one continuous stream.
+type downTrack struct {
+	track      *publishedTrack
+	subscriber *WebRTCClient
+	local      *webrtc.TrackLocalStaticRTP
+	sender     *webrtc.RTPSender
+
+	mu        sync.Mutex
+	current   string // RID being forwarded; simulcast tracks start with none
+	target    string // RID to switch to at its next keyframe
+	seqOffset uint16
+	tsOffset  uint32
+	lastSeq   uint16
+	lastTS    uint32
+	lastWrite time.Time
+}
+
+func newDownTrack(track *publishedTrack, subscriber *WebRTCClient) (*downTrack, error) {
+	local, err := webrtc.NewTrackLocalStaticRTP(track.codec, track.id, track.streamID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create local track: %w", err)
+	}
+
+	d := &downTrack{
+		track:      track,
+		subscriber: subscriber,
+		local:      local,
+	}
+
+	// Start on the lowest layer so video appears quickly on any connection;
+	// the allocator moves up once the subscriber's bandwidth is known
+	if track.simulcast() {
+		if layers := track.layersByBitrate(); len(layers) > 0 {
+			d.target = layers[0].rid
+		}
+	}
+	return d, nil
+}
+
+func (d *downTrack) layers() (current, target string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.current, d.target
+}
+
+// setTarget picks the layer to switch to and asks for a keyframe on it
+func (d *downTrack) setTarget(rid string) error {
+	d.mu.Lock()
+	if d.target == rid {
+		d.mu.Unlock()
+		return nil
+	}
+	d.target = rid
+	d.mu.Unlock()
+
+	return d.track.requestKeyframe(rid)
+}
+
+// requestKeyframe asks for a keyframe on the layer the subscriber is
+// watching, or on the one it is waiting for
+func (d *downTrack) requestKeyframe() error {
+	current, target := d.layers()
+	if current == "" && d.track.simulcast() {
+		return d.track.requestKeyframe(target)
+	}
+	return d.track.requestKeyframe(current)
+}
+
+func (d *downTrack) writeRTP(layer *simulcastLayer, packet *rtp.Packet, keyframe bool) error {
+	d.mu.Lock()
+
+	if layer.rid != d.current {
+		// Video can only change layer where the target layer has a keyframe
+		if layer.rid != d.target || (d.track.kind == webrtc.RTPCodecTypeVideo && !keyframe) {
+			d.mu.Unlock()
+			return nil
+		}
+		d.switchLayer(layer.rid, packet)
+	}
+
+	out := *packet
+	out.SequenceNumber = packet.SequenceNumber - d.seqOffset
+	out.Timestamp = packet.Timestamp - d.tsOffset
+
+	// Extension IDs were negotiated with the publisher and mean nothing to
+	// the subscriber, the subscriber's interceptors add their own
+	out.Extension = false
+	out.Extensions = nil
+	out.ExtensionProfile = 0
+
+	d.lastSeq = out.SequenceNumber
+	d.lastTS = out.Timestamp
+	d.lastWrite = time.Now()
+	d.mu.Unlock()
+
+	return d.local.WriteRTP(&out)
+}
+
+// switchLayer continues the subscriber's sequence numbers and timeline where
+// the previous layer stopped. Callers hold mu.
+func (d *downTrack) switchLayer(rid string, packet *rtp.Packet) {
+	if !d.lastWrite.IsZero() {
+		elapsed := uint32(time.Since(d.lastWrite).Seconds() * float64(d.track.codec.ClockRate))
+		if elapsed == 0 {
+			elapsed = 1
+		}
+		d.seqOffset = packet.SequenceNumber - (d.lastSeq + 1)
+		d.tsOffset = packet.Timestamp - (d.lastTS + elapsed)
+	}
+	d.current = rid
+}
+
+// readSubscriberRTCP passes keyframe requests upstream and keeps the
+// subscriber's REMB estimate. Reading also feeds the sender's interceptors,
+// including the TWCC bandwidth estimator.
+func (s *Server) readSubscriberRTCP(d *downTrack) {
+	buf := make([]byte, rtcpReadBufferLength)
+	for {
+		n, _, err := d.sender.Read(buf)
+		if err != nil {
+			return
+		}
+
+		packets, err := rtcp.Unmarshal(buf[:n])
+		if err != nil {
+			continue
+		}
+		for _, packet := range packets {
+			switch packet := packet.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				if err := d.requestKeyframe(); err != nil {
+					s.logger.Warn("Failed to forward keyframe request",
+						zap.String("track", d.track.key),
+						zap.Error(err))
+				}
+			case *rtcp.ReceiverEstimatedMaximumBitrate:
+				d.subscriber.setREMB(packet.Bitrate)
+			}
+		}
+	}
+}
+
+func (c *WebRTCClient) setREMB(bitrate float32) {
+	c.bandwidthMutex.Lock()
+	defer c.bandwidthMutex.Unlock()
+	c.remb = float64(bitrate)
+	c.rembAt = time.Now()
+}
+
+// availableBitrate is the subscriber's downlink estimate in bits per second.
+// Browsers send either REMB or TWCC feedback; REMB is the receiver's own
+// estimate and wins while it is fresh.
+func (c *WebRTCClient) availableBitrate() float64 {
+	c.bandwidthMutex.Lock()
+	defer c.bandwidthMutex.Unlock()
+
+	if !c.rembAt.IsZero() && time.Since(c.rembAt) < rembTimeout {
+		return c.remb
+	}
+	return float64(c.estimator.GetTargetBitrate())
+}
+
+// allocateBandwidth periodically reassigns simulcast layers so the video a
+// subscriber receives fits their connection
+func (s *Server) allocateBandwidth(c *WebRTCClient) {
+	ticker := time.NewTicker(allocationInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.assignLayers(c)
+	}
+}
+
+func (s *Server) assignLayers(c *WebRTCClient) {
+	c.negotiationMutex.Lock()
+	downTracks := make([]*downTrack, 0, len(c.subscriptions))
+	for _, d := range c.subscriptions {
+		downTracks = append(downTracks, d)
+	}
+	c.negotiationMutex.Unlock()
+
+	// Audio is never dropped, and screen shares matter more than cameras
+	sort.Slice(downTracks, func(i, j int) bool {
+		return allocationPriority(downTracks[i].track) < allocationPriority(downTracks[j].track)
+	})
+
+	budget := c.availableBitrate()
+	for _, d := range downTracks {
+		if d.track.kind == webrtc.RTPCodecTypeAudio {
+			budget -= audioReserveBps
+			continue
+		}
+
+		layers := d.track.layersByBitrate()
+		if len(layers) == 0 {
+			continue
+		}
+		if !d.track.simulcast() {
+			budget -= float64(layers[0].activeBitrate())
+			continue
+		}
+
+		current, _ := d.layers()
+		choice := layers[0]
+		for _, layer := range layers[1:] {
+			need := float64(layer.activeBitrate())
+			if layer.rid != current {
+				need *= layerSwitchHeadroom
+			}
+			if need <= budget {
+				choice = layer
+			}
+		}
+		budget -= float64(choice.activeBitrate())
+
+		if err := d.setTarget(choice.rid); err != nil {
+			s.logger.Warn("Failed to switch simulcast layer",
+				zap.String("clientID", c.clientID),
+				zap.String("track", d.track.key),
+				zap.Error(err))
+		}
+	}
+}
+
+func allocationPriority(track *publishedTrack) int {
+	switch {
+	case track.kind == webrtc.RTPCodecTypeAudio:
+		return 0
+	case track.label == TrackLabelScreen:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// isKeyframe reports whether an RTP payload starts a keyframe, the only
+// place a subscriber can switch to another simulcast layer
+func isKeyframe(mimeType string, payload []byte) bool {
+	if len(payload) == 0 {
+		return false
+	}
+
+	switch strings.ToLower(mimeType) {
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		var vp8 codecs.VP8Packet
+		frame, err := vp8.Unmarshal(payload)
+		return err == nil && vp8.S == 1 && vp8.PID == 0 && len(frame) > 0 && frame[0]&0x01 == 0
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		var vp9 codecs.VP9Packet
+		if _, err := vp9.Unmarshal(payload); err != nil {
+			return false
+		}
+		return vp9.B && !vp9.P
+	case strings.ToLower(webrtc.MimeTypeH264):
+		return isH264Keyframe(payload)
+	default:
+		// Without a parser every packet is a switch point; the keyframe
+		// requested for the new layer follows shortly
+		return true
+	}
+}
+
+func isH264Keyframe(payload []byte) bool {
+	const (
+		naluIDR   = 5
+		naluSPS   = 7
+		naluSTAPA = 24
+		naluFUA   = 28
+	)
+
+	switch payload[0] & 0x1F {
+	case naluIDR, naluSPS:
+		return true
+	case naluSTAPA:
+		for i := 1; i+2 < len(payload); {
+			size := int(payload[i])<<8 | int(payload[i+1])
+			i += 2
+			if naluType := payload[i] & 0x1F; naluType == naluIDR || naluType == naluSPS {
+				return true
+			}
+			i += size
+		}
+	case naluFUA:
+		return len(payload) > 1 && payload[1]&0x80 != 0 && payload[1]&0x1F == naluIDR
+	}
+	return false
+}
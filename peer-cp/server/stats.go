@@ -0,0 +1,373 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/elskow/codepair/peer-cp/client"
+	"github.com/gofiber/fiber/v2"
+	"github.com/pion/interceptor/pkg/stats"
+	"github.com/pion/webrtc/v4"
+	"go.uber.org/zap"
+)
+
+// Thresholds above which a connection is rated fair or poor
+const (
+	fairRTTMs    = 200
+	poorRTTMs    = 400
+	fairJitterMs = 30
+	poorJitterMs = 50
+	fairLossPct  = 2
+	poorLossPct  = 5
+)
+
+// pion's recorder starts inbound jitter from an arbitrary transit time; the
+// estimate is only meaningful after a few hundred packets
+const jitterSettlePackets = 300
+
+const (
+	qualityGood    = "good"
+	qualityFair    = "fair"
+	qualityPoor    = "poor"
+	qualityUnknown = "unknown" // No sample yet
+)
+
+// CandidatePair describes the ICE route media takes between a participant
+// and the SFU. A relay candidate means the participant goes through TURN.
+type CandidatePair struct {
+	Local    string `json:"local"`
+	Remote   string `json:"remote"`
+	Protocol string `json:"protocol"`
+}
+
+// QualitySample is one measurement of a participant's connection to the SFU.
+// Uplink covers the media they publish, downlink the media forwarded to them.
+type QualitySample struct {
+	ClientID        string         `json:"clientId"`
+	Participant     string         `json:"participant"`
+	State           string         `json:"state"`
+	Level           string         `json:"level"`
+	RTTMs           float64        `json:"rttMs"`
+	JitterMs        float64        `json:"jitterMs"`
+	UplinkLossPct   float64        `json:"uplinkLossPct"`
+	DownlinkLossPct float64        `json:"downlinkLossPct"`
+	InboundKbps     float64        `json:"inboundKbps"`
+	OutboundKbps    float64        `json:"outboundKbps"`
+	CandidatePair   *CandidatePair `json:"candidatePair,omitempty"`
+	Timestamp       time.Time      `json:"timestamp"`
+}
+
+// QualityEvent shares a participant's latest sample with the room
+type QualityEvent struct {
+	Type   string        `json:"type"`
+	Sample QualitySample `json:"sample"`
+}
+
+// RoomQuality is the admin view of one room
+type RoomQuality struct {
+	RoomID       string          `json:"roomId"`
+	Participants []QualitySample `json:"participants"`
+}
+
+type streamCounters struct {
+	bytes   uint64
+	packets uint64
+	lost    int64
+}
+
+// qualityMonitor keeps a participant's latest sample and the running totals
+// for the summary saved when they leave
+type qualityMonitor struct {
+	getter   stats.Getter
+	joinedAt time.Time
+
+	mu       sync.Mutex
+	latest   *QualitySample
+	counters map[uint32]streamCounters // By SSRC, as of the previous sample
+	sampleAt time.Time
+
+	samples       int
+	poorSamples   int
+	sumRTT        float64
+	maxRTT        float64
+	sumJitter     float64
+	sumLoss       float64
+	sumInbound    float64
+	sumOutbound   float64
+	candidateType string
+	protocol      string
+}
+
+func newQualityMonitor(getter stats.Getter) *qualityMonitor {
+	now := time.Now()
+	return &qualityMonitor{
+		getter:   getter,
+		joinedAt: now,
+		counters: make(map[uint32]streamCounters),
+		sampleAt: now,
+	}
+}
+
+type inboundStream struct {
+	ssrc      uint32
+	clockRate uint32
+}
+
+// monitorQuality samples the participant's connection until they leave and
+// shares every sample with the room
+func (s *Server) monitorQuality(roomID string, room *Room, c *WebRTCClient) {
+	ticker := time.NewTicker(s.config.Stats.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if c.pc.ConnectionState() != webrtc.PeerConnectionStateConnected {
+			continue
+		}
+
+		sample := s.sampleQuality(room, c)
+		s.broadcastVideoEvent(roomID, nil, QualityEvent{Type: "quality", Sample: sample})
+	}
+}
+
+func (s *Server) sampleQuality(room *Room, c *WebRTCClient) QualitySample {
+	now := time.Now()
+	sample := QualitySample{
+		ClientID:    c.clientID,
+		Participant: c.name,
+		State:       c.pc.ConnectionState().String(),
+		Timestamp:   now,
+	}
+
+	sample.CandidatePair, sample.RTTMs = selectedCandidatePair(c.pc)
+
+	var inbound []inboundStream
+	for _, track := range room.tracksSnapshot() {
+		if track.publisher != c {
+			continue
+		}
+		for _, layer := range track.layersByBitrate() {
+			inbound = append(inbound, inboundStream{
+				ssrc:      uint32(layer.remote.SSRC()),
+				clockRate: track.codec.ClockRate,
+			})
+		}
+	}
+
+	var outbound []uint32
+	c.negotiationMutex.Lock()
+	for _, d := range c.subscriptions {
+		for _, encoding := range d.sender.GetParameters().Encodings {
+			outbound = append(outbound, uint32(encoding.SSRC))
+		}
+	}
+	c.negotiationMutex.Unlock()
+
+	m := c.quality
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	counters := make(map[uint32]streamCounters, len(inbound)+len(outbound))
+	var bytesIn, bytesOut uint64
+	var received, lost int64
+
+	for _, stream := range inbound {
+		st := m.getter.Get(stream.ssrc)
+		if st == nil {
+			continue
+		}
+		current := streamCounters{
+			bytes:   st.InboundRTPStreamStats.BytesReceived,
+			packets: st.InboundRTPStreamStats.PacketsReceived,
+			lost:    st.InboundRTPStreamStats.PacketsLost,
+		}
+		previous := m.counters[stream.ssrc]
+		bytesIn += counterDelta(current.bytes, previous.bytes)
+		received += int64(counterDelta(current.packets, previous.packets))
+		if current.lost > previous.lost {
+			lost += current.lost - previous.lost
+		}
+		counters[stream.ssrc] = current
+
+		// Inbound jitter is kept in RTP timestamp units
+		if stream.clockRate > 0 && current.packets >= jitterSettlePackets {
+			sample.JitterMs = math.Max(sample.JitterMs, st.InboundRTPStreamStats.Jitter/float64(stream.clockRate)*1000)
+		}
+	}
+	if received+lost > 0 {
+		sample.UplinkLossPct = float64(lost) / float64(received+lost) * 100
+	}
+
+	for _, ssrc := range outbound {
+		st := m.getter.Get(ssrc)
+		if st == nil {
+			continue
+		}
+		current := streamCounters{bytes: st.OutboundRTPStreamStats.BytesSent}
+		bytesOut += counterDelta(current.bytes, m.counters[ssrc].bytes)
+		counters[ssrc] = current
+
+		// Receiver reports from the participant describe the downlink
+		remote := st.RemoteInboundRTPStreamStats
+		sample.DownlinkLossPct = math.Max(sample.DownlinkLossPct, remote.FractionLost*100)
+		sample.JitterMs = math.Max(sample.JitterMs, remote.Jitter*1000)
+		if sample.RTTMs == 0 && remote.RoundTripTime > 0 {
+			sample.RTTMs = float64(remote.RoundTripTime) / float64(time.Millisecond)
+		}
+	}
+
+	if elapsed := now.Sub(m.sampleAt).Seconds(); elapsed > 0 {
+		sample.InboundKbps = float64(bytesIn) * 8 / 1000 / elapsed
+		sample.OutboundKbps = float64(bytesOut) * 8 / 1000 / elapsed
+	}
+	sample.Level = qualityLevel(sample)
+
+	m.counters = counters
+	m.sampleAt = now
+	m.latest = &sample
+
+	m.samples++
+	if sample.Level == qualityPoor {
+		m.poorSamples++
+	}
+	m.sumRTT += sample.RTTMs
+	m.maxRTT = math.Max(m.maxRTT, sample.RTTMs)
+	m.sumJitter += sample.JitterMs
+	m.sumLoss += math.Max(sample.UplinkLossPct, sample.DownlinkLossPct)
+	m.sumInbound += sample.InboundKbps
+	m.sumOutbound += sample.OutboundKbps
+	if sample.CandidatePair != nil {
+		m.candidateType = sample.CandidatePair.Remote
+		m.protocol = sample.CandidatePair.Protocol
+	}
+
+	return sample
+}
+
+// selectedCandidatePair returns the nominated pair, which carries the media,
+// and the RTT of its STUN checks in milliseconds
+func selectedCandidatePair(pc *webrtc.PeerConnection) (*CandidatePair, float64) {
+	report := pc.GetStats()
+	for _, entry := range report {
+		pair, ok := entry.(webrtc.ICECandidatePairStats)
+		if !ok || !pair.Nominated || pair.State != webrtc.StatsICECandidatePairStateSucceeded {
+			continue
+		}
+		local, _ := report[pair.LocalCandidateID].(webrtc.ICECandidateStats)
+		remote, _ := report[pair.RemoteCandidateID].(webrtc.ICECandidateStats)
+		return &CandidatePair{
+			Local:    local.CandidateType.String(),
+			Remote:   remote.CandidateType.String(),
+			Protocol: local.Protocol,
+		}, pair.CurrentRoundTripTime * 1000
+	}
+	return nil, 0
+}
+
+func counterDelta(current, previous uint64) uint64 {
+	if current < previous {
+		return current // The stream restarted
+	}
+	return current - previous
+}
+
+func qualityLevel(sample QualitySample) string {
+	loss := math.Max(sample.UplinkLossPct, sample.DownlinkLossPct)
+	switch {
+	case sample.RTTMs > poorRTTMs || sample.JitterMs > poorJitterMs || loss > poorLossPct:
+		return qualityPoor
+	case sample.RTTMs > fairRTTMs || sample.JitterMs > fairJitterMs || loss > fairLossPct:
+		return qualityFair
+	default:
+		return qualityGood
+	}
+}
+
+// latestSample returns the participant's last sample, or a placeholder with
+// only the connection state before the first one is taken
+func (c *WebRTCClient) latestSample() QualitySample {
+	c.quality.mu.Lock()
+	defer c.quality.mu.Unlock()
+
+	if c.quality.latest != nil {
+		return *c.quality.latest
+	}
+	return QualitySample{
+		ClientID:    c.clientID,
+		Participant: c.name,
+		State:       c.pc.ConnectionState().String(),
+		Level:       qualityUnknown,
+	}
+}
+
+// saveQualitySummary stores the participant's averages with the room once
+// they leave. Participants who never connected media have nothing to save.
+func (s *Server) saveQualitySummary(roomID string, c *WebRTCClient) {
+	m := c.quality
+	m.mu.Lock()
+	if m.samples == 0 {
+		m.mu.Unlock()
+		return
+	}
+	samples := float64(m.samples)
+	summary := client.SessionQuality{
+		ClientID:        c.clientID,
+		Participant:     c.name,
+		Interviewer:     c.user != nil,
+		CandidateType:   m.candidateType,
+		Protocol:        m.protocol,
+		Samples:         m.samples,
+		PoorSamples:     m.poorSamples,
+		AvgRTTMs:        m.sumRTT / samples,
+		MaxRTTMs:        m.maxRTT,
+		AvgJitterMs:     m.sumJitter / samples,
+		PacketLossPct:   m.sumLoss / samples,
+		AvgInboundKbps:  m.sumInbound / samples,
+		AvgOutboundKbps: m.sumOutbound / samples,
+		JoinedAt:        m.joinedAt,
+		LeftAt:          time.Now(),
+	}
+	m.mu.Unlock()
+
+	err := s.coreClient.SaveSessionQuality(roomID, summary)
+	if errors.Is(err, client.ErrNoServiceSecret) {
+		return // Quality is only kept with a service secret
+	}
+	if err != nil {
+		s.logger.Error("Failed to save session quality",
+			zap.String("roomID", roomID),
+			zap.String("clientID", c.clientID),
+			zap.Error(err))
+	}
+}
+
+// HandleAdminStats lists the latest quality sample of every participant in
+// a video call. ?room= limits the report to one room.
+func (s *Server) HandleAdminStats(c *fiber.Ctx) error {
+	filter := c.Query("room")
+
+	s.roomsMutex.RLock()
+	defer s.roomsMutex.RUnlock()
+
+	rooms := make([]RoomQuality, 0, len(s.rooms))
+	for roomID, room := range s.rooms {
+		if (filter != "" && roomID != filter) || len(room.webrtcClients) == 0 {
+			continue
+		}
+
+		participants := make([]QualitySample, 0, len(room.webrtcClients))
+		for _, wc := range room.webrtcClients {
+			participants = append(participants, wc.latestSample())
+		}
+		rooms = append(rooms, RoomQuality{RoomID: roomID, Participants: participants})
+	}
+
+	return c.JSON(fiber.Map{"rooms": rooms})
+}
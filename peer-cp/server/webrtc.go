@@ -5,104 +5,195 @@ import (
 	"encoding/json"
 	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/gofiber/websocket/v2"
+	"github.com/elskow/codepair/peer-cp/client"
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/interceptor/pkg/stats"
 	"github.com/pion/webrtc/v4"
 	"go.uber.org/zap"
 )
 
 // WebRTCClient represents a client connected for video chat
 type WebRTCClient struct {
-	conn       *websocket.Conn
-	pc         *webrtc.PeerConnection
-	writeMutex sync.Mutex
-	candidates []webrtc.ICECandidateInit
-	ctx        context.Context
-	cancel     context.CancelFunc
+	conn         Conn
+	pc           *webrtc.PeerConnection
+	candidates   []webrtc.ICECandidateInit
+	ctx          context.Context
+	cancel       context.CancelFunc
+	clientID     string
+	token        string       // Room token the participant joined with
+	name         string       // Shown on recordings
+	authToken    string       // Interviewer access token, empty for candidates
+	user         *client.User // Resolved from authToken
+	consentMutex sync.Mutex
+	consentedAt  time.Time   // Zero until the participant agrees to be recorded
+	muted        atomic.Bool // Audio is not forwarded while an interviewer has the participant muted
+
+	labelsMutex sync.Mutex
+	trackLabels map[string]string // Remote track ID to label, sent by the client in track_info
+
+	negotiationMutex   sync.Mutex
+	negotiationPending bool                  // Subscriptions changed while an offer was outstanding
+	subscriptions      map[string]*downTrack // Other participants' tracks, keyed like publishedTrack
+
+	quality   *qualityMonitor
+	estimator cc.BandwidthEstimator // TWCC based downlink estimate
+
+	bandwidthMutex sync.Mutex
+	remb           float64 // Latest REMB from the client, in bits per second
+	rembAt         time.Time
+}
+
+// mediaConnection is a peer connection together with the interceptors the
+// SFU reads quality and bandwidth from
+type mediaConnection struct {
+	pc        *webrtc.PeerConnection
+	stats     stats.Getter
+	estimator cc.BandwidthEstimator
 }
 
-func (s *Server) createPeerConnection() (*webrtc.PeerConnection, error) {
+func (s *Server) createPeerConnection() (*mediaConnection, error) {
+	// The SFU has a public address and only needs STUN to learn it
 	config := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{s.config.Server.StunServerURL},
-			},
-		},
+		ICEServers: s.staticICEServers(),
 	}
 
 	m := &webrtc.MediaEngine{}
 	if err := m.RegisterDefaultCodecs(); err != nil {
 		return nil, fmt.Errorf("failed to register default codecs: %w", err)
 	}
+	m.RegisterFeedback(webrtc.RTCPFeedback{Type: webrtc.TypeRTCPFBGoogREMB}, webrtc.RTPCodecTypeVideo)
 
-	api := webrtc.NewAPI(webrtc.WithMediaEngine(m))
-	pc, err := api.NewPeerConnection(config)
+	conn := &mediaConnection{}
+	registry := &interceptor.Registry{}
+
+	// RTCP reports give the stats interceptor round trip times and loss as
+	// seen by the client
+	statsInterceptor, err := stats.NewInterceptor()
 	if err != nil {
-		return nil, fmt.Errorf("failed to create peer connection: %w", err)
+		return nil, fmt.Errorf("failed to create stats interceptor: %w", err)
 	}
+	statsInterceptor.OnNewPeerConnection(func(_ string, g stats.Getter) {
+		conn.stats = g
+	})
+	registry.Add(statsInterceptor)
 
-	if _, err := pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{
-		Direction: webrtc.RTPTransceiverDirectionSendrecv,
-	}); err != nil {
-		return nil, fmt.Errorf("failed to add video transceiver: %w", err)
+	// Estimates the client's downlink from TWCC feedback. Forwarded media is
+	// never paced; the estimate only picks simulcast layers.
+	sfuConfig := s.config.SFU
+	congestionController, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		return gcc.NewSendSideBWE(
+			gcc.SendSideBWEPacer(gcc.NewNoOpPacer()),
+			gcc.SendSideBWEInitialBitrate(sfuConfig.InitialBitrateKbps*1000),
+			gcc.SendSideBWEMinBitrate(sfuConfig.MinBitrateKbps*1000),
+			gcc.SendSideBWEMaxBitrate(sfuConfig.MaxBitrateKbps*1000),
+		)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create congestion controller: %w", err)
 	}
+	congestionController.OnNewPeerConnection(func(_ string, estimator cc.BandwidthEstimator) {
+		conn.estimator = estimator
+	})
+	registry.Add(congestionController)
 
-	if _, err := pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{
-		Direction: webrtc.RTPTransceiverDirectionSendrecv,
-	}); err != nil {
-		return nil, fmt.Errorf("failed to add audio transceiver: %w", err)
+	if err := webrtc.ConfigureTWCCHeaderExtensionSender(m, registry); err != nil {
+		return nil, fmt.Errorf("failed to configure TWCC: %w", err)
+	}
+	if err := webrtc.RegisterDefaultInterceptors(m, registry); err != nil {
+		return nil, fmt.Errorf("failed to register interceptors: %w", err)
 	}
 
-	return pc, nil
+	// Transceivers come from the client's first offer, the SFU adds its own
+	// senders when it renegotiates
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(registry))
+	conn.pc, err = api.NewPeerConnection(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create peer connection: %w", err)
+	}
+
+	return conn, nil
 }
 
-func (s *Server) handleSDP(ctx context.Context, client *WebRTCClient, sdp map[string]interface{}) error {
+// handleSDP applies a session description from the client. The server is the
+// polite peer: when both sides offer at once it drops its own offer, answers
+// the client and offers again afterwards.
+func (s *Server) handleSDP(ctx context.Context, room *Room, client *WebRTCClient, desc webrtc.SessionDescription) error {
 	logger := s.getLogger(ctx)
-	logger.Debug("Handling SDP", zap.Any("type", sdp["type"]))
+	logger.Debug("Handling SDP", zap.String("type", desc.Type.String()))
 
-	sdpJSON, err := json.Marshal(sdp)
+	client.negotiationMutex.Lock()
+	err := s.applySDP(ctx, client, desc)
+	client.negotiationMutex.Unlock()
 	if err != nil {
-		logger.Error("Failed to marshal SDP", zap.Error(err))
-		return fmt.Errorf("failed to marshal SDP: %w", err)
+		return err
+	}
+
+	// Catch up on track changes that arrived mid-negotiation
+	if err := s.negotiate(room, client); err != nil {
+		return err
 	}
 
-	var sessionDesc webrtc.SessionDescription
-	if err := json.Unmarshal(sdpJSON, &sessionDesc); err != nil {
-		logger.Error("Failed to parse SDP", zap.Error(err))
-		return fmt.Errorf("failed to parse SDP: %w", err)
+	// A client offer means a new or restarted session that needs the track list
+	if desc.Type == webrtc.SDPTypeOffer {
+		return client.sendJSON(TracksEvent{Type: "tracks", Tracks: room.trackInfos()})
+	}
+	return nil
+}
+
+func (s *Server) applySDP(ctx context.Context, client *WebRTCClient, desc webrtc.SessionDescription) error {
+	logger := s.getLogger(ctx)
+
+	if desc.Type == webrtc.SDPTypeOffer && client.pc.SignalingState() != webrtc.SignalingStateStable {
+		logger.Debug("Offer collision, rolling back local offer")
+		if err := client.pc.SetLocalDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeRollback}); err != nil {
+			return fmt.Errorf("failed to roll back local offer: %w", err)
+		}
+		client.negotiationPending = true
 	}
 
 	logger.Debug("Setting remote description")
-	if err := client.pc.SetRemoteDescription(sessionDesc); err != nil {
+	if err := client.pc.SetRemoteDescription(desc); err != nil {
 		logger.Error("Failed to set remote description", zap.Error(err))
 		return fmt.Errorf("failed to set remote description: %w", err)
 	}
 
-	if sessionDesc.Type == webrtc.SDPTypeOffer {
-		logger.Debug("Creating answer")
-		answer, err := client.pc.CreateAnswer(nil)
-		if err != nil {
-			logger.Error("Failed to create answer", zap.Error(err))
-			return fmt.Errorf("failed to create answer: %w", err)
+	// Process candidates that arrived before the description
+	for _, candidate := range client.candidates {
+		if err := client.pc.AddICECandidate(candidate); err != nil {
+			logger.Error("Failed to add stored ICE candidate", zap.Error(err))
 		}
+	}
+	client.candidates = nil
 
-		logger.Debug("Setting local description")
-		if err := client.pc.SetLocalDescription(answer); err != nil {
-			logger.Error("Failed to set local description", zap.Error(err))
-			return fmt.Errorf("failed to set local description: %w", err)
-		}
+	if desc.Type != webrtc.SDPTypeOffer {
+		return nil
+	}
+
+	logger.Debug("Creating answer")
+	answer, err := client.pc.CreateAnswer(nil)
+	if err != nil {
+		logger.Error("Failed to create answer", zap.Error(err))
+		return fmt.Errorf("failed to create answer: %w", err)
+	}
 
-		client.writeMutex.Lock()
-		defer client.writeMutex.Unlock()
+	logger.Debug("Setting local description")
+	if err := client.pc.SetLocalDescription(answer); err != nil {
+		logger.Error("Failed to set local description", zap.Error(err))
+		return fmt.Errorf("failed to set local description: %w", err)
+	}
 
-		logger.Debug("Sending answer")
-		if err := client.conn.WriteJSON(map[string]interface{}{
-			"type": "answer",
-			"sdp":  answer,
-		}); err != nil {
-			logger.Error("Failed to send answer", zap.Error(err))
-			return fmt.Errorf("failed to send answer: %w", err)
-		}
+	logger.Debug("Sending answer")
+	if err := client.sendJSON(map[string]interface{}{
+		"type": "answer",
+		"sdp":  answer.SDP,
+	}); err != nil {
+		logger.Error("Failed to send answer", zap.Error(err))
+		return fmt.Errorf("failed to send answer: %w", err)
 	}
 
 	return nil
@@ -139,23 +230,44 @@ func (s *Server) handleICECandidate(ctx context.Context, client *WebRTCClient, c
 	return nil
 }
 
-func (s *Server) broadcastToRoom(roomID string, sender *websocket.Conn, message []byte) {
+func (s *Server) broadcastToRoom(roomID string, sender Conn, message []byte) {
+	s.roomsMutex.RLock()
+	room, exists := s.rooms[roomID]
+	s.roomsMutex.RUnlock()
+
+	if exists {
+		s.deliverVideo(room, sender, message)
+	}
+	s.publish(roomID, "", busVideo, message)
+}
+
+// deliverVideo writes a message to the video clients connected here
+func (s *Server) deliverVideo(room *Room, sender Conn, message []byte) {
+	header := parseHeader(message)
+
 	s.roomsMutex.RLock()
 	defer s.roomsMutex.RUnlock()
 
-	if room, exists := s.rooms[roomID]; exists {
-		for client, wc := range room.webrtcClients {
-			if client != sender {
-				wc.writeMutex.Lock()
-				err := client.WriteMessage(websocket.TextMessage, message)
-				wc.writeMutex.Unlock()
-
-				if err != nil {
-					s.logger.Error("Failed to broadcast message to client",
-						zap.Error(err),
-						zap.String("roomID", roomID))
-				}
+	for client := range room.webrtcClients {
+		if client != sender {
+			if err := client.writeText(header, message); err != nil {
+				s.logger.Error("Failed to broadcast message to client",
+					zap.Error(err),
+					zap.String("roomID", room.id))
 			}
 		}
 	}
 }
+
+func (s *Server) broadcastVideoEvent(roomID string, sender Conn, v interface{}) {
+	message, err := json.Marshal(v)
+	if err != nil {
+		s.logger.Error("Failed to marshal video event", zap.Error(err))
+		return
+	}
+	s.broadcastToRoom(roomID, sender, message)
+}
+
+func (c *WebRTCClient) sendJSON(v interface{}) error {
+	return c.conn.WriteJSON(v)
+}
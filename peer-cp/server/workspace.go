@@ -0,0 +1,276 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultFilePath  = "main" // File used by clients that only know about a single Code/Language pair
+	MaxWorkspaceSize = 50     // Maximum number of files per room workspace
+	MaxFilePathLen   = 255
+)
+
+// WorkspaceFile is a single file in a room workspace
+type WorkspaceFile struct {
+	Path     string `json:"path"`
+	Language string `json:"language,omitempty"`
+	Content  string `json:"content,omitempty"`
+}
+
+// Workspace holds every file the room is working on
+type Workspace struct {
+	mu    sync.RWMutex
+	files map[string]*WorkspaceFile
+}
+
+func newWorkspace() *Workspace {
+	return &Workspace{
+		files: make(map[string]*WorkspaceFile),
+	}
+}
+
+func cleanFilePath(p string) (string, error) {
+	p = strings.TrimSpace(p)
+	if p == "" {
+		return "", fmt.Errorf("file path is required")
+	}
+	if len(p) > MaxFilePathLen {
+		return "", fmt.Errorf("file path is too long")
+	}
+	if strings.HasPrefix(p, "/") || strings.Contains(p, "\\") {
+		return "", fmt.Errorf("file path must be relative")
+	}
+
+	cleaned := path.Clean(p)
+	if cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("file path escapes the workspace")
+	}
+	return cleaned, nil
+}
+
+// Create adds a new file and fails if the path is already taken
+func (w *Workspace) Create(filePath, language, content string) (WorkspaceFile, error) {
+	filePath, err := cleanFilePath(filePath)
+	if err != nil {
+		return WorkspaceFile{}, err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, exists := w.files[filePath]; exists {
+		return WorkspaceFile{}, fmt.Errorf("file %q already exists", filePath)
+	}
+	if len(w.files) >= MaxWorkspaceSize {
+		return WorkspaceFile{}, fmt.Errorf("workspace is limited to %d files", MaxWorkspaceSize)
+	}
+
+	file := &WorkspaceFile{Path: filePath, Language: language, Content: content}
+	w.files[filePath] = file
+	return *file, nil
+}
+
+// Update replaces the content of a file, creating it when it does not exist yet.
+// An empty language keeps the one already set on the file.
+func (w *Workspace) Update(filePath, language, content string) (WorkspaceFile, error) {
+	file, _, err := w.Replace(filePath, language, content)
+	return file, err
+}
+
+// Replace is Update that also returns the file as it was before. previous has
+// an empty path when the file is new.
+func (w *Workspace) Replace(filePath, language, content string) (file, previous WorkspaceFile, err error) {
+	filePath, err = cleanFilePath(filePath)
+	if err != nil {
+		return WorkspaceFile{}, WorkspaceFile{}, err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	current, exists := w.files[filePath]
+	if exists {
+		previous = *current
+	} else {
+		if len(w.files) >= MaxWorkspaceSize {
+			return WorkspaceFile{}, WorkspaceFile{}, fmt.Errorf("workspace is limited to %d files", MaxWorkspaceSize)
+		}
+		current = &WorkspaceFile{Path: filePath}
+		w.files[filePath] = current
+	}
+
+	current.Content = content
+	if language != "" {
+		current.Language = language
+	}
+	return *current, previous, nil
+}
+
+// SetLanguage changes the language of an existing file and also returns the
+// file as it was before
+func (w *Workspace) SetLanguage(filePath, language string) (file, previous WorkspaceFile, err error) {
+	filePath, err = cleanFilePath(filePath)
+	if err != nil {
+		return WorkspaceFile{}, WorkspaceFile{}, err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	current, exists := w.files[filePath]
+	if !exists {
+		return WorkspaceFile{}, WorkspaceFile{}, fmt.Errorf("file %q not found", filePath)
+	}
+	previous = *current
+	current.Language = language
+	return *current, previous, nil
+}
+
+func (w *Workspace) Rename(oldPath, newPath string) error {
+	oldPath, err := cleanFilePath(oldPath)
+	if err != nil {
+		return err
+	}
+	newPath, err = cleanFilePath(newPath)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	file, exists := w.files[oldPath]
+	if !exists {
+		return fmt.Errorf("file %q not found", oldPath)
+	}
+	if _, taken := w.files[newPath]; taken {
+		return fmt.Errorf("file %q already exists", newPath)
+	}
+
+	delete(w.files, oldPath)
+	file.Path = newPath
+	w.files[newPath] = file
+	return nil
+}
+
+func (w *Workspace) Delete(filePath string) error {
+	filePath, err := cleanFilePath(filePath)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, exists := w.files[filePath]; !exists {
+		return fmt.Errorf("file %q not found", filePath)
+	}
+	delete(w.files, filePath)
+	return nil
+}
+
+func (w *Workspace) Get(filePath string) (WorkspaceFile, bool) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	file, exists := w.files[filePath]
+	if !exists {
+		return WorkspaceFile{}, false
+	}
+	return *file, true
+}
+
+// Files returns a copy of every file sorted by path
+func (w *Workspace) Files() []WorkspaceFile {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	files := make([]WorkspaceFile, 0, len(w.files))
+	for _, file := range w.files {
+		files = append(files, *file)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+	return files
+}
+
+// Tree returns the workspace layout without file contents
+func (w *Workspace) Tree() []WorkspaceFile {
+	files := w.Files()
+	for i := range files {
+		files[i].Content = ""
+	}
+	return files
+}
+
+func (w *Workspace) IsEmpty() bool {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return len(w.files) == 0
+}
+
+// Archive packs the workspace into a zip file
+func (w *Workspace) Archive() ([]byte, error) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	for _, file := range w.Files() {
+		f, err := zw.Create(file.Path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to add %s to archive: %w", file.Path, err)
+		}
+		if _, err := f.Write([]byte(file.Content)); err != nil {
+			return nil, fmt.Errorf("failed to write %s to archive: %w", file.Path, err)
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to finalize archive: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// HandleWorkspaceArchive serves the room workspace as a zip download
+func (s *Server) HandleWorkspaceArchive(c *fiber.Ctx) error {
+	roomID := c.Params("roomId")
+	token := c.Query("token")
+
+	validRoom, err := s.validateRoom(roomID, token)
+	if err != nil {
+		return fiber.ErrUnauthorized
+	}
+
+	if !validRoom.IsActive {
+		return fiber.NewError(fiber.StatusForbidden, "room is not active")
+	}
+
+	s.roomsMutex.RLock()
+	room, exists := s.rooms[roomID]
+	s.roomsMutex.RUnlock()
+
+	if !exists || room.workspace.IsEmpty() {
+		return fiber.NewError(fiber.StatusNotFound, "workspace is empty")
+	}
+
+	archive, err := room.workspace.Archive()
+	if err != nil {
+		s.logger.Error("Failed to build workspace archive",
+			zap.String("roomID", roomID),
+			zap.Error(err))
+		return fiber.ErrInternalServerError
+	}
+
+	c.Set(fiber.HeaderContentType, "application/zip")
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf("attachment; filename=\"workspace-%s.zip\"", roomID))
+	return c.Send(archive)
+}
@@ -0,0 +1,79 @@
+package turnserver
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/pion/turn/v4"
+)
+
+// Config describes the embedded TURN relay
+type Config struct {
+	ListenAddress string // UDP address the relay listens on, e.g. 0.0.0.0:3478
+	PublicIP      string // Address advertised in relay candidates
+	Realm         string
+	Secret        string // Shared secret for REST-style credentials
+	RelayMinPort  uint16
+	RelayMaxPort  uint16
+}
+
+// Server is a TURN relay that only accepts credentials issued by NewCredentials
+type Server struct {
+	server *turn.Server
+}
+
+func New(config Config) (*Server, error) {
+	publicIP := net.ParseIP(config.PublicIP)
+	if publicIP == nil {
+		return nil, fmt.Errorf("invalid public IP %q", config.PublicIP)
+	}
+
+	conn, err := net.ListenPacket("udp4", config.ListenAddress)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", config.ListenAddress, err)
+	}
+
+	server, err := turn.NewServer(turn.ServerConfig{
+		Realm:       config.Realm,
+		AuthHandler: turn.LongTermTURNRESTAuthHandler(config.Secret, nil),
+		PacketConnConfigs: []turn.PacketConnConfig{
+			{
+				PacketConn: conn,
+				RelayAddressGenerator: &turn.RelayAddressGeneratorPortRange{
+					RelayAddress: publicIP,
+					Address:      "0.0.0.0",
+					MinPort:      config.RelayMinPort,
+					MaxPort:      config.RelayMaxPort,
+				},
+				PermissionHandler: allowPeer,
+			},
+		},
+	})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to start TURN server: %w", err)
+	}
+
+	return &Server{server: server}, nil
+}
+
+func (s *Server) Close() error {
+	return s.server.Close()
+}
+
+// AllocationCount returns the number of active relay allocations
+func (s *Server) AllocationCount() int {
+	return s.server.AllocationCount()
+}
+
+// allowPeer keeps the relay from being used to reach the host itself
+func allowPeer(_ net.Addr, peerIP net.IP) bool {
+	return !peerIP.IsLoopback() && !peerIP.IsUnspecified() && !peerIP.IsMulticast()
+}
+
+// NewCredentials issues ephemeral TURN REST credentials for one participant.
+// The username carries the expiry, so the relay needs no credential store.
+func NewCredentials(secret, user string, ttl time.Duration) (username, password string, err error) {
+	return turn.GenerateLongTermTURNRESTCredentials(secret, user, ttl)
+}